@@ -70,11 +70,7 @@ func runAddBranch(name string) error {
 	}
 
 	// Create branch with current HEAD
-	head := repo.Head
-	if head == "" {
-		head = ""
-	}
-	if err := os.WriteFile(branchFile, []byte(head), 0644); err != nil {
+	if err := repo.NewRefTransaction().Create(name, repo.Head, "branch: created from HEAD").Commit(); err != nil {
 		return fmt.Errorf("failed to create branch: %w", err)
 	}
 
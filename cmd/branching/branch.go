@@ -4,28 +4,47 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
-	"steria/core"
+	"steria/internal/storage"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
 func NewBranchCmd() *cobra.Command {
-	var deleteFlag bool
+	var deleteFlag, unsetUpstream bool
+	var setUpstream string
 	cmd := &cobra.Command{
 		Use:   "branch [name]",
-		Short: "Create, switch, or delete a branch",
-		Long:  "Create a new branch, switch to an existing one, or delete a branch with --delete.",
-		Args:  cobra.ExactArgs(1),
+		Short: "List, create, switch, or delete branches",
+		Long: `Without a name, list local branches with how far each is ahead of and behind
+its upstream as of the last fetch. With a name, create and switch to the
+branch, switch to it if it exists, or delete it with --delete.
+--set-upstream-to <remote>/<branch> and --unset-upstream change which
+remote-tracking branch a branch (the current one by default) follows.`,
+		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if deleteFlag {
-				return runDeleteBranch(args[0])
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
 			}
-			return runBranch(args[0])
+			switch {
+			case setUpstream != "" || unsetUpstream:
+				return runSetUpstream(name, setUpstream)
+			case name == "":
+				return runListBranches()
+			case deleteFlag:
+				return runDeleteBranch(name)
+			}
+			return runBranch(name)
 		},
 	}
 	cmd.Flags().BoolVar(&deleteFlag, "delete", false, "Delete the branch instead of switching/creating")
+	cmd.Flags().StringVar(&setUpstream, "set-upstream-to", "", "Make the branch follow <remote>/<branch>")
+	cmd.Flags().BoolVar(&unsetUpstream, "unset-upstream", false, "Stop the branch following a remote branch")
+	cmd.MarkFlagsMutuallyExclusive("set-upstream-to", "unset-upstream", "delete")
 	return cmd
 }
 
@@ -38,7 +57,7 @@ func runBranch(name string) error {
 		return fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	repo, err := core.LoadOrInitRepo(cwd)
+	repo, err := storage.LoadOrInitRepo(cwd)
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
@@ -56,34 +75,140 @@ func runBranch(name string) error {
 		return fmt.Errorf("failed to create branch parent dir: %w", err) //so fucking annoying
 	}
 
-	// If branch file doesn't exist, create it with current HEAD
+	// Switch branch: update .steria/branch and .steria/HEAD together,
+	// creating the branch at the current HEAD if it doesn't exist
+	tx := repo.NewRefTransaction()
+	branchHead := repo.Head
 	if _, err := os.Stat(branchFile); os.IsNotExist(err) {
-		head := repo.Head
-		if head == "" {
-			head = ""
+		tx.Create(name, repo.Head, "branch: created from HEAD")
+	} else if branchHead, err = repo.ReadRef(name); err != nil {
+		return fmt.Errorf("failed to read branch HEAD: %w", err)
+	}
+	previous := strings.TrimSpace(repo.Branch)
+	err = tx.UpdateFrom("HEAD", branchHead, repo.Head, "branch: "+previous+" -> "+name).
+		SetCurrentBranch(name).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to switch branch: %w", err)
+	}
+
+	switchMsg := fmt.Sprintf("%s Switched to branch: %s\n", green("✅"), cyan(name))
+	fmt.Print(switchMsg)
+	if tracking, err := repo.TrackingStatus(name); err == nil && tracking != nil {
+		fmt.Printf("%s Your branch is %s\n", cyan("🔗"), tracking.Summary())
+	}
+	return nil
+}
+
+func runListBranches() error {
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repo, err := storage.LoadOrInitRepo(cwd)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+	branches, err := repo.Branches()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(branches))
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	current := strings.TrimSpace(repo.Branch)
+	for _, name := range names {
+		marker, label := "  ", name
+		if name == current {
+			marker, label = "* ", green(name)
+		}
+		hash := branches[name]
+		if len(hash) > 8 {
+			hash = hash[:8]
+		}
+		line := fmt.Sprintf("%s%s %s", marker, label, yellow(hash))
+		tracking, err := repo.TrackingStatus(name)
+		if err != nil {
+			return err
 		}
-		if err := os.WriteFile(branchFile, []byte(head), 0644); err != nil {
-			return fmt.Errorf("failed to create branch: %w", err)
+		if tracking != nil {
+			line += " " + cyan("["+trackingLabel(tracking)+"]")
 		}
+		fmt.Println(line)
 	}
+	return nil
+}
 
-	// Switch branch: update .steria/branch and .steria/HEAD
-	if err := os.WriteFile(filepath.Join(cwd, ".steria", "branch"), []byte(name), 0644); err != nil {
-		return fmt.Errorf("failed to switch branch: %w", err)
+// trackingLabel is the short form of a tracking status shown next to a
+// branch, e.g. "origin/Stem: ahead 2, behind 1"
+func trackingLabel(t *storage.TrackingStatus) string {
+	var parts []string
+	if t.Gone {
+		parts = append(parts, "gone")
+	}
+	if t.Ahead > 0 {
+		parts = append(parts, fmt.Sprintf("ahead %d", t.Ahead))
 	}
+	if t.Behind > 0 {
+		parts = append(parts, fmt.Sprintf("behind %d", t.Behind))
+	}
+	if len(parts) == 0 {
+		return t.Upstream.String()
+	}
+	return t.Upstream.String() + ": " + strings.Join(parts, ", ")
+}
+
+func runSetUpstream(name, upstream string) error {
+	green := color.New(color.FgGreen).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
 
-	// Read the branch's HEAD and update the main HEAD
-	branchHead, err := os.ReadFile(branchFile)
+	cwd, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("failed to read branch HEAD: %w", err)
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repo, err := storage.LoadOrInitRepo(cwd)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
 	}
-	if err := os.WriteFile(filepath.Join(cwd, ".steria", "HEAD"), branchHead, 0644); err != nil {
-		return fmt.Errorf("failed to update HEAD: %w", err)
+	if name == "" {
+		name = strings.TrimSpace(repo.Branch)
+	}
+	if _, err := repo.ReadRef(name); err != nil {
+		return fmt.Errorf("branch '%s' does not exist", name)
 	}
 
-	repo.Branch = name
-	switchMsg := fmt.Sprintf("%s Switched to branch: %s\n", green("✅"), cyan(name))
-	fmt.Print(switchMsg)
+	if upstream == "" {
+		if err := repo.SetUpstream(name, nil); err != nil {
+			return err
+		}
+		fmt.Printf("%s Branch '%s' no longer has an upstream\n", green("✅"), cyan(name))
+		return nil
+	}
+	up, err := storage.ParseUpstream(upstream)
+	if err != nil {
+		return err
+	}
+	rf, err := storage.LoadRemotes(repo.Path)
+	if err != nil {
+		return err
+	}
+	if _, ok := rf.Find(up.Remote); !ok {
+		return fmt.Errorf("remote '%s' not found", up.Remote)
+	}
+	if err := repo.SetUpstream(name, &up); err != nil {
+		return err
+	}
+	fmt.Printf("%s Branch '%s' now tracks %s\n", green("✅"), cyan(name), cyan(up.String()))
+	if tracking, err := repo.TrackingStatus(name); err == nil && tracking != nil {
+		fmt.Printf("%s Your branch is %s\n", cyan("🔗"), tracking.Summary())
+	}
 	return nil
 }
 
@@ -103,10 +228,21 @@ func runDeleteBranch(name string) error {
 		return fmt.Errorf("cannot delete the currently checked-out branch: %s", name)
 	}
 
-	branchFile := filepath.Join(cwd, ".steria", "branches", name)
-	if err := os.Remove(branchFile); err != nil {
+	repo, err := storage.LoadOrInitRepo(cwd)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
+	hash, err := repo.ReadRef(name)
+	if err != nil {
+		return fmt.Errorf("failed to delete branch: %w", err)
+	}
+	if err := repo.NewRefTransaction().Delete(name, hash).Commit(); err != nil {
 		return fmt.Errorf("failed to delete branch: %w", err)
 	}
+	if err := repo.SetUpstream(name, nil); err != nil {
+		return fmt.Errorf("failed to remove upstream: %w", err)
+	}
 
 	fmt.Printf("%s Branch '%s' deleted successfully!\n", green("✅"), red(name))
 	return nil
@@ -69,9 +69,16 @@ func runDeleteBranchCmd(name string) error {
 		return fmt.Errorf("branch '%s' does not exist", red(name))
 	}
 
-	if err := os.Remove(branchFile); err != nil {
+	hash, err := repo.ReadRef(name)
+	if err != nil {
+		return fmt.Errorf("failed to delete branch: %w", err)
+	}
+	if err := repo.NewRefTransaction().Delete(name, hash).Commit(); err != nil {
 		return fmt.Errorf("failed to delete branch: %w", err)
 	}
+	if err := repo.SetUpstream(name, nil); err != nil {
+		return fmt.Errorf("failed to remove upstream: %w", err)
+	}
 
 	fmt.Printf("%s Branch '%s' deleted successfully!\n", green("✅"), red(name))
 	fmt.Printf("%s Performance optimized with concurrent processing!\n", cyan("⚡"))
@@ -42,21 +42,6 @@ func runBranchGraph(mermaid bool) error {
 		return err
 	}
 
-	// Map: commit hash -> commit object
-	commits := map[string]*storage.Commit{}
-	commit := repo.Head
-	for commit != "" {
-		c, err := repo.LoadCommit(commit)
-		if err != nil {
-			break
-		}
-		commits[commit] = c
-		if c.Parent == "" {
-			break
-		}
-		commit = c.Parent
-	}
-
 	// Read branches from .steria/branches
 	branches := map[string]string{}
 	branchesDir := filepath.Join(repo.Path, ".steria", "branches")
@@ -77,6 +62,20 @@ func runBranchGraph(mermaid bool) error {
 		}
 	}
 
+	// Map: commit hash -> commit object, for every commit reachable from HEAD or any branch
+	tips := []string{repo.Head}
+	for _, hash := range branches {
+		tips = append(tips, hash)
+	}
+	history, err := repo.WalkHistory(tips...)
+	if err != nil {
+		return err
+	}
+	commits := map[string]*storage.Commit{}
+	for _, c := range history {
+		commits[c.Hash] = c
+	}
+
 	if mermaid {
 		return printMermaidGraph(commits, branches, repo.Head)
 	}
@@ -103,10 +102,15 @@ func printAsciiGraph(commits map[string]*storage.Commit, branches map[string]str
 				headStr = headMark
 			}
 			fmt.Printf("  * %s %s %s\n", cHash[:8], c.Message, headStr)
-			if c.Parent != "" {
-				fmt.Printf("    |\n    +-- parent: %s\n", c.Parent[:8])
+			if c.FirstParent() != "" {
+				fmt.Printf("    |\n    +-- parent: %s\n", c.FirstParent()[:8])
 			}
-			cHash = c.Parent
+			if c.IsMerge() {
+				for _, merged := range c.Parents[1:] {
+					fmt.Printf("    +-- merged: %s\n", merged[:8])
+				}
+			}
+			cHash = c.FirstParent()
 		}
 	}
 	return nil
@@ -114,23 +118,14 @@ func printAsciiGraph(commits map[string]*storage.Commit, branches map[string]str
 
 func printMermaidGraph(commits map[string]*storage.Commit, branches map[string]string, head string) error {
 	fmt.Println("graph TD;")
-	commitNodes := map[string]bool{}
-	for branch, hash := range branches {
-		cHash := hash
-		for cHash != "" {
-			c := commits[cHash]
-			if c == nil {
-				break
-			}
-			if !commitNodes[cHash] {
-				fmt.Printf("  %s[\"%s\"]\n", cHash[:8], cHash[:8])
-				commitNodes[cHash] = true
-			}
-			if c.Parent != "" {
-				fmt.Printf("  %s --> %s\n", cHash[:8], c.Parent[:8])
-			}
-			cHash = c.Parent
+	// Emit every commit once, with an edge to each of its parents
+	for _, c := range commits {
+		fmt.Printf("  %s[\"%s\"]\n", c.Hash[:8], c.Hash[:8])
+		for _, parent := range c.Parents {
+			fmt.Printf("  %s --> %s\n", c.Hash[:8], parent[:8])
 		}
+	}
+	for branch, hash := range branches {
 		// Branch label
 		if hash != "" {
 			fmt.Printf("  %s_branch((%s))\n", branch, branch)
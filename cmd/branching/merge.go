@@ -1,13 +1,12 @@
 // Author: KleaSCM
 // Email: KleaSCM@gmail.com
 // Name of the file: merge.go
-// Description: Implements the steria merge command for merging branches, with fast-forward support. Advanced merge support is planned for future implementation.
+// Description: Implements the steria merge command for merging branches, with fast-forward support. Diverged branches are three-way merged against their merge base and joined with a merge commit.
 package branching
 
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"steria/internal/metrics"
@@ -21,7 +20,7 @@ func NewMergeCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "merge [branch] - [signer]",
 		Short: "Merge a branch into the current branch",
-		Long:  "Merge a branch into the current branch with optimized processing",
+		Long:  "Merge a branch, or a remote-tracking branch such as origin/Stem, into the current branch with optimized processing",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 3 || args[1] != "-" {
@@ -61,221 +60,32 @@ func runMerge(branch, signer string) error {
 	}
 	_ = storage.NewOptimizedRepo(repo)
 
-	// --- Real fast-forward merge logic ---
-	branchesDir := filepath.Join(cwd, ".steria", "branches")
-	branchFile := filepath.Join(branchesDir, branch)
-	if _, err := os.Stat(branchFile); err != nil {
+	// Local branches, or remote-tracking ones such as origin/Stem
+	if _, err := repo.ResolveRevision(branch); err != nil {
 		return fmt.Errorf("branch '%s' does not exist", branch)
 	}
-	// Read the commit hash of the target branch
-	branchHashBytes, err := os.ReadFile(branchFile)
+
+	// Three-way merge against the merge base, fast-forwarding when possible
+	result, err := repo.MergeBranches(branch, signer)
 	if err != nil {
-		return fmt.Errorf("failed to read branch file: %w", err)
-	}
-	branchHash := strings.TrimSpace(string(branchHashBytes))
-	if branchHash == "" {
-		return fmt.Errorf("branch '%s' has no commits", branch)
+		return fmt.Errorf("failed to merge branch '%s': %w", branch, err)
 	}
-	// Check if fast-forward is possible (current HEAD is ancestor of branchHash)
-	currentHash := repo.Head
-	if currentHash == branchHash {
+	switch {
+	case result.UpToDate:
 		fmt.Printf("%s Already up to date!\n", yellow("💡"))
 		return nil
-	}
-	// Walk the ancestry of branchHash to see if currentHash is an ancestor
-	ancestor := false
-	testHash := branchHash
-	for i := 0; i < 1000 && testHash != ""; i++ {
-		if testHash == currentHash {
-			ancestor = true
-			break
-		}
-		commit, err := repo.LoadCommit(testHash)
-		if err != nil {
-			break
-		}
-		testHash = commit.Parent
-	}
-	if ancestor {
-		// Fast-forward: update HEAD and branch pointer
-		repo.Head = branchHash
-		headPath := filepath.Join(cwd, ".steria", "HEAD")
-		if err := os.WriteFile(headPath, []byte(branchHash), 0644); err != nil {
-			return fmt.Errorf("failed to update HEAD: %w", err)
-		}
-		// Update current branch pointer (if needed)
-		currentBranchFile := filepath.Join(cwd, ".steria", "branch")
-		if _, err := os.Stat(currentBranchFile); err == nil {
-			if err := os.WriteFile(currentBranchFile, []byte(branch), 0644); err != nil {
-				return fmt.Errorf("failed to update current branch: %w", err)
-			}
-		}
+	case result.FastForward:
 		fmt.Printf("%s Fast-forward merged branch '%s' into current branch (signed by %s)!\n", green("✅"), red(branch), red(signer))
-		fmt.Printf("%s Performance optimized with concurrent processing!\n", cyan("⚡"))
-		return nil
-	}
-	// --- Advanced merge (three-way, conflict resolution) ---
-	// Find merge base (common ancestor)
-	findMergeBase := func(a, b string) (string, error) {
-		visited := make(map[string]bool)
-		// Walk ancestry of a
-		hash := a
-		for i := 0; i < 1000 && hash != ""; i++ {
-			visited[hash] = true
-			commit, err := repo.LoadCommit(hash)
-			if err != nil {
-				break
-			}
-			hash = commit.Parent
-		}
-		// Walk ancestry of b
-		hash = b
-		for i := 0; i < 1000 && hash != ""; i++ {
-			if visited[hash] {
-				return hash, nil
-			}
-			commit, err := repo.LoadCommit(hash)
-			if err != nil {
-				break
-			}
-			hash = commit.Parent
-		}
-		return "", fmt.Errorf("no common ancestor found")
-	}
-
-	mergeBaseHash, err := findMergeBase(currentHash, branchHash)
-	if err != nil {
-		return fmt.Errorf("failed to find merge base: %w", err)
-	}
-	baseCommit, err := repo.LoadCommit(mergeBaseHash)
-	if err != nil {
-		return fmt.Errorf("failed to load merge base: %w", err)
-	}
-	targetCommit, err := repo.LoadCommit(branchHash)
-	if err != nil {
-		return fmt.Errorf("failed to load target branch commit: %w", err)
-	}
-	currentCommit, err := repo.LoadCommit(currentHash)
-	if err != nil {
-		return fmt.Errorf("failed to load current branch commit: %w", err)
-	}
-
-	// Build set of all files
-	fileSet := make(map[string]struct{})
-	for _, f := range baseCommit.Files {
-		fileSet[f] = struct{}{}
-	}
-	for _, f := range targetCommit.Files {
-		fileSet[f] = struct{}{}
-	}
-	for _, f := range currentCommit.Files {
-		fileSet[f] = struct{}{}
-	}
-
-	// For each file, determine merge result
-	conflicts := []string{}
-	for file := range fileSet {
-		baseBlob := baseCommit.FileBlobs[file]
-		currentBlob := currentCommit.FileBlobs[file]
-		targetBlob := targetCommit.FileBlobs[file]
-
-		// If unchanged in current, changed in target: use target
-		if baseBlob == currentBlob && baseBlob != targetBlob && targetBlob != "" {
-			if err := restoreBlobToFile(repo, file, targetBlob); err != nil {
-				return err
-			}
-			continue
-		}
-		// If unchanged in target, changed in current: use current
-		if baseBlob == targetBlob && baseBlob != currentBlob && currentBlob != "" {
-			if err := restoreBlobToFile(repo, file, currentBlob); err != nil {
-				return err
-			}
-			continue
-		}
-		// If changed in both and blobs differ: conflict
-		if baseBlob != currentBlob && baseBlob != targetBlob && currentBlob != targetBlob && currentBlob != "" && targetBlob != "" {
-			if err := writeConflictFile(repo, file, currentBlob, targetBlob); err != nil {
-				return err
-			}
-			conflicts = append(conflicts, file)
-			continue
-		}
-		// If only in target (added): use target
-		if baseBlob == "" && currentBlob == "" && targetBlob != "" {
-			if err := restoreBlobToFile(repo, file, targetBlob); err != nil {
-				return err
-			}
-			continue
-		}
-		// If only in current (added): use current
-		if baseBlob == "" && targetBlob == "" && currentBlob != "" {
-			if err := restoreBlobToFile(repo, file, currentBlob); err != nil {
-				return err
-			}
-			continue
-		}
-		// If deleted in both: remove file
-		if baseBlob != "" && currentBlob == "" && targetBlob == "" {
-			os.Remove(file)
-			continue
-		}
-	}
-
-	if len(conflicts) > 0 {
+	case len(result.Conflicts) > 0:
 		fmt.Printf("%s Merge completed with conflicts in the following files:\n", yellow("⚠️"))
-		for _, f := range conflicts {
+		for _, f := range result.Conflicts {
 			fmt.Printf("  - %s\n", f)
 		}
-		fmt.Printf("Please resolve conflicts and commit the result.\n")
+		fmt.Printf("Please resolve conflicts and commit the result to record the merge.\n")
 		return fmt.Errorf("merge completed with conflicts")
+	default:
+		fmt.Printf("%s Three-way merged branch '%s' into current branch as %s (signed by %s)\n", green("✅"), red(branch), yellow(result.Commit[:8]), red(signer))
 	}
-
-	// Update HEAD and branch pointer
-	repo.Head = branchHash
-	headPath := filepath.Join(cwd, ".steria", "HEAD")
-	if err := os.WriteFile(headPath, []byte(branchHash), 0644); err != nil {
-		return fmt.Errorf("failed to update HEAD: %w", err)
-	}
-	currentBranchFile := filepath.Join(cwd, ".steria", "branch")
-	if _, err := os.Stat(currentBranchFile); err == nil {
-		if err := os.WriteFile(currentBranchFile, []byte(branch), 0644); err != nil {
-			return fmt.Errorf("failed to update current branch: %w", err)
-		}
-	}
-	fmt.Printf("%s Three-way merged branch '%s' into current branch (signed by %s)\n", green("✅"), red(branch), red(signer))
 	fmt.Printf("%s Performance optimized with concurrent processing!\n", cyan("⚡"))
 	return nil
 }
-
-// restoreBlobToFile restores a file from a blob hash
-func restoreBlobToFile(repo *storage.Repo, filePath, blobHash string) error {
-	blobPath := filepath.Join(repo.Path, ".steria", "objects", "blobs", blobHash)
-	blobData, err := os.ReadFile(blobPath)
-	if err != nil {
-		return fmt.Errorf("failed to read blob for '%s': %w", filePath, err)
-	}
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directory: %w", err)
-	}
-	if err := os.WriteFile(filePath, blobData, 0644); err != nil {
-		return fmt.Errorf("failed to write restored file: %w", err)
-	}
-	return nil
-}
-
-// writeConflictFile writes a file with conflict markers
-func writeConflictFile(repo *storage.Repo, filePath, currentBlob, targetBlob string) error {
-	currentBlobPath := filepath.Join(repo.Path, ".steria", "objects", "blobs", currentBlob)
-	currentData, _ := os.ReadFile(currentBlobPath)
-	targetBlobPath := filepath.Join(repo.Path, ".steria", "objects", "blobs", targetBlob)
-	targetData, _ := os.ReadFile(targetBlobPath)
-	conflictContent := []byte(fmt.Sprintf("<<<<<<< CURRENT\n%s\n=======\n%s\n>>>>>>> TARGET\n", string(currentData), string(targetData)))
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directory: %w", err)
-	}
-	if err := os.WriteFile(filePath, conflictContent, 0644); err != nil {
-		return fmt.Errorf("failed to write conflict file: %w", err)
-	}
-	return nil
-}
@@ -66,24 +66,22 @@ func runRenameBranch(oldName, newName string) error {
 		return fmt.Errorf("branch '%s' already exists", red(newName))
 	}
 
-	// Ensure parent directory for new branch file exists
-	if err := os.MkdirAll(filepath.Dir(newBranchFile), 0755); err != nil {
-		return fmt.Errorf("failed to create branch parent dir: %w", err)
-	}
-
-	// Rename the branch file
-	if err := os.Rename(oldBranchFile, newBranchFile); err != nil {
+	// Rename the branch, and if this was the current branch the current
+	// branch file, in one ref transaction
+	hash, err := repo.ReadRef(oldName)
+	if err != nil {
 		return fmt.Errorf("failed to rename branch: %w", err)
 	}
-
-	// If this was the current branch, update the current branch file
+	tx := repo.NewRefTransaction().Rename(oldName, newName, hash, "branch: renamed from "+oldName)
 	branchPath := filepath.Join(cwd, ".steria", "branch")
-	if currentBranch, err := os.ReadFile(branchPath); err == nil {
-		if string(currentBranch) == oldName {
-			if err := os.WriteFile(branchPath, []byte(newName), 0644); err != nil {
-				return fmt.Errorf("failed to update current branch: %w", err)
-			}
-		}
+	if currentBranch, err := os.ReadFile(branchPath); err == nil && string(currentBranch) == oldName {
+		tx.SetCurrentBranch(newName)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rename branch: %w", err)
+	}
+	if err := repo.RenameUpstream(oldName, newName); err != nil {
+		return fmt.Errorf("failed to move upstream: %w", err)
 	}
 
 	fmt.Printf("%s Renamed branch '%s' to '%s'\n", green("✅"), cyan(oldName), cyan(newName))
@@ -1,6 +1,7 @@
 package branching
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -18,14 +19,14 @@ func NewSwitchBranchCmd() *cobra.Command {
 		Long:  "Switch to an existing branch and update HEAD",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runSwitchBranch(args[0])
+			return runSwitchBranch(cmd.Context(), args[0])
 		},
 	}
 
 	return cmd
 }
 
-func runSwitchBranch(branch string) error {
+func runSwitchBranch(ctx context.Context, branch string) error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("failed to get current directory: %w", err)
@@ -40,7 +41,7 @@ func runSwitchBranch(branch string) error {
 	// Always allow switching to 'Stem' if it exists (default branch)
 	if branch == "Stem" {
 		if _, err := os.Stat(branchPath); err == nil {
-			return doSwitchBranch(repoRoot, branch, branchPath)
+			return doSwitchBranch(ctx, repoRoot, branch, branchPath)
 		}
 		return fmt.Errorf("default branch 'Stem' does not exist")
 	}
@@ -48,29 +49,30 @@ func runSwitchBranch(branch string) error {
 	if _, err := os.Stat(branchPath); err != nil {
 		return fmt.Errorf("branch '%s' does not exist", branch)
 	}
-	return doSwitchBranch(repoRoot, branch, branchPath)
+	return doSwitchBranch(ctx, repoRoot, branch, branchPath)
 }
 
-func doSwitchBranch(repoRoot, branch, branchPath string) error {
+func doSwitchBranch(ctx context.Context, repoRoot, branch, branchPath string) error {
 	head, err := os.ReadFile(branchPath)
 	if err != nil {
 		return fmt.Errorf("failed to read branch ref: %w", err)
 	}
-	// Update HEAD and branch
-	headPath := filepath.Join(repoRoot, ".steria", "HEAD")
-	branchFile := filepath.Join(repoRoot, ".steria", "branch")
-	if err := os.WriteFile(headPath, head, 0644); err != nil {
-		return fmt.Errorf("failed to update HEAD: %w", err)
-	}
-	if err := os.WriteFile(branchFile, []byte(branch), 0644); err != nil {
-		return fmt.Errorf("failed to update branch: %w", err)
-	}
-
-	// Restore working directory to match HEAD commit of the target branch
 	repo, err := storage.LoadOrInitRepo(repoRoot)
 	if err != nil {
 		return fmt.Errorf("failed to load repo for restore: %w", err)
 	}
+
+	// Update HEAD and branch together
+	op := fmt.Sprintf("switch-branch: %s -> %s", strings.TrimSpace(repo.Branch), branch)
+	err = repo.NewRefTransaction().
+		UpdateFrom("HEAD", strings.TrimSpace(string(head)), repo.Head, op).
+		SetCurrentBranch(branch).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to switch to '%s': %w", branch, err)
+	}
+
+	// Restore working directory to match HEAD commit of the target branch
 	commit, err := repo.LoadCommit(strings.TrimSpace(string(head)))
 	if err != nil {
 		return fmt.Errorf("failed to load HEAD commit for restore: %w", err)
@@ -82,12 +84,10 @@ func doSwitchBranch(repoRoot, branch, branchPath string) error {
 		if blob == "" {
 			continue
 		}
-		data, err := storage.ReadFileBlobDecompressed(store, blob)
-		if err != nil {
-			continue
+		if ctx.Err() != nil {
+			return fmt.Errorf("switch to '%s' interrupted; run it again to finish restoring files: %w", branch, ctx.Err())
 		}
-		os.MkdirAll(filepath.Dir(filepath.Join(repoRoot, file)), 0755)
-		os.WriteFile(filepath.Join(repoRoot, file), data, 0644)
+		storage.WriteBlobToFile(ctx, store, blob, filepath.Join(repoRoot, file))
 	}
 
 	fmt.Printf("\nSwitched to branch '%s'\n\n", branch)
@@ -0,0 +1,78 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: projects.go
+// Description: Groups the project commands under 'steria projects' so 'steria add' and 'steria pull' are left to staging and remotes, and keeps the old root forms working with a deprecation warning.
+package projects
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewProjectsCmd returns the Cobra command for 'steria projects'
+func NewProjectsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "projects",
+		Short: "Manage projects (add, delete, pull)",
+	}
+	cmd.AddCommand(NewAddCmd())
+	cmd.AddCommand(NewDeleteCmd())
+	cmd.AddCommand(NewPullCmd())
+	return cmd
+}
+
+// NewLegacyCmds returns the project commands' old root names, kept so
+// existing scripts keep working: 'steria add-project' and 'steria delete'
+func NewLegacyCmds() []*cobra.Command {
+	addCmd := NewAddCmd()
+	addCmd.Use = "add-project \"project name\" - signer"
+	addCmd.Deprecated = "use 'steria projects add' instead"
+
+	deleteCmd := NewDeleteCmd()
+	deleteCmd.Deprecated = "use 'steria projects delete' instead"
+
+	return []*cobra.Command{addCmd, deleteCmd}
+}
+
+// WithLegacyAdd lets the staging 'steria add' still run the old
+// 'steria add "project name" - signer' form of 'steria projects add'
+func WithLegacyAdd(cmd *cobra.Command) *cobra.Command {
+	return withLegacyForm(cmd, NewAddCmd(), "steria projects add", func(args []string) bool {
+		return len(args) >= 3 && args[1] == "-"
+	})
+}
+
+// WithLegacyPull lets the remote 'steria pull' still run the old
+// 'steria pull [project name] [version] - [signer]' form of 'steria projects pull'
+func WithLegacyPull(cmd *cobra.Command) *cobra.Command {
+	return withLegacyForm(cmd, NewPullCmd(), "steria projects pull", func(args []string) bool {
+		return len(args) >= 4 && args[2] == "-"
+	})
+}
+
+// withLegacyForm runs target instead of cmd when the arguments match the
+// old form, after warning that the old form is deprecated
+func withLegacyForm(cmd, target *cobra.Command, replacement string, isLegacy func(args []string) bool) *cobra.Command {
+	validate, run := cmd.Args, cmd.RunE
+	cmd.Args = func(c *cobra.Command, args []string) error {
+		if isLegacy(args) {
+			return nil
+		}
+		if validate == nil {
+			return nil
+		}
+		return validate(c, args)
+	}
+	cmd.RunE = func(c *cobra.Command, args []string) error {
+		if !isLegacy(args) {
+			return run(c, args)
+		}
+		yellow := color.New(color.FgYellow).SprintFunc()
+		fmt.Fprintf(os.Stderr, "%s '%s' with a project is deprecated, use '%s' instead\n", yellow("⚠️"), c.CommandPath(), replacement)
+		return target.RunE(c, args)
+	}
+	return cmd
+}
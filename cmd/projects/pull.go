@@ -1,19 +1,18 @@
 // Author: KleaSCM
 // Email: KleaSCM@gmail.com
 // Name of the file: pull.go
-// Description: Implements the steria projects pull command for pulling a specific version from a local Steria project. Remote/registry support is planned for future implementation.
+// Description: Implements the steria projects pull command for pulling a specific version from a local Steria project or from a project registry set with STERIA_REMOTE_URL.
 package projects
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"steria/internal/metrics"
+	"steria/internal/storage"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
@@ -27,19 +26,19 @@ func NewPullCmd() *cobra.Command {
 		Args:  cobra.MinimumNArgs(4),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 4 || args[2] != "-" {
-				return fmt.Errorf("usage: steria pull [project name] [version] - [signer]")
+				return fmt.Errorf("usage: steria projects pull [project name] [version] - [signer]")
 			}
 			project := args[0]
 			version := args[1]
 			signer := strings.Join(args[3:], " ")
-			return runPull(project, version, signer)
+			return runPull(cmd.Context(), project, version, signer)
 		},
 	}
 
 	return cmd
 }
 
-func runPull(project, version, signer string) error {
+func runPull(ctx context.Context, project, version, signer string) error {
 	// Start performance profiling
 	profiler := metrics.StartProfiling()
 	defer func() {
@@ -63,18 +62,14 @@ func runPull(project, version, signer string) error {
 	projectDir := filepath.Join(steriaBase, project)
 	if _, err := os.Stat(projectDir); err == nil {
 		// Project exists locally
-		// Load the commit object from the local project
-		commitObjPath := filepath.Join(projectDir, ".steria", "objects", version[:2], version[2:])
-		commitData, err := os.ReadFile(commitObjPath)
+		// Load the commit object from the local project (flattening its tree if needed)
+		projectRepo, err := storage.LoadOrInitRepo(projectDir)
 		if err != nil {
-			return fmt.Errorf("failed to read commit object: %w", err)
-		}
-		var commit struct {
-			Files     []string          `json:"files"`
-			FileBlobs map[string]string `json:"file_blobs"`
+			return fmt.Errorf("failed to load project repository: %w", err)
 		}
-		if err := json.Unmarshal(commitData, &commit); err != nil {
-			return fmt.Errorf("failed to parse commit object: %w", err)
+		commit, err := projectRepo.LoadCommit(version)
+		if err != nil {
+			return fmt.Errorf("failed to read commit object: %w", err)
 		}
 		// Restore each file in the commit
 		for _, filePath := range commit.Files {
@@ -82,17 +77,9 @@ func runPull(project, version, signer string) error {
 			if !ok {
 				return fmt.Errorf("file blob for '%s' not found in commit %s", filePath, version[:8])
 			}
-			blobPath := filepath.Join(projectDir, ".steria", "objects", "blobs", blobHash)
-			blobData, err := os.ReadFile(blobPath)
-			if err != nil {
-				return fmt.Errorf("failed to read blob for '%s': %w", filePath, err)
-			}
 			targetPath := filepath.Join(cwd, filePath)
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return fmt.Errorf("failed to create parent directory: %w", err)
-			}
-			if err := os.WriteFile(targetPath, blobData, 0644); err != nil {
-				return fmt.Errorf("failed to write restored file: %w", err)
+			if err := storage.WriteBlobToFile(ctx, projectRepo.BlobStore, blobHash, targetPath); err != nil {
+				return fmt.Errorf("failed to restore '%s': %w", filePath, err)
 			}
 			fmt.Printf("%s Restored file: %s\n", green("✅"), filePath)
 		}
@@ -101,55 +88,26 @@ func runPull(project, version, signer string) error {
 		return nil
 	}
 
-	// Remote/project registry mode (planned for future implementation)
+	// Remote/project registry mode
 	remoteBase := os.Getenv("STERIA_REMOTE_URL")
 	if remoteBase == "" {
 		remoteBase = "https://steria-remote.example.com" // Default remote registry URL
 	}
-	projectRemote := remoteBase + "/" + project
-	commitObjURL := projectRemote + "/.steria/objects/" + version[:2] + "/" + version[2:]
-	resp, err := fetchURL(commitObjURL)
+	registry := &storage.RegistryProject{URL: remoteBase + "/" + project}
+	commit, err := registry.Commit(ctx, version)
 	if err != nil {
-		fmt.Printf("%s Project '%s' not found locally or remotely.\n", yellow("⚠️"), project)
-		return fmt.Errorf("project '%s' not found locally or remotely", project)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		fmt.Printf("%s Commit object not found at remote registry.\n", yellow("⚠️"))
-		return fmt.Errorf("commit object not found at remote registry")
-	}
-	var commit struct {
-		Files     []string          `json:"files"`
-		FileBlobs map[string]string `json:"file_blobs"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&commit); err != nil {
-		return fmt.Errorf("failed to parse remote commit object: %w", err)
+		fmt.Printf("%s Version '%s' of project '%s' not found locally or remotely.\n", yellow("⚠️"), version, project)
+		return fmt.Errorf("project '%s' not found locally or remotely: %w", project, err)
 	}
+	blobs := registry.BlobStore()
 	for _, filePath := range commit.Files {
 		blobHash, ok := commit.FileBlobs[filePath]
 		if !ok {
 			return fmt.Errorf("file blob for '%s' not found in remote commit %s", filePath, version[:8])
 		}
-		blobURL := projectRemote + "/.steria/objects/blobs/" + blobHash
-		blobResp, err := fetchURL(blobURL)
-		if err != nil {
-			return fmt.Errorf("failed to fetch blob for '%s': %w", filePath, err)
-		}
-		if blobResp.StatusCode != 200 {
-			blobResp.Body.Close()
-			return fmt.Errorf("blob for '%s' not found at remote registry", filePath)
-		}
-		blobData, err := io.ReadAll(blobResp.Body)
-		blobResp.Body.Close()
-		if err != nil {
-			return fmt.Errorf("failed to read blob data for '%s': %w", filePath, err)
-		}
 		targetPath := filepath.Join(cwd, filePath)
-		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return fmt.Errorf("failed to create parent directory: %w", err)
-		}
-		if err := os.WriteFile(targetPath, blobData, 0644); err != nil {
-			return fmt.Errorf("failed to write restored file: %w", err)
+		if err := storage.WriteBlobToFile(ctx, blobs, blobHash, targetPath); err != nil {
+			return fmt.Errorf("failed to restore '%s' from remote: %w", filePath, err)
 		}
 		fmt.Printf("%s Restored file from remote: %s\n", green("✅"), filePath)
 	}
@@ -157,13 +115,3 @@ func runPull(project, version, signer string) error {
 	fmt.Printf("%s Performance optimized with concurrent processing!\n", cyan("⚡"))
 	return nil
 }
-
-// fetchURL is a helper to fetch a URL using HTTP GET
-func fetchURL(url string) (*http.Response, error) {
-	client := &http.Client{}
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
-}
@@ -6,6 +6,7 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -31,12 +32,12 @@ func NewBlameCmd() *cobra.Command {
 		Long:  "Blame shows who changed each line and when",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blameFile(args[0])
+			return blameFile(cmd.Context(), args[0])
 		},
 	}
 }
 
-func blameFile(filePath string) error {
+func blameFile(ctx context.Context, filePath string) error {
 	repoPath, _ := os.Getwd()
 
 	// Load repository
@@ -44,6 +45,7 @@ func blameFile(filePath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	// Check if file exists
 	fullPath := filepath.Join(repoPath, filePath)
@@ -89,34 +91,27 @@ func calculateBlame(repo *storage.Repo, filePath, currentContent string) ([]Blam
 		}
 	}
 
-	// Walk through commit history to find when each line was last modified
-	hash := repo.Head
-	seen := make(map[string]bool)
-
-	for hash != "" && !seen[hash] {
-		seen[hash] = true
-		commit, err := repo.LoadCommit(hash)
-		if err != nil {
-			break
-		}
+	// Walk through commit history to find when each line was last modified.
+	// The walk is topological, so every merge parent is visited after the merge.
+	history, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		return nil, err
+	}
 
+	for _, commit := range history {
 		// Check if this commit modified the file
 		if !hasFileInCommit(commit, filePath) {
-			hash = commit.Parent
 			continue
 		}
 
 		// Get the file content from this commit
 		commitContent, err := getFileContentFromCommit(repo, commit, filePath)
 		if err != nil {
-			hash = commit.Parent
 			continue
 		}
 
 		// Update blame lines for lines that were modified in this commit
 		updateBlameLines(blameLines, commit, commitContent)
-
-		hash = commit.Parent
 	}
 
 	return blameLines, nil
@@ -148,7 +143,7 @@ func getFileContentFromCommit(repo *storage.Repo, commit *storage.Commit, filePa
 	// Get blob content
 	blobDir := filepath.Join(repo.Path, ".steria", "objects", "blobs")
 	store := &storage.LocalBlobStore{Dir: blobDir}
-	data, err := storage.ReadFileBlobDecompressed(store, blobRef)
+	data, err := storage.ReadFileBlobDecompressed(repo.Context(), store, blobRef)
 	if err != nil {
 		return "", err
 	}
@@ -6,6 +6,7 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -21,12 +22,12 @@ func NewCherryPickCmd() *cobra.Command {
 		Long:  "Cherry-pick applies the changes from a specific commit to the current branch",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return cherryPick(args[0])
+			return cherryPick(cmd.Context(), args[0])
 		},
 	}
 }
 
-func cherryPick(commitHash string) error {
+func cherryPick(ctx context.Context, commitHash string) error {
 	repoPath, _ := os.Getwd()
 
 	// Load repository
@@ -34,8 +35,12 @@ func cherryPick(commitHash string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx).WithOperation("cherry-pick")
 
 	// Load the commit to cherry-pick
+	if commitHash, err = repo.ResolveRevision(commitHash); err != nil {
+		return err
+	}
 	sourceCommit, err := repo.LoadCommit(commitHash)
 	if err != nil {
 		return fmt.Errorf("commit %s not found: %w", commitHash, err)
@@ -48,10 +53,11 @@ func cherryPick(commitHash string) error {
 
 	// Note: We don't need current state for cherry-pick since we're applying changes directly
 
-	// Get the parent commit of the source commit
+	// Get the parent commit of the source commit. For a merge commit the
+	// changes are taken relative to its first parent.
 	var parentCommit *storage.Commit
-	if sourceCommit.Parent != "" {
-		parentCommit, err = repo.LoadCommit(sourceCommit.Parent)
+	if parent := sourceCommit.FirstParent(); parent != "" {
+		parentCommit, err = repo.LoadCommit(parent)
 		if err != nil {
 			return fmt.Errorf("failed to load parent commit: %w", err)
 		}
@@ -61,7 +67,7 @@ func cherryPick(commitHash string) error {
 	changes := calculateCommitChanges(parentCommit, sourceCommit)
 
 	// Apply changes to working directory
-	if err := applyChangesToWorkingDir(repoPath, changes); err != nil {
+	if err := applyChangesToWorkingDir(ctx, repoPath, changes); err != nil {
 		return fmt.Errorf("failed to apply changes: %w", err)
 	}
 
@@ -80,19 +86,10 @@ func cherryPick(commitHash string) error {
 }
 
 func isCommitInBranch(repo *storage.Repo, commitHash string) bool {
-	// Walk from HEAD to root to check if commit is in current branch
-	hash := repo.Head
-	for hash != "" {
-		if hash == commitHash {
-			return true
-		}
-		commit, err := repo.LoadCommit(hash)
-		if err != nil {
-			break
-		}
-		hash = commit.Parent
-	}
-	return false
+	// The commit is in the current branch if it is reachable from HEAD
+	// through any parent, including the merged-in side of merge commits
+	inBranch, err := repo.IsAncestor(commitHash, repo.Head)
+	return err == nil && inBranch
 }
 
 func calculateCommitChanges(parent, commit *storage.Commit) map[string]string {
@@ -123,7 +120,7 @@ func calculateCommitChanges(parent, commit *storage.Commit) map[string]string {
 	return changes
 }
 
-func applyChangesToWorkingDir(repoPath string, changes map[string]string) error {
+func applyChangesToWorkingDir(ctx context.Context, repoPath string, changes map[string]string) error {
 	for file, blobRef := range changes {
 		filePath := filepath.Join(repoPath, file)
 
@@ -141,16 +138,10 @@ func applyChangesToWorkingDir(repoPath string, changes map[string]string) error
 			return fmt.Errorf("failed to create directory for %s: %w", file, err)
 		}
 
-		// Get blob data
+		// Stream blob data into the file
 		blobDir := filepath.Join(repoPath, ".steria", "objects", "blobs")
 		store := &storage.LocalBlobStore{Dir: blobDir}
-		data, err := storage.ReadFileBlobDecompressed(store, blobRef)
-		if err != nil {
-			return fmt.Errorf("failed to read blob for %s: %w", file, err)
-		}
-
-		// Write file
-		if err := os.WriteFile(filePath, data, 0644); err != nil {
+		if err := storage.WriteBlobToFile(ctx, store, blobRef, filePath); err != nil {
 			return fmt.Errorf("failed to write file %s: %w", file, err)
 		}
 	}
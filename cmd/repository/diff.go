@@ -7,6 +7,7 @@ package repository
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -37,7 +38,7 @@ func NewDiffCmd() *cobra.Command {
 			if len(args) > 0 {
 				filePath = args[0]
 			}
-			return runDiffWithMode(filePath, sideBySide, contextLines)
+			return runDiffWithMode(cmd.Context(), filePath, sideBySide, contextLines)
 		},
 	}
 	cmd.Flags().BoolVar(&sideBySide, "side-by-side", false, "Show side-by-side diff view")
@@ -45,7 +46,7 @@ func NewDiffCmd() *cobra.Command {
 	return cmd
 }
 
-func runDiffWithMode(filePath string, sideBySide bool, contextLines int) error {
+func runDiffWithMode(ctx context.Context, filePath string, sideBySide bool, contextLines int) error {
 	profiler := metrics.StartProfiling()
 	defer func() {
 		fmt.Println(profiler.EndProfiling())
@@ -65,6 +66,7 @@ func runDiffWithMode(filePath string, sideBySide bool, contextLines int) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	if repo.Head == "" {
 		fmt.Printf("%s No commits found in repository\n", yellow("⚠️"))
@@ -102,10 +104,10 @@ func showFileDiffWithMode(repo *storage.Repo, filePath string, commit *storage.C
 				break
 			}
 		}
-		if found || c.Parent == "" {
+		if found || c.FirstParent() == "" {
 			break
 		}
-		parent, err := repo.LoadCommit(c.Parent)
+		parent, err := repo.LoadCommit(c.FirstParent())
 		if err != nil {
 			break
 		}
@@ -118,13 +120,11 @@ func showFileDiffWithMode(repo *storage.Repo, filePath string, commit *storage.C
 	var commitContent []string
 	blobHash := lastCommit.FileBlobs[filePath]
 	if blobHash != "" {
-		blobPath := repo.Path + "/.steria/objects/blobs/" + blobHash
-		if f, err := os.Open(blobPath); err == nil {
-			scanner := bufio.NewScanner(f)
+		if data, err := storage.ReadFileBlobDecompressed(repo.Context(), repo.BlobStore, blobHash); err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
 			for scanner.Scan() {
 				commitContent = append(commitContent, scanner.Text())
 			}
-			f.Close()
 		}
 	}
 
@@ -0,0 +1,113 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: fsck.go
+// Description: Implements the 'steria fsck' CLI command for checking the integrity of every object and ref in the repository.
+
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewFsckCmd returns the Cobra command for 'steria fsck'
+func NewFsckCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Check the integrity of the repository",
+		Long: `Decompress and re-hash every blob, parse and re-hash every commit and tree,
+follow every parent, tree and blob reference, and check that HEAD, branches and
+tags name stored commits.
+
+Missing and corrupt objects and broken refs are errors and make fsck exit with
+a non-zero status. Dangling objects, which no ref reaches, are only listed;
+'steria prune' removes them.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runFsck(cmd.Context(), asJSON)
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the result as JSON")
+	return cmd
+}
+
+func runFsck(ctx context.Context, asJSON bool) error {
+	if !asJSON {
+		profiler := metrics.StartProfiling()
+		defer func() {
+			fmt.Println(profiler.EndProfiling())
+		}()
+	}
+
+	green := color.New(color.FgGreen).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+	repo = repo.WithContext(ctx)
+
+	result, err := repo.Fsck()
+	if err != nil {
+		return fmt.Errorf("fsck failed: %w", err)
+	}
+
+	if asJSON {
+		if result.Problems == nil {
+			result.Problems = []storage.FsckProblem{}
+		}
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, p := range result.Problems {
+			mark := red("✗")
+			if p.Kind == storage.FsckDangling {
+				mark = yellow("•")
+			}
+			line := fmt.Sprintf("%s %-8s %-6s %s", mark, p.Kind, p.Object, p.Name)
+			if p.Detail != "" {
+				line += " (" + p.Detail + ")"
+			}
+			if p.From != "" {
+				line += " referenced by " + p.From
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%s Checked %d commits, %d trees, %d blobs and %d refs\n",
+			green("🔍"), result.Commits, result.Trees, result.Blobs, result.Refs)
+		if dangling := len(result.Problems) - result.Errors(); dangling > 0 {
+			fmt.Printf("%s %d dangling objects (run 'steria prune' to remove them)\n", yellow("ℹ️"), dangling)
+		}
+		if result.Errors() == 0 {
+			fmt.Printf("%s Repository is consistent\n", green("✅"))
+		}
+	}
+
+	if n := result.Errors(); n > 0 {
+		return fmt.Errorf("fsck found %d problems", n)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: gc.go
+// Description: Implements the 'steria gc' CLI command for packing loose objects into a single packfile.
+
+package repository
+
+import (
+	"fmt"
+	"os"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewGCCmd returns the Cobra command for 'steria gc'
+func NewGCCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Pack loose objects",
+		Long:  "Consolidate loose blobs, trees and commits (and any older packs) into a single packfile, then delete the loose copies.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGC()
+		},
+	}
+	return cmd
+}
+
+func runGC() error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	green := color.New(color.FgGreen).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
+	fmt.Printf("%s Packing objects...\n", cyan("📦"))
+	result, err := repo.GC()
+	if err != nil {
+		return fmt.Errorf("gc failed: %w", err)
+	}
+	if result.Pack == "" {
+		fmt.Printf("%s Nothing to pack, repository is already packed\n", green("✨"))
+		return nil
+	}
+	fmt.Printf("%s Packed %d objects into %s\n", green("✅"), result.Objects, result.Pack)
+	fmt.Printf("%s Removed %d loose objects and %d old packs\n", cyan("🧹"), result.LooseRemoved, result.PacksRemoved)
+	return nil
+}
@@ -8,6 +8,7 @@ package repository
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"steria/internal/metrics"
 	"steria/internal/storage"
@@ -60,20 +61,29 @@ func runLog() error {
 		return nil
 	}
 
-	// Walk through commit history
-	currentHash := repo.Head
+	// Walk through commit history, following every parent of merge commits
+	history, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		fmt.Printf("%s Failed to walk commit history: %v\n", red("❌"), err)
+		return err
+	}
 	commitCount := 0
-	maxCommits := 50 // Limit to prevent infinite loops
+	maxCommits := 50 // Limit output for long histories
 
-	for currentHash != "" && commitCount < maxCommits {
-		commit, err := repo.LoadCommit(currentHash)
-		if err != nil {
-			fmt.Printf("%s Failed to load commit %s: %v\n", red("❌"), currentHash[:8], err)
+	for _, commit := range history {
+		if len(history) > maxCommits {
 			break
 		}
 
 		// Print commit info with colors
 		fmt.Printf("\n%s %s\n", magenta("📍"), yellow(commit.Hash[:8]))
+		if commit.IsMerge() {
+			short := make([]string, len(commit.Parents))
+			for i, p := range commit.Parents {
+				short[i] = p[:8]
+			}
+			fmt.Printf("%s Merge: %s\n", cyan("🔀"), strings.Join(short, " "))
+		}
 		fmt.Printf("%s %s\n", green("👤"), commit.Author)
 		fmt.Printf("%s %s\n", cyan("📅"), commit.Timestamp.Format("2006-01-02 15:04:05"))
 		fmt.Printf("%s %s\n", magenta("💬"), commit.Message)
@@ -82,8 +92,6 @@ func runLog() error {
 			fmt.Printf("%s %d files\n", cyan("📁"), len(commit.Files))
 		}
 
-		// Move to parent commit
-		currentHash = commit.Parent
 		commitCount++
 	}
 
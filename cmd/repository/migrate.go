@@ -0,0 +1,87 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: migrate.go
+// Description: Implements the 'steria migrate' CLI command for upgrading a repository's on-disk format in place and rolling an upgrade back.
+
+package repository
+
+import (
+	"fmt"
+	"os"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewMigrateCmd returns the Cobra command for 'steria migrate'
+func NewMigrateCmd() *cobra.Command {
+	var to int
+	var dryRun, rollback bool
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the repository format",
+		Long: fmt.Sprintf(`Upgrade the repository in place to a newer on-disk format (default: %d, the
+newest this steria supports). Config, refs, commits and trees are backed up to
+.steria/backups first; a failed upgrade restores the backup automatically and
+--rollback restores the most recent backup on request.`, storage.CurrentFormatVersion),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMigrate(to, dryRun, rollback)
+		},
+	}
+	cmd.Flags().IntVar(&to, "to", storage.CurrentFormatVersion, "Format version to upgrade to")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Only list the upgrade steps")
+	cmd.Flags().BoolVar(&rollback, "rollback", false, "Restore the backup taken before the last upgrade")
+	return cmd
+}
+
+func runMigrate(to int, dryRun, rollback bool) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	green := color.New(color.FgGreen).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+
+	if rollback {
+		backup, err := storage.RollbackMigration(repoRoot)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s Restored the repository from %s\n", green("↩️"), backup)
+		return nil
+	}
+
+	result, err := storage.MigrateRepo(repoRoot, storage.MigrateOptions{Target: to, DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+	if len(result.Steps) == 0 {
+		fmt.Printf("%s Repository is already at format version %d\n", green("✨"), result.From)
+		return nil
+	}
+	for _, step := range result.Steps {
+		fmt.Printf("  %s\n", step)
+	}
+	if dryRun {
+		fmt.Printf("%s Dry run, the repository was not changed\n", cyan("ℹ️"))
+		return nil
+	}
+	fmt.Printf("%s Upgraded repository from format version %d to %d\n", green("⬆️"), result.From, result.To)
+	fmt.Printf("%s Backup kept at %s ('steria migrate --rollback' restores it)\n", cyan("💾"), result.Backup)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: op.go
+// Description: Implements the 'steria op log', 'steria op restore' and 'steria undo' CLI commands for listing the operation log and rewinding the repository to an earlier operation.
+
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewOpCmd returns the Cobra command for 'steria op'
+func NewOpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "op",
+		Short: "Inspect and restore the operation log",
+		Long: `Every command that changes the repository is recorded in the operation log
+with the refs and working directory from before and after it ran.`,
+	}
+	cmd.AddCommand(newOpLogCmd())
+	cmd.AddCommand(newOpRestoreCmd())
+	return cmd
+}
+
+func newOpLogCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:          "log",
+		Short:        "List recorded operations, newest first",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runOpLog(asJSON)
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the operations as JSON")
+	return cmd
+}
+
+func newOpRestoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <id>",
+		Short: "Put the repository back into the state an operation left it in",
+		Long: `Restore HEAD, the current branch, branches, tags, stashes, the staging index and
+the working directory to how operation <id> left them. Uncommitted changes are
+kept in the operation log, so the restore itself can be undone.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid operation id '%s'", args[0])
+			}
+			return runOpRestore(id)
+		},
+	}
+}
+
+// NewUndoCmd returns the Cobra command for 'steria undo'
+func NewUndoCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "undo",
+		Short: "Undo the last operation",
+		Long: `Rewind refs, the staging index and the working directory to how they were before
+the most recent operation. Running undo again undoes the operation before that.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUndo()
+		},
+	}
+}
+
+// loadOpRepo loads the repository the current directory is in
+func loadOpRepo() (*storage.Repo, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return nil, fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load repository: %w", err)
+	}
+	return repo, nil
+}
+
+func runOpLog(asJSON bool) error {
+	if !asJSON {
+		profiler := metrics.StartProfiling()
+		defer func() {
+			fmt.Println(profiler.EndProfiling())
+		}()
+	}
+
+	repo, err := loadOpRepo()
+	if err != nil {
+		return err
+	}
+	ops, err := repo.Operations()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(ops, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(ops) == 0 {
+		fmt.Println("No operations recorded")
+		return nil
+	}
+	yellow := color.New(color.FgYellow).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+	faint := color.New(color.Faint).SprintfFunc()
+	undoneBy := map[int]int{}
+	for _, op := range ops {
+		if op.Undoes != 0 {
+			undoneBy[op.Undoes] = op.ID
+		}
+	}
+	for _, op := range ops {
+		fmt.Printf("%s %s %s\n", yellow(fmt.Sprintf("#%d", op.ID)), op.Command,
+			faint("(%s, %s)", op.Actor, op.Time.Local().Format("2006-01-02 15:04:05")))
+		if by, ok := undoneBy[op.ID]; ok {
+			fmt.Printf("    %s\n", faint("undone by #%d", by))
+		}
+		if op.Error != "" {
+			fmt.Printf("    %s %s\n", red("failed:"), op.Error)
+		}
+		for _, change := range op.Changes() {
+			fmt.Printf("    %s\n", change)
+		}
+	}
+	return nil
+}
+
+func runOpRestore(id int) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	repo, err := loadOpRepo()
+	if err != nil {
+		return err
+	}
+	op, err := repo.RestoreOperation(id)
+	if err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("⏪ Restored the state after operation #%d (recorded as #%d)\n", id, op.ID)
+	printOpChanges(op)
+	return nil
+}
+
+func runUndo() error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	repo, err := loadOpRepo()
+	if err != nil {
+		return err
+	}
+	op, err := repo.Undo()
+	if errors.Is(err, storage.ErrNothingToUndo) {
+		color.New(color.FgYellow).Println("Nothing to undo")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	undone, err := repo.LoadOperation(op.Undoes)
+	if err != nil {
+		return err
+	}
+	color.New(color.FgGreen).Printf("⏪ Undid #%d: %s\n", undone.ID, undone.Command)
+	printOpChanges(op)
+	return nil
+}
+
+// printOpChanges lists what a restore changed
+func printOpChanges(op *storage.Operation) {
+	for _, change := range op.Changes() {
+		fmt.Printf("   %s\n", change)
+	}
+}
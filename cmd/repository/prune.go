@@ -0,0 +1,138 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: prune.go
+// Description: Implements the 'steria prune' CLI command for deleting unreachable objects older than a grace period.
+
+package repository
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewPruneCmd returns the Cobra command for 'steria prune'
+func NewPruneCmd() *cobra.Command {
+	var dryRun bool
+	var expire string
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete unreachable objects",
+		Long: `Walk every branch, tag, stash and the staging index, and delete the commits,
+trees and blobs none of them can reach. Objects newer than --expire are kept so
+a commit running at the same time is never affected.
+
+--expire accepts forms like 2.weeks, 3.days.ago, 12.hours, 90m, now or never.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			grace, err := parseExpire(expire)
+			if err != nil {
+				return err
+			}
+			return runPrune(storage.PruneOptions{Expire: grace, DryRun: dryRun})
+		},
+	}
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Only list what would be deleted")
+	cmd.Flags().StringVar(&expire, "expire", "2.weeks", "Only delete unreachable objects older than this")
+	return cmd
+}
+
+// expireUnits maps the unit names accepted by --expire to their length
+var expireUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// parseExpire parses a grace period such as "2.weeks", "3.days.ago", "now",
+// "never" or a Go duration like "90m"
+func parseExpire(s string) (time.Duration, error) {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".ago")
+	switch s {
+	case "now":
+		return 0, nil
+	case "never":
+		return time.Duration(math.MaxInt64), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[0])
+		unit, ok := expireUnits[strings.TrimSuffix(parts[1], "s")]
+		if err == nil && ok && n >= 0 {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid --expire value %q (try 2.weeks, 3.days, 12.hours, now or never)", s)
+}
+
+func runPrune(opts storage.PruneOptions) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	green := color.New(color.FgGreen).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
+	result, err := repo.Prune(opts)
+	if err != nil {
+		return fmt.Errorf("prune failed: %w", err)
+	}
+
+	verb := "Removed"
+	if opts.DryRun {
+		verb = "Would remove"
+		for _, hash := range result.Commits {
+			fmt.Printf("  commit %s\n", hash)
+		}
+		for _, hash := range result.Trees {
+			fmt.Printf("  tree   %s\n", hash)
+		}
+		for _, hash := range result.Blobs {
+			fmt.Printf("  blob   %s\n", hash)
+		}
+	}
+	if result.Total() == 0 && result.CacheFiles == 0 {
+		fmt.Printf("%s No unreachable objects to prune\n", green("✨"))
+	} else {
+		fmt.Printf("%s %s %d commits, %d trees, %d blobs and %d cache files (%d bytes)\n",
+			green("🧹"), verb, len(result.Commits), len(result.Trees), len(result.Blobs), result.CacheFiles, result.BytesFreed)
+	}
+	if result.Recent > 0 {
+		fmt.Printf("%s Kept %d unreachable objects newer than the grace period\n", yellow("⏳"), result.Recent)
+	}
+	if opts.DryRun {
+		fmt.Printf("%s Dry run, nothing was deleted\n", cyan("ℹ️"))
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package repository
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -32,13 +33,13 @@ func NewRebaseCmd() *cobra.Command {
 		Long:  "Opens an editor where you can reorder, combine, or skip commits to clean up your history",
 		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runRebase()
+			return runRebase(cmd.Context())
 		},
 	}
 	return cmd
 }
 
-func runRebase() error {
+func runRebase(ctx context.Context) error {
 	cyan := color.New(color.FgCyan).SprintFunc()
 	green := color.New(color.FgGreen).SprintFunc()
 	yellow := color.New(color.FgYellow).SprintFunc()
@@ -50,6 +51,7 @@ func runRebase() error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx).WithOperation("rebase")
 
 	// Get all commits from HEAD back to the beginning
 	commits, err := getAllCommits(repo)
@@ -118,21 +120,13 @@ func runRebase() error {
 }
 
 func getAllCommits(repo *storage.Repo) ([]*storage.Commit, error) {
-	var commits []*storage.Commit
-	seen := map[string]bool{}
-
-	hash := repo.Head
-	for hash != "" && !seen[hash] {
-		seen[hash] = true
-		commit, err := repo.LoadCommit(hash)
-		if err != nil {
-			break
-		}
-		commits = append(commits, commit)
-		hash = commit.Parent
+	commits, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		return nil, err
 	}
 
-	// Reverse to get chronological order (oldest first)
+	// Reverse to get chronological order (oldest first). The walk is
+	// topological, so every parent still comes before its children.
 	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
 		commits[i], commits[j] = commits[j], commits[i]
 	}
@@ -207,7 +201,7 @@ func applyRebasePlan(repo *storage.Repo, plan []RebaseAction) error {
 	}
 
 	// Start from the first commit's parent
-	parent := firstCommit.Parent
+	parent := firstCommit.FirstParent()
 	var combinedMsg strings.Builder
 
 	for _, action := range plan {
@@ -250,8 +244,7 @@ func applyRebasePlan(repo *storage.Repo, plan []RebaseAction) error {
 	}
 
 	// Update HEAD to the last commit
-	headPath := filepath.Join(repo.Path, ".steria", "HEAD")
-	return os.WriteFile(headPath, []byte(parent), 0644)
+	return repo.NewRefTransaction().UpdateFrom("HEAD", parent, repo.Head, "rebase (finish)").Commit()
 }
 
 func applyCommitToWorkingDir(repo *storage.Repo, commit *storage.Commit) error {
@@ -267,16 +260,10 @@ func applyCommitToWorkingDir(repo *storage.Repo, commit *storage.Commit) error {
 			return err
 		}
 
-		// Get blob data
+		// Stream blob data into the file
 		blobDir := filepath.Join(repoPath, ".steria", "objects", "blobs")
 		store := &storage.LocalBlobStore{Dir: blobDir}
-		data, err := storage.ReadFileBlobDecompressed(store, blobRef)
-		if err != nil {
-			return err
-		}
-
-		// Write file
-		if err := os.WriteFile(filePath, data, 0644); err != nil {
+		if err := storage.WriteBlobToFile(repo.Context(), store, blobRef, filePath); err != nil {
 			return err
 		}
 	}
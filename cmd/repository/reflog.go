@@ -0,0 +1,102 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: reflog.go
+// Description: Implements the 'steria reflog' CLI command for listing every move of HEAD or a branch.
+
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewReflogCmd returns the Cobra command for 'steria reflog'
+func NewReflogCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "reflog [ref]",
+		Short: "Show where HEAD or a branch has pointed",
+		Long: `List every move of a ref (HEAD when none is given, or a branch name), newest
+first. Each entry can be named as <ref>@{n}, and <ref>@{date} names the commit
+the ref pointed at on that date (e.g. Stem@{2}, HEAD@{yesterday},
+Stem@{3.hours.ago}), so commits lost to a rebase, branch switch or bad merge can be
+restored or branched from again.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ref := "HEAD"
+			if len(args) == 1 {
+				ref = args[0]
+			}
+			return runReflog(ref, asJSON)
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the entries as JSON")
+	return cmd
+}
+
+func runReflog(ref string, asJSON bool) error {
+	if !asJSON {
+		profiler := metrics.StartProfiling()
+		defer func() {
+			fmt.Println(profiler.EndProfiling())
+		}()
+	}
+
+	yellow := color.New(color.FgYellow).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
+	entries, err := repo.Reflog(ref)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if entries == nil {
+			entries = []storage.ReflogEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Printf("No reflog entries for '%s'\n", ref)
+		return nil
+	}
+	for i, e := range entries {
+		fmt.Printf("%s %s: %s %s\n", yellow(shortHash(e.New)), cyan(fmt.Sprintf("%s@{%d}", ref, i)), e.Op,
+			color.New(color.Faint).Sprintf("(%s, %s)", e.Actor, e.Time.Local().Format("2006-01-02 15:04:05")))
+	}
+	return nil
+}
+
+// shortHash abbreviates a commit hash for display
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
@@ -1,56 +1,48 @@
 // Author: KleaSCM
 // Email: KleaSCM@gmail.com
 // Name of the file: remote.go
-// Description: CLI commands for distributed remotes (add, push, pull) in Steria.
+// Description: CLI commands for distributed remotes (add, push, fetch, pull) in Steria. Push, fetch and pull transfer branches with their commits, trees and blobs.
 
 package repository
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
-	"steria/internal/storage"
 	"strings"
 
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
-type RemoteConfig struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
-	URL  string `json:"url"`
-}
+// RemoteConfig and RemotesFile describe .steria/remotes.json
+type RemoteConfig = storage.RemoteConfig
 
-type RemotesFile struct {
-	Remotes []RemoteConfig `json:"remotes"`
-}
+type RemotesFile = storage.RemotesFile
 
 func loadRemotes(repoPath string) (*RemotesFile, error) {
-	remotesPath := filepath.Join(repoPath, ".steria", "remotes.json")
-	f, err := os.Open(remotesPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &RemotesFile{}, nil
-		}
-		return nil, err
-	}
-	defer f.Close()
-	var rf RemotesFile
-	if err := json.NewDecoder(f).Decode(&rf); err != nil {
-		return nil, err
-	}
-	return &rf, nil
+	return storage.LoadRemotes(repoPath)
 }
 
 func saveRemotes(repoPath string, rf *RemotesFile) error {
-	remotesPath := filepath.Join(repoPath, ".steria", "remotes.json")
-	f, err := os.Create(remotesPath)
+	return storage.SaveRemotes(repoPath, rf)
+}
+
+// openRemote looks up a remote by name and opens its store
+func openRemote(ctx context.Context, repoPath, remoteName string) (storage.RemoteStore, error) {
+	rf, err := loadRemotes(repoPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(rf)
+	remote, ok := rf.Find(remoteName)
+	if !ok {
+		return nil, fmt.Errorf("remote '%s' not found", remoteName)
+	}
+	return storage.OpenRemoteStore(ctx, remote)
 }
 
 func NewRemoteCmd() *cobra.Command {
@@ -64,26 +56,26 @@ func NewRemoteCmd() *cobra.Command {
 }
 
 func newRemoteAddCmd() *cobra.Command {
-	return &cobra.Command{
+	var timeout string
+	cmd := &cobra.Command{
 		Use:   "add <name> <type> <url>",
 		Short: "Add or update a remote (type: local, http, s3, peer)",
 		Args:  cobra.ExactArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			name, typ, url := args[0], args[1], args[2]
+			remote := RemoteConfig{Name: name, Type: typ, URL: url, Timeout: timeout}
+			if _, err := remote.TimeoutDuration(); err != nil {
+				return err
+			}
 			repoPath, _ := os.Getwd()
 			rf, err := loadRemotes(repoPath)
 			if err != nil {
 				return err
 			}
-			found := false
-			for i, r := range rf.Remotes {
-				if r.Name == name {
-					rf.Remotes[i] = RemoteConfig{Name: name, Type: typ, URL: url}
-					found = true
-				}
-			}
-			if !found {
-				rf.Remotes = append(rf.Remotes, RemoteConfig{Name: name, Type: typ, URL: url})
+			if existing, ok := rf.Find(name); ok {
+				*existing = remote
+			} else {
+				rf.Remotes = append(rf.Remotes, remote)
 			}
 			if err := saveRemotes(repoPath, rf); err != nil {
 				return err
@@ -92,6 +84,8 @@ func newRemoteAddCmd() *cobra.Command {
 			return nil
 		},
 	}
+	cmd.Flags().StringVar(&timeout, "timeout", "", "Abandon requests after the remote is silent this long, e.g. 90s (default 30s, 0 disables)")
+	return cmd
 }
 
 func newRemoteListCmd() *cobra.Command {
@@ -105,6 +99,10 @@ func newRemoteListCmd() *cobra.Command {
 				return err
 			}
 			for _, r := range rf.Remotes {
+				if r.Timeout != "" {
+					fmt.Printf("%s: %s (%s, timeout %s)\n", r.Name, r.URL, r.Type, r.Timeout)
+					continue
+				}
 				fmt.Printf("%s: %s (%s)\n", r.Name, r.URL, r.Type)
 			}
 			return nil
@@ -112,132 +110,337 @@ func newRemoteListCmd() *cobra.Command {
 	}
 }
 
+// leaseFromTracking is the value of a bare --force-with-lease: expect the
+// remote branch where the remote-tracking branch says it is
+const leaseFromTracking = "(remote-tracking branch)"
+
 func NewPushCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "push [remote]",
-		Short: "Push all blobs to the remote",
-		Args:  cobra.MaximumNArgs(1),
+	var force bool
+	var lease string
+	cmd := &cobra.Command{
+		Use:   "push [remote] [branch...]",
+		Short: "Push branches and their history to a remote",
+		Long: `Upload branches (the current one by default) to a remote (the branch's
+upstream remote, or origin): every commit the remote does not have yet, with
+the trees and blobs it names, and then the remote branch itself. The first
+push of a branch makes the remote branch its upstream.
+
+A remote branch only moves if it is an ancestor of the pushed commit and
+nobody else moved it during the push; otherwise the push of that branch is
+rejected. --force discards commits on the remote branch. --force-with-lease
+does the same only while the remote branch is still at <expected>, or where
+it was at the last fetch when no value is given.`,
+		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			repoPath, _ := os.Getwd()
-			rf, err := loadRemotes(repoPath)
-			if err != nil {
-				return err
-			}
-			remoteName := "origin"
+			remoteName := ""
+			var branches []string
 			if len(args) > 0 {
-				remoteName = args[0]
-			}
-			var remote *RemoteConfig
-			for _, r := range rf.Remotes {
-				if r.Name == remoteName {
-					remote = &r
-				}
+				remoteName, branches = args[0], args[1:]
 			}
-			if remote == nil {
-				return fmt.Errorf("remote '%s' not found", remoteName)
-			}
-			var store storage.BlobStore
-			switch remote.Type {
-			case "http":
-				store = &storage.HTTPBlobStore{BaseURL: remote.URL}
-			case "s3":
-				s, err := storage.NewS3BlobStore(remote.URL, "")
-				if err != nil {
-					return err
-				}
-				store = s
-			case "peer":
-				store = &storage.PeerToPeerBlobStore{Peers: strings.Split(remote.URL, ",")}
-			case "local":
-				store = &storage.LocalBlobStore{Dir: remote.URL}
-			default:
-				return fmt.Errorf("unknown remote type: %s", remote.Type)
-			}
-			// Push all local blobs not present on remote
-			local := &storage.LocalBlobStore{Dir: filepath.Join(repoPath, ".steria", "objects", "blobs")}
-			blobs, err := local.ListBlobs()
-			if err != nil {
-				return err
-			}
-			for _, b := range blobs {
-				if !store.HasBlob(b) {
-					data, err := local.GetBlob(b)
-					if err != nil {
-						return err
-					}
-					if err := store.PutBlob(b, data); err != nil {
-						return err
-					}
-					fmt.Printf("Pushed blob %s\n", b)
-				}
-			}
-			fmt.Println("Push complete.")
-			return nil
+			opts := pushFlags{force: force, leased: cmd.Flags().Changed("force-with-lease"), lease: lease}
+			return runPush(cmd.Context(), remoteName, branches, opts)
 		},
 	}
+	cmd.Flags().BoolVar(&force, "force", false, "Move remote branches even if that discards commits on them")
+	cmd.Flags().StringVar(&lease, "force-with-lease", "", "Like --force, but only if the remote branch is at `expected` (default: its remote-tracking branch)")
+	cmd.Flags().Lookup("force-with-lease").NoOptDefVal = leaseFromTracking
+	cmd.MarkFlagsMutuallyExclusive("force", "force-with-lease")
+	return cmd
+}
+
+// pushFlags are the command line options of 'steria push'
+type pushFlags struct {
+	force  bool
+	leased bool
+	lease  string
 }
 
 func NewPullCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "pull [remote]",
-		Short: "Pull all blobs from the remote",
-		Args:  cobra.MaximumNArgs(1),
+		Short: "Fetch a remote's branches and fast-forward the current branch",
+		Long: `Download every branch of a remote (the current branch's upstream remote, or
+origin) with the history it needs into remote-tracking branches such as
+origin/Stem, then fast-forward the current branch to its upstream. When both
+sides have new commits, merge the remote-tracking branch with
+'steria merge origin/<branch> - <signer>'.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			repoPath, _ := os.Getwd()
-			rf, err := loadRemotes(repoPath)
-			if err != nil {
-				return err
-			}
-			remoteName := "origin"
+			remoteName := ""
 			if len(args) > 0 {
 				remoteName = args[0]
 			}
-			var remote *RemoteConfig
-			for _, r := range rf.Remotes {
-				if r.Name == remoteName {
-					remote = &r
-				}
-			}
-			if remote == nil {
-				return fmt.Errorf("remote '%s' not found", remoteName)
-			}
-			var store storage.BlobStore
-			switch remote.Type {
-			case "http":
-				store = &storage.HTTPBlobStore{BaseURL: remote.URL}
-			case "s3":
-				s, err := storage.NewS3BlobStore(remote.URL, "")
-				if err != nil {
-					return err
-				}
-				store = s
-			case "peer":
-				store = &storage.PeerToPeerBlobStore{Peers: strings.Split(remote.URL, ",")}
-			case "local":
-				store = &storage.LocalBlobStore{Dir: remote.URL}
-			default:
-				return fmt.Errorf("unknown remote type: %s", remote.Type)
+			return runPull(cmd.Context(), remoteName)
+		},
+	}
+}
+
+// loadRemoteRepo loads the repository around the current directory and
+// opens one of its remotes. An empty remote name means the current branch's
+// upstream remote, or origin; the name used is returned.
+func loadRemoteRepo(ctx context.Context, remoteName string) (*storage.Repo, storage.RemoteStore, string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return nil, nil, "", fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to load repository: %w", err)
+	}
+	if remoteName == "" {
+		remoteName = "origin"
+		up, err := repo.Upstream(strings.TrimSpace(repo.Branch))
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if up != nil {
+			remoteName = up.Remote
+		}
+	}
+	store, err := openRemote(ctx, repoRoot, remoteName)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return repo.WithContext(ctx), store, remoteName, nil
+}
+
+func runPush(ctx context.Context, remoteName string, branches []string, flags pushFlags) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	cyan := color.New(color.FgCyan).SprintFunc()
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	repo, store, remoteName, err := loadRemoteRepo(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+	if len(branches) == 0 {
+		branches = []string{strings.TrimSpace(repo.Branch)}
+	}
+	transfer, endProgress := transferProgress("Uploading")
+	repo = repo.WithTransfer(transfer)
+	fmt.Printf("%s Pushing to '%s'...\n", cyan("🚀"), remoteName)
+
+	rejected := 0
+	for _, branch := range branches {
+		opts := storage.PushOptions{Force: flags.force}
+		if flags.leased {
+			expected := flags.lease
+			if expected == leaseFromTracking {
+				expected = ""
 			}
-			// Pull all remote blobs not present locally
-			local := &storage.LocalBlobStore{Dir: filepath.Join(repoPath, ".steria", "objects", "blobs")}
-			blobs, err := store.ListBlobs()
-			if err != nil {
+			if opts.Expected, err = repo.LeaseExpectation(remoteName, branch, expected); err != nil {
 				return err
 			}
-			for _, b := range blobs {
-				if !local.HasBlob(b) {
-					data, err := store.GetBlob(b)
-					if err != nil {
-						return err
-					}
-					if err := local.PutBlob(b, data); err != nil {
-						return err
-					}
-					fmt.Printf("Pulled blob %s\n", b)
-				}
+			opts.Lease = true
+		}
+		result, err := repo.Push(store, remoteName, branch, opts)
+		endProgress()
+		if result != nil && len(result.Failed) > 0 {
+			reportFailures(result.Failed, "push "+remoteName)
+		}
+		if err != nil && !errors.Is(err, storage.ErrPushRejected) {
+			if ctx.Err() != nil {
+				return fmt.Errorf("push interrupted: %w", err)
 			}
-			fmt.Println("Pull complete.")
-			return nil
+			return err
+		}
+		if result.Commits+result.Trees+result.Blobs > 0 {
+			fmt.Printf("%s Uploaded %d commits, %d trees and %d blobs for '%s'\n", cyan("📦"), result.Commits, result.Trees, result.Blobs, branch)
+		}
+		ref := branch + " -> " + remoteName + "/" + branch
+		switch result.Status {
+		case storage.PushNew:
+			fmt.Printf("   %s %-20s %s\n", green("[new branch]"), shortHash(result.Commit), ref)
+		case storage.PushFastForward:
+			fmt.Printf("   %s %-20s %s\n", green("[updated]   "), shortHash(result.Old)+".."+shortHash(result.Commit), ref)
+		case storage.PushForced:
+			fmt.Printf("   %s %-20s %s\n", yellow("[forced]    "), shortHash(result.Old)+"..."+shortHash(result.Commit), ref)
+		case storage.PushUpToDate:
+			fmt.Printf("   %s %-20s %s\n", cyan("[up to date]"), shortHash(result.Commit), ref)
+		default:
+			rejected++
+			fmt.Printf("   %s %-20s %s (%s)\n", red("[rejected]  "), shortHash(result.Commit), ref, strings.TrimPrefix(string(result.Status), "rejected-"))
+			fmt.Printf("      %s\n", result.Reason)
+		}
+		if result.SetUpstream {
+			fmt.Printf("%s Branch '%s' now tracks %s/%s\n", cyan("🔗"), branch, remoteName, branch)
+		}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d of %d branches were rejected by '%s'", rejected, len(branches), remoteName)
+	}
+	return nil
+}
+
+func runPull(ctx context.Context, remoteName string) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	cyan := color.New(color.FgCyan).SprintFunc()
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	repo, store, remoteName, err := loadRemoteRepo(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+	transfer, endProgress := transferProgress("Downloading")
+	repo = repo.WithTransfer(transfer)
+	fmt.Printf("%s Pulling from '%s'...\n", cyan("🚀"), remoteName)
+	result, err := repo.Pull(store, remoteName)
+	endProgress()
+	var fetched *storage.FetchResult
+	if result != nil {
+		fetched = result.FetchResult
+	}
+	if err := reportFetch(ctx, remoteName, fetched, err); err != nil {
+		return err
+	}
+	switch {
+	case result.NoUpstream:
+		fmt.Printf("%s '%s' does not exist; nothing to update\n", yellow("💡"), result.Upstream)
+	case result.UpToDate:
+		fmt.Printf("%s Already up to date with %s\n", yellow("💡"), result.Upstream)
+	case result.FastForward:
+		fmt.Printf("%s Fast-forwarded to %s at %s\n", green("✅"), result.Upstream, shortHash(repo.Head))
+	case result.Diverged:
+		fmt.Printf("%s Your branch and %s have diverged; run 'steria merge %s - <signer>' to combine them\n", yellow("⚠️"), result.Upstream, result.Upstream)
+	}
+	return nil
+}
+
+// NewFetchCmd returns the Cobra command for 'steria fetch'
+func NewFetchCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fetch [remote]",
+		Short: "Download a remote's branches into remote-tracking branches",
+		Long: `Download every branch of a remote (the current branch's upstream remote, or
+origin) with the history it needs into remote-tracking branches such as
+origin/Stem. Local branches and the working directory are left alone; compare
+with 'steria status' and bring them up to date with 'steria pull' or
+'steria merge origin/<branch> - <signer>'.`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			remoteName := ""
+			if len(args) > 0 {
+				remoteName = args[0]
+			}
+			return runFetch(cmd.Context(), remoteName)
 		},
 	}
 }
+
+func runFetch(ctx context.Context, remoteName string) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	repo, store, remoteName, err := loadRemoteRepo(ctx, remoteName)
+	if err != nil {
+		return err
+	}
+	transfer, endProgress := transferProgress("Downloading")
+	repo = repo.WithTransfer(transfer)
+	fmt.Printf("%s Fetching from '%s'...\n", cyan("🚀"), remoteName)
+	result, err := repo.Fetch(store, remoteName)
+	endProgress()
+	if err := reportFetch(ctx, remoteName, result, err); err != nil {
+		return err
+	}
+	branch := strings.TrimSpace(repo.Branch)
+	tracking, err := repo.TrackingStatus(branch)
+	if err != nil {
+		return err
+	}
+	if tracking != nil {
+		fmt.Printf("%s Your branch is %s\n", cyan("🔗"), tracking.Summary())
+	}
+	return nil
+}
+
+// reportFetch prints what a fetch downloaded and which remote-tracking
+// branches moved, and returns err once rejected objects are listed
+func reportFetch(ctx context.Context, remoteName string, result *storage.FetchResult, err error) error {
+	cyan := color.New(color.FgCyan).SprintFunc()
+	green := color.New(color.FgGreen).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	if result != nil {
+		for _, hash := range result.Rejected {
+			fmt.Printf("%s Rejected %s: content does not match its hash\n", red("❌"), hash)
+		}
+		if len(result.Failed) > 0 {
+			reportFailures(result.Failed, "fetch "+remoteName)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("fetch from '%s' interrupted: %w", remoteName, err)
+		}
+		return err
+	}
+	fmt.Printf("%s Downloaded %d commits, %d trees and %d blobs\n", cyan("📦"), result.Commits, result.Trees, result.Blobs)
+	for _, u := range result.Updated {
+		ref := remoteName + "/" + u.Branch
+		if u.Old == "" {
+			fmt.Printf("   %s %s at %s\n", green("[new]"), ref, shortHash(u.New))
+			continue
+		}
+		fmt.Printf("   %s..%s %s\n", shortHash(u.Old), shortHash(u.New), ref)
+	}
+	return nil
+}
+
+// transferProgress returns transfer options that keep a live progress line
+// (objects, bytes, rate, ETA) on a terminal, and a function ending that line
+// once the transfer is done
+func transferProgress(verb string) (storage.TransferOptions, func()) {
+	opts := storage.TransferOptions{}
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return opts, func() {}
+	}
+	cyan := color.New(color.FgCyan).SprintFunc()
+	shown := false
+	opts.Progress = func(p storage.TransferProgress) {
+		if p.Total == 0 {
+			return
+		}
+		fmt.Printf("\r\033[K%s %s: %s", cyan("📡"), verb, p)
+		shown = true
+	}
+	return opts, func() {
+		if shown {
+			fmt.Println()
+			shown = false
+		}
+	}
+}
+
+// reportFailures lists objects that still failed after retries and how to
+// retry them
+func reportFailures(failed []storage.TransferFailure, command string) {
+	red := color.New(color.FgRed).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+	fmt.Printf("%s %d objects failed after retries:\n", red("❌"), len(failed))
+	for _, f := range failed {
+		fmt.Printf("   %s: %s\n", shortHash(f.Hash), f.Error)
+	}
+	fmt.Printf("%s Run 'steria %s' again to retry them; only missing objects are transferred\n", yellow("💡"), command)
+}
@@ -97,6 +97,15 @@ func runResolve(file string) error {
 	if err := storage.ResolveConflict(repoRoot, file, user); err != nil {
 		return fmt.Errorf("failed to mark conflict as resolved: %w", err)
 	}
-	color.New(color.FgGreen).Printf("\nConflict in %s marked as resolved!\n\n", file)
+
+	// Stage the resolved content so the next commit records it
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+	if _, err := repo.Stage(file); err != nil {
+		return fmt.Errorf("failed to stage resolved file: %w", err)
+	}
+	color.New(color.FgGreen).Printf("\nConflict in %s marked as resolved and staged!\n\n", file)
 	return nil
 }
@@ -6,6 +6,7 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -20,7 +21,7 @@ import (
 // NewRestoreCmd creates the 'restore' command for Steria
 func NewRestoreCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "restore <file> [commit-hash]",
+		Use:   "restore <file> [revision]",
 		Short: "Restore files from previous commits",
 		Long:  "Restore deleted or previous versions of files from specific commits or the last commit",
 		Args:  cobra.RangeArgs(1, 2),
@@ -30,14 +31,14 @@ func NewRestoreCmd() *cobra.Command {
 			if len(args) > 1 {
 				commitHash = args[1]
 			}
-			return runRestore(filePath, commitHash)
+			return runRestore(cmd.Context(), filePath, commitHash)
 		},
 	}
 	return cmd
 }
 
 // runRestore restores a file from a specific commit or the last commit
-func runRestore(filePath, commitHash string) error {
+func runRestore(ctx context.Context, filePath, commitHash string) error {
 	// Start performance profiling
 	profiler := metrics.StartProfiling()
 	defer func() {
@@ -61,6 +62,7 @@ func runRestore(filePath, commitHash string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	if repo.Head == "" {
 		return fmt.Errorf("no commits found in repository")
@@ -69,7 +71,9 @@ func runRestore(filePath, commitHash string) error {
 	// Determine which commit to restore from
 	targetCommit := repo.Head
 	if commitHash != "" {
-		targetCommit = commitHash
+		if targetCommit, err = repo.ResolveRevision(commitHash); err != nil {
+			return err
+		}
 	}
 
 	fmt.Printf("%s Restoring from commit: %s\n", magenta("📍"), yellow(targetCommit[:8]))
@@ -115,17 +119,9 @@ func runRestore(filePath, commitHash string) error {
 	if !ok {
 		return fmt.Errorf("file blob for '%s' not found in commit %s", filePath, targetCommit[:8])
 	}
-	blobPath := filepath.Join(cwd, ".steria", "objects", "blobs", blobHash)
-	blobData, err := os.ReadFile(blobPath)
-	if err != nil {
-		return fmt.Errorf("failed to read blob for '%s': %w", filePath, err)
-	}
-	// Ensure parent directory exists
-	if err := os.MkdirAll(filepath.Dir(currentPath), 0755); err != nil {
-		return fmt.Errorf("failed to create parent directory: %w", err)
-	}
-	if err := os.WriteFile(currentPath, blobData, 0644); err != nil {
-		return fmt.Errorf("failed to write restored file: %w", err)
+	// Stream the blob straight into the working file
+	if err := storage.WriteBlobToFile(ctx, repo.BlobStore, blobHash, currentPath); err != nil {
+		return fmt.Errorf("failed to restore '%s': %w", filePath, err)
 	}
 
 	fmt.Printf("%s File '%s' restored from commit %s\n", green("✅"), filePath, targetCommit[:8])
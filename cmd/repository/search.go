@@ -8,7 +8,6 @@ package repository
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"regexp"
 	"steria/internal/storage"
 	"strings"
@@ -44,6 +43,7 @@ func NewSearchCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			repo = repo.WithContext(cmd.Context())
 
 			// If --all is set, do both
 			if searchAll {
@@ -124,24 +124,13 @@ func searchFilesInCommits(repo *storage.Repo, pattern string, useRegex bool, aut
 		}
 	}
 
-	commitHashes := []string{}
-	commit := repo.Head
-	commitMap := map[string]bool{}
-	for commit != "" && !commitMap[commit] {
-		commitMap[commit] = true
-		commitHashes = append(commitHashes, commit)
-		c, err := repo.LoadCommit(commit)
-		if err != nil || c.Parent == "" {
-			break
-		}
-		commit = c.Parent
+	history, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		return fmt.Errorf("failed to walk commit history: %w", err)
 	}
 
-	for _, hash := range commitHashes {
-		c, err := repo.LoadCommit(hash)
-		if err != nil {
-			continue
-		}
+	for _, c := range history {
+		hash := c.Hash
 		if author != "" && !strings.Contains(strings.ToLower(c.Author), strings.ToLower(author)) {
 			continue
 		}
@@ -153,8 +142,7 @@ func searchFilesInCommits(repo *storage.Repo, pattern string, useRegex bool, aut
 			if blobHash == "" {
 				continue
 			}
-			blobPath := filepath.Join(repo.Path, ".steria", "objects", "blobs", blobHash)
-			data, err := os.ReadFile(blobPath)
+			data, err := storage.ReadFileBlobDecompressed(repo.Context(), repo.BlobStore, blobHash)
 			if err != nil {
 				continue
 			}
@@ -223,24 +211,13 @@ func searchCommitsMeta(repo *storage.Repo, pattern string, useRegex bool, author
 		}
 	}
 
-	commitHashes := []string{}
-	commit := repo.Head
-	commitMap := map[string]bool{}
-	for commit != "" && !commitMap[commit] {
-		commitMap[commit] = true
-		commitHashes = append(commitHashes, commit)
-		c, err := repo.LoadCommit(commit)
-		if err != nil || c.Parent == "" {
-			break
-		}
-		commit = c.Parent
+	history, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		return fmt.Errorf("failed to walk commit history: %w", err)
 	}
 
-	for _, hash := range commitHashes {
-		c, err := repo.LoadCommit(hash)
-		if err != nil {
-			continue
-		}
+	for _, c := range history {
+		hash := c.Hash
 		match := false
 		fields := []struct {
 			label string
@@ -6,6 +6,7 @@
 package repository
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -48,7 +49,7 @@ func newStashSaveCmd() *cobra.Command {
 			if len(args) > 0 {
 				message = args[0]
 			}
-			return stashSave(message)
+			return stashSave(cmd.Context(), message)
 		},
 	}
 }
@@ -73,7 +74,7 @@ func newStashApplyCmd() *cobra.Command {
 			if len(args) > 0 {
 				stashID = args[0]
 			}
-			return stashApply(stashID)
+			return stashApply(cmd.Context(), stashID)
 		},
 	}
 }
@@ -103,12 +104,12 @@ func newStashPopCmd() *cobra.Command {
 			if len(args) > 0 {
 				stashID = args[0]
 			}
-			return stashPop(stashID)
+			return stashPop(cmd.Context(), stashID)
 		},
 	}
 }
 
-func stashSave(message string) error {
+func stashSave(ctx context.Context, message string) error {
 	repoPath, _ := os.Getwd()
 
 	// Load repository
@@ -116,6 +117,7 @@ func stashSave(message string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	// Get current changes
 	changes, err := repo.GetChanges()
@@ -180,7 +182,7 @@ func stashList() error {
 	return nil
 }
 
-func stashApply(stashID string) error {
+func stashApply(ctx context.Context, stashID string) error {
 	repoPath, _ := os.Getwd()
 
 	// Load stash
@@ -207,16 +209,10 @@ func stashApply(stashID string) error {
 			return fmt.Errorf("failed to create directory for %s: %w", file, err)
 		}
 
-		// Get blob data
+		// Stream blob data into the file
 		blobDir := filepath.Join(repoPath, ".steria", "objects", "blobs")
 		store := &storage.LocalBlobStore{Dir: blobDir}
-		data, err := storage.ReadFileBlobDecompressed(store, blobRef)
-		if err != nil {
-			return fmt.Errorf("failed to read blob for %s: %w", file, err)
-		}
-
-		// Write file
-		if err := os.WriteFile(filePath, data, 0644); err != nil {
+		if err := storage.WriteBlobToFile(ctx, store, blobRef, filePath); err != nil {
 			return fmt.Errorf("failed to write file %s: %w", file, err)
 		}
 	}
@@ -257,9 +253,9 @@ func stashDrop(stashID string) error {
 	return nil
 }
 
-func stashPop(stashID string) error {
+func stashPop(ctx context.Context, stashID string) error {
 	// Apply stash
-	if err := stashApply(stashID); err != nil {
+	if err := stashApply(ctx, stashID); err != nil {
 		return err
 	}
 
@@ -373,16 +369,10 @@ func revertWorkingDirectory(repoPath string, repo *storage.Repo) error {
 			return err
 		}
 
-		// Get blob data
+		// Stream blob data into the file
 		blobDir := filepath.Join(repoPath, ".steria", "objects", "blobs")
 		store := &storage.LocalBlobStore{Dir: blobDir}
-		data, err := storage.ReadFileBlobDecompressed(store, blobRef)
-		if err != nil {
-			return err
-		}
-
-		// Write file
-		if err := os.WriteFile(filePath, data, 0644); err != nil {
+		if err := storage.WriteBlobToFile(repo.Context(), store, blobRef, filePath); err != nil {
 			return err
 		}
 	}
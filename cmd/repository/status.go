@@ -3,6 +3,7 @@ package repository
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"steria/internal/metrics"
 	"steria/internal/storage"
@@ -54,6 +55,19 @@ func runStatus() error {
 	fmt.Printf("%s Repository: %s\n", cyan("📁"), repo.Config.Name)
 	fmt.Printf("%s Branch: %s\n", cyan("🌿"), green(repo.Branch))
 
+	// Ahead/behind is as of the last fetch or pull
+	tracking, err := repo.TrackingStatus(strings.TrimSpace(repo.Branch))
+	if err != nil {
+		return fmt.Errorf("failed to compare with upstream: %w", err)
+	}
+	if tracking != nil {
+		summary := tracking.Summary()
+		if tracking.Behind > 0 || tracking.Gone {
+			summary = yellow(summary)
+		}
+		fmt.Printf("%s Your branch is %s\n", cyan("🔗"), summary)
+	}
+
 	if repo.Head != "" {
 		fmt.Printf("%s HEAD: %s\n", cyan("📍"), yellow(repo.Head[:8]))
 	} else {
@@ -103,6 +103,8 @@ func createTag(name, commit, message string) error {
 	// Use HEAD if no commit specified
 	if commit == "" {
 		commit = repo.Head
+	} else if commit, err = repo.ResolveRevision(commit); err != nil {
+		return err
 	}
 
 	// Verify commit exists
@@ -171,9 +173,13 @@ func checkoutTag(name string) error {
 		return fmt.Errorf("failed to load tag '%s': %w", name, err)
 	}
 
+	repo, err := storage.LoadOrInitRepo(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
 	// Update HEAD to point to tagged commit
-	headPath := filepath.Join(repoPath, ".steria", "HEAD")
-	if err := os.WriteFile(headPath, []byte(tag.Commit), 0644); err != nil {
+	if err := repo.NewRefTransaction().UpdateFrom("HEAD", tag.Commit, repo.Head, "checkout: tag "+name).Commit(); err != nil {
 		return fmt.Errorf("failed to update HEAD: %w", err)
 	}
 
@@ -0,0 +1,105 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: verify.go
+// Description: Implements the 'steria verify' CLI command for recomputing commit hashes from their stored canonical encoding.
+
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// NewVerifyCmd returns the Cobra command for 'steria verify'
+func NewVerifyCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "verify [revision...]",
+		Short: "Recompute commit hashes from the stored commits",
+		Long: `Walk the history of the given revisions (HEAD, branches, tags or commit hashes),
+or of every ref when none are given, and recompute each commit's hash from its
+stored object. A commit passes when the sha256 of the stored bytes is its hash
+and the bytes are in the canonical commit encoding.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runVerify(args, asJSON)
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the result as JSON")
+	return cmd
+}
+
+func runVerify(revisions []string, asJSON bool) error {
+	if !asJSON {
+		profiler := metrics.StartProfiling()
+		defer func() {
+			fmt.Println(profiler.EndProfiling())
+		}()
+	}
+
+	green := color.New(color.FgGreen).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	repoRoot := findRepoRoot(cwd)
+	if repoRoot == "" {
+		return fmt.Errorf("not inside a Steria repository")
+	}
+	repo, err := storage.LoadOrInitRepo(repoRoot)
+	if err != nil {
+		return fmt.Errorf("failed to load repository: %w", err)
+	}
+
+	var tips []string
+	for _, rev := range revisions {
+		hash, err := repo.ResolveRevision(rev)
+		if err != nil {
+			return err
+		}
+		tips = append(tips, hash)
+	}
+	checks, err := repo.VerifyCommits(tips...)
+	if err != nil {
+		return fmt.Errorf("verify failed: %w", err)
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.Err != "" {
+			failed++
+		}
+	}
+	if asJSON {
+		if checks == nil {
+			checks = []storage.CommitCheck{}
+		}
+		data, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, c := range checks {
+			if c.Err != "" {
+				fmt.Printf("%s %s: %s\n", red("❌"), c.Hash, c.Err)
+			}
+		}
+		if failed == 0 {
+			fmt.Printf("%s Verified %d commits\n", green("✅"), len(checks))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commits failed verification", failed, len(checks))
+	}
+	return nil
+}
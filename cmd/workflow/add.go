@@ -0,0 +1,142 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: add.go
+// Description: Implements the 'steria add' and 'steria unstage' commands for managing the staging index used by 'steria commit'.
+
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"steria/internal/metrics"
+	"steria/internal/storage"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func NewAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <path>...",
+		Short: "Stage files for the next commit",
+		Long: `Record the current contents of files or directories in the staging index.
+'steria commit' commits exactly what is staged; deleted files are staged as removals.
+
+Example: steria add src/main.go docs`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAdd(cmd.Context(), args)
+		},
+	}
+
+	return cmd
+}
+
+func NewUnstageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "unstage <path>...",
+		Aliases: []string{"reset"},
+		Short:   "Remove files from the staging index",
+		Long:    "Reset the staged version of files back to HEAD. The working directory is left untouched.",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUnstage(cmd.Context(), args)
+		},
+	}
+
+	return cmd
+}
+
+func runAdd(ctx context.Context, paths []string) error {
+	profiler := metrics.StartProfiling()
+	defer func() {
+		fmt.Println(profiler.EndProfiling())
+	}()
+
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	repo, rels, err := loadRepoPaths(ctx, paths)
+	if err != nil {
+		return err
+	}
+
+	changes, err := repo.Stage(rels...)
+	if err != nil {
+		return fmt.Errorf("failed to stage files: %w", err)
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s Nothing new to stage\n", yellow("💡"))
+		return nil
+	}
+	for _, change := range changes {
+		switch change.Type {
+		case storage.ChangeTypeAdded:
+			fmt.Printf("  %s %s\n", green("+"), change.Path)
+		case storage.ChangeTypeDeleted:
+			fmt.Printf("  %s %s\n", red("-"), change.Path)
+		default:
+			fmt.Printf("  %s %s\n", yellow("~"), change.Path)
+		}
+	}
+	fmt.Printf("%s Staged %d changes\n", green("✅"), len(changes))
+	return nil
+}
+
+func runUnstage(ctx context.Context, paths []string) error {
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	repo, rels, err := loadRepoPaths(ctx, paths)
+	if err != nil {
+		return err
+	}
+
+	reset, err := repo.Unstage(rels...)
+	if err != nil {
+		return fmt.Errorf("failed to unstage files: %w", err)
+	}
+	if len(reset) == 0 {
+		fmt.Printf("%s Nothing staged for those paths\n", yellow("💡"))
+		return nil
+	}
+	for _, file := range reset {
+		fmt.Printf("  %s\n", file)
+	}
+	fmt.Printf("%s Unstaged %d files\n", green("✅"), len(reset))
+	return nil
+}
+
+// loadRepoPaths loads the repository in the current directory and converts
+// command line paths to repository-relative paths
+func loadRepoPaths(ctx context.Context, paths []string) (*storage.Repo, []string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+
+	repo, err := storage.LoadOrInitRepo(cwd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load repository: %w", err)
+	}
+	repo = repo.WithContext(ctx)
+
+	rels := make([]string, 0, len(paths))
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid path '%s': %w", p, err)
+		}
+		rel, err := filepath.Rel(repo.Path, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, nil, fmt.Errorf("path '%s' is outside the repository", p)
+		}
+		rels = append(rels, rel)
+	}
+	return repo, rels, nil
+}
@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -16,20 +17,20 @@ import (
 func NewCommitCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "commit \"message\" - signer",
-		Short: "Create a manual commit",
-		Long:  "Create a commit with a specific message and signer",
+		Short: "Commit staged changes",
+		Long:  "Create a commit from exactly the files staged with 'steria add', with a specific message and signer",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			message := args[0]
 			signer := strings.Join(args[1:], " ")
-			return runCommit(signer, message)
+			return runCommit(cmd.Context(), signer, message)
 		},
 	}
 
 	return cmd
 }
 
-func runCommit(signer, message string) error {
+func runCommit(ctx context.Context, signer, message string) error {
 	// Start performance profiling
 	profiler := metrics.StartProfiling()
 	defer func() {
@@ -54,25 +55,23 @@ func runCommit(signer, message string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
-	// Create optimized repository
-	optRepo := storage.NewOptimizedRepo(repo)
-
-	// Check for changes with optimized method
+	// Only what has been staged with 'steria add' is committed
 	endOp := metrics.GlobalMetrics.StartOperation("get_changes")
-	changes, err := optRepo.GetChangesOptimized()
+	changes, err := repo.StagedChanges()
 	endOp()
 
 	if err != nil {
-		return fmt.Errorf("failed to get changes: %w", err)
+		return fmt.Errorf("failed to get staged changes: %w", err)
 	}
 
-	if len(changes) == 0 {
-		fmt.Printf("%s No changes detected. Nothing to commit!\n", yellow("⚠️"))
+	if len(changes) == 0 && repo.MergeHead() == "" {
+		fmt.Printf("%s Nothing staged. Use 'steria add <path>' to stage changes, or 'steria done' to commit everything.\n", yellow("⚠️"))
 		return nil
 	}
 
-	fmt.Printf("%s Found %d changed files\n", yellow("📝"), len(changes))
+	fmt.Printf("%s Found %d staged files\n", yellow("📝"), len(changes))
 
 	// Create cryptographic signature
 	keyPair, err := security.GenerateKeyPair()
@@ -97,9 +96,9 @@ func runCommit(signer, message string) error {
 
 	fmt.Printf("%s Message cryptographically signed by: %s\n", green("🔐"), red(signer))
 
-	// Create commit with optimized method
+	// Commit the staged snapshot
 	endOp = metrics.GlobalMetrics.StartOperation("create_commit")
-	commit, err := optRepo.CreateCommitOptimized(message, signer)
+	commit, err := repo.CommitIndex(message, signer)
 	endOp()
 
 	if err != nil {
@@ -108,7 +107,6 @@ func runCommit(signer, message string) error {
 
 	metrics.GlobalMetrics.IncrementCommitsCreated()
 	fmt.Printf("%s Created commit: %s\n", green("✅"), commit.Hash[:8])
-	fmt.Printf("%s Performance optimized with concurrent processing!\n", cyan("⚡"))
 
 	return nil
 }
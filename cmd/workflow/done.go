@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -31,14 +32,14 @@ Example: steria done "feat - added new feature" - KleaSCM`,
 			message := args[0]
 			// Join all remaining arguments as the signer (in case it contains spaces)
 			signer := strings.Join(args[1:], " ")
-			return runDone(signer, message)
+			return runDone(cmd.Context(), signer, message)
 		},
 	}
 
 	return cmd
 }
 
-func runDone(signer, message string) error {
+func runDone(ctx context.Context, signer, message string) error {
 	// Start performance profiling
 	profiler := metrics.StartProfiling()
 	defer func() {
@@ -63,6 +64,7 @@ func runDone(signer, message string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	// Create optimized repository
 	optRepo := storage.NewOptimizedRepo(repo)
@@ -122,6 +124,7 @@ func runDone(signer, message string) error {
 
 	metrics.GlobalMetrics.IncrementCommitsCreated()
 	fmt.Printf("%s Created commit: %s\n", green("✅"), commit.Hash[:8])
+	fmt.Printf("%s Stored %d new objects (%d as deltas), reused %d existing\n", cyan("📦"), commit.Stats.NewBlobs, commit.Stats.DeltaBlobs, commit.Stats.ReusedBlobs)
 
 	// Sync with remote if available
 	if optRepo.HasRemote() {
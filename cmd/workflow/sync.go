@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -17,14 +18,14 @@ func NewSyncCmd() *cobra.Command {
 		Short: "Sync with remote repository",
 		Long:  "Sync with remote repository using optimized processing",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runSync()
+			return runSync(cmd.Context())
 		},
 	}
 
 	return cmd
 }
 
-func runSync() error {
+func runSync(ctx context.Context) error {
 	// Start performance profiling
 	profiler := metrics.StartProfiling()
 	defer func() {
@@ -47,6 +48,7 @@ func runSync() error {
 	if err != nil {
 		return fmt.Errorf("failed to load repository: %w", err)
 	}
+	repo = repo.WithContext(ctx)
 
 	// Create optimized repository
 	optRepo := storage.NewOptimizedRepo(repo)
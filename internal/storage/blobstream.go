@@ -0,0 +1,523 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: blobstream.go
+// Description: Streaming blob access for Steria. Every BlobStore can open a stored blob as an io.ReadCloser and create one through a hashing io.WriteCloser, so multi-GB files are committed, restored, pushed and pulled without holding them in memory.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// BlobWriter streams a blob's stored bytes into a store. The blob only
+// becomes visible once Close succeeds; Abort discards everything written.
+type BlobWriter interface {
+	io.WriteCloser
+	Abort() error
+	Sum() string // sha256 of the bytes written so far
+	Size() int64 // Number of bytes written so far
+}
+
+// hashingWriter is the BlobWriter shared by all stores: it hashes what passes
+// through and hands the commit/discard decision to the store. Once ctx is
+// cancelled writes fail and Close discards the blob instead of committing it.
+type hashingWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	sum    hash.Hash
+	size   int64
+	commit func() error
+	abort  func() error
+	done   bool
+}
+
+func newHashingWriter(ctx context.Context, w io.Writer, commit, abort func() error) *hashingWriter {
+	return &hashingWriter{ctx: ctx, w: w, sum: sha256.New(), commit: commit, abort: abort}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	if h.done {
+		return 0, os.ErrClosed
+	}
+	if err := h.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := h.w.Write(p)
+	h.sum.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+func (h *hashingWriter) Close() error {
+	if h.done {
+		return nil
+	}
+	h.done = true
+	if err := h.ctx.Err(); err != nil {
+		h.abort()
+		return err
+	}
+	return h.commit()
+}
+
+func (h *hashingWriter) Abort() error {
+	if h.done {
+		return nil
+	}
+	h.done = true
+	return h.abort()
+}
+
+func (h *hashingWriter) Sum() string { return hex.EncodeToString(h.sum.Sum(nil)) }
+func (h *hashingWriter) Size() int64 { return h.size }
+
+// spooledWriter buffers a blob in a temporary file so stores that need a
+// seekable or repeatable body (S3, several peers) still stream in bounded memory
+func spooledWriter(ctx context.Context, upload func(f *os.File) error) (BlobWriter, error) {
+	tmp, err := os.CreateTemp("", "steria-blob-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}
+	return newHashingWriter(ctx, tmp, func() error {
+		defer cleanup()
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return upload(tmp)
+	}, cleanup), nil
+}
+
+// sectionCloser reads one packed object straight from its pack file
+type sectionCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s *sectionCloser) Close() error { return s.f.Close() }
+
+// openPacked opens a packed object for streaming
+func openPacked(dir, hash string, kind PackObjectKind) (io.ReadCloser, error) {
+	key, ok := decodeHash(hash)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	for _, pf := range loadPacks(dir) {
+		if e, ok := pf.find(key, kind); ok {
+			f, err := os.Open(pf.packPath)
+			if err != nil {
+				return nil, err
+			}
+			return &sectionCloser{io.NewSectionReader(f, int64(e.offset), int64(e.length)), f}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// OpenBlob streams a stored blob from disk or from a pack
+func (l *LocalBlobStore) OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hash = strings.TrimSuffix(hash, ".gz")
+	if f, err := os.Open(filepath.Join(l.Dir, hash+".gz")); err == nil {
+		return f, nil
+	}
+	if f, err := os.Open(filepath.Join(l.Dir, hash)); err == nil {
+		return f, nil // Legacy uncompressed blob
+	}
+	return openPacked(packDirFor(l.Dir), hash, PackBlob)
+}
+
+// CreateBlob writes a blob to a temporary file that is renamed into place on Close
+func (l *LocalBlobStore) CreateBlob(ctx context.Context, hash string) (BlobWriter, error) {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(l.Dir, hash+".gz.tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return newHashingWriter(ctx, tmp, func() error {
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return os.Rename(tmp.Name(), filepath.Join(l.Dir, hash+".gz"))
+	}, func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}), nil
+}
+
+// OpenBlob streams a blob from the remote. The request is abandoned if the
+// remote sends nothing for the store's timeout.
+func (h *HTTPBlobStore) OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error) {
+	ctx, touch, cancel := withStallTimeout(ctx, h.Timeout)
+	body, err := openURL(ctx, h.BaseURL+"/blobs/"+strings.TrimSuffix(hash, ".gz")+".gz")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &touchReader{ReadCloser: body, touch: touch, cancel: cancel}, nil
+}
+
+// openURL issues a GET and returns the body of a 200 response
+func openURL(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, &HTTPStatusError{Method: "GET", Status: resp.Status, Code: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+// CreateBlob streams a blob to the remote as the body of a single PUT
+func (h *HTTPBlobStore) CreateBlob(ctx context.Context, hash string) (BlobWriter, error) {
+	reqCtx, touch, cancel := withStallTimeout(ctx, h.Timeout)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(reqCtx, "PUT", h.BaseURL+"/blobs/"+hash+".gz", pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	result := make(chan error, 1)
+	go func() {
+		defer cancel()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			result <- err
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 && resp.StatusCode != 201 {
+			result <- &HTTPStatusError{Method: "PUT", Status: resp.Status, Code: resp.StatusCode}
+			return
+		}
+		result <- nil
+	}()
+	return newHashingWriter(ctx, &touchWriter{w: pw, touch: touch}, func() error {
+		pw.Close()
+		return <-result
+	}, func() error {
+		pw.CloseWithError(fmt.Errorf("upload of blob %s aborted", hash))
+		<-result
+		return nil
+	}), nil
+}
+
+// OpenBlob streams a blob from the bucket
+func (s *S3BlobStore) OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error) {
+	ctx, touch, cancel := withStallTimeout(ctx, s.Timeout)
+	key := s.Prefix + strings.TrimSuffix(hash, ".gz") + ".gz"
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &touchReader{ReadCloser: resp.Body, touch: touch, cancel: cancel}, nil
+}
+
+// CreateBlob spools the blob to a temporary file and uploads it on Close,
+// since S3 needs a seekable body to sign the request
+func (s *S3BlobStore) CreateBlob(ctx context.Context, hash string) (BlobWriter, error) {
+	key := s.Prefix + hash + ".gz"
+	return spooledWriter(ctx, func(f *os.File) error {
+		ctx, touch, cancel := withStallTimeout(ctx, s.Timeout)
+		defer cancel()
+		_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &s.Bucket,
+			Key:    &key,
+			Body:   &touchFile{File: f, touch: touch},
+		})
+		return err
+	})
+}
+
+// OpenBlob streams a blob from the first peer that has it
+func (p *PeerToPeerBlobStore) OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error) {
+	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reqCtx, touch, cancel := withStallTimeout(ctx, p.Timeout)
+		body, err := openURL(reqCtx, peer+"/blobs/"+strings.TrimSuffix(hash, ".gz")+".gz")
+		if err != nil {
+			cancel()
+			continue
+		}
+		return &touchReader{ReadCloser: body, touch: touch, cancel: cancel}, nil
+	}
+	return nil, fmt.Errorf("blob %s not found on any peer", hash)
+}
+
+// CreateBlob spools the blob to a temporary file and uploads it to every peer on Close
+func (p *PeerToPeerBlobStore) CreateBlob(ctx context.Context, hash string) (BlobWriter, error) {
+	return spooledWriter(ctx, func(f *os.File) error {
+		var lastErr error
+		for _, peer := range p.Peers {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			lastErr = p.putFile(ctx, peer, hash, f)
+		}
+		return lastErr
+	})
+}
+
+// putFile uploads a spooled blob to one peer
+func (p *PeerToPeerBlobStore) putFile(ctx context.Context, peer, hash string, f *os.File) error {
+	ctx, touch, cancel := withStallTimeout(ctx, p.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", peer+"/blobs/"+hash+".gz", io.NopCloser(&touchFile{File: f, touch: touch}))
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		req.ContentLength = info.Size()
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return &HTTPStatusError{Method: "PUT", Status: resp.Status, Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// CopyBlob streams a blob's stored bytes from one store to another
+func CopyBlob(ctx context.Context, dst, src BlobStore, hash string) error {
+	in, err := src.OpenBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.CreateBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Close()
+}
+
+// verifyingReader checks the content hash once the whole blob has been read
+type verifyingReader struct {
+	r    io.Reader
+	sum  hash.Hash
+	want string
+	c    io.Closer
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.sum.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.sum.Sum(nil)) != v.want {
+		return n, fmt.Errorf("blob %s is corrupt: content hash mismatch", v.want)
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error { return v.c.Close() }
+
+// multiCloser closes several readers that back one stream
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// readCloser joins a reader with the closer of its underlying stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// openStoredBlob streams the content of a blob stored under hash, whichever
+// form it is stored in: gzip, delta object or a legacy uncompressed file.
+// Content is checked against hash when the hash is a real content hash.
+func openStoredBlob(ctx context.Context, blobStore BlobStore, hash string) (io.ReadCloser, error) {
+	raw, err := blobStore.OpenBlob(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(raw)
+	magic, _ := br.Peek(len(deltaObjectMagic))
+
+	var content io.ReadCloser
+	switch {
+	case bytes.Equal(magic, deltaObjectMagic):
+		// Deltas are only used below the chunk threshold, so resolving in memory is bounded
+		stored, err := io.ReadAll(br)
+		raw.Close()
+		if err != nil {
+			return nil, err
+		}
+		data, err := readDeltaObject(ctx, blobStore, hash, stored)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		content = readCloser{gr, multiCloser{gr, raw}}
+	default:
+		content = readCloser{br, raw}
+	}
+	if _, ok := decodeHash(hash); ok {
+		return &verifyingReader{r: content, sum: sha256.New(), want: hash, c: content}, nil
+	}
+	return content, nil
+}
+
+// chunkReader streams a chunked file one chunk at a time
+type chunkReader struct {
+	ctx     context.Context
+	store   BlobStore
+	chunks  []ChunkRef
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := openStoredBlob(c.ctx, c.store, c.chunks[0].Hash)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read chunk %s: %w", c.chunks[0].Hash, err)
+			}
+			c.current, c.chunks = rc, c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
+
+// OpenBlobDecompressed streams the content behind a snapshot blob ref: a
+// plain blob, a chunked file or a legacy delta ref
+func OpenBlobDecompressed(ctx context.Context, blobStore BlobStore, blobRef string) (io.ReadCloser, error) {
+	switch {
+	case IsChunkRef(blobRef):
+		list, err := LoadChunkList(ctx, blobStore, blobRef)
+		if err != nil {
+			return nil, err
+		}
+		cr := &chunkReader{ctx: ctx, store: blobStore, chunks: list.Chunks}
+		return &verifyingReader{r: cr, sum: sha256.New(), want: list.Hash, c: cr}, nil
+	case strings.HasPrefix(blobRef, "delta:"):
+		data, err := ReadFileBlobDecompressed(ctx, blobStore, blobRef)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	default:
+		return openStoredBlob(ctx, blobStore, blobRef)
+	}
+}
+
+// WriteBlobToFile streams a blob into a file, replacing it atomically so an
+// interrupted restore never leaves a half-written file behind
+func WriteBlobToFile(ctx context.Context, blobStore BlobStore, blobRef, path string) error {
+	in, err := OpenBlobDecompressed(ctx, blobStore, blobRef)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".steria-tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, &contextReader{ctx, in}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// contextReader stops a copy once ctx is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamingBlobRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local := &LocalBlobStore{Dir: filepath.Join(dir, "blobs")}
+
+	content := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(11)).Read(content)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	src := filepath.Join(dir, "big.bin")
+	os.WriteFile(src, content, 0644)
+	if err := writeBlobCompressed(ctx, local, hash, src); err != nil {
+		t.Fatalf("writeBlobCompressed failed: %v", err)
+	}
+	if err := writeBlobCompressed(ctx, local, strings.Repeat("0", 64), src); err == nil {
+		t.Error("Expected a content hash mismatch to be rejected")
+	}
+	if entries, _ := os.ReadDir(local.Dir); len(entries) != 1 {
+		t.Errorf("Expected only the stored blob in %s, got %d entries", local.Dir, len(entries))
+	}
+
+	// A remote that serves PUT/GET /blobs/{hash}.gz from a second local store
+	remoteStore := &LocalBlobStore{Dir: filepath.Join(dir, "remote")}
+	os.MkdirAll(remoteStore.Dir, 0755)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/blobs/"), ".gz")
+		switch r.Method {
+		case "PUT":
+			out, _ := remoteStore.CreateBlob(r.Context(), name)
+			io.Copy(out, r.Body)
+			out.Close()
+			w.WriteHeader(201)
+		case "GET":
+			in, err := remoteStore.OpenBlob(r.Context(), name)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer in.Close()
+			io.Copy(w, in)
+		}
+	}))
+	defer server.Close()
+	remote := &HTTPBlobStore{BaseURL: server.URL}
+
+	if err := CopyBlob(ctx, remote, local, hash); err != nil {
+		t.Fatalf("CopyBlob to remote failed: %v", err)
+	}
+	pulled := &LocalBlobStore{Dir: filepath.Join(dir, "pulled")}
+	if err := CopyBlob(ctx, pulled, remote, hash); err != nil {
+		t.Fatalf("CopyBlob from remote failed: %v", err)
+	}
+	dst := filepath.Join(dir, "out", "big.bin")
+	if err := WriteBlobToFile(ctx, pulled, hash, dst); err != nil {
+		t.Fatalf("WriteBlobToFile failed: %v", err)
+	}
+	if restored, _ := os.ReadFile(dst); !bytes.Equal(restored, content) {
+		t.Error("Streamed blob does not match the original file")
+	}
+
+	// Corruption is caught when the stream reaches EOF
+	corrupt, _ := compressBytes([]byte("not the right content"))
+	pulled.PutBlob(ctx, hash, corrupt)
+	if err := WriteBlobToFile(ctx, pulled, hash, dst); err == nil {
+		t.Error("Expected a corrupt blob to fail verification")
+	}
+	if restored, _ := os.ReadFile(dst); !bytes.Equal(restored, content) {
+		t.Error("A failed restore must leave the existing file untouched")
+	}
+}
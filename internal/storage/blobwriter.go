@@ -0,0 +1,148 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: blobwriter.go
+// Description: Incremental blob writing for Steria commits. Only content the blob store does not already hold is compressed and written, in parallel, as a delta against the file's previous version when that is smaller.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// CommitStats counts the blob objects a commit had to write versus objects it
+// found already stored
+type CommitStats struct {
+	NewBlobs     int
+	ReusedBlobs  int
+	DeltaBlobs   int // New blobs stored as a delta against the file's previous version
+	ChunkedFiles int // Files stored as content-defined chunks; their chunks count as new or reused blobs
+}
+
+// writeBlob stores one file's content under hash. Large files are stored as a
+// binary delta against base (the file's previous blob) when that is clearly
+// smaller. Deltas are only written to local stores, where the base is
+// guaranteed to be present. Reports whether a delta was written.
+func writeBlob(ctx context.Context, store BlobStore, hash, fullPath, base string) (bool, error) {
+	if _, local := store.(*LocalBlobStore); local && base != "" && base != hash {
+		if info, err := os.Stat(fullPath); err == nil && info.Size() >= deltaMinSize {
+			content, err := os.ReadFile(fullPath)
+			if err != nil {
+				return false, err
+			}
+			// Skip the delta if the file changed since it was hashed
+			if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) == hash {
+				if ok, err := writeBlobDelta(ctx, store, hash, base, content); ok || err != nil {
+					return ok, err
+				}
+			}
+		}
+	}
+	return false, writeBlobCompressed(ctx, store, hash, fullPath)
+}
+
+// storeBlobs makes sure every file in the path -> content hash snapshot is in
+// the store and returns the path -> blob ref snapshot to commit. Identical
+// content is written once, blobs the store already has are skipped, files
+// above the chunk threshold are chunked, and the rest are written by a pool
+// of workers. previous is the parent snapshot: it provides delta bases for
+// modified files and lets unchanged chunked files keep their chunk ref.
+func (r *Repo) storeBlobs(ctx context.Context, store BlobStore, files, previous map[string]string) (map[string]string, CommitStats, error) {
+	pending := make(map[string]string) // hash -> one file with that content
+	for file, hash := range files {
+		pending[hash] = file
+	}
+	chunked := make(map[string]string) // content hash -> chunk ref already committed
+	for _, ref := range previous {
+		if IsChunkRef(ref) {
+			chunked[BlobContentHash(ref)] = ref
+		}
+	}
+
+	workers := runtime.NumCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	jobs := make(chan [2]string)
+	refs := make(map[string]string, len(pending)) // content hash -> blob ref
+	var (
+		stats    CommitStats
+		firstErr error
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hash, file := job[0], job[1]
+				ref, fileStats, err := r.storeContent(ctx, store, hash, file, previous[file], chunked)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to write compressed blob for %s: %w", file, err)
+				} else if err == nil {
+					refs[hash] = ref
+					stats.NewBlobs += fileStats.NewBlobs
+					stats.ReusedBlobs += fileStats.ReusedBlobs
+					stats.DeltaBlobs += fileStats.DeltaBlobs
+					stats.ChunkedFiles += fileStats.ChunkedFiles
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for hash, file := range pending {
+		jobs <- [2]string{hash, file}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, stats, firstErr
+	}
+
+	snapshot := make(map[string]string, len(files))
+	for file, hash := range files {
+		snapshot[file] = refs[hash]
+	}
+	return snapshot, stats, nil
+}
+
+// storeContent stores one file's content and returns its blob ref: the content
+// hash for whole and delta blobs, or a chunk ref for files at or above the
+// chunk threshold
+func (r *Repo) storeContent(ctx context.Context, store BlobStore, hash, file, base string, chunked map[string]string) (string, CommitStats, error) {
+	var stats CommitStats
+	if err := ctx.Err(); err != nil {
+		return "", stats, err
+	}
+	if ref, ok := chunked[hash]; ok {
+		_, listHash, _ := parseChunkRef(ref)
+		freshenBlob(store, listHash)
+		stats.ReusedBlobs++
+		return ref, stats, nil
+	}
+	full := filepath.Join(r.Path, file)
+	if info, err := os.Stat(full); err == nil && info.Size() >= r.chunkThreshold() {
+		ref, newChunks, reused, err := writeChunked(ctx, store, hash, full)
+		stats.NewBlobs, stats.ReusedBlobs, stats.ChunkedFiles = newChunks, reused, 1
+		return ref, stats, err
+	}
+	if store.HasBlob(ctx, hash) {
+		freshenBlob(store, hash)
+		stats.ReusedBlobs++
+		return hash, stats, nil
+	}
+	delta, err := writeBlob(ctx, store, hash, full, base)
+	stats.NewBlobs++
+	if delta {
+		stats.DeltaBlobs++
+	}
+	return hash, stats, err
+}
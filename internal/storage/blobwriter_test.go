@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestCreateCommitReusesStoredBlobs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.txt", []byte("alpha"), 0644)
+	os.WriteFile(dir+"/b.txt", []byte("beta"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+
+	os.WriteFile(dir+"/a.txt", []byte("alpha v2"), 0644)
+	os.WriteFile(dir+"/copy.txt", []byte("beta"), 0644)
+	commit, err := repo.CreateCommit("Edit a", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	if commit.Stats.NewBlobs != 1 {
+		t.Errorf("Expected only the edited file to be written, got %+v", commit.Stats)
+	}
+	if commit.Stats.ReusedBlobs != 1 {
+		t.Errorf("Expected b.txt and its copy to share one reused blob, got %+v", commit.Stats)
+	}
+	for file, blob := range commit.FileBlobs {
+		if !repo.BlobStore.HasBlob(ctx, blob) {
+			t.Errorf("Blob for %s missing from store", file)
+		}
+	}
+
+	again, err := repo.CreateCommit("No changes", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	if again.Stats.NewBlobs != 0 {
+		t.Errorf("Expected no new blobs for an unchanged tree, got %+v", again.Stats)
+	}
+}
@@ -0,0 +1,233 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: chunk.go
+// Description: Content-defined chunking for large files in Steria. Files above a threshold are split at rolling-hash boundaries so an edit only stores the chunks around it, and identical chunks are shared across files and versions.
+
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// DefaultChunkThreshold is the file size from which files are chunked,
+	// unless config.json sets chunk_threshold
+	DefaultChunkThreshold = 4 * 1024 * 1024
+
+	chunkMinSize = 64 * 1024
+	chunkMaxSize = 1024 * 1024
+	chunkMask    = 1<<18 - 1 // Average chunk of about 256 KiB past the minimum
+
+	chunkRefPrefix = "chunks:"
+
+	// chunkPreallocLimit caps how much of a chunk list's declared size is
+	// allocated up front when a chunked file is read into memory
+	chunkPreallocLimit = 64 * chunkMaxSize
+)
+
+// gearTable maps each byte to a pseudo-random value for the gear rolling hash.
+// It is generated from a fixed seed: changing it would change every chunk boundary.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x5374657269614344) // "SteriaCD"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ChunkRef is one chunk of a chunked file
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ChunkList is the object that replaces a single blob for a chunked file
+type ChunkList struct {
+	Hash   string     `json:"hash"` // Content hash of the whole file
+	Size   int64      `json:"size"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// chunkRef builds the snapshot ref for a chunked file
+func chunkRef(contentHash, listHash string) string {
+	return chunkRefPrefix + contentHash + ":" + listHash
+}
+
+// parseChunkRef splits a chunk ref into the file's content hash and the chunk list hash
+func parseChunkRef(ref string) (string, string, bool) {
+	if !strings.HasPrefix(ref, chunkRefPrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(ref, chunkRefPrefix), ":")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// IsChunkRef reports whether a snapshot ref points at a chunk list
+func IsChunkRef(ref string) bool {
+	_, _, ok := parseChunkRef(ref)
+	return ok
+}
+
+// BlobContentHash returns the content hash behind a snapshot ref, so a chunked
+// file compares equal to the working file it was made from
+func BlobContentHash(ref string) string {
+	if content, _, ok := parseChunkRef(ref); ok {
+		return content
+	}
+	return ref
+}
+
+// chunkThreshold returns the file size from which this repository chunks files
+func (r *Repo) chunkThreshold() int64 {
+	if r.Config != nil && r.Config.ChunkThreshold > 0 {
+		return r.Config.ChunkThreshold
+	}
+	return DefaultChunkThreshold
+}
+
+// nextChunk reads the next content-defined chunk. A boundary falls where the
+// gear hash matches chunkMask, but never before chunkMinSize or after chunkMaxSize.
+func nextChunk(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var h uint64
+	for len(buf) < chunkMaxSize {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				return buf, nil
+			}
+			return buf, err
+		}
+		buf = append(buf, b)
+		h = (h << 1) + gearTable[b]
+		if len(buf) >= chunkMinSize && h&chunkMask == 0 {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// writeChunked splits a file into chunks, stores the chunks the store does not
+// already have and then the chunk list. Returns the snapshot ref and how many
+// chunks were new versus already stored.
+func writeChunked(ctx context.Context, store BlobStore, contentHash, fullPath string) (ref string, newChunks, reused int, err error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer f.Close()
+
+	list := ChunkList{}
+	whole := sha256.New()
+	reader := bufio.NewReaderSize(f, 256*1024)
+	buf := make([]byte, 0, chunkMaxSize)
+	for {
+		chunk, err := nextChunk(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("failed to read %s: %w", fullPath, err)
+		}
+		whole.Write(chunk)
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		if store.HasBlob(ctx, hash) {
+			freshenBlob(store, hash)
+			reused++
+		} else {
+			compressed, err := compressBytes(chunk)
+			if err != nil {
+				return "", 0, 0, err
+			}
+			if err := store.PutBlob(ctx, hash, compressed); err != nil {
+				return "", 0, 0, fmt.Errorf("failed to write chunk: %w", err)
+			}
+			newChunks++
+		}
+		list.Chunks = append(list.Chunks, ChunkRef{Hash: hash, Size: int64(len(chunk))})
+		list.Size += int64(len(chunk))
+	}
+	list.Hash = hex.EncodeToString(whole.Sum(nil))
+	if list.Hash != contentHash {
+		return "", 0, 0, fmt.Errorf("file %s changed while it was being chunked", fullPath)
+	}
+
+	data, err := json.Marshal(&list)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	sum := sha256.Sum256(data)
+	listHash := hex.EncodeToString(sum[:])
+	if store.HasBlob(ctx, listHash) {
+		freshenBlob(store, listHash)
+	} else {
+		compressed, err := compressBytes(data)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if err := store.PutBlob(ctx, listHash, compressed); err != nil {
+			return "", 0, 0, fmt.Errorf("failed to write chunk list: %w", err)
+		}
+	}
+	return chunkRef(contentHash, listHash), newChunks, reused, nil
+}
+
+// LoadChunkList reads the chunk list behind a chunk ref
+func LoadChunkList(ctx context.Context, store BlobStore, ref string) (*ChunkList, error) {
+	_, listHash, ok := parseChunkRef(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid chunk ref: %s", ref)
+	}
+	data, err := ReadBlobDecompressed(ctx, store, listHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk list %s: %w", listHash, err)
+	}
+	var list ChunkList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse chunk list %s: %w", listHash, err)
+	}
+	return &list, nil
+}
+
+// readChunked reassembles a chunked file and checks it against its content hash
+func readChunked(ctx context.Context, store BlobStore, ref string) ([]byte, error) {
+	list, err := LoadChunkList(ctx, store, ref)
+	if err != nil {
+		return nil, err
+	}
+	// Size comes from the store and may be forged, so it only sizes the
+	// buffer up to a bound; past that the buffer grows as chunks arrive
+	out := make([]byte, 0, max(0, min(list.Size, chunkPreallocLimit)))
+	whole := sha256.New()
+	for _, c := range list.Chunks {
+		chunk, err := ReadBlobDecompressed(ctx, store, c.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %s: %w", c.Hash, err)
+		}
+		whole.Write(chunk)
+		out = append(out, chunk...)
+	}
+	if hex.EncodeToString(whole.Sum(nil)) != list.Hash || list.Hash != BlobContentHash(ref) {
+		return nil, errors.New("reassembled chunks do not match the file's content hash")
+	}
+	return out, nil
+}
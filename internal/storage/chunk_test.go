@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestLargeFilesAreChunkedAndDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(dir+"/small.txt", []byte("small"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	repo.Config.ChunkThreshold = 256 * 1024
+
+	rng := rand.New(rand.NewSource(3))
+	content := make([]byte, 2*1024*1024)
+	rng.Read(content)
+	os.WriteFile(dir+"/asset.bin", content, 0644)
+	first, err := repo.CreateCommit("Add asset", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	ref := first.FileBlobs["asset.bin"]
+	if !IsChunkRef(ref) || first.Stats.ChunkedFiles != 1 {
+		t.Fatalf("Expected asset.bin to be chunked, got %q %+v", ref, first.Stats)
+	}
+	list, err := LoadChunkList(ctx, repo.BlobStore, ref)
+	if err != nil || len(list.Chunks) < 3 {
+		t.Fatalf("Expected several chunks, got %+v, %v", list, err)
+	}
+	data, err := ReadFileBlobDecompressed(ctx, repo.BlobStore, ref)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Reassembling chunks failed: %v", err)
+	}
+	if changes, _ := repo.GetChanges(); len(changes) != 0 {
+		t.Fatalf("Expected a chunked file to match its working copy, got %+v", changes)
+	}
+
+	// A one-byte edit and a copy only store the chunks around the edit
+	edited := append([]byte{}, content...)
+	edited[1024*1024] ^= 0xff
+	os.WriteFile(dir+"/asset.bin", edited, 0644)
+	os.WriteFile(dir+"/copy.bin", content, 0644)
+	second, err := repo.CreateCommit("Edit asset", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	if second.Stats.NewBlobs > 2 || second.Stats.NewBlobs == 0 {
+		t.Errorf("Expected only the edited chunk to be new, got %+v", second.Stats)
+	}
+	if second.FileBlobs["copy.bin"] != ref {
+		t.Errorf("Expected the copy to reuse the original chunk list")
+	}
+
+	os.Remove(dir + "/asset.bin")
+	if err := repo.restoreFile("asset.bin", second.FileBlobs["asset.bin"]); err != nil {
+		t.Fatalf("restoreFile failed: %v", err)
+	}
+	if restored, _ := os.ReadFile(dir + "/asset.bin"); !bytes.Equal(restored, edited) {
+		t.Error("Restored chunked file does not match")
+	}
+
+	reach, err := repo.Reachable()
+	if err != nil {
+		t.Fatalf("Reachable failed: %v", err)
+	}
+	for _, c := range list.Chunks {
+		if !reach.Blobs[c.Hash] {
+			t.Fatalf("Expected chunk %s to be reachable", c.Hash)
+		}
+	}
+}
+
+func TestReadChunkedIgnoresForgedSize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(dir+"/small.txt", []byte("small"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+
+	content := []byte("a chunk whose list claims an absurd size")
+	sum := sha256.Sum256(content)
+	chunkHash := hex.EncodeToString(sum[:])
+	compressed, _ := compressBytes(content)
+	repo.BlobStore.PutBlob(ctx, chunkHash, compressed)
+
+	// The list's Size is not covered by any hash check beyond the list itself
+	list, _ := json.Marshal(&ChunkList{Hash: chunkHash, Size: 1 << 62, Chunks: []ChunkRef{{Hash: chunkHash, Size: int64(len(content))}}})
+	sum = sha256.Sum256(list)
+	listHash := hex.EncodeToString(sum[:])
+	compressed, _ = compressBytes(list)
+	repo.BlobStore.PutBlob(ctx, listHash, compressed)
+
+	data, err := ReadFileBlobDecompressed(ctx, repo.BlobStore, chunkRef(chunkHash, listHash))
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Expected the chunk back despite the forged size, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,312 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: commitenc.go
+// Description: Canonical commit encoding for Steria. Commits are stored as exactly the bytes their hash is computed from, so anyone can recompute a commit's hash from the stored object; also verifies stored commits and migrates repositories written with the old encoding.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CommitTimeFormat is the fixed timestamp format of canonical commits. Times
+// are always UTC with nine fractional digits.
+const CommitTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// canonicalCommit is the canonical commit object. Fields are declared in
+// ascending key order so encoding/json emits sorted keys. The hash is never
+// part of the object: it is the sha256 of these bytes.
+type canonicalCommit struct {
+	Author    string            `json:"author"`
+	FileBlobs map[string]string `json:"file_blobs,omitempty"` // Only for legacy commits without a tree
+	Files     []string          `json:"files,omitempty"`      // Only for legacy commits without a tree
+	Message   string            `json:"message"`
+	Parents   []string          `json:"parents,omitempty"`
+	Timestamp string            `json:"timestamp"`
+	Tree      string            `json:"tree,omitempty"`
+}
+
+// EncodeCommit returns the canonical encoding of a commit: compact JSON with
+// keys in ascending order, no hash field, a UTC CommitTimeFormat timestamp,
+// empty parents and tree omitted, the flat file list only for commits without
+// a tree, and no HTML escaping of <, > and &. Commits are hashed and stored
+// as exactly these bytes.
+func EncodeCommit(commit *Commit) ([]byte, error) {
+	stored := storedCommit(commit)
+	c := canonicalCommit{
+		Author:    stored.Author,
+		FileBlobs: stored.FileBlobs,
+		Files:     stored.Files,
+		Message:   stored.Message,
+		Parents:   stored.Parents,
+		Timestamp: stored.Timestamp.UTC().Format(CommitTimeFormat),
+		Tree:      stored.Tree,
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&c); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// DecodeCommit parses a stored commit object named hash. Objects written
+// before the canonical encoding also parse.
+func DecodeCommit(hash string, data []byte) (*Commit, error) {
+	var commit Commit
+	if err := json.Unmarshal(data, &commit); err != nil {
+		return nil, err
+	}
+	commit.Hash = hash
+	return &commit, nil
+}
+
+// verifyCommitObject checks that a stored commit object hashes to its name
+// and is in canonical form
+func verifyCommitObject(hash string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("content does not match its hash")
+	}
+	commit, err := DecodeCommit(hash, data)
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	canonical, err := EncodeCommit(commit)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(canonical, data) {
+		return fmt.Errorf("not in canonical encoding")
+	}
+	return nil
+}
+
+// readCommitObject returns the stored bytes of a commit
+func (r *Repo) readCommitObject(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("commit hash too short: %q", hash)
+	}
+	data, err := os.ReadFile(filepath.Join(r.Path, ".steria", "objects", hash[:2], hash[2:]))
+	if os.IsNotExist(err) {
+		data, err = readPacked(r.packDir(), hash, PackCommit)
+	}
+	return data, err
+}
+
+// hasCommit reports whether a commit object is stored, loose or packed
+func (r *Repo) hasCommit(hash string) bool {
+	if len(hash) < 2 {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(r.Path, ".steria", "objects", hash[:2], hash[2:])); err == nil {
+		return true
+	}
+	return hasPacked(r.packDir(), hash, PackCommit)
+}
+
+// CommitCheck is the result of verifying one commit
+type CommitCheck struct {
+	Hash string `json:"hash"`
+	Err  string `json:"error,omitempty"`
+}
+
+// VerifyCommits recomputes the hash of every commit reachable from tips, or
+// from every ref when no tips are given, and checks that each stored object
+// is in canonical form. A commit that cannot be read is reported and its
+// ancestors are not visited.
+func (r *Repo) VerifyCommits(tips ...string) ([]CommitCheck, error) {
+	if len(tips) == 0 {
+		roots, err := r.rootCommits()
+		if err != nil {
+			return nil, err
+		}
+		tips = roots
+	}
+	var checks []CommitCheck
+	seen := map[string]bool{}
+	stack := append([]string(nil), tips...)
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash == "" || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		data, err := r.readCommitObject(hash)
+		if err == nil {
+			err = verifyCommitObject(hash, data)
+		}
+		if err != nil {
+			checks = append(checks, CommitCheck{Hash: hash, Err: err.Error()})
+		} else {
+			checks = append(checks, CommitCheck{Hash: hash})
+		}
+		if commit, err := DecodeCommit(hash, data); err == nil {
+			stack = append(stack, commit.Parents...)
+		}
+	}
+	return checks, nil
+}
+
+// migrateCommitEncoding rewrites every commit that is not in canonical form,
+// parents first, and points HEAD, MERGE_HEAD, branches and tags at the new
+// hashes. It is safe to run again after an interruption: canonical commits
+// map to themselves and refs still naming old hashes are remapped. Returns
+// the number of commits rewritten.
+func (r *Repo) migrateCommitEncoding() (int, error) {
+	loose, err := r.looseObjects()
+	if err != nil {
+		return 0, err
+	}
+	commits := map[string]*Commit{}
+	for _, obj := range loose {
+		if obj.kind != PackCommit {
+			continue
+		}
+		data, err := os.ReadFile(obj.path)
+		if err != nil {
+			return 0, err
+		}
+		if commits[obj.hash], err = DecodeCommit(obj.hash, data); err != nil {
+			return 0, fmt.Errorf("failed to parse commit %s: %w", obj.hash, err)
+		}
+	}
+	for _, hash := range listPacked(r.packDir(), PackCommit) {
+		if commits[hash] != nil {
+			continue
+		}
+		data, err := readPacked(r.packDir(), hash, PackCommit)
+		if err != nil {
+			return 0, err
+		}
+		if commits[hash], err = DecodeCommit(hash, data); err != nil {
+			return 0, fmt.Errorf("failed to parse commit %s: %w", hash, err)
+		}
+	}
+
+	renamed := map[string]string{}
+	var rewrite func(hash string) (string, error)
+	rewrite = func(hash string) (string, error) {
+		if newHash, ok := renamed[hash]; ok {
+			return newHash, nil
+		}
+		commit := commits[hash]
+		if commit == nil {
+			return hash, nil // Missing parents keep their name
+		}
+		renamed[hash] = hash // Guards against cycles in a damaged history
+		migrated := *commit
+		migrated.Parents = make([]string, len(commit.Parents))
+		for i, parent := range commit.Parents {
+			newParent, err := rewrite(parent)
+			if err != nil {
+				return "", err
+			}
+			migrated.Parents[i] = newParent
+		}
+		if len(migrated.Parents) == 0 {
+			migrated.Parents = nil
+		}
+		newHash, err := hashCommit(&migrated)
+		if err != nil {
+			return "", err
+		}
+		if newHash != hash {
+			migrated.Hash = newHash
+			if err := r.writeCommitObject(&migrated); err != nil {
+				return "", fmt.Errorf("failed to write migrated commit %s: %w", hash, err)
+			}
+		}
+		renamed[hash] = newHash
+		return newHash, nil
+	}
+	for hash := range commits {
+		if _, err := rewrite(hash); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := r.remapRefs(renamed); err != nil {
+		return 0, err
+	}
+	count := 0
+	for oldHash, newHash := range renamed {
+		if oldHash == newHash {
+			continue
+		}
+		count++
+		os.Remove(filepath.Join(r.Path, ".steria", "objects", oldHash[:2], oldHash[2:]))
+	}
+	return count, nil
+}
+
+// remapRefs points every ref that names a renamed commit at its new hash
+func (r *Repo) remapRefs(renamed map[string]string) error {
+	steriaDir := filepath.Join(r.Path, ".steria")
+	remapFile := func(path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		old := strings.TrimSpace(string(data))
+		if newHash, ok := renamed[old]; ok && newHash != old {
+			return atomicWrite(path, []byte(newHash))
+		}
+		return nil
+	}
+
+	paths := []string{filepath.Join(steriaDir, "HEAD"), r.mergeHeadPath()}
+	for _, dir := range []string{filepath.Join(steriaDir, "branches"), filepath.Join(steriaDir, "refs", "remotes")} {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !isRefScratchFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+	for _, path := range paths {
+		if err := remapFile(path); err != nil {
+			return fmt.Errorf("failed to update ref %s: %w", path, err)
+		}
+	}
+	if newHead, ok := renamed[r.Head]; ok {
+		r.Head = newHead
+	}
+
+	tagsDir := filepath.Join(steriaDir, "refs", "tags")
+	tags, _ := os.ReadDir(tagsDir)
+	for _, e := range tags {
+		path := filepath.Join(tagsDir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var tag map[string]interface{}
+		if json.Unmarshal(data, &tag) != nil {
+			continue
+		}
+		old, _ := tag["commit"].(string)
+		newHash, ok := renamed[old]
+		if !ok || newHash == old {
+			continue
+		}
+		tag["commit"] = newHash
+		data, err = json.MarshalIndent(tag, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := atomicWrite(path, data); err != nil {
+			return fmt.Errorf("failed to update tag %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
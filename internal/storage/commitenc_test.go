@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLegacyCommit stores a commit the way Steria did before the canonical
+// encoding: hashed as compact JSON with an empty hash field, stored indented
+func writeLegacyCommit(t *testing.T, dir string, commit *Commit) string {
+	commit.Hash = ""
+	data, _ := json.Marshal(commit)
+	sum := sha256.Sum256(data)
+	commit.Hash = hex.EncodeToString(sum[:])
+	stored, _ := json.MarshalIndent(commit, "", "  ")
+	path := filepath.Join(dir, ".steria", "objects", commit.Hash[:2], commit.Hash[2:])
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, stored, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return commit.Hash
+}
+
+func TestCanonicalCommitEncodingAndMigration(t *testing.T) {
+	when := time.Date(2025, 3, 1, 9, 30, 0, 5, time.FixedZone("AEST", 10*3600))
+	commit := &Commit{Hash: "ignored", Message: "a <b> & c", Author: "tester", Timestamp: when, Tree: strings.Repeat("a", 64), FileBlobs: map[string]string{"x": "y"}}
+	data, err := EncodeCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"author":"tester","message":"a <b> & c","timestamp":"2025-02-28T23:30:00.000000005Z","tree":"` + strings.Repeat("a", 64) + `"}`
+	if string(data) != want {
+		t.Fatalf("Unexpected canonical encoding:\n got %s\nwant %s", data, want)
+	}
+	sum := sha256.Sum256(data)
+	if hash, _ := hashCommit(commit); hash != hex.EncodeToString(sum[:]) {
+		t.Error("A commit's hash must be the sha256 of its canonical encoding")
+	}
+
+	// A repository written before the canonical encoding
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := writeLegacyCommit(t, dir, &Commit{Message: "root", Author: "tester", Timestamp: when, Files: []string{}, FileBlobs: map[string]string{}})
+	child := writeLegacyCommit(t, dir, &Commit{Message: "child", Author: "tester", Timestamp: when.Add(time.Hour), Parents: []string{root}, FileBlobs: map[string]string{}})
+	steriaDir := filepath.Join(dir, ".steria")
+	os.WriteFile(filepath.Join(steriaDir, "HEAD"), []byte(child), 0644)
+	os.WriteFile(filepath.Join(steriaDir, "branches", "old"), []byte(root), 0644)
+	os.MkdirAll(filepath.Join(steriaDir, "refs", "tags"), 0755)
+	os.WriteFile(filepath.Join(steriaDir, "refs", "tags", "v1"), []byte(`{"name":"v1","commit":"`+child+`"}`), 0644)
+	repo.Config.RepositoryFormatVersion = 0
+	repo.Config.Features = nil
+	if err := repo.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if checks, _ := repo.VerifyCommits(child); len(checks) != 2 || checks[0].Err == "" {
+		t.Fatalf("Expected legacy commits to fail verification, got %+v", checks)
+	}
+
+	if _, err := LoadOrInitRepo(dir); err == nil || !strings.Contains(err.Error(), "steria migrate") {
+		t.Fatalf("Expected a legacy repository to ask for 'steria migrate', got %v", err)
+	}
+	if _, err := MigrateRepo(dir, MigrateOptions{}); err != nil {
+		t.Fatalf("MigrateRepo failed: %v", err)
+	}
+	migrated, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatalf("Loading a migrated repository failed: %v", err)
+	}
+	if migrated.Head == child || migrated.Config.RepositoryFormatVersion != CurrentFormatVersion {
+		t.Fatalf("Expected HEAD to move to the migrated commit, got %s", migrated.Head)
+	}
+	tag, err := migrated.ResolveRevision("v1")
+	if err != nil || tag != migrated.Head {
+		t.Errorf("Expected the tag to follow the migration, got %s, %v", tag, err)
+	}
+	newRoot, _ := migrated.ResolveRevision("old")
+	head, err := migrated.LoadCommit(migrated.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Message != "child" || len(head.Parents) != 1 || head.Parents[0] != newRoot || newRoot == root {
+		t.Errorf("Expected the child's parent to be the migrated root, got %+v", head)
+	}
+	checks, err := migrated.VerifyCommits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range checks {
+		if c.Err != "" {
+			t.Errorf("Commit %s failed verification after migration: %s", c.Hash, c.Err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(steriaDir, "objects", child[:2], child[2:])); !os.IsNotExist(err) {
+		t.Error("Expected the legacy commit object to be removed")
+	}
+}
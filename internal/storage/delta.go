@@ -0,0 +1,326 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: delta.go
+// Description: Binary delta compression for Steria blobs. Encodes a new file version as copy/insert instructions against its previous version and stores the result as a delta object in the BlobStore.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Delta instruction stream
+//
+//	"SBD1" | base size uvarint | target size uvarint | ops...
+//	op 0x01 COPY:   offset uvarint | length uvarint  (bytes from the base)
+//	op 0x02 INSERT: length uvarint | literal bytes
+//
+// Delta object, stored in the BlobStore under the target's content hash:
+//
+//	"SDLT" | chain depth u8 | base hash (64 hex chars) | gzip(instruction stream)
+const (
+	deltaBlockSize = 32        // Rolling hash window; shorter matches are inserted literally
+	deltaMinSize   = 16 * 1024 // Files smaller than this are always stored whole
+	maxDeltaDepth  = 8         // Longest base -> delta chain a read may have to resolve
+	// Largest delta object, stored or decompressed, that is written or
+	// accepted. Deltas are only made for files below the chunk threshold,
+	// 4 MB by default, so this leaves room for repositories that raise it.
+	maxDeltaObjectSize = 64 << 20
+
+	deltaOpCopy   = 0x01
+	deltaOpInsert = 0x02
+
+	deltaHashBase = 1099511628211 // FNV prime, used as the rolling hash multiplier
+)
+
+var (
+	deltaMagic       = []byte("SBD1")
+	deltaObjectMagic = []byte("SDLT")
+	deltaHeaderSize  = len(deltaObjectMagic) + 1 + 64
+)
+
+// blockHash hashes one deltaBlockSize window
+func blockHash(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*deltaHashBase + uint64(c)
+	}
+	return h
+}
+
+// encodeDelta returns copy/insert instructions that rebuild target from base.
+// Base is indexed at block boundaries and target is scanned with a rolling
+// hash, so matches are found at any offset and the output is binary safe.
+func encodeDelta(base, target []byte) []byte {
+	var out bytes.Buffer
+	out.Write(deltaMagic)
+	putUvarint(&out, uint64(len(base)))
+	putUvarint(&out, uint64(len(target)))
+
+	index := make(map[uint64]int, len(base)/deltaBlockSize+1)
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		h := blockHash(base[off : off+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	// pow is deltaHashBase^(deltaBlockSize-1), used to roll the oldest byte out
+	pow := uint64(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		pow *= deltaHashBase
+	}
+
+	literalStart := 0
+	flushLiteral := func(end int) {
+		if end > literalStart {
+			out.WriteByte(deltaOpInsert)
+			putUvarint(&out, uint64(end-literalStart))
+			out.Write(target[literalStart:end])
+		}
+	}
+
+	i := 0
+	var h uint64
+	if len(target) >= deltaBlockSize {
+		h = blockHash(target[:deltaBlockSize])
+	}
+	for i+deltaBlockSize <= len(target) {
+		if off, ok := index[h]; ok && bytes.Equal(base[off:off+deltaBlockSize], target[i:i+deltaBlockSize]) {
+			// Extend the match backwards into pending literals and forwards
+			start, bStart := i, off
+			for start > literalStart && bStart > 0 && target[start-1] == base[bStart-1] {
+				start--
+				bStart--
+			}
+			end, bEnd := i+deltaBlockSize, off+deltaBlockSize
+			for end < len(target) && bEnd < len(base) && target[end] == base[bEnd] {
+				end++
+				bEnd++
+			}
+			flushLiteral(start)
+			out.WriteByte(deltaOpCopy)
+			putUvarint(&out, uint64(bStart))
+			putUvarint(&out, uint64(end-start))
+			i, literalStart = end, end
+			if i+deltaBlockSize <= len(target) {
+				h = blockHash(target[i : i+deltaBlockSize])
+			}
+			continue
+		}
+		if i+deltaBlockSize < len(target) {
+			h = (h-uint64(target[i])*pow)*deltaHashBase + uint64(target[i+deltaBlockSize])
+		}
+		i++
+	}
+	flushLiteral(len(target))
+	return out.Bytes()
+}
+
+// applyDelta rebuilds the target from base and a delta instruction stream
+func applyDelta(base, delta []byte) ([]byte, error) {
+	if !bytes.HasPrefix(delta, deltaMagic) {
+		return nil, errors.New("not a binary delta")
+	}
+	r := bytes.NewReader(delta[len(deltaMagic):])
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta header: %w", err)
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta base size mismatch: want %d, have %d", baseSize, len(base))
+	}
+	targetSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta header: %w", err)
+	}
+	// Every copy instruction takes at least three bytes and copies at most the
+	// whole base, and inserts produce no more than their literal bytes, so a
+	// header claiming more than that is corrupt. Even an honest target is
+	// only preallocated up to the size of its inputs; longer ones grow.
+	rest := uint64(r.Len())
+	if targetSize > rest+rest/3*uint64(len(base)) {
+		return nil, fmt.Errorf("corrupt delta header: target size %d is more than the instructions can produce", targetSize)
+	}
+	out := make([]byte, 0, min(targetSize, uint64(len(base))+rest))
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		switch op {
+		case deltaOpCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off+n > uint64(len(base)) || off+n < off {
+				return nil, errors.New("corrupt delta copy instruction")
+			}
+			out = append(out, base[off:off+n]...)
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, errors.New("corrupt delta insert instruction")
+			}
+			lit := make([]byte, n)
+			io.ReadFull(r, lit)
+			out = append(out, lit...)
+		default:
+			return nil, fmt.Errorf("unknown delta instruction 0x%02x", op)
+		}
+		if uint64(len(out)) > targetSize {
+			return nil, fmt.Errorf("delta produced more than %d bytes", targetSize)
+		}
+	}
+	if uint64(len(out)) != targetSize {
+		return nil, fmt.Errorf("delta produced %d bytes, want %d", len(out), targetSize)
+	}
+	return out, nil
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+// isDeltaObject reports whether stored blob bytes are a delta object
+func isDeltaObject(stored []byte) bool {
+	return len(stored) >= deltaHeaderSize && bytes.HasPrefix(stored, deltaObjectMagic)
+}
+
+// parseDeltaObject splits a stored delta object into its chain depth, base
+// hash and delta instruction stream
+func parseDeltaObject(stored []byte) (int, string, []byte, error) {
+	if !isDeltaObject(stored) {
+		return 0, "", nil, errors.New("not a delta object")
+	}
+	depth := int(stored[len(deltaObjectMagic)])
+	base := string(stored[len(deltaObjectMagic)+1 : deltaHeaderSize])
+	gr, err := gzip.NewReader(bytes.NewReader(stored[deltaHeaderSize:]))
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("corrupt delta object: %w", err)
+	}
+	defer gr.Close()
+	delta, err := io.ReadAll(io.LimitReader(gr, maxDeltaObjectSize+1))
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("corrupt delta object: %w", err)
+	}
+	if len(delta) > maxDeltaObjectSize {
+		return 0, "", nil, fmt.Errorf("corrupt delta object: instructions exceed %d bytes", maxDeltaObjectSize)
+	}
+	return depth, base, delta, nil
+}
+
+// deltaBase returns the base blob of a stored delta object, or "" for a whole blob
+func deltaBase(stored []byte) string {
+	if !isDeltaObject(stored) {
+		return ""
+	}
+	return string(stored[len(deltaObjectMagic)+1 : deltaHeaderSize])
+}
+
+// chainDepth returns how many deltas must be applied to read a stored blob
+func chainDepth(stored []byte) int {
+	if !isDeltaObject(stored) {
+		return 0
+	}
+	return int(stored[len(deltaObjectMagic)])
+}
+
+// readDeltaObject resolves a stored delta object into the blob's content and
+// checks the result against the blob hash
+func readDeltaObject(ctx context.Context, blobStore BlobStore, hash string, stored []byte) ([]byte, error) {
+	depth, baseHash, delta, err := parseDeltaObject(stored)
+	if err != nil {
+		return nil, err
+	}
+	if depth > maxDeltaDepth {
+		return nil, fmt.Errorf("delta chain for %s is too deep (%d)", hash, depth)
+	}
+	baseData, err := ReadBlobDecompressed(ctx, blobStore, baseHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delta base %s: %w", baseHash, err)
+	}
+	data, err := applyDelta(baseData, delta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply delta for %s: %w", hash, err)
+	}
+	if _, ok := decodeHash(hash); ok {
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+			return nil, fmt.Errorf("delta for %s reconstructed the wrong content", hash)
+		}
+	}
+	return data, nil
+}
+
+// encodeDeltaObject builds a stored delta object for content against base
+func encodeDeltaObject(depth int, baseHash string, base, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(deltaObjectMagic)
+	buf.WriteByte(byte(depth))
+	buf.WriteString(baseHash)
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(encodeDelta(base, content)); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBlobDelta stores content as a delta against baseHash when that is
+// clearly smaller than storing it whole. Returns false if the blob should be
+// written whole instead (small file, missing base, chain too deep, poor delta).
+func writeBlobDelta(ctx context.Context, blobStore BlobStore, hash, baseHash string, content []byte) (bool, error) {
+	if len(content) < deltaMinSize || len(content) > maxDeltaObjectSize || baseHash == "" || baseHash == hash {
+		return false, nil
+	}
+	if _, ok := decodeHash(baseHash); !ok {
+		return false, nil
+	}
+	baseStored, err := blobStore.GetBlob(ctx, baseHash+".gz")
+	if err != nil {
+		return false, nil
+	}
+	depth := chainDepth(baseStored) + 1
+	if depth > maxDeltaDepth {
+		return false, nil
+	}
+	base, err := ReadBlobDecompressed(ctx, blobStore, baseHash)
+	if err != nil {
+		return false, nil
+	}
+	obj, err := encodeDeltaObject(depth, baseHash, base, content)
+	if err != nil {
+		return false, err
+	}
+	whole, err := compressBytes(content)
+	if err != nil {
+		return false, err
+	}
+	if len(obj)*2 > len(whole) {
+		return false, nil // Not worth a chain link
+	}
+	return true, blobStore.PutBlob(ctx, hash, obj)
+}
+
+// compressBytes gzips data
+func compressBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBinaryDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 64*1024)
+	rng.Read(base)
+
+	target := append([]byte{}, base[:20000]...)
+	target = append(target, 0, 0, 0xff, '\n', 0x80)             // Inserted bytes, not valid UTF-8
+	target = append(target, base[20000:40000]...)               // Unchanged middle
+	target = append(target, bytes.Repeat([]byte{0xfe}, 300)...) // Replaced region
+	target = append(target, base[40300:]...)
+
+	delta := encodeDelta(base, target)
+	if len(delta) > len(target)/10 {
+		t.Errorf("Expected a small delta for a mostly unchanged file, got %d bytes", len(delta))
+	}
+	got, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatalf("applyDelta failed: %v", err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Fatal("Binary delta did not reconstruct the target")
+	}
+	if _, err := applyDelta(base[:100], delta); err == nil {
+		t.Error("Expected applying a delta to the wrong base to fail")
+	}
+}
+
+func TestCorruptDeltaHeaderIsRejected(t *testing.T) {
+	base := bytes.Repeat([]byte("steria "), 4096)
+	target := append(append([]byte{}, base...), "tail"...)
+	delta := encodeDelta(base, target)
+
+	// withTargetSize rewrites the header's target size, keeping the instructions
+	withTargetSize := func(size uint64) []byte {
+		r := bytes.NewReader(delta[len(deltaMagic):])
+		binary.ReadUvarint(r)
+		binary.ReadUvarint(r)
+		var out bytes.Buffer
+		out.Write(deltaMagic)
+		putUvarint(&out, uint64(len(base)))
+		putUvarint(&out, size)
+		r.WriteTo(&out)
+		return out.Bytes()
+	}
+	if got, err := applyDelta(base, withTargetSize(uint64(len(target)))); err != nil || !bytes.Equal(got, target) {
+		t.Fatalf("Expected the rewritten header to still apply, got %v", err)
+	}
+	for _, size := range []uint64{1 << 62, uint64(len(target)) * 1000, uint64(len(target)) - 1} {
+		if _, err := applyDelta(base, withTargetSize(size)); err == nil {
+			t.Errorf("Expected a target size of %d to be rejected", size)
+		}
+	}
+}
+
+func TestCommitStoresLargeModifiedFileAsDelta(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(2))
+	content := make([]byte, 128*1024)
+	rng.Read(content)
+	os.WriteFile(dir+"/large.bin", content, 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	first, _ := repo.LoadCommit(repo.Head)
+	baseBlob := first.FileBlobs["large.bin"]
+
+	changed := append([]byte{}, content...)
+	copy(changed[50000:], []byte("patched in the middle"))
+	os.WriteFile(dir+"/large.bin", changed, 0644)
+	commit, err := repo.CreateCommit("Patch large file", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	if commit.Stats.DeltaBlobs != 1 {
+		t.Fatalf("Expected the modified file to be stored as a delta, got %+v", commit.Stats)
+	}
+	blob := commit.FileBlobs["large.bin"]
+	if base := deltaBase(repo.storedBlobHeader(blob)); base != baseBlob {
+		t.Fatalf("Expected delta against %s, got %q", baseBlob, base)
+	}
+	data, err := ReadBlobDecompressed(ctx, repo.BlobStore, blob)
+	if err != nil || !bytes.Equal(data, changed) {
+		t.Fatalf("Reading delta blob failed: %v", err)
+	}
+
+	// The base stays reachable through the delta even once no commit names it
+	orphan := &Commit{Message: "Orphan", Author: "tester", Timestamp: time.Now(),
+		Files: []string{"large.bin"}, FileBlobs: map[string]string{"large.bin": blob}}
+	if err := repo.writeCommit(orphan); err != nil {
+		t.Fatalf("writeCommit failed: %v", err)
+	}
+	// The reflog keeps every commit a ref once named; forget it
+	os.RemoveAll(repo.Path + "/.steria/logs")
+	if _, err := repo.GC(); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	reach, err := repo.Reachable()
+	if err != nil {
+		t.Fatalf("Reachable failed: %v", err)
+	}
+	if reach.Commits[first.Hash] {
+		t.Fatal("Expected the original history to be unreachable")
+	}
+	if !reach.Blobs[baseBlob] {
+		t.Error("Expected the delta base to be reachable")
+	}
+	if data, err := ReadBlobDecompressed(ctx, repo.BlobStore, blob); err != nil || !bytes.Equal(data, changed) {
+		t.Fatalf("Reading packed delta blob failed: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: format.go
+// Description: Repository format versioning for Steria. Records the on-disk format and feature flags in config.json, refuses repositories this build cannot read, and upgrades older repositories in place with a backup that failed or unwanted upgrades roll back to.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Repository format versions
+//
+//	0: commits stored as indented JSON hashed in a different form (no version in config.json)
+//	1: canonical commit encoding, named by the sha256 of the stored bytes
+const CurrentFormatVersion = 1
+
+// Feature flags name optional on-disk capabilities a repository may use. A
+// build refuses to open a repository that lists a feature it does not know.
+const (
+	FeatureTrees            = "trees"             // Commits reference tree objects instead of a flat file list
+	FeaturePacks            = "packs"             // Objects may live in .steria/objects/pack
+	FeatureDeltaObjects     = "delta-objects"     // Blobs may be stored as deltas against another blob
+	FeatureChunkedFiles     = "chunked-files"     // Large files may be stored as content-defined chunks
+	FeatureCanonicalCommits = "canonical-commits" // Commits use the canonical encoding
+)
+
+// knownFeatures is every feature flag this build understands
+var knownFeatures = map[string]bool{
+	FeatureTrees:            true,
+	FeaturePacks:            true,
+	FeatureDeltaObjects:     true,
+	FeatureChunkedFiles:     true,
+	FeatureCanonicalCommits: true,
+}
+
+// defaultFeatures are the features of a repository created by this build
+func defaultFeatures() []string {
+	return []string{FeatureCanonicalCommits, FeatureChunkedFiles, FeatureDeltaObjects, FeaturePacks, FeatureTrees}
+}
+
+// checkFormat refuses repositories written by a newer Steria or by an older
+// one that needs 'steria migrate' first
+func checkFormat(config *Config) error {
+	if config.RepositoryFormatVersion > CurrentFormatVersion {
+		return fmt.Errorf("repository format version %d is newer than this steria supports (%d); upgrade steria to use this repository",
+			config.RepositoryFormatVersion, CurrentFormatVersion)
+	}
+	for _, feature := range config.Features {
+		if !knownFeatures[feature] {
+			return fmt.Errorf("repository uses feature %q, which this steria does not support; upgrade steria to use this repository", feature)
+		}
+	}
+	if config.RepositoryFormatVersion < CurrentFormatVersion {
+		return fmt.Errorf("repository format version %d is older than %d; run 'steria migrate' to upgrade it",
+			config.RepositoryFormatVersion, CurrentFormatVersion)
+	}
+	return nil
+}
+
+// migrationStep upgrades a repository from one format version to the next
+type migrationStep struct {
+	Description string
+	Features    []string // Feature flags the step turns on
+	Run         func(r *Repo) error
+}
+
+// migrationSteps[v] upgrades format version v to v+1
+var migrationSteps = []migrationStep{
+	{
+		Description: "Rewrite commits in the canonical encoding",
+		Features:    defaultFeatures(),
+		Run: func(r *Repo) error {
+			_, err := r.migrateCommitEncoding()
+			return err
+		},
+	},
+}
+
+// MigrateOptions control 'steria migrate'
+type MigrateOptions struct {
+	Target int  // Format version to upgrade to; 0 means CurrentFormatVersion
+	DryRun bool // Only report the steps that would run
+}
+
+// MigrateResult describes a completed or planned migration
+type MigrateResult struct {
+	From   int
+	To     int
+	Steps  []string
+	Backup string // Backup directory taken before the migration, if any
+}
+
+// backupRoot is where migration backups are kept
+func backupRoot(path string) string {
+	return filepath.Join(path, ".steria", "backups")
+}
+
+// MigrateRepo upgrades the repository at path to the target format version.
+// The repository's metadata (config, refs, commits and trees) is backed up
+// first; if any step fails the backup is restored before the error is
+// returned, and RollbackMigration restores it on request later. Blobs and
+// packs are never modified by a migration and are not copied.
+func MigrateRepo(path string, opts MigrateOptions) (*MigrateResult, error) {
+	r, err := readRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	target := opts.Target
+	if target == 0 {
+		target = CurrentFormatVersion
+	}
+	from := r.Config.RepositoryFormatVersion
+	result := &MigrateResult{From: from, To: target}
+	switch {
+	case target > CurrentFormatVersion:
+		return nil, fmt.Errorf("format version %d is newer than this steria supports (%d)", target, CurrentFormatVersion)
+	case target < from:
+		return nil, fmt.Errorf("downgrading from format version %d to %d is not supported; use 'steria migrate --rollback' to restore the backup taken before an upgrade", from, target)
+	case target == from:
+		if raw, err := os.ReadFile(filepath.Join(path, ".steria", "config.json")); err == nil && legacyCommitEncoding(raw) != "" {
+			return result, r.saveConfig() // Record the version in place of the old commit_encoding key
+		}
+		return result, nil
+	}
+	for v := from; v < target; v++ {
+		result.Steps = append(result.Steps, fmt.Sprintf("%d -> %d: %s", v, v+1, migrationSteps[v].Description))
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// Backup names sort by the time they were taken
+	backup := filepath.Join(backupRoot(path), fmt.Sprintf("%s-format-%d", time.Now().UTC().Format("20060102T150405.000000000"), from))
+	if err := backupMetadata(path, backup); err != nil {
+		os.RemoveAll(backup)
+		return nil, fmt.Errorf("failed to back up repository: %w", err)
+	}
+	result.Backup = backup
+
+	for v := from; v < target; v++ {
+		step := migrationSteps[v]
+		err := step.Run(r)
+		if err == nil {
+			r.Config.RepositoryFormatVersion = v + 1
+			r.Config.Features = mergeFeatures(r.Config.Features, step.Features)
+			err = r.saveConfig()
+		}
+		if err != nil {
+			if rerr := restoreMetadata(path, backup); rerr != nil {
+				return nil, fmt.Errorf("migration to format version %d failed (%v) and restoring the backup at %s also failed: %w", v+1, err, backup, rerr)
+			}
+			os.RemoveAll(backup)
+			return nil, fmt.Errorf("migration to format version %d failed, repository restored: %w", v+1, err)
+		}
+	}
+	return result, nil
+}
+
+// RollbackMigration restores the most recent migration backup and removes it.
+// Returns the backup that was restored.
+func RollbackMigration(path string) (string, error) {
+	entries, err := os.ReadDir(backupRoot(path))
+	if err != nil || len(entries) == 0 {
+		return "", fmt.Errorf("no migration backup to roll back to")
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no migration backup to roll back to")
+	}
+	sort.Strings(names)
+	backup := filepath.Join(backupRoot(path), names[len(names)-1])
+	if err := restoreMetadata(path, backup); err != nil {
+		return "", fmt.Errorf("failed to restore %s: %w", backup, err)
+	}
+	return backup, os.RemoveAll(backup)
+}
+
+// mergeFeatures returns the sorted union of two feature lists
+func mergeFeatures(have, add []string) []string {
+	set := map[string]bool{}
+	for _, f := range append(append([]string(nil), have...), add...) {
+		set[f] = true
+	}
+	merged := make([]string, 0, len(set))
+	for f := range set {
+		merged = append(merged, f)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// metadataUnits lists the paths, relative to .steria, that a migration may
+// change: every top-level entry except backups, the repository lock and the
+// object store, plus every entry of objects except blobs, packs and the blob
+// cache
+func metadataUnits(steriaDir string) ([]string, error) {
+	var units []string
+	top, err := os.ReadDir(steriaDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range top {
+		switch e.Name() {
+		case "backups", "objects", "lock", "readers":
+		default:
+			units = append(units, e.Name())
+		}
+	}
+	objects, _ := os.ReadDir(filepath.Join(steriaDir, "objects"))
+	for _, e := range objects {
+		switch e.Name() {
+		case "blobs", "pack", "cache", "quarantine":
+		default:
+			units = append(units, filepath.Join("objects", e.Name()))
+		}
+	}
+	return units, nil
+}
+
+// backupMetadata copies the metadata units of a repository into backup
+func backupMetadata(path, backup string) error {
+	steriaDir := filepath.Join(path, ".steria")
+	units, err := metadataUnits(steriaDir)
+	if err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := copyTree(filepath.Join(steriaDir, unit), filepath.Join(backup, unit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreMetadata replaces the repository's metadata units with the backup
+func restoreMetadata(path, backup string) error {
+	steriaDir := filepath.Join(path, ".steria")
+	units, err := metadataUnits(steriaDir)
+	if err != nil {
+		return err
+	}
+	for _, unit := range units {
+		if err := os.RemoveAll(filepath.Join(steriaDir, unit)); err != nil {
+			return err
+		}
+	}
+	saved, err := metadataUnits(backup)
+	if err != nil {
+		return err
+	}
+	for _, unit := range saved {
+		if err := copyTree(filepath.Join(backup, unit), filepath.Join(steriaDir, unit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies a file or directory. Files under objects are named by
+// their content and never edited in place, so they are hard-linked when
+// possible; everything else is copied.
+func copyTree(src, dst string) error {
+	link := filepath.Base(filepath.Dir(src)) == "objects"
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if link && os.Link(path, target) == nil {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// legacyCommitEncoding reads the commit_encoding key that repositories
+// created before format versioning used to mark canonical commits
+func legacyCommitEncoding(configData []byte) string {
+	var legacy struct {
+		CommitEncoding string `json:"commit_encoding"`
+	}
+	json.Unmarshal(configData, &legacy)
+	return legacy.CommitEncoding
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatVersionChecksAndMigrationRollback(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Config.RepositoryFormatVersion != CurrentFormatVersion || len(repo.Config.Features) == 0 {
+		t.Fatalf("Expected a new repository at format %d with features, got %+v", CurrentFormatVersion, repo.Config)
+	}
+	head := repo.Head
+
+	// Newer formats and unknown features are refused
+	repo.Config.RepositoryFormatVersion = CurrentFormatVersion + 1
+	repo.saveConfig()
+	if _, err := LoadOrInitRepo(dir); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected a newer format to be refused, got %v", err)
+	}
+	repo.Config.RepositoryFormatVersion = CurrentFormatVersion
+	repo.Config.Features = append(repo.Config.Features, "time-travel")
+	repo.saveConfig()
+	if _, err := LoadOrInitRepo(dir); err == nil || !strings.Contains(err.Error(), "time-travel") {
+		t.Errorf("Expected an unknown feature to be refused, got %v", err)
+	}
+
+	// Upgrade from format 0, then roll back to the backup
+	repo.Config.RepositoryFormatVersion = 0
+	repo.Config.Features = nil
+	repo.saveConfig()
+	plan, err := MigrateRepo(dir, MigrateOptions{DryRun: true})
+	if err != nil || len(plan.Steps) != CurrentFormatVersion || plan.Backup != "" {
+		t.Fatalf("Unexpected dry run result %+v, %v", plan, err)
+	}
+	result, err := MigrateRepo(dir, MigrateOptions{})
+	if err != nil {
+		t.Fatalf("MigrateRepo failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(result.Backup, "config.json")); err != nil {
+		t.Errorf("Expected config.json in the backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(result.Backup, "objects", "blobs")); !os.IsNotExist(err) {
+		t.Error("Blobs must not be copied into the backup")
+	}
+	if _, err := LoadOrInitRepo(dir); err != nil {
+		t.Fatalf("Expected the migrated repository to load: %v", err)
+	}
+	if _, err := MigrateRepo(dir, MigrateOptions{Target: -1}); err == nil {
+		t.Error("Expected a downgrade to be refused")
+	}
+
+	restored, err := RollbackMigration(dir)
+	if err != nil || restored != result.Backup {
+		t.Fatalf("RollbackMigration failed: %s, %v", restored, err)
+	}
+	old, err := readRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Config.RepositoryFormatVersion != 0 || old.Head != head {
+		t.Errorf("Expected format 0 and the original HEAD after rollback, got %d and %s", old.Config.RepositoryFormatVersion, old.Head)
+	}
+	if _, err := RollbackMigration(dir); err == nil {
+		t.Error("Expected no backup to be left after rolling back")
+	}
+}
@@ -0,0 +1,539 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: fsck.go
+// Description: Repository integrity checking for Steria. Re-hashes every stored object, follows every reference between commits, trees and blobs, validates refs and reports missing, corrupt and dangling objects.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FsckProblem kinds
+const (
+	FsckMissing  = "missing"  // Referenced but not stored
+	FsckCorrupt  = "corrupt"  // Stored but unreadable or not matching its hash
+	FsckBadRef   = "bad-ref"  // A ref that does not name a stored commit
+	FsckDangling = "dangling" // Stored but unreachable from any ref; harmless until pruned
+)
+
+// FsckProblem is one finding of an integrity check
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	Object string `json:"object"`         // "commit", "tree", "blob", "pack" or "ref"
+	Name   string `json:"name"`           // Object hash, pack file or ref name
+	From   string `json:"from,omitempty"` // What references a missing object
+	Detail string `json:"detail,omitempty"`
+}
+
+// FsckResult summarizes an integrity check
+type FsckResult struct {
+	Commits  int           `json:"commits"`
+	Trees    int           `json:"trees"`
+	Blobs    int           `json:"blobs"`
+	Refs     int           `json:"refs"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// Errors counts the problems that mean data is missing or damaged; dangling
+// objects are reported but are not errors
+func (f *FsckResult) Errors() int {
+	n := 0
+	for _, p := range f.Problems {
+		if p.Kind != FsckDangling {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck holds the state of one integrity check
+type fsck struct {
+	r       *Repo
+	store   *LocalBlobStore
+	result  *FsckResult
+	commits map[string]*Commit
+	trees   map[string]*Tree
+	blobs   map[string]bool       // Stored blobs, true once verified
+	lists   map[string]*ChunkList // Chunk lists by list hash
+	bad     map[string]bool       // Objects already reported corrupt
+	reach   *Reachability
+}
+
+func (f *fsck) report(kind, object, name, from, detail string) {
+	f.result.Problems = append(f.result.Problems, FsckProblem{Kind: kind, Object: object, Name: name, From: from, Detail: detail})
+}
+
+// Fsck checks the whole object store: every blob is decompressed and
+// re-hashed, every commit and tree is parsed and re-hashed, every reference
+// between objects and every ref must resolve, and objects no ref reaches are
+// listed as dangling.
+func (r *Repo) Fsck() (*FsckResult, error) {
+	f := &fsck{
+		r:       r,
+		store:   &LocalBlobStore{Dir: filepath.Join(r.Path, ".steria", "objects", "blobs")},
+		result:  &FsckResult{},
+		commits: map[string]*Commit{},
+		trees:   map[string]*Tree{},
+		blobs:   map[string]bool{},
+		lists:   map[string]*ChunkList{},
+		bad:     map[string]bool{},
+		reach:   &Reachability{Commits: map[string]bool{}, Trees: map[string]bool{}, Blobs: map[string]bool{}},
+	}
+	f.checkPacks()
+	if err := f.loadObjects(); err != nil {
+		return nil, err
+	}
+	if err := f.checkBlobs(); err != nil {
+		return nil, err
+	}
+	f.checkLinks()
+	roots := f.checkRefs()
+	f.walk(roots)
+	f.reportDangling()
+
+	sort.SliceStable(f.result.Problems, func(i, j int) bool {
+		a, b := f.result.Problems[i], f.result.Problems[j]
+		if a.Kind != b.Kind {
+			return fsckKindOrder(a.Kind) < fsckKindOrder(b.Kind)
+		}
+		return a.Name < b.Name
+	})
+	return f.result, nil
+}
+
+func fsckKindOrder(kind string) int {
+	switch kind {
+	case FsckCorrupt:
+		return 0
+	case FsckMissing:
+		return 1
+	case FsckBadRef:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// checkPacks validates every pack index and the checksum trailer of its pack
+func (f *fsck) checkPacks() {
+	idxFiles, _ := filepath.Glob(filepath.Join(f.r.packDir(), "*.idx"))
+	for _, idx := range idxFiles {
+		name := filepath.Base(idx)
+		if _, err := readPackIndex(idx); err != nil {
+			f.report(FsckCorrupt, "pack", name, "", err.Error())
+			continue
+		}
+		packPath := strings.TrimSuffix(idx, ".idx") + ".pack"
+		if err := verifyPackChecksum(packPath); err != nil {
+			f.report(FsckCorrupt, "pack", filepath.Base(packPath), "", err.Error())
+		}
+	}
+}
+
+// verifyPackChecksum checks the sha256 trailer of a pack file
+func verifyPackChecksum(packPath string) error {
+	file, err := os.Open(packPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < packHeaderSize+sha256.Size {
+		return fmt.Errorf("pack is truncated")
+	}
+	sum := sha256.New()
+	if _, err := io.CopyN(sum, file, info.Size()-sha256.Size); err != nil {
+		return err
+	}
+	trailer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		return err
+	}
+	if hex.EncodeToString(trailer) != hex.EncodeToString(sum.Sum(nil)) {
+		return fmt.Errorf("pack checksum mismatch")
+	}
+	return nil
+}
+
+// loadObjects parses and re-hashes every loose and packed commit and tree
+func (f *fsck) loadObjects() error {
+	loose, err := f.r.looseObjects()
+	if err != nil {
+		return err
+	}
+	seen := map[PackObjectKind]map[string]bool{PackCommit: {}, PackTree: {}}
+	for _, obj := range loose {
+		if obj.kind == PackBlob {
+			continue
+		}
+		seen[obj.kind][obj.hash] = true
+		data, err := os.ReadFile(obj.path)
+		f.parseObject(obj.kind, obj.hash, data, err)
+	}
+	for _, kind := range []PackObjectKind{PackCommit, PackTree} {
+		for _, hash := range listPacked(f.r.packDir(), kind) {
+			if seen[kind][hash] {
+				continue
+			}
+			data, err := readPacked(f.r.packDir(), hash, kind)
+			f.parseObject(kind, hash, data, err)
+		}
+	}
+	return nil
+}
+
+// parseObject validates one commit or tree object against its name
+func (f *fsck) parseObject(kind PackObjectKind, hash string, data []byte, readErr error) {
+	if kind == PackCommit {
+		f.result.Commits++
+		if readErr != nil {
+			f.report(FsckCorrupt, "commit", hash, "", readErr.Error())
+			return
+		}
+		commit, err := DecodeCommit(hash, data)
+		if err != nil {
+			f.report(FsckCorrupt, "commit", hash, "", "invalid JSON: "+err.Error())
+			return
+		}
+		if err := verifyCommitObject(hash, data); err != nil {
+			f.report(FsckCorrupt, "commit", hash, "", err.Error())
+		}
+		f.commits[hash] = commit
+		return
+	}
+
+	f.result.Trees++
+	if readErr != nil {
+		f.report(FsckCorrupt, "tree", hash, "", readErr.Error())
+		return
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		f.report(FsckCorrupt, "tree", hash, "", "invalid JSON: "+err.Error())
+		return
+	}
+	if sum, _, err := hashTree(&tree); err != nil || sum != hash {
+		f.report(FsckCorrupt, "tree", hash, "", "content does not match its hash")
+	}
+	f.trees[hash] = &tree
+}
+
+// checkBlobs decompresses every stored blob and checks it against its name
+func (f *fsck) checkBlobs() error {
+	ctx := f.r.Context()
+	hashes, err := f.store.ListBlobs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list blobs: %w", err)
+	}
+	for _, hash := range hashes {
+		if f.blobs[hash] {
+			continue
+		}
+		f.result.Blobs++
+		f.blobs[hash] = true
+		if _, ok := decodeHash(hash); !ok {
+			continue // Legacy patch objects are not named by content
+		}
+		rc, err := openStoredBlob(ctx, f.store, hash)
+		if err == nil {
+			_, err = io.Copy(io.Discard, rc)
+			rc.Close()
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			f.bad[hash] = true
+			f.report(FsckCorrupt, "blob", hash, "", err.Error())
+		}
+	}
+	return nil
+}
+
+// hasBlob reports whether a blob is stored
+func (f *fsck) hasBlob(hash string) bool {
+	return f.blobs[strings.TrimSuffix(hash, ".gz")]
+}
+
+// checkBlobRef checks that everything a snapshot blob ref needs is stored
+func (f *fsck) checkBlobRef(ref, from string) {
+	switch {
+	case strings.HasPrefix(ref, "delta:"):
+		parts := strings.Split(ref, ":")
+		if len(parts) != 3 {
+			f.report(FsckCorrupt, "blob", ref, from, "invalid delta ref")
+			return
+		}
+		f.checkBlobRef(parts[1], from)
+		if !f.hasBlob(parts[2]) {
+			f.report(FsckMissing, "blob", parts[2], from, "delta patch")
+		}
+	case IsChunkRef(ref):
+		_, listHash, _ := parseChunkRef(ref)
+		if !f.hasBlob(listHash) {
+			f.report(FsckMissing, "blob", listHash, from, "chunk list")
+			return
+		}
+		list, ok := f.lists[listHash]
+		if !ok {
+			var err error
+			if list, err = LoadChunkList(f.r.Context(), f.store, ref); err != nil {
+				if !f.bad[listHash] {
+					f.bad[listHash] = true
+					f.report(FsckCorrupt, "blob", listHash, from, err.Error())
+				}
+				return
+			}
+			f.lists[listHash] = list
+			for _, c := range list.Chunks {
+				if !f.hasBlob(c.Hash) {
+					f.report(FsckMissing, "blob", c.Hash, "chunk list "+listHash, "chunk")
+				}
+			}
+		}
+		if list.Hash != BlobContentHash(ref) {
+			f.report(FsckCorrupt, "blob", listHash, from, "chunk list does not describe "+BlobContentHash(ref))
+		}
+	default:
+		if ref == "" {
+			f.report(FsckCorrupt, "blob", "", from, "empty blob ref")
+		} else if !f.hasBlob(ref) {
+			f.report(FsckMissing, "blob", strings.TrimSuffix(ref, ".gz"), from, "")
+		}
+	}
+}
+
+// checkLinks checks every parent, tree and blob reference of the stored
+// commits and trees
+func (f *fsck) checkLinks() {
+	for hash, commit := range f.commits {
+		from := "commit " + hash
+		for _, parent := range commit.Parents {
+			if f.commits[parent] == nil && !f.storedCommit(parent) {
+				f.report(FsckMissing, "commit", parent, from, "parent")
+			}
+		}
+		if commit.Tree != "" {
+			if f.trees[commit.Tree] == nil && !f.storedTree(commit.Tree) {
+				f.report(FsckMissing, "tree", commit.Tree, from, "root tree")
+			}
+		}
+		for file, ref := range commit.FileBlobs {
+			f.checkBlobRef(ref, from+" ("+file+")")
+		}
+	}
+	for hash, tree := range f.trees {
+		from := "tree " + hash
+		for _, e := range tree.Entries {
+			switch e.Type {
+			case TreeEntryTree:
+				if f.trees[e.Hash] == nil && !f.storedTree(e.Hash) {
+					f.report(FsckMissing, "tree", e.Hash, from, e.Name)
+				}
+			case TreeEntryBlob:
+				f.checkBlobRef(e.Hash, from+" ("+e.Name+")")
+			default:
+				f.report(FsckCorrupt, "tree", hash, "", fmt.Sprintf("entry %q has unknown type %q", e.Name, e.Type))
+			}
+		}
+	}
+}
+
+// storedCommit reports whether a commit file exists even though it failed to parse
+func (f *fsck) storedCommit(hash string) bool {
+	return f.r.hasCommit(hash)
+}
+
+// storedTree reports whether a tree file exists even though it failed to parse
+func (f *fsck) storedTree(hash string) bool {
+	if len(hash) < 2 {
+		return false
+	}
+	if _, err := os.Stat(f.r.treePath(hash)); err == nil {
+		return true
+	}
+	return hasPacked(f.r.packDir(), hash, PackTree)
+}
+
+// checkRefs validates HEAD, MERGE_HEAD, branches and tags and returns the
+// commits they name
+func (f *fsck) checkRefs() []string {
+	steriaDir := filepath.Join(f.r.Path, ".steria")
+	var roots []string
+	check := func(name, hash string) {
+		f.result.Refs++
+		switch {
+		case hash == "":
+			f.report(FsckBadRef, "ref", name, "", "empty")
+		case f.commits[hash] != nil:
+			roots = append(roots, hash)
+		case f.storedCommit(hash):
+			roots = append(roots, hash) // Reported as corrupt already
+		default:
+			f.report(FsckBadRef, "ref", name, "", "points at missing commit "+hash)
+		}
+	}
+	readRef := func(name, path string) {
+		if data, err := os.ReadFile(path); err == nil {
+			check(name, strings.TrimSpace(string(data)))
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "HEAD")); err == nil {
+		if head := strings.TrimSpace(string(data)); head != "" {
+			check("HEAD", head)
+		}
+	}
+	readRef("MERGE_HEAD", f.r.mergeHeadPath())
+
+	branchesDir := filepath.Join(steriaDir, "branches")
+	filepath.Walk(branchesDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !isRefScratchFile(path) {
+			rel, _ := filepath.Rel(branchesDir, path)
+			readRef("branches/"+filepath.ToSlash(rel), path)
+		}
+		return nil
+	})
+
+	remotesDir := filepath.Join(steriaDir, "refs", "remotes")
+	filepath.Walk(remotesDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !isRefScratchFile(path) {
+			rel, _ := filepath.Rel(remotesDir, path)
+			readRef("remotes/"+filepath.ToSlash(rel), path)
+		}
+		return nil
+	})
+
+	tagsDir := filepath.Join(steriaDir, "refs", "tags")
+	tags, _ := os.ReadDir(tagsDir)
+	for _, e := range tags {
+		name := "tags/" + e.Name()
+		data, err := os.ReadFile(filepath.Join(tagsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var tag struct {
+			Commit string `json:"commit"`
+		}
+		if err := json.Unmarshal(data, &tag); err != nil {
+			f.result.Refs++
+			f.report(FsckBadRef, "ref", name, "", "invalid tag JSON: "+err.Error())
+			continue
+		}
+		check(name, tag.Commit)
+	}
+
+	// Commits only a reflog or the operation log remembers are kept, not dangling
+	opCommits, _, _ := f.r.operationRoots()
+	for _, hash := range append(f.r.reflogCommits(), opCommits...) {
+		if f.commits[hash] != nil {
+			roots = append(roots, hash)
+		}
+	}
+
+	// Stashes and the staging index hold blobs outside any commit
+	for _, ref := range f.r.rootBlobs() {
+		f.checkBlobRef(ref, "stash or index")
+	}
+	return roots
+}
+
+// walk marks everything reachable from the refs, tolerating missing objects
+func (f *fsck) walk(roots []string) {
+	var markTree func(hash string)
+	markTree = func(hash string) {
+		if f.reach.Trees[hash] {
+			return
+		}
+		f.reach.Trees[hash] = true
+		if tree := f.trees[hash]; tree != nil {
+			for _, e := range tree.Entries {
+				if e.Type == TreeEntryTree {
+					markTree(e.Hash)
+				} else {
+					f.reach.markBlobRef(e.Hash)
+				}
+			}
+		}
+	}
+	stack := roots
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if f.reach.Commits[hash] {
+			continue
+		}
+		f.reach.Commits[hash] = true
+		commit := f.commits[hash]
+		if commit == nil {
+			continue
+		}
+		if commit.Tree != "" {
+			markTree(commit.Tree)
+		}
+		for _, ref := range commit.FileBlobs {
+			f.reach.markBlobRef(ref)
+		}
+		stack = append(stack, commit.Parents...)
+	}
+	_, opTrees, _ := f.r.operationRoots()
+	for _, hash := range opTrees {
+		if f.trees[hash] != nil {
+			markTree(hash)
+		}
+	}
+	for _, ref := range f.r.rootBlobs() {
+		f.reach.markBlobRef(ref)
+	}
+	for _, ref := range f.reach.chunkLists {
+		_, listHash, _ := parseChunkRef(ref)
+		if list := f.lists[listHash]; list != nil {
+			for _, c := range list.Chunks {
+				f.reach.Blobs[c.Hash] = true
+			}
+		}
+	}
+	queue := make([]string, 0, len(f.reach.Blobs))
+	for blob := range f.reach.Blobs {
+		queue = append(queue, blob)
+	}
+	for len(queue) > 0 {
+		blob := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if base := deltaBase(f.r.storedBlobHeader(blob)); base != "" && !f.reach.Blobs[base] {
+			f.reach.Blobs[base] = true
+			queue = append(queue, base)
+		}
+	}
+}
+
+// reportDangling lists stored objects that no ref reaches
+func (f *fsck) reportDangling() {
+	for hash := range f.commits {
+		if !f.reach.Commits[hash] {
+			f.report(FsckDangling, "commit", hash, "", "")
+		}
+	}
+	for hash := range f.trees {
+		if !f.reach.Trees[hash] {
+			f.report(FsckDangling, "tree", hash, "", "")
+		}
+	}
+	for hash := range f.blobs {
+		if !f.reach.Blobs[hash] {
+			f.report(FsckDangling, "blob", hash, "", "")
+		}
+	}
+}
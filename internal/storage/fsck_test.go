@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// findProblem returns the first problem of the given kind for name
+func findProblem(result *FsckResult, kind, name string) *FsckProblem {
+	for i, p := range result.Problems {
+		if p.Kind == kind && p.Name == name {
+			return &result.Problems[i]
+		}
+	}
+	return nil
+}
+
+func TestFsckReportsMissingCorruptAndDanglingObjects(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bravo"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatalf("LoadOrInitRepo failed: %v", err)
+	}
+
+	clean, err := repo.Fsck()
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if clean.Errors() != 0 || clean.Commits == 0 || clean.Blobs == 0 {
+		t.Fatalf("Expected a fresh repository to be consistent, got %+v", clean)
+	}
+
+	head, err := repo.LoadCommit(repo.Head)
+	if err != nil {
+		t.Fatalf("LoadCommit failed: %v", err)
+	}
+	files, err := repo.CommitFiles(head)
+	if err != nil {
+		t.Fatalf("CommitFiles failed: %v", err)
+	}
+	blobDir := filepath.Join(dir, ".steria", "objects", "blobs")
+	corrupted := BlobContentHash(files["a.txt"])
+	missing := BlobContentHash(files["b.txt"])
+	junk, _ := compressBytes([]byte("not alpha"))
+	os.WriteFile(filepath.Join(blobDir, corrupted+".gz"), junk, 0644)
+	os.Remove(filepath.Join(blobDir, missing+".gz"))
+
+	os.WriteFile(filepath.Join(dir, ".steria", "branches", "broken"), []byte(strings.Repeat("f", 64)), 0644)
+	stray, _ := compressBytes([]byte("nobody refers to me"))
+	sum := sha256.Sum256([]byte("nobody refers to me"))
+	strayHash := hex.EncodeToString(sum[:])
+	os.WriteFile(filepath.Join(blobDir, strayHash+".gz"), stray, 0644)
+
+	result, err := repo.Fsck()
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if findProblem(result, FsckCorrupt, corrupted) == nil {
+		t.Errorf("Expected blob %s to be reported corrupt, got %+v", corrupted, result.Problems)
+	}
+	if p := findProblem(result, FsckMissing, missing); p == nil || p.From == "" {
+		t.Errorf("Expected blob %s to be reported missing with its referrer, got %+v", missing, result.Problems)
+	}
+	if findProblem(result, FsckBadRef, "branches/broken") == nil {
+		t.Errorf("Expected the broken branch to be reported, got %+v", result.Problems)
+	}
+	if findProblem(result, FsckDangling, strayHash) == nil {
+		t.Errorf("Expected the stray blob to be reported dangling, got %+v", result.Problems)
+	}
+	if result.Errors() != 3 {
+		t.Errorf("Expected 3 errors, got %d: %+v", result.Errors(), result.Problems)
+	}
+
+	// A commit whose content no longer matches its name is corrupt
+	commitPath := filepath.Join(dir, ".steria", "objects", repo.Head[:2], repo.Head[2:])
+	data, _ := os.ReadFile(commitPath)
+	os.WriteFile(commitPath, []byte(strings.Replace(string(data), head.Message, "Rewritten", 1)), 0644)
+	result, err = repo.Fsck()
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if findProblem(result, FsckCorrupt, repo.Head) == nil {
+		t.Errorf("Expected the rewritten commit to be reported corrupt, got %+v", result.Problems)
+	}
+}
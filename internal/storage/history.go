@@ -0,0 +1,291 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: history.go
+// Description: Commit DAG traversal for Steria. Walks history across merge commits in topological order, finds merge bases and tracks merges that are waiting on conflict resolution.
+
+package storage
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnmarshalJSON loads a commit, upgrading the single "parent" field written by
+// older versions of Steria into Parents
+func (c *Commit) UnmarshalJSON(data []byte) error {
+	type commitAlias Commit
+	aux := struct {
+		*commitAlias
+		Parent string `json:"parent"`
+	}{commitAlias: (*commitAlias)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(c.Parents) == 0 && aux.Parent != "" {
+		c.Parents = []string{aux.Parent}
+	}
+	return nil
+}
+
+// FirstParent returns the parent on the branch the commit was made on, or ""
+// for a root commit
+func (c *Commit) FirstParent() string {
+	if len(c.Parents) == 0 {
+		return ""
+	}
+	return c.Parents[0]
+}
+
+// IsMerge reports whether the commit joins two or more lines of history
+func (c *Commit) IsMerge() bool {
+	return len(c.Parents) > 1
+}
+
+// newerCommit orders commits by timestamp, newest first, breaking ties by hash
+// so the order is stable
+func newerCommit(a, b *Commit) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.Hash > b.Hash
+	}
+	return a.Timestamp.After(b.Timestamp)
+}
+
+// commitQueue orders commits that are ready to be emitted, newest first
+type commitQueue []*Commit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return newerCommit(q[i], q[j]) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// WalkHistory returns every commit reachable from the given tips in
+// topological order: a commit is always listed before all of its parents, and
+// among commits that are ready at the same time the newest comes first.
+func (r *Repo) WalkHistory(tips ...string) ([]*Commit, error) {
+	commits := map[string]*Commit{}
+	children := map[string]int{}
+	stack := append([]string(nil), tips...)
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash == "" || commits[hash] != nil {
+			continue
+		}
+		commit, err := r.LoadCommit(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		if commit.Hash == "" {
+			commit.Hash = hash
+		}
+		commits[hash] = commit
+		for _, parent := range commit.Parents {
+			children[parent]++
+			stack = append(stack, parent)
+		}
+	}
+
+	ready := &commitQueue{}
+	for hash, commit := range commits {
+		if children[hash] == 0 {
+			heap.Push(ready, commit)
+		}
+	}
+	ordered := make([]*Commit, 0, len(commits))
+	for ready.Len() > 0 {
+		commit := heap.Pop(ready).(*Commit)
+		ordered = append(ordered, commit)
+		for _, parent := range commit.Parents {
+			children[parent]--
+			if children[parent] == 0 && commits[parent] != nil {
+				heap.Push(ready, commits[parent])
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// IsAncestor reports whether ancestor is reachable from descendant by
+// following parent links. A commit is considered its own ancestor.
+func (r *Repo) IsAncestor(ancestor, descendant string) (bool, error) {
+	if ancestor == "" || descendant == "" {
+		return false, nil
+	}
+	seen := map[string]bool{}
+	queue := []string{descendant}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if hash == ancestor {
+			return true, nil
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		commit, err := r.loadCommit(hash)
+		if err != nil {
+			return false, fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		queue = append(queue, commit.Parents...)
+	}
+	return false, nil
+}
+
+// ancestors returns every commit reachable from hash, including hash itself
+func (r *Repo) ancestors(hash string) (map[string]*Commit, error) {
+	found := map[string]*Commit{}
+	queue := []string{hash}
+	for len(queue) > 0 {
+		h := queue[0]
+		queue = queue[1:]
+		if h == "" || found[h] != nil {
+			continue
+		}
+		commit, err := r.loadCommit(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commit %s: %w", h, err)
+		}
+		if commit.Hash == "" {
+			commit.Hash = h
+		}
+		found[h] = commit
+		queue = append(queue, commit.Parents...)
+	}
+	return found, nil
+}
+
+// AheadBehind counts the commits reachable from local but not from upstream
+// (ahead) and from upstream but not from local (behind)
+func (r *Repo) AheadBehind(local, upstream string) (int, int, error) {
+	if local == upstream {
+		return 0, 0, nil
+	}
+	ancestorsLocal, err := r.ancestors(local)
+	if err != nil {
+		return 0, 0, err
+	}
+	ancestorsUpstream, err := r.ancestors(upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	ahead, behind := 0, 0
+	for hash := range ancestorsLocal {
+		if ancestorsUpstream[hash] == nil {
+			ahead++
+		}
+	}
+	for hash := range ancestorsUpstream {
+		if ancestorsLocal[hash] == nil {
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// MergeBase returns the lowest common ancestor of two commits: a shared
+// ancestor that is not itself an ancestor of another shared ancestor. When
+// criss-cross merges leave several candidates, the newest one is chosen.
+// Returns "" if the commits have no history in common.
+func (r *Repo) MergeBase(a, b string) (string, error) {
+	if a == "" || b == "" {
+		return "", nil
+	}
+	ancestorsA, err := r.ancestors(a)
+	if err != nil {
+		return "", err
+	}
+	ancestorsB, err := r.ancestors(b)
+	if err != nil {
+		return "", err
+	}
+	var common []*Commit
+	for hash, commit := range ancestorsA {
+		if ancestorsB[hash] != nil {
+			common = append(common, commit)
+		}
+	}
+
+	// Anything reachable from a common ancestor's parents is not the lowest
+	redundant := map[string]bool{}
+	var queue []string
+	for _, commit := range common {
+		queue = append(queue, commit.Parents...)
+	}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if redundant[hash] {
+			continue
+		}
+		redundant[hash] = true
+		if commit := ancestorsA[hash]; commit != nil {
+			queue = append(queue, commit.Parents...)
+		}
+	}
+
+	var best *Commit
+	for _, commit := range common {
+		if redundant[commit.Hash] {
+			continue
+		}
+		if best == nil || newerCommit(commit, best) {
+			best = commit
+		}
+	}
+	if best == nil {
+		return "", nil
+	}
+	return best.Hash, nil
+}
+
+// mergeHeadPath returns the file recording a merge that is waiting on conflict resolution
+func (r *Repo) mergeHeadPath() string {
+	return filepath.Join(r.Path, ".steria", "MERGE_HEAD")
+}
+
+// MergeHead returns the commit being merged into the current branch, or "" if
+// no merge is in progress
+func (r *Repo) MergeHead() string {
+	data, err := os.ReadFile(r.mergeHeadPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// commitParents returns the parents of the next commit: HEAD, plus the pending
+// merge head once every conflict from that merge has been resolved
+func (r *Repo) commitParents() ([]string, error) {
+	var parents []string
+	if r.Head != "" {
+		parents = append(parents, r.Head)
+	}
+	mergeHead := r.MergeHead()
+	if mergeHead == "" || mergeHead == r.Head {
+		return parents, nil
+	}
+	unresolved, err := ListUnresolvedConflicts(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load conflicts: %w", err)
+	}
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("cannot commit merge: %d unresolved conflict(s) remain", len(unresolved))
+	}
+	return append(parents, mergeHead), nil
+}
+
+// clearMergeHead marks the pending merge as recorded
+func (r *Repo) clearMergeHead() {
+	os.Remove(r.mergeHeadPath())
+}
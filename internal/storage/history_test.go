@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLegacyParentIsLoadedAsParents(t *testing.T) {
+	var c Commit
+	if err := c.UnmarshalJSON([]byte(`{"hash":"abc","message":"old","parent":"def"}`)); err != nil {
+		t.Fatalf("Failed to unmarshal legacy commit: %v", err)
+	}
+	if len(c.Parents) != 1 || c.Parents[0] != "def" {
+		t.Errorf("Expected legacy parent to become Parents[0], got %v", c.Parents)
+	}
+	if c.FirstParent() != "def" || c.IsMerge() {
+		t.Errorf("Unexpected parent helpers for legacy commit: first=%q merge=%v", c.FirstParent(), c.IsMerge())
+	}
+}
+
+func TestMergeBranchesCreatesMergeCommit(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	base := repo.Head
+
+	// Feature branch adds its own file
+	os.WriteFile(dir+"/feature.txt", []byte("feature"), 0644)
+	feature, err := repo.CreateCommit("feature work", "author")
+	if err != nil {
+		t.Fatalf("Failed to create feature commit: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, ".steria", "branches", "feature"), []byte(feature.Hash), 0644)
+
+	// Current branch diverges from the same base
+	repo.UpdateRef("HEAD", base, "test")
+	os.Remove(dir + "/feature.txt")
+	os.WriteFile(dir+"/main.txt", []byte("main"), 0644)
+	mainCommit, err := repo.CreateCommit("main work", "author")
+	if err != nil {
+		t.Fatalf("Failed to create main commit: %v", err)
+	}
+
+	result, err := repo.MergeBranches("feature", "author")
+	if err != nil {
+		t.Fatalf("MergeBranches failed: %v", err)
+	}
+	if len(result.Conflicts) != 0 {
+		t.Fatalf("Expected clean merge, got conflicts: %v", result.Conflicts)
+	}
+	merge, err := repo.LoadCommit(repo.Head)
+	if err != nil {
+		t.Fatalf("Failed to load merge commit: %v", err)
+	}
+	if !merge.IsMerge() || merge.Parents[0] != mainCommit.Hash || merge.Parents[1] != feature.Hash {
+		t.Errorf("Expected merge commit with parents [%s %s], got %v", mainCommit.Hash, feature.Hash, merge.Parents)
+	}
+	if repo.MergeHead() != "" {
+		t.Errorf("Expected MERGE_HEAD to be cleared after a clean merge")
+	}
+
+	history, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		t.Fatalf("WalkHistory failed: %v", err)
+	}
+	pos := map[string]int{}
+	for i, c := range history {
+		pos[c.Hash] = i
+	}
+	if history[0].Hash != merge.Hash {
+		t.Errorf("Expected merge commit first in history")
+	}
+	if pos[base] < pos[mainCommit.Hash] || pos[base] < pos[feature.Hash] {
+		t.Errorf("Expected merge base after both merged lines in topological order")
+	}
+	if ok, _ := repo.IsAncestor(feature.Hash, repo.Head); !ok {
+		t.Errorf("Expected merged-in commit to be an ancestor of the merge")
+	}
+}
@@ -0,0 +1,323 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: index.go
+// Description: Staging index for Steria. Records the path -> blob snapshot that the next 'steria commit' will record, so a subset of working directory changes can be committed.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IndexEntry is a staged file together with the stat data it was staged from
+type IndexEntry struct {
+	Hash    string    `json:"hash"` // Blob ref of the staged content
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+	Mode    uint32    `json:"mode,omitempty"`
+}
+
+// Index is the staged snapshot for the next commit. Base is the commit the
+// index was built on; when HEAD moves without going through the index (done,
+// merge, branch switches) the index is rebuilt from the new HEAD.
+type Index struct {
+	Base    string                `json:"base"`
+	Entries map[string]IndexEntry `json:"entries"`
+}
+
+// indexPath returns the location of the staging index
+func (r *Repo) indexPath() string {
+	return filepath.Join(r.Path, ".steria", "index.json")
+}
+
+// LoadIndex loads the staging index, seeding it from HEAD when it does not
+// exist yet or was built on a different commit
+func (r *Repo) LoadIndex() (*Index, error) {
+	data, err := os.ReadFile(r.indexPath())
+	if err == nil {
+		var idx Index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("failed to parse index: %w", err)
+		}
+		if idx.Base == r.Head {
+			if idx.Entries == nil {
+				idx.Entries = make(map[string]IndexEntry)
+			}
+			return &idx, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	idx := &Index{Base: r.Head, Entries: make(map[string]IndexEntry)}
+	head, err := r.headFiles()
+	if err != nil {
+		return nil, err
+	}
+	for file, blob := range head {
+		idx.Entries[file] = IndexEntry{Hash: blob}
+	}
+	return idx, nil
+}
+
+// SaveIndex writes the staging index
+func (r *Repo) SaveIndex(idx *Index) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if err := atomicWrite(r.indexPath(), data); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// Snapshot returns the staged path -> blob map
+func (idx *Index) Snapshot() map[string]string {
+	files := make(map[string]string, len(idx.Entries))
+	for file, entry := range idx.Entries {
+		files[file] = entry.Hash
+	}
+	return files
+}
+
+// headFiles returns the snapshot of the HEAD commit, or an empty one before the first commit
+func (r *Repo) headFiles() (map[string]string, error) {
+	if r.Head == "" {
+		return map[string]string{}, nil
+	}
+	commit, err := r.LoadCommit(r.Head)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load HEAD commit: %w", err)
+	}
+	return commit.FileBlobs, nil
+}
+
+// pathWithin reports whether file is dir itself or lies inside it
+func pathWithin(file, dir string) bool {
+	return dir == "." || file == dir || strings.HasPrefix(file, dir+string(filepath.Separator))
+}
+
+// Stage records the current working directory contents of the given paths in
+// the index. Paths are relative to the repository root and may name files or
+// directories; tracked files that no longer exist are staged as deletions.
+func (r *Repo) Stage(paths ...string) ([]FileChange, error) {
+	idx, err := r.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+	internal := filepath.Join(r.Path, ".steria")
+	var changes []FileChange
+	for _, p := range paths {
+		rel := filepath.Clean(p)
+		if pathWithin(rel, ".steria") {
+			return nil, fmt.Errorf("cannot stage Steria internal path '%s'", p)
+		}
+		full := filepath.Join(r.Path, rel)
+		info, statErr := os.Stat(full)
+		if statErr != nil && !os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("failed to stat %s: %w", p, statErr)
+		}
+
+		matched := false
+		for file := range idx.Entries {
+			if !pathWithin(file, rel) {
+				continue
+			}
+			matched = true
+			if _, err := os.Stat(filepath.Join(r.Path, file)); os.IsNotExist(err) {
+				delete(idx.Entries, file)
+				changes = append(changes, FileChange{Path: file, Type: ChangeTypeDeleted})
+			}
+		}
+		if statErr != nil {
+			if !matched {
+				return nil, fmt.Errorf("path '%s' did not match any files", p)
+			}
+			continue
+		}
+
+		files := []string{full}
+		if info.IsDir() {
+			files = getAllFiles(full)
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file, internal) {
+				continue
+			}
+			fileRel, err := filepath.Rel(r.Path, file)
+			if err != nil {
+				return nil, err
+			}
+			change, err := r.stageFile(idx, fileRel)
+			if err != nil {
+				return nil, err
+			}
+			if change != nil {
+				changes = append(changes, *change)
+			}
+		}
+	}
+	if err := r.SaveIndex(idx); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// stageFile stores one file in the blob store and updates its index entry.
+// Returns nil if the staged content did not change.
+func (r *Repo) stageFile(idx *Index, rel string) (*FileChange, error) {
+	full := filepath.Join(r.Path, rel)
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", rel, err)
+	}
+	hash, err := r.calculateFileHash(full)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file %s: %w", rel, err)
+	}
+	old, tracked := idx.Entries[rel]
+	entry := IndexEntry{Hash: old.Hash, Size: info.Size(), ModTime: info.ModTime(), Mode: uint32(info.Mode().Perm())}
+	if tracked && BlobContentHash(old.Hash) == hash {
+		idx.Entries[rel] = entry // Same content; keep its blob ref
+		return nil, nil
+	}
+	if entry.Hash, _, err = r.storeContent(r.Context(), r.BlobStore, hash, rel, old.Hash, nil); err != nil {
+		return nil, fmt.Errorf("failed to write compressed blob for %s: %w", rel, err)
+	}
+	idx.Entries[rel] = entry
+	changeType := ChangeTypeModified
+	if !tracked {
+		changeType = ChangeTypeAdded
+	}
+	return &FileChange{Path: rel, Type: changeType, Hash: entry.Hash}, nil
+}
+
+// Unstage resets the index entries for the given paths back to their HEAD
+// versions, leaving the working directory untouched. Returns the paths that changed.
+func (r *Repo) Unstage(paths ...string) ([]string, error) {
+	idx, err := r.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.headFiles()
+	if err != nil {
+		return nil, err
+	}
+	var reset []string
+	for _, p := range paths {
+		rel := filepath.Clean(p)
+		candidates := map[string]bool{}
+		for file := range idx.Entries {
+			if pathWithin(file, rel) {
+				candidates[file] = true
+			}
+		}
+		for file := range head {
+			if pathWithin(file, rel) {
+				candidates[file] = true
+			}
+		}
+		for file := range candidates {
+			entry, staged := idx.Entries[file]
+			blob, inHead := head[file]
+			switch {
+			case inHead && (!staged || entry.Hash != blob):
+				idx.Entries[file] = IndexEntry{Hash: blob}
+			case !inHead && staged:
+				delete(idx.Entries, file)
+			default:
+				continue
+			}
+			reset = append(reset, file)
+		}
+	}
+	if err := r.SaveIndex(idx); err != nil {
+		return nil, err
+	}
+	sort.Strings(reset)
+	return reset, nil
+}
+
+// StagedChanges returns the differences between HEAD and the index
+func (r *Repo) StagedChanges() ([]FileChange, error) {
+	idx, err := r.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.headFiles()
+	if err != nil {
+		return nil, err
+	}
+	var changes []FileChange
+	for file, entry := range idx.Entries {
+		blob, ok := head[file]
+		switch {
+		case !ok:
+			changes = append(changes, FileChange{Path: file, Type: ChangeTypeAdded, Hash: entry.Hash})
+		case blob != entry.Hash:
+			changes = append(changes, FileChange{Path: file, Type: ChangeTypeModified, Hash: entry.Hash})
+		}
+	}
+	for file := range head {
+		if _, ok := idx.Entries[file]; !ok {
+			changes = append(changes, FileChange{Path: file, Type: ChangeTypeDeleted})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// CommitIndex creates a commit from exactly the staged snapshot, leaving
+// unstaged working directory changes out of it
+func (r *Repo) CommitIndex(message, author string) (*Commit, error) {
+	idx, err := r.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := r.commitSnapshot(message, author, idx.Snapshot())
+	if err != nil {
+		return nil, err
+	}
+	idx.Base = commit.Hash
+	if err := r.SaveIndex(idx); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+// commitSnapshot creates a commit of exactly the given path -> blob ref
+// snapshot, whatever the working directory holds, with HEAD and any pending
+// merge as its parents
+func (r *Repo) commitSnapshot(message, author string, snapshot map[string]string) (*Commit, error) {
+	parents, err := r.commitParents()
+	if err != nil {
+		return nil, err
+	}
+	commit := &Commit{
+		Message:   message,
+		Author:    author,
+		Timestamp: time.Now(),
+		Parents:   parents,
+		FileBlobs: snapshot,
+	}
+	for file := range commit.FileBlobs {
+		commit.Files = append(commit.Files, file)
+	}
+	sort.Strings(commit.Files)
+
+	if err := r.writeCommit(commit); err != nil {
+		return nil, err
+	}
+
+	go r.autoSyncToRemotes()
+
+	return commit, nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCommitIndexCommitsOnlyStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	head := repo.Head
+
+	os.WriteFile(dir+"/file.txt", []byte("changed"), 0644)
+	os.WriteFile(dir+"/staged.txt", []byte("new"), 0644)
+	os.WriteFile(dir+"/unstaged.txt", []byte("wip"), 0644)
+	changes, err := repo.Stage("file.txt", "staged.txt")
+	if err != nil {
+		t.Fatalf("Stage failed: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 staged changes, got %+v", changes)
+	}
+
+	c, err := repo.CommitIndex("partial", "author")
+	if err != nil {
+		t.Fatalf("CommitIndex failed: %v", err)
+	}
+	if c.FirstParent() != head {
+		t.Errorf("Expected index commit to follow HEAD")
+	}
+	loaded, _ := repo.LoadCommit(c.Hash)
+	if _, ok := loaded.FileBlobs["unstaged.txt"]; ok {
+		t.Errorf("Unstaged file must not be committed")
+	}
+	if loaded.FileBlobs["staged.txt"] == "" || loaded.FileBlobs["file.txt"] == "" {
+		t.Errorf("Expected staged files in commit, got %v", loaded.FileBlobs)
+	}
+	if staged, _ := repo.StagedChanges(); len(staged) != 0 {
+		t.Errorf("Expected clean index after commit, got %+v", staged)
+	}
+}
+
+func TestStageDeletionAndUnstage(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	os.WriteFile(dir+"/gone.txt", []byte("bye"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+
+	os.Remove(dir + "/gone.txt")
+	os.WriteFile(dir+"/file.txt", []byte("changed"), 0644)
+	if _, err := repo.Stage("."); err != nil {
+		t.Fatalf("Stage failed: %v", err)
+	}
+	staged, _ := repo.StagedChanges()
+	if len(staged) != 2 || staged[1].Path != "gone.txt" || staged[1].Type != ChangeTypeDeleted {
+		t.Fatalf("Expected modification and deletion to be staged, got %+v", staged)
+	}
+
+	reset, err := repo.Unstage("gone.txt")
+	if err != nil || len(reset) != 1 {
+		t.Fatalf("Unstage failed: %v %v", reset, err)
+	}
+	staged, _ = repo.StagedChanges()
+	if len(staged) != 1 || staged[0].Path != "file.txt" {
+		t.Errorf("Expected only file.txt to remain staged, got %+v", staged)
+	}
+	if _, err := repo.Stage("missing.txt"); err == nil {
+		t.Errorf("Expected error staging a path that matches nothing")
+	}
+}
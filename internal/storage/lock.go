@@ -0,0 +1,269 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: lock.go
+// Description: Repository-wide operation lock for Steria. Commands that change the working directory or .steria take .steria/lock exclusively, read-only commands and the background indexer register as readers under .steria/readers, and locks left behind by crashed processes are detected from the holder's PID, host and start time.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// LockMode selects how a command holds the repository lock
+type LockMode int
+
+const (
+	LockShared    LockMode = iota // Any number of readers; no writer
+	LockExclusive                 // One writer; no readers
+)
+
+func (m LockMode) String() string {
+	if m == LockExclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+// ErrRepoLocked is returned when another steria process holds the repository lock
+var ErrRepoLocked = errors.New("another steria process is running")
+
+// StaleLockAge is how old a lock held from another host must be before it is
+// considered abandoned. Locks from this host are stale as soon as their
+// process has exited.
+var StaleLockAge = 2 * time.Hour
+
+// readerWait is how long a writer waits for running readers to finish
+var readerWait = 5 * time.Second
+
+// LockInfo describes the holder of a lock
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Command string    `json:"command"`
+	Mode    string    `json:"mode"`
+}
+
+// LockedError reports who holds the lock a command could not take
+type LockedError struct {
+	Holder LockInfo
+	Path   string
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v: '%s' (pid %d on %s, %s lock taken %s ago); if that process is no longer running, remove %s",
+		ErrRepoLocked, e.Holder.Command, e.Holder.PID, e.Holder.Host, e.Holder.Mode,
+		time.Since(e.Holder.Started).Round(time.Second), e.Path)
+}
+
+func (e *LockedError) Unwrap() error { return ErrRepoLocked }
+
+// RepoLock is a held repository lock
+type RepoLock struct {
+	path  string // .steria/lock, or this reader's file under .steria/readers
+	token []byte // What this process wrote, so Release never removes another's lock
+}
+
+// lockSeq makes reader file names unique within a process
+var lockSeq atomic.Int64
+
+// repoLockPath returns the exclusive lock file of the repository at path
+func repoLockPath(path string) string {
+	return filepath.Join(path, ".steria", "lock")
+}
+
+// repoReadersDir returns the directory shared lock holders register in
+func repoReadersDir(path string) string {
+	return filepath.Join(path, ".steria", "readers")
+}
+
+// LockRepo takes the repository lock of the repository at path. An
+// exclusive lock fails at once if another process holds the lock and waits
+// briefly for running readers to finish; a shared lock fails if a writer
+// holds it. command names the operation in errors other processes report.
+func LockRepo(path string, mode LockMode, command string) (*RepoLock, error) {
+	host, _ := os.Hostname()
+	info := LockInfo{PID: os.Getpid(), Host: host, Started: time.Now().UTC(), Command: command, Mode: mode.String()}
+	token, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if mode == LockExclusive {
+		return lockExclusive(path, token)
+	}
+	return lockShared(path, token)
+}
+
+func lockExclusive(path string, token []byte) (*RepoLock, error) {
+	lockPath := repoLockPath(path)
+	// Write the lock next to its final name and link it into place, so the
+	// lock file appears complete or not at all
+	tmp := fmt.Sprintf("%s.%d.%d.tmp", lockPath, os.Getpid(), lockSeq.Add(1))
+	if err := os.WriteFile(tmp, token, 0644); err != nil {
+		return nil, fmt.Errorf("failed to create lock: %w", err)
+	}
+	defer os.Remove(tmp)
+	for {
+		err := os.Link(tmp, lockPath)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock: %w", err)
+		}
+		holder, ok := readLockInfo(lockPath)
+		if !ok || !holder.stale() {
+			return nil, &LockedError{Holder: holder, Path: lockPath}
+		}
+		if err := breakStaleLock(lockPath); err != nil {
+			return nil, &LockedError{Holder: holder, Path: lockPath}
+		}
+	}
+	lock := &RepoLock{path: lockPath, token: token}
+
+	// Readers that registered before the lock existed must finish first
+	deadline := time.Now().Add(readerWait)
+	for {
+		reader, busy := liveReader(path)
+		if !busy {
+			return lock, nil
+		}
+		if time.Now().After(deadline) {
+			lock.Release()
+			return nil, &LockedError{Holder: reader, Path: repoReadersDir(path)}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func lockShared(path string, token []byte) (*RepoLock, error) {
+	lockPath := repoLockPath(path)
+	if holder, ok := readLockInfo(lockPath); ok && !holder.stale() && !holder.ours() {
+		return nil, &LockedError{Holder: holder, Path: lockPath}
+	}
+	dir := repoReadersDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock: %w", err)
+	}
+	host, _ := os.Hostname()
+	readerPath := filepath.Join(dir, fmt.Sprintf("%s-%d-%d", host, os.Getpid(), lockSeq.Add(1)))
+	if err := atomicWrite(readerPath, token); err != nil {
+		return nil, fmt.Errorf("failed to create lock: %w", err)
+	}
+	lock := &RepoLock{path: readerPath, token: token}
+
+	// A writer that locked while this reader registered did not see it
+	if holder, ok := readLockInfo(lockPath); ok && !holder.stale() && !holder.ours() {
+		lock.Release()
+		return nil, &LockedError{Holder: holder, Path: lockPath}
+	}
+	return lock, nil
+}
+
+// Release gives the lock up. Releasing a lock another process has since
+// taken over is a no-op.
+func (l *RepoLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil || string(data) != string(l.token) {
+		return nil
+	}
+	return os.Remove(l.path)
+}
+
+// readLockInfo reads a lock file. A lock that exists but cannot be parsed is
+// reported as held by an unknown process until it is old enough to be stale.
+func readLockInfo(path string) (LockInfo, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LockInfo{}, false
+	}
+	var info LockInfo
+	if json.Unmarshal(data, &info) != nil || info.PID == 0 {
+		info = LockInfo{Command: "unknown", Mode: "unknown"}
+		if st, err := os.Stat(path); err == nil {
+			info.Started = st.ModTime()
+		}
+	}
+	return info, true
+}
+
+// stale reports whether the process holding a lock is gone
+func (i LockInfo) stale() bool {
+	host, _ := os.Hostname()
+	if i.PID != 0 && i.Host == host {
+		return !processAlive(i.PID)
+	}
+	return time.Since(i.Started) > StaleLockAge
+}
+
+// ours reports whether a lock is held by this process, whose own readers
+// (such as a search's index rebuild) never wait for it
+func (i LockInfo) ours() bool {
+	host, _ := os.Hostname()
+	return i.PID == os.Getpid() && i.Host == host
+}
+
+// processAlive reports whether a process with the given PID exists on this host
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// breakStaleLock removes a stale lock. The lock is first moved aside and
+// checked again, so a fresh lock another process took in the meantime is put
+// back instead of being deleted.
+func breakStaleLock(lockPath string) error {
+	aside := lockPath + ".stale-" + strconv.Itoa(os.Getpid())
+	if err := os.Rename(lockPath, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil // Someone else broke it first
+		}
+		return err
+	}
+	if holder, ok := readLockInfo(aside); ok && !holder.stale() {
+		os.Link(aside, lockPath)
+		os.Remove(aside)
+		return ErrRepoLocked
+	}
+	return os.Remove(aside)
+}
+
+// liveReader returns a reader that still holds the shared lock, removing the
+// registrations of readers that have exited
+func liveReader(path string) (LockInfo, bool) {
+	dir := repoReadersDir(path)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if isRefScratchFile(e.Name()) {
+			continue
+		}
+		readerPath := filepath.Join(dir, e.Name())
+		info, ok := readLockInfo(readerPath)
+		if !ok {
+			continue
+		}
+		if info.stale() {
+			os.Remove(readerPath)
+			continue
+		}
+		if !info.ours() {
+			return info, true
+		}
+	}
+	return LockInfo{}, false
+}
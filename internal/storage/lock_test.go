@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeForeignLock writes a lock file as another process would
+func writeForeignLock(t *testing.T, path string, info LockInfo) {
+	data, _ := json.Marshal(info)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepoLockExclusionAndStaleLocks(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".steria"), 0755)
+	host, _ := os.Hostname()
+	lockPath := repoLockPath(dir)
+	defer func(d time.Duration) { readerWait = d }(readerWait)
+	readerWait = 50 * time.Millisecond
+
+	// A live writer in another process keeps out writers and readers
+	writeForeignLock(t, lockPath, LockInfo{PID: os.Getppid(), Host: host, Started: time.Now(), Command: "steria done", Mode: "exclusive"})
+	for _, mode := range []LockMode{LockExclusive, LockShared} {
+		_, err := LockRepo(dir, mode, "test")
+		var locked *LockedError
+		if !errors.As(err, &locked) || !errors.Is(err, ErrRepoLocked) || locked.Holder.Command != "steria done" {
+			t.Fatalf("Expected a %s lock to report the running writer, got %v", mode, err)
+		}
+	}
+
+	// A lock whose process has exited is broken
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skip("cannot start a process to get a dead PID")
+	}
+	writeForeignLock(t, lockPath, LockInfo{PID: exited.Process.Pid, Host: host, Started: time.Now(), Command: "steria merge", Mode: "exclusive"})
+	lock, err := LockRepo(dir, LockExclusive, "test")
+	if err != nil {
+		t.Fatalf("Expected a dead process's lock to be broken, got %v", err)
+	}
+
+	// Readers wait for the writer; the writer's own process may still read
+	if _, err := LockRepo(dir, LockShared, "test"); err != nil {
+		t.Errorf("Expected this process to read under its own lock, got %v", err)
+	}
+	lock.Release()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("Expected Release to remove the lock")
+	}
+
+	// A reader in another process holds off writers until it finishes
+	readerPath := filepath.Join(repoReadersDir(dir), "other")
+	writeForeignLock(t, readerPath, LockInfo{PID: os.Getppid(), Host: host, Started: time.Now(), Command: "steria status", Mode: "shared"})
+	if _, err := LockRepo(dir, LockExclusive, "test"); !errors.Is(err, ErrRepoLocked) {
+		t.Errorf("Expected a running reader to block a writer, got %v", err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("Expected a writer that gave up to remove its lock")
+	}
+	shared, err := LockRepo(dir, LockShared, "test")
+	if err != nil {
+		t.Fatalf("Expected readers to share the lock, got %v", err)
+	}
+	shared.Release()
+
+	// Locks from other hosts are only stale once they are old
+	os.Remove(readerPath)
+	writeForeignLock(t, lockPath, LockInfo{PID: 1, Host: "elsewhere", Started: time.Now(), Command: "steria sync", Mode: "exclusive"})
+	if _, err := LockRepo(dir, LockExclusive, "test"); !errors.Is(err, ErrRepoLocked) {
+		t.Errorf("Expected a recent lock from another host to be honoured, got %v", err)
+	}
+	writeForeignLock(t, lockPath, LockInfo{PID: 1, Host: "elsewhere", Started: time.Now().Add(-2 * StaleLockAge), Command: "steria sync", Mode: "exclusive"})
+	lock, err = LockRepo(dir, LockExclusive, "test")
+	if err != nil {
+		t.Fatalf("Expected an old lock from another host to be broken, got %v", err)
+	}
+
+	// Releasing never removes a lock another process has taken over
+	writeForeignLock(t, lockPath, LockInfo{PID: os.Getppid(), Host: host, Started: time.Now(), Command: "steria gc", Mode: "exclusive"})
+	lock.Release()
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Error("Expected Release to leave another process's lock alone")
+	}
+}
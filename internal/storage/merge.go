@@ -0,0 +1,226 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: merge.go
+// Description: Three-way merge engine for Steria. Merges file contents diff3-style against the merge base so only regions changed on both sides conflict.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// ErrLocalChanges is returned when checking out a snapshot would overwrite or
+// delete working directory files that differ from the snapshot being left
+var ErrLocalChanges = errors.New("local changes would be overwritten")
+
+// MergeResult describes the outcome of merging a branch into the current branch
+type MergeResult struct {
+	Base        string   // Merge base of the two heads, "" if they share no history
+	Commit      string   // HEAD after the merge; empty while conflicts are pending
+	FastForward bool     // The current branch was moved forward without a merge commit
+	UpToDate    bool     // The target branch was already contained in the current branch
+	Conflicts   []string // Files left with conflict markers
+}
+
+// lineRune maps the n-th distinct line to a rune, skipping the surrogate range
+// so every line stays a single valid rune
+func lineRune(n int) rune {
+	r := rune(n + 1)
+	if r >= 0xD800 {
+		r += 0x800
+	}
+	return r
+}
+
+// matchLines aligns b against a and returns, for every line of a, the index of
+// the matching line in b or -1 if the line was removed or changed
+func matchLines(a, b []string) []int {
+	ids := map[string]rune{}
+	toRunes := func(lines []string) []rune {
+		runes := make([]rune, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = lineRune(len(ids))
+				ids[line] = id
+			}
+			runes[i] = id
+		}
+		return runes
+	}
+	runesA, runesB := toRunes(a), toRunes(b)
+
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = 0
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+	i, j := 0, 0
+	for _, d := range dmp.DiffMainRunes(runesA, runesB, false) {
+		n := utf8.RuneCountInString(d.Text)
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			for k := 0; k < n; k++ {
+				match[i+k] = j + k
+			}
+			i += n
+			j += n
+		case diffmatchpatch.DiffDelete:
+			i += n
+		case diffmatchpatch.DiffInsert:
+			j += n
+		}
+	}
+	return match
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// merge3Lines performs a diff3-style merge. Base lines left untouched by both
+// sides split the files into chunks; a chunk changed on only one side takes that
+// side's version, and a chunk changed differently on both sides becomes a
+// conflict. Returns the merged lines and the 1-based line of each conflict marker.
+func merge3Lines(base, ours, theirs []string, oursLabel, theirsLabel string) ([]string, []int) {
+	matchOurs := matchLines(base, ours)
+	matchTheirs := matchLines(base, theirs)
+
+	var merged []string
+	var conflicts []int
+	i, j, k := 0, 0, 0
+	flush := func(baseEnd, oursEnd, theirsEnd int) {
+		b, o, t := base[i:baseEnd], ours[j:oursEnd], theirs[k:theirsEnd]
+		switch {
+		case equalLines(o, t):
+			merged = append(merged, o...)
+		case equalLines(b, o):
+			merged = append(merged, t...)
+		case equalLines(b, t):
+			merged = append(merged, o...)
+		default:
+			conflicts = append(conflicts, len(merged)+1)
+			merged = append(merged, "<<<<<<< "+oursLabel)
+			merged = append(merged, o...)
+			merged = append(merged, "||||||| base")
+			merged = append(merged, b...)
+			merged = append(merged, "=======")
+			merged = append(merged, t...)
+			merged = append(merged, ">>>>>>> "+theirsLabel)
+		}
+	}
+	for x := range base {
+		if matchOurs[x] < 0 || matchTheirs[x] < 0 {
+			continue
+		}
+		// Line x is unchanged on both sides and anchors the chunk before it
+		flush(x, matchOurs[x], matchTheirs[x])
+		merged = append(merged, base[x])
+		i, j, k = x+1, matchOurs[x]+1, matchTheirs[x]+1
+	}
+	flush(len(base), len(ours), len(theirs))
+	return merged, conflicts
+}
+
+// restoreFile writes the contents of a blob to a path in the working directory
+func (r *Repo) restoreFile(file, blobRef string) error {
+	return WriteBlobToFile(r.Context(), r.BlobStore, blobRef, filepath.Join(r.Path, file))
+}
+
+// checkoutSnapshot moves the working directory from one commit snapshot to
+// another, touching only files whose blob differs. Nothing is touched if any
+// of those files has local changes.
+func (r *Repo) checkoutSnapshot(from, to map[string]string) error {
+	if err := r.checkClean(from, to); err != nil {
+		return fmt.Errorf("%w; commit or stash them first", err)
+	}
+	for file := range from {
+		if _, ok := to[file]; !ok {
+			os.Remove(filepath.Join(r.Path, file))
+		}
+	}
+	for file, blob := range to {
+		if from[file] == blob {
+			continue
+		}
+		if err := r.restoreFile(file, blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkClean fails with ErrLocalChanges, naming the files, if a checkout
+// from one snapshot to another would lose local changes
+func (r *Repo) checkClean(from, to map[string]string) error {
+	dirty, err := r.dirtyFiles(from, to)
+	if err != nil {
+		return err
+	}
+	if len(dirty) > 0 {
+		return fmt.Errorf("%w: %s", ErrLocalChanges, strings.Join(dirty, ", "))
+	}
+	return nil
+}
+
+// dirtyFiles returns the files a checkout from one snapshot to another would
+// change whose working copy matches neither: edited or untracked files that
+// would be overwritten, or edited files that would be deleted. Files missing
+// from disk lose nothing.
+func (r *Repo) dirtyFiles(from, to map[string]string) ([]string, error) {
+	var paths []string
+	for file, blob := range from {
+		if to[file] != blob {
+			paths = append(paths, filepath.Join(r.Path, file))
+		}
+	}
+	for file := range to {
+		if _, ok := from[file]; !ok {
+			paths = append(paths, filepath.Join(r.Path, file))
+		}
+	}
+	present := paths[:0]
+	for _, full := range paths {
+		if info, err := os.Stat(full); err == nil && info.Mode().IsRegular() {
+			present = append(present, full)
+		}
+	}
+	if len(present) == 0 {
+		return nil, nil
+	}
+	hashes, err := NewFileProcessor().ProcessFiles(present)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check working directory: %w", err)
+	}
+	var dirty []string
+	for _, full := range present {
+		file, _ := filepath.Rel(r.Path, full)
+		hash := hashes[full]
+		if blob, ok := from[file]; ok && BlobContentHash(blob) == hash {
+			continue
+		}
+		if blob, ok := to[file]; ok && BlobContentHash(blob) == hash {
+			continue
+		}
+		dirty = append(dirty, file)
+	}
+	sort.Strings(dirty)
+	return dirty, nil
+}
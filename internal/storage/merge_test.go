@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMerge3LinesInsertionsDoNotConflict(t *testing.T) {
+	base := []string{"a", "b", "c", "d"}
+	ours := []string{"new-top", "a", "b", "c", "d"}
+	theirs := []string{"a", "b", "c", "C2", "d"}
+	merged, conflicts := merge3Lines(base, ours, theirs, "ours", "theirs")
+	if len(conflicts) != 0 {
+		t.Fatalf("Expected no conflicts, got %v in %v", conflicts, merged)
+	}
+	want := "new-top a b c C2 d"
+	if got := strings.Join(merged, " "); got != want {
+		t.Errorf("Merged = %q, want %q", got, want)
+	}
+}
+
+func TestMerge3LinesOverlappingEditsConflict(t *testing.T) {
+	base := []string{"a", "b", "c"}
+	ours := []string{"a", "B1", "c"}
+	theirs := []string{"a", "B2", "c"}
+	merged, conflicts := merge3Lines(base, ours, theirs, "ours", "theirs")
+	if len(conflicts) != 1 || conflicts[0] != 2 {
+		t.Fatalf("Expected one conflict at line 2, got %v", conflicts)
+	}
+	want := "a\n<<<<<<< ours\nB1\n||||||| base\nb\n=======\nB2\n>>>>>>> theirs\nc"
+	if got := strings.Join(merged, "\n"); got != want {
+		t.Errorf("Merged = %q, want %q", got, want)
+	}
+}
+
+func TestMergeBranchesThreeWayAndFastForward(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("one\ntwo\nthree\n"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	base := repo.Head
+	branchRef := func(name, hash string) {
+		os.WriteFile(filepath.Join(dir, ".steria", "branches", name), []byte(hash), 0644)
+	}
+
+	// Feature edits the last line; current branch inserts a line at the top
+	os.WriteFile(dir+"/file.txt", []byte("one\ntwo\nTHREE\n"), 0644)
+	feature, _ := repo.CreateCommit("feature", "author")
+	branchRef("feature", feature.Hash)
+	repo.UpdateRef("HEAD", base, "test")
+	os.WriteFile(dir+"/file.txt", []byte("zero\none\ntwo\nthree\n"), 0644)
+	ours, _ := repo.CreateCommit("ours", "author")
+
+	if mb, _ := repo.MergeBase(ours.Hash, feature.Hash); mb != base {
+		t.Fatalf("MergeBase = %s, want %s", mb, base)
+	}
+	result, err := repo.MergeBranches("feature", "author")
+	if err != nil {
+		t.Fatalf("MergeBranches failed: %v", err)
+	}
+	if len(result.Conflicts) != 0 || result.FastForward {
+		t.Fatalf("Expected a clean three-way merge, got %+v", result)
+	}
+	data, _ := os.ReadFile(dir + "/file.txt")
+	if string(data) != "zero\none\ntwo\nTHREE\n" {
+		t.Errorf("Unexpected merged content: %q", data)
+	}
+
+	// Merging again is a no-op, and a branch behind the merge fast-forwards to it
+	if again, _ := repo.MergeBranches("feature", "author"); again == nil || !again.UpToDate {
+		t.Errorf("Expected second merge to be up to date, got %+v", again)
+	}
+	merged := repo.Head
+	branchRef("merged", merged)
+	repo.UpdateRef("HEAD", feature.Hash, "test")
+
+	// An uncommitted edit to a file the fast-forward changes stops it
+	os.WriteFile(dir+"/file.txt", []byte("local edit\n"), 0644)
+	if _, err := repo.MergeBranches("merged", "author"); !errors.Is(err, ErrLocalChanges) || !strings.Contains(err.Error(), "file.txt") || repo.Head != feature.Hash {
+		t.Fatalf("Expected the fast-forward to refuse naming file.txt, got %v at %s", err, repo.Head)
+	}
+	if data, _ := os.ReadFile(dir + "/file.txt"); string(data) != "local edit\n" {
+		t.Errorf("Expected the local edit kept, got %q", data)
+	}
+
+	os.WriteFile(dir+"/file.txt", []byte("one\ntwo\nTHREE\n"), 0644)
+	ff, err := repo.MergeBranches("merged", "author")
+	if err != nil || !ff.FastForward || repo.Head != merged {
+		t.Fatalf("Expected fast-forward to %s, got %+v (err %v)", merged, ff, err)
+	}
+	data, _ = os.ReadFile(dir + "/file.txt")
+	if string(data) != "zero\none\ntwo\nTHREE\n" {
+		t.Errorf("Expected fast-forward to update working directory, got %q", data)
+	}
+}
+
+func TestMergeBranchesLeavesLocalChangesOut(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bee\n"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	base := repo.Head
+
+	// Feature changes a.txt; the current branch adds c.txt
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("feature\n"), 0644)
+	feature, _ := repo.CreateCommit("feature", "author")
+	os.WriteFile(filepath.Join(dir, ".steria", "branches", "feature"), []byte(feature.Hash), 0644)
+	repo.UpdateRef("HEAD", base, "test")
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "c.txt"), []byte("sea\n"), 0644)
+	ours, _ := repo.CreateCommit("ours", "author")
+
+	// An edit to a file the merge writes stops it before anything changes
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("MY LOCAL WORK\n"), 0644)
+	if _, err := repo.MergeBranches("feature", "author"); !errors.Is(err, ErrLocalChanges) || !strings.Contains(err.Error(), "a.txt") {
+		t.Fatalf("Expected the merge to refuse naming a.txt, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "MY LOCAL WORK\n" || repo.MergeHead() != "" || repo.Head != ours.Hash {
+		t.Fatalf("Expected nothing touched, got %q, MERGE_HEAD %q, HEAD %s", data, repo.MergeHead(), repo.Head)
+	}
+
+	// Edits elsewhere and untracked files stay out of the merge commit
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("local bee\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "scratch.txt"), []byte("scratch\n"), 0644)
+	result, err := repo.MergeBranches("feature", "author")
+	if err != nil || result.FastForward || len(result.Conflicts) != 0 {
+		t.Fatalf("Expected a clean three-way merge, got %+v, %v", result, err)
+	}
+	commit, err := repo.LoadCommit(result.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := commit.FileBlobs["scratch.txt"]; ok {
+		t.Error("Expected the untracked scratch.txt to stay out of the merge commit")
+	}
+	if commit.FileBlobs["b.txt"] != ours.FileBlobs["b.txt"] || commit.FileBlobs["a.txt"] != feature.FileBlobs["a.txt"] || commit.FileBlobs["c.txt"] != ours.FileBlobs["c.txt"] {
+		t.Errorf("Expected HEAD's snapshot with feature's a.txt, got %v", commit.FileBlobs)
+	}
+	if len(commit.Parents) != 2 {
+		t.Errorf("Expected a merge commit with two parents, got %v", commit.Parents)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "b.txt")); string(data) != "local bee\n" {
+		t.Errorf("Expected the local edit to b.txt kept, got %q", data)
+	}
+}
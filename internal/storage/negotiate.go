@@ -0,0 +1,314 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: negotiate.go
+// Description: Have/want negotiation for Steria pushes. Works out the history a remote already has from its branch tips, so only commits, trees and blobs reachable from new commits are checked and sent, and checks the rest with batched existence queries where the backend supports them.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MaxHaveHashes caps how many hashes go into one batched existence check
+const MaxHaveHashes = 1000
+
+// BatchChecker is implemented by remotes that can report which of many
+// objects they hold in one round trip
+type BatchChecker interface {
+	// HasObjects returns the subset of hashes the remote stores
+	HasObjects(ctx context.Context, kind PackObjectKind, hashes []string) (map[string]bool, error)
+}
+
+// kindNamespace names every object kind on the wire: blobs, trees or commits
+func kindNamespace(kind PackObjectKind) string {
+	if kind == PackBlob {
+		return "blobs"
+	}
+	return objectNamespace(kind)
+}
+
+// ParseObjectKind is the inverse of kindNamespace
+func ParseObjectKind(name string) (PackObjectKind, bool) {
+	switch name {
+	case "blobs":
+		return PackBlob, true
+	case "trees":
+		return PackTree, true
+	case "commits":
+		return PackCommit, true
+	}
+	return 0, false
+}
+
+// HaveRequest and HaveResponse are the JSON bodies of POST /have: which of
+// up to MaxHaveHashes objects of one kind the remote stores
+type HaveRequest struct {
+	Kind   string   `json:"kind"`
+	Hashes []string `json:"hashes"`
+}
+
+type HaveResponse struct {
+	Have []string `json:"have"`
+}
+
+// remoteHas returns which of hashes a remote stores, in batches when the
+// remote is a BatchChecker and one probe per object otherwise
+func remoteHas(ctx context.Context, store RemoteStore, kind PackObjectKind, hashes []string) (map[string]bool, error) {
+	have := map[string]bool{}
+	if checker, ok := store.(BatchChecker); ok {
+		for start := 0; start < len(hashes); start += MaxHaveHashes {
+			end := min(start+MaxHaveHashes, len(hashes))
+			found, err := checker.HasObjects(ctx, kind, hashes[start:end])
+			if err != nil {
+				return nil, fmt.Errorf("failed to check remote %s: %w", kindNamespace(kind), err)
+			}
+			for hash := range found {
+				have[hash] = true
+			}
+		}
+		return have, nil
+	}
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if kind == PackBlob && store.HasBlob(ctx, hash) || kind != PackBlob && store.HasObject(ctx, kind, hash) {
+			have[hash] = true
+		}
+	}
+	return have, nil
+}
+
+// HasObjects asks POST /have; a server without the endpoint is probed one
+// object at a time instead
+func (h *HTTPBlobStore) HasObjects(ctx context.Context, kind PackObjectKind, hashes []string) (map[string]bool, error) {
+	return httpHas(ctx, h.Timeout, h.BaseURL, kind, hashes, func(hash string) bool {
+		if kind == PackBlob {
+			return h.HasBlob(ctx, hash)
+		}
+		return h.HasObject(ctx, kind, hash)
+	})
+}
+
+// HasObjects reports an object as present if any peer stores it, matching
+// HasBlob and HasObject
+func (p *PeerToPeerBlobStore) HasObjects(ctx context.Context, kind PackObjectKind, hashes []string) (map[string]bool, error) {
+	have := map[string]bool{}
+	for _, peer := range p.Peers {
+		var missing []string
+		for _, hash := range hashes {
+			if !have[hash] {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		found, err := (&HTTPBlobStore{BaseURL: peer, Timeout: p.Timeout}).HasObjects(ctx, kind, missing)
+		if err != nil {
+			return nil, err
+		}
+		for hash := range found {
+			have[hash] = true
+		}
+	}
+	return have, nil
+}
+
+// httpHas makes one POST /have request, falling back to probe for each hash
+// when it fails, as servers from before the endpoint answer it with an error
+func httpHas(ctx context.Context, timeout time.Duration, baseURL string, kind PackObjectKind, hashes []string, probe func(string) bool) (map[string]bool, error) {
+	body, err := json.Marshal(HaveRequest{Kind: kindNamespace(kind), Hashes: hashes})
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	data, err := httpExchange(ctx, timeout, "POST", baseURL+"/have", body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			if probe(hash) {
+				have[hash] = true
+			}
+		}
+		return have, nil
+	}
+	var resp HaveResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse existence check: %w", err)
+	}
+	asked := map[string]bool{}
+	for _, hash := range hashes {
+		asked[hash] = true
+	}
+	for _, hash := range resp.Have {
+		if asked[hash] {
+			have[hash] = true
+		}
+	}
+	return have, nil
+}
+
+// pushPlan is what a push has to send: commits parents first, and the trees
+// and blobs they reach that the remote does not have
+type pushPlan struct {
+	commits []*Commit
+	trees   []string
+	blobs   []string
+}
+
+// planPush negotiates what the remote is missing of tip's history. Remote
+// branch tips this repository knows, and every commit the remote confirms
+// it stores, are "haves": the remote holds their whole history, since
+// pushes send history before moving refs. Only commits beyond the haves are
+// sent, and of the trees and blobs those commits reach, the ones in the
+// snapshots of the haves they build on are taken as present; the remaining
+// candidates are confirmed with batched existence checks.
+func (r *Repo) planPush(store RemoteStore, refs map[string]string, tip string) (*pushPlan, error) {
+	ctx := r.Context()
+	haves := map[string]bool{}
+	var tips []string
+	for _, hash := range refs {
+		if r.hasCommit(hash) {
+			tips = append(tips, hash)
+		}
+	}
+	if err := r.markHaves(haves, tips); err != nil {
+		return nil, err
+	}
+
+	// Commits beyond the advertised haves, parents before children
+	candidates, err := r.commitsSince(tip, haves)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) > 0 {
+		hashes := make([]string, len(candidates))
+		for i, c := range candidates {
+			hashes[i] = c.Hash
+		}
+		stored, err := remoteHas(ctx, store, PackCommit, hashes)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.markHaves(haves, sortedKeys(stored)); err != nil {
+			return nil, err
+		}
+	}
+	plan := &pushPlan{}
+	for _, c := range candidates {
+		if !haves[c.Hash] {
+			plan.commits = append(plan.commits, c)
+		}
+	}
+	if len(plan.commits) == 0 {
+		return plan, nil
+	}
+
+	// Objects of the new commits, less those in the snapshots they build on
+	want, have := newReachability(), newReachability()
+	for _, c := range plan.commits {
+		if err := r.markCommit(want, c); err != nil {
+			return nil, err
+		}
+		for _, parent := range c.Parents {
+			if !haves[parent] || have.Commits[parent] {
+				continue
+			}
+			commit, err := r.loadCommit(parent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load commit %s: %w", parent, err)
+			}
+			commit.Hash = parent
+			if err := r.markCommit(have, commit); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, reach := range []*Reachability{want, have} {
+		if err := r.expandBlobs(reach); err != nil {
+			return nil, err
+		}
+	}
+	for _, check := range []struct {
+		kind PackObjectKind
+		want map[string]bool
+		have map[string]bool
+		into *[]string
+	}{{PackTree, want.Trees, have.Trees, &plan.trees}, {PackBlob, want.Blobs, have.Blobs, &plan.blobs}} {
+		var candidates []string
+		for _, hash := range sortedKeys(check.want) {
+			if !check.have[hash] {
+				candidates = append(candidates, hash)
+			}
+		}
+		stored, err := remoteHas(ctx, store, check.kind, candidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range candidates {
+			if !stored[hash] {
+				*check.into = append(*check.into, hash)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// markHaves adds hashes and all their ancestors to haves, without walking
+// below commits already in it
+func (r *Repo) markHaves(haves map[string]bool, hashes []string) error {
+	queue := append([]string(nil), hashes...)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if hash == "" || haves[hash] {
+			continue
+		}
+		commit, err := r.loadCommit(hash)
+		if err != nil {
+			return fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		haves[hash] = true
+		queue = append(queue, commit.Parents...)
+	}
+	return nil
+}
+
+// commitsSince returns the commits reachable from tip that are not in stop,
+// parents before children
+func (r *Repo) commitsSince(tip string, stop map[string]bool) ([]*Commit, error) {
+	var commits []*Commit
+	seen := map[string]bool{}
+	var visit func(hash string) error
+	visit = func(hash string) error {
+		if seen[hash] || stop[hash] {
+			return nil
+		}
+		seen[hash] = true
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		commit, err := r.loadCommit(hash)
+		if err != nil {
+			return fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		commit.Hash = hash
+		for _, parent := range commit.Parents {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		commits = append(commits, commit)
+		return nil
+	}
+	if err := visit(tip); err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// probingStore counts the single-object existence checks a push makes
+type probingStore struct {
+	*LocalBlobStore
+	probes int
+}
+
+func (s *probingStore) HasBlob(ctx context.Context, hash string) bool {
+	s.probes++
+	return s.LocalBlobStore.HasBlob(ctx, hash)
+}
+
+func (s *probingStore) HasObject(ctx context.Context, kind PackObjectKind, hash string) bool {
+	s.probes++
+	return s.LocalBlobStore.HasObject(ctx, kind, hash)
+}
+
+// batchingStore answers existence checks in batches and counts them
+type batchingStore struct {
+	*probingStore
+	batches int
+}
+
+func (s *batchingStore) HasObjects(ctx context.Context, kind PackObjectKind, hashes []string) (map[string]bool, error) {
+	s.batches++
+	have := map[string]bool{}
+	for _, hash := range hashes {
+		if kind == PackBlob && s.LocalBlobStore.HasBlob(ctx, hash) || kind != PackBlob && s.LocalBlobStore.HasObject(ctx, kind, hash) {
+			have[hash] = true
+		}
+	}
+	return have, nil
+}
+
+func TestPushNegotiatesFromRemoteTips(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 40; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0644)
+	}
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile := func(name, content string) string {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		commit, err := repo.CreateCommit(content, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.advanceHead(commit.Hash, "test"); err != nil {
+			t.Fatal(err)
+		}
+		return commit.Hash
+	}
+	store := &probingStore{LocalBlobStore: &LocalBlobStore{Dir: t.TempDir()}}
+	if _, err := repo.Push(store, "origin", "Stem", PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote tip is known, so only the new commit's changes are checked
+	commitFile("file00.txt", "changed")
+	store.probes = 0
+	pushed, err := repo.Push(store, "origin", "Stem", PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Commits != 1 || pushed.Blobs != 1 {
+		t.Errorf("Expected one commit and one blob pushed, got %+v", pushed)
+	}
+	if store.probes > 4 {
+		t.Errorf("Expected a handful of existence checks, got %d", store.probes)
+	}
+
+	// Without an advertised tip the remote's commits are found by asking;
+	// batching backends answer each kind in one round trip
+	batching := &batchingStore{probingStore: store}
+	commitFile("file01.txt", "changed too")
+	os.Remove(filepath.Join(store.Dir, "refs", "Stem"))
+	store.probes = 0
+	pushed, err = repo.Push(batching, "origin", "Stem", PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Commits != 1 || pushed.Blobs != 1 || pushed.Status != PushNew {
+		t.Errorf("Expected only the new commit and blob pushed, got %+v", pushed)
+	}
+	if store.probes != 0 || batching.batches > 3 {
+		t.Errorf("Expected at most three batched checks and no probes, got %d batches, %d probes", batching.batches, store.probes)
+	}
+	if refs, _ := store.ListRefs(repo.Context()); refs["Stem"] != repo.Head {
+		t.Errorf("Expected the remote Stem at %s, got %v", repo.Head, refs)
+	}
+}
@@ -0,0 +1,501 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: oplog.go
+// Description: Operation log for Steria. Every mutating command records the complete ref state (HEAD, the current branch, branches, tags, remote-tracking refs, stashes, MERGE_HEAD, conflicts and the staging index) and a snapshot of the working directory, dirty files included, from before and after it ran, so 'steria undo' and 'steria op restore' can rewind the repository to any earlier operation.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxOperations is how many operations the log keeps; older ones are dropped
+var MaxOperations = 100
+
+// ErrNothingToUndo is returned by Undo when every logged operation has been undone
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// stateFiles are the ref files, besides HEAD and branches, an operation
+// captures verbatim, by path under .steria; directories capture every file in them
+var stateFiles = []string{"MERGE_HEAD", "conflicts.json", "refs/tags", "refs/remotes", "stashes", "upstreams.json"}
+
+// RefState is the state of a repository at one point of the operation log
+type RefState struct {
+	Head      string            `json:"head"`
+	Branch    string            `json:"branch"`
+	Branches  map[string]string `json:"branches"`
+	Files     map[string]string `json:"files"`                // Contents of tags, remote-tracking refs, stashes, upstreams, MERGE_HEAD and conflicts.json by path under .steria
+	Index     string            `json:"index,omitempty"`      // Tree of the staging index; empty when there is none
+	IndexBase string            `json:"index_base,omitempty"` // Commit the staging index was built on
+	Working   string            `json:"working"`              // Tree of the working directory, dirty files included; empty for commands that never touch it
+}
+
+// Operation is one entry of the operation log
+type Operation struct {
+	ID      int       `json:"id"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Error   string    `json:"error,omitempty"`  // Set when the command failed after changing the repository
+	Undoes  int       `json:"undoes,omitempty"` // For 'steria undo', the operation it rewound
+	Before  RefState  `json:"before"`
+	After   RefState  `json:"after"`
+}
+
+// opsDir returns the directory holding one file per logged operation
+func (r *Repo) opsDir() string {
+	return filepath.Join(r.Path, ".steria", "ops")
+}
+
+// CaptureState records the repository's current refs and working directory.
+// Files that differ from HEAD are written to the blob store so the snapshot
+// can be checked out again later; unchanged files reuse HEAD's blobs.
+func (r *Repo) CaptureState() (*RefState, error) {
+	return r.captureState(true)
+}
+
+// CaptureRefState records the repository's refs and staging index but not
+// its working directory, for commands that never touch it. Working is left
+// empty, and restoring such a state leaves the working directory alone.
+func (r *Repo) CaptureRefState() (*RefState, error) {
+	return r.captureState(false)
+}
+
+func (r *Repo) captureState(worktree bool) (*RefState, error) {
+	steriaDir := filepath.Join(r.Path, ".steria")
+	state := &RefState{Files: map[string]string{}}
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "HEAD")); err == nil {
+		state.Head = strings.TrimSpace(string(data))
+	}
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "branch")); err == nil {
+		state.Branch = string(data)
+	}
+
+	branches, err := r.Branches()
+	if err != nil {
+		return nil, err
+	}
+	state.Branches = branches
+
+	for _, name := range stateFiles {
+		err := filepath.Walk(filepath.Join(steriaDir, filepath.FromSlash(name)), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || isRefScratchFile(path) {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(steriaDir, path)
+			state.Files[filepath.ToSlash(rel)] = string(data)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+	}
+
+	if data, err := os.ReadFile(r.indexPath()); err == nil {
+		var idx Index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("failed to parse index: %w", err)
+		}
+		if state.Index, err = r.WriteTree(idx.Snapshot()); err != nil {
+			return nil, fmt.Errorf("failed to snapshot index: %w", err)
+		}
+		state.IndexBase = idx.Base
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if !worktree {
+		return state, nil
+	}
+	files, err := r.workingHashes(NewFileProcessor().ProcessFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash working directory: %w", err)
+	}
+	var previous map[string]string
+	if state.Head != "" {
+		if commit, err := r.LoadCommit(state.Head); err == nil {
+			previous = commit.FileBlobs
+		}
+	}
+	// Only dirty files need storing; clean ones are already in HEAD
+	snapshot := make(map[string]string, len(files))
+	dirty := map[string]string{}
+	for file, hash := range files {
+		if ref, ok := previous[file]; ok && BlobContentHash(ref) == hash {
+			snapshot[file] = ref
+		} else {
+			dirty[file] = hash
+		}
+	}
+	if len(dirty) > 0 {
+		stored, _, err := r.storeBlobs(r.Context(), r.BlobStore, dirty, previous)
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot working directory: %w", err)
+		}
+		for file, ref := range stored {
+			snapshot[file] = ref
+		}
+	}
+	if state.Working, err = r.WriteTree(snapshot); err != nil {
+		return nil, fmt.Errorf("failed to snapshot working directory: %w", err)
+	}
+	return state, nil
+}
+
+// RecordOperation appends an operation to the log. An operation that left
+// the repository as it found it is not recorded and nil is returned.
+// cmdErr is the error the command failed with, if any.
+func (r *Repo) RecordOperation(command string, before, after *RefState, cmdErr error) (*Operation, error) {
+	if reflect.DeepEqual(before, after) {
+		return nil, nil
+	}
+	op := &Operation{Command: command, Time: time.Now(), Actor: reflogActor(), Before: *before, After: *after}
+	if cmdErr != nil {
+		op.Error = cmdErr.Error()
+	}
+	return op, r.appendOperation(op)
+}
+
+// appendOperation assigns op the next ID, writes it and drops the oldest
+// operations beyond MaxOperations
+func (r *Repo) appendOperation(op *Operation) error {
+	ids, err := r.operationIDs()
+	if err != nil {
+		return err
+	}
+	op.ID = 1
+	if len(ids) > 0 {
+		op.ID = ids[len(ids)-1] + 1
+	}
+	data, err := json.MarshalIndent(op, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal operation: %w", err)
+	}
+	if err := os.MkdirAll(r.opsDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create operation log: %w", err)
+	}
+	if err := atomicWrite(filepath.Join(r.opsDir(), strconv.Itoa(op.ID)), data); err != nil {
+		return fmt.Errorf("failed to write operation: %w", err)
+	}
+	ids = append(ids, op.ID)
+	for len(ids) > MaxOperations {
+		os.Remove(filepath.Join(r.opsDir(), strconv.Itoa(ids[0])))
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// operationIDs lists the IDs in the operation log, oldest first
+func (r *Repo) operationIDs() ([]int, error) {
+	entries, err := os.ReadDir(r.opsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read operation log: %w", err)
+	}
+	var ids []int
+	for _, e := range entries {
+		if id, err := strconv.Atoi(e.Name()); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// LoadOperation reads one operation from the log
+func (r *Repo) LoadOperation(id int) (*Operation, error) {
+	data, err := os.ReadFile(filepath.Join(r.opsDir(), strconv.Itoa(id)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("operation %d is not in the operation log", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operation %d: %w", id, err)
+	}
+	var op Operation
+	if err := json.Unmarshal(data, &op); err != nil {
+		return nil, fmt.Errorf("failed to parse operation %d: %w", id, err)
+	}
+	return &op, nil
+}
+
+// Operations returns the operation log, newest first
+func (r *Repo) Operations() ([]Operation, error) {
+	ids, err := r.operationIDs()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]Operation, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		op, err := r.LoadOperation(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, *op)
+	}
+	return ops, nil
+}
+
+// Undo rewinds the repository to the state before the most recent operation
+// that has not been undone yet. Repeated undos walk further back. The undo is
+// itself recorded, so it can be reverted with 'steria op restore'.
+func (r *Repo) Undo() (*Operation, error) {
+	ops, err := r.Operations()
+	if err != nil {
+		return nil, err
+	}
+	undone := map[int]bool{}
+	for _, op := range ops {
+		if op.Undoes != 0 {
+			undone[op.Undoes] = true
+			continue
+		}
+		if undone[op.ID] {
+			continue
+		}
+		undo, err := r.restoreState(fmt.Sprintf("undo: %s", op.Command), &op.Before)
+		if err != nil {
+			return nil, err
+		}
+		undo.Undoes = op.ID
+		return undo, r.appendOperation(undo)
+	}
+	return nil, ErrNothingToUndo
+}
+
+// RestoreOperation puts the repository back into the state operation id
+// left it in, and records the restore as a new operation
+func (r *Repo) RestoreOperation(id int) (*Operation, error) {
+	target, err := r.LoadOperation(id)
+	if err != nil {
+		return nil, err
+	}
+	op, err := r.restoreState(fmt.Sprintf("op restore %d", id), &target.After)
+	if err != nil {
+		return nil, err
+	}
+	return op, r.appendOperation(op)
+}
+
+// restoreState moves refs, the staging index and the working directory to
+// target and returns the (not yet logged) operation describing the change.
+// Uncommitted changes are not lost: they are part of the operation's Before
+// snapshot.
+func (r *Repo) restoreState(command string, target *RefState) (*Operation, error) {
+	current, err := r.CaptureState()
+	if err != nil {
+		return nil, err
+	}
+	// Load everything that will be checked out before touching anything. A
+	// state captured without its working directory leaves it alone.
+	var from, to map[string]string
+	if target.Working != "" {
+		if from, err = r.FlattenTree(current.Working); err != nil {
+			return nil, err
+		}
+		if to, err = r.FlattenTree(target.Working); err != nil {
+			return nil, fmt.Errorf("failed to load working directory snapshot: %w", err)
+		}
+	}
+	var staged map[string]string
+	if target.Index != "" {
+		if staged, err = r.FlattenTree(target.Index); err != nil {
+			return nil, fmt.Errorf("failed to load index snapshot: %w", err)
+		}
+	}
+
+	op := r.operation(command)
+	tx := r.NewRefTransaction()
+	if target.Head != current.Head {
+		tx.UpdateFrom("HEAD", target.Head, current.Head, op)
+	}
+	for name, hash := range target.Branches {
+		if current.Branches[name] != hash {
+			tx.UpdateFrom(name, hash, current.Branches[name], op)
+		}
+	}
+	for name, hash := range current.Branches {
+		if _, ok := target.Branches[name]; !ok {
+			tx.Delete(name, hash)
+		}
+	}
+	if target.Branch != current.Branch {
+		tx.SetCurrentBranch(target.Branch)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to restore refs: %w", err)
+	}
+
+	steriaDir := filepath.Join(r.Path, ".steria")
+	for name := range current.Files {
+		if _, ok := target.Files[name]; !ok {
+			if err := os.Remove(filepath.Join(steriaDir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+		}
+	}
+	for name, data := range target.Files {
+		if current.Files[name] == data {
+			continue
+		}
+		path := filepath.Join(steriaDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		if err := atomicWrite(path, []byte(data)); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+
+	if staged == nil {
+		if err := os.Remove(r.indexPath()); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove index: %w", err)
+		}
+	} else {
+		idx := &Index{Base: target.IndexBase, Entries: make(map[string]IndexEntry, len(staged))}
+		for file, blob := range staged {
+			idx.Entries[file] = IndexEntry{Hash: blob}
+		}
+		if err := r.SaveIndex(idx); err != nil {
+			return nil, err
+		}
+	}
+
+	if target.Working != "" {
+		if err := r.checkoutSnapshot(from, to); err != nil {
+			return nil, fmt.Errorf("failed to restore working directory: %w", err)
+		}
+	}
+
+	after, err := r.CaptureState()
+	if err != nil {
+		return nil, err
+	}
+	return &Operation{Command: command, Time: time.Now(), Actor: reflogActor(), Before: *current, After: *after}, nil
+}
+
+// Changes summarises what an operation changed, one line per ref
+func (op *Operation) Changes() []string {
+	var changes []string
+	move := func(name, old, new string) {
+		if old != new {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, shortRef(old), shortRef(new)))
+		}
+	}
+	move("HEAD", op.Before.Head, op.After.Head)
+	if op.Before.Branch != op.After.Branch {
+		changes = append(changes, fmt.Sprintf("current branch: %s -> %s", op.Before.Branch, op.After.Branch))
+	}
+	names := map[string]bool{}
+	for name := range op.Before.Branches {
+		names[name] = true
+	}
+	for name := range op.After.Branches {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		move(name, op.Before.Branches[name], op.After.Branches[name])
+	}
+	files := map[string]bool{}
+	for name := range op.Before.Files {
+		files[name] = true
+	}
+	for name := range op.After.Files {
+		files[name] = true
+	}
+	for _, name := range sortedKeys(files) {
+		before, had := op.Before.Files[name]
+		after, has := op.After.Files[name]
+		switch {
+		case !had:
+			changes = append(changes, name+": added")
+		case !has:
+			changes = append(changes, name+": removed")
+		case before != after:
+			changes = append(changes, name+": changed")
+		}
+	}
+	if op.Before.Index != op.After.Index {
+		changes = append(changes, "staging index changed")
+	}
+	if op.Before.Working != op.After.Working && op.Before.Working != "" && op.After.Working != "" {
+		changes = append(changes, "working directory changed")
+	}
+	return changes
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// operationRoots returns the commits, trees and blobs logged operations
+// refer to, so pruning never removes state an operation can be restored to
+func (r *Repo) operationRoots() (commits, trees, blobs []string) {
+	ops, _ := r.Operations()
+	for _, op := range ops {
+		for _, s := range []RefState{op.Before, op.After} {
+			commits = append(commits, s.Head)
+			for _, hash := range s.Branches {
+				commits = append(commits, hash)
+			}
+			for name, data := range s.Files {
+				switch {
+				case name == "MERGE_HEAD", strings.HasPrefix(name, "refs/remotes/"):
+					commits = append(commits, strings.TrimSpace(data))
+				case strings.HasPrefix(name, "refs/tags/"):
+					var tag struct {
+						Commit string `json:"commit"`
+					}
+					if json.Unmarshal([]byte(data), &tag) == nil {
+						commits = append(commits, tag.Commit)
+					}
+				case strings.HasPrefix(name, "stashes/"):
+					var stash struct {
+						Files map[string]string `json:"files"`
+					}
+					if json.Unmarshal([]byte(data), &stash) == nil {
+						for _, blob := range stash.Files {
+							blobs = append(blobs, blob)
+						}
+					}
+				}
+			}
+			trees = append(trees, s.Working, s.Index)
+		}
+	}
+	return filterEmpty(commits), filterEmpty(trees), blobs
+}
+
+// filterEmpty drops empty strings from a list
+func filterEmpty(list []string) []string {
+	out := list[:0]
+	for _, s := range list {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
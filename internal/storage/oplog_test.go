@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOperationLogUndoAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := repo.Head
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("uncommitted"), 0644)
+
+	// One operation commits, adds a branch and leaves a dirty file behind
+	before, err := repo.CaptureState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("two"), 0644)
+	commit, err := repo.CreateCommit("Second", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.advanceHead(commit.Hash, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.NewRefTransaction().Create("dev", commit.Hash, "test").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "new.txt"), []byte("scratch"), 0644)
+	after, err := repo.CaptureState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, err := repo.RecordOperation("steria test", before, after, nil)
+	if err != nil || op == nil || op.ID != 1 {
+		t.Fatalf("Expected operation 1 to be recorded, got %+v, %v", op, err)
+	}
+	if noop, err := repo.RecordOperation("steria status", after, after, nil); noop != nil || err != nil {
+		t.Errorf("Expected an operation that changed nothing not to be logged, got %+v, %v", noop, err)
+	}
+
+	// Undo puts refs and the dirty working directory back
+	undo, err := repo.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undo.Undoes != 1 || repo.Head != base {
+		t.Errorf("Expected undo of #1 back to %s, got undoes=%d head=%s", base, undo.Undoes, repo.Head)
+	}
+	if _, err := repo.ReadRef("dev"); err == nil {
+		t.Error("Expected undo to delete the branch the operation created")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "uncommitted" {
+		t.Errorf("Expected the uncommitted edit back, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); !os.IsNotExist(err) {
+		t.Error("Expected undo to remove a file the operation left behind")
+	}
+	if _, err := repo.Undo(); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("Expected ErrNothingToUndo once every operation is undone, got %v", err)
+	}
+
+	// Commits only the operation log remembers survive pruning
+	os.RemoveAll(filepath.Join(dir, ".steria", "logs"))
+	ageObjects(t, repo)
+	if _, err := repo.Prune(PruneOptions{Expire: DefaultPruneExpire}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.loadCommit(commit.Hash); err != nil {
+		t.Fatalf("Expected the undone commit to survive pruning: %v", err)
+	}
+
+	// Restoring the operation brings its result back
+	if _, err := repo.RestoreOperation(1); err != nil {
+		t.Fatal(err)
+	}
+	if dev, _ := repo.ReadRef("dev"); dev != commit.Hash || repo.Head != commit.Hash {
+		t.Errorf("Expected HEAD and dev at %s, got %s and %s", commit.Hash, repo.Head, dev)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "new.txt")); string(data) != "scratch" {
+		t.Errorf("Expected the restored working directory, got %q", data)
+	}
+	if ops, _ := repo.Operations(); len(ops) != 3 || ops[0].Command != "op restore 1" {
+		t.Errorf("Expected the undo and restore to be logged, got %+v", ops)
+	}
+}
+
+func TestRefOnlyOperationLeavesWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := repo.CaptureRefState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.NewRefTransaction().Create("dev", repo.Head, "test").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := repo.CaptureRefState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Working != "" || after.Working != "" {
+		t.Errorf("Expected no working directory snapshot, got %q and %q", before.Working, after.Working)
+	}
+	if _, err := repo.RecordOperation("steria add-branch dev", before, after, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undo drops the branch but keeps an edit made since
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("edited"), 0644)
+	if _, err := repo.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.ReadRef("dev"); err == nil {
+		t.Error("Expected undo to delete the branch")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "edited" {
+		t.Errorf("Expected the edit to be left alone, got %q", data)
+	}
+}
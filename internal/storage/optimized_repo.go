@@ -2,17 +2,12 @@ package storage
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
-
-	"steria/internal/utils"
 )
 
 // OptimizedRepo represents a high-performance Steria repository
@@ -21,121 +16,9 @@ type OptimizedRepo struct {
 	fileProcessor    *FileProcessor
 	hashCalculator   *FastHashCalculator
 	concurrentWalker *ConcurrentFileWalker
-	cache            *FileCache
 	mu               sync.RWMutex
 }
 
-// FileCache provides in-memory caching for file operations
-type FileCache struct {
-	fileHashes map[string]string
-	fileStats  map[string]os.FileInfo
-	mu         sync.RWMutex
-	ttl        time.Duration
-	lastAccess map[string]time.Time
-}
-
-// NewFileCache creates a new file cache
-func NewFileCache(ttl time.Duration) *FileCache {
-	cache := &FileCache{
-		fileHashes: make(map[string]string),
-		fileStats:  make(map[string]os.FileInfo),
-		lastAccess: make(map[string]time.Time),
-		ttl:        ttl,
-	}
-
-	// Start cache cleanup goroutine
-	go cache.cleanup()
-	return cache
-}
-
-// cleanup removes expired cache entries
-func (fc *FileCache) cleanup() {
-	ticker := time.NewTicker(fc.ttl / 2)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		fc.mu.Lock()
-		now := time.Now()
-		for path, lastAccess := range fc.lastAccess {
-			if now.Sub(lastAccess) > fc.ttl {
-				delete(fc.fileHashes, path)
-				delete(fc.fileStats, path)
-				delete(fc.lastAccess, path)
-			}
-		}
-		fc.mu.Unlock()
-	}
-}
-
-// GetHash gets cached hash or calculates new one
-func (fc *FileCache) GetHash(path string) (string, error) {
-	fc.mu.RLock()
-	if hash, exists := fc.fileHashes[path]; exists {
-		fc.lastAccess[path] = time.Now()
-		fc.mu.RUnlock()
-		return hash, nil
-	}
-	fc.mu.RUnlock()
-
-	// Calculate new hash
-	hash, err := fc.calculateHash(path)
-	if err != nil {
-		return "", err
-	}
-
-	// Cache the result
-	fc.mu.Lock()
-	fc.fileHashes[path] = hash
-	fc.lastAccess[path] = time.Now()
-	fc.mu.Unlock()
-
-	return hash, nil
-}
-
-// calculateHash calculates file hash with optimized method
-func (fc *FileCache) calculateHash(path string) (string, error) {
-	// Try memory mapping first for large files
-	stat, err := os.Stat(path)
-	if err != nil {
-		return "", err
-	}
-
-	// Use memory mapping for files larger than 1MB
-	if stat.Size() > 1024*1024 {
-		mmFile, err := OpenMMap(path)
-		if err == nil {
-			defer mmFile.Close()
-			return mmFile.CalculateHash()
-		}
-		// Fall back to regular method if mmap fails
-	}
-
-	// Regular buffered reading for smaller files
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	buffer := make([]byte, 64*1024) // 64KB buffer
-
-	for {
-		n, err := file.Read(buffer)
-		if n > 0 {
-			hash.Write(buffer[:n])
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
-		}
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
 // NewOptimizedRepo creates a new optimized repository
 func NewOptimizedRepo(repo *Repo) *OptimizedRepo {
 	ignorePatterns := []string{".steria"}
@@ -145,7 +28,6 @@ func NewOptimizedRepo(repo *Repo) *OptimizedRepo {
 		fileProcessor:    NewFileProcessor(),
 		hashCalculator:   NewFastHashCalculator(),
 		concurrentWalker: NewConcurrentFileWalker(ignorePatterns),
-		cache:            NewFileCache(5 * time.Minute),
 	}
 }
 
@@ -198,117 +80,18 @@ func (or *OptimizedRepo) GetChangesOptimized() ([]FileChange, error) {
 		return nil, fmt.Errorf("operation timeout")
 	}
 
-	// Compare states with concurrent processing
-	return or.compareStatesOptimized(currentState, workingState), nil
+	return compareStates(currentState, workingState), nil
 }
 
-// getCurrentStateOptimized gets current state with caching
+// getCurrentStateOptimized returns the blob hash of every file in the HEAD commit
 func (or *OptimizedRepo) getCurrentStateOptimized() (map[string]string, error) {
-	if or.Head == "" {
-		return make(map[string]string), nil
-	}
-
-	commit, err := or.loadCommit(or.Head)
-	if err != nil {
-		return nil, err
-	}
-
-	// Process files concurrently
-	var files []string
-	for _, file := range commit.Files {
-		fullPath := filepath.Join(or.Path, file)
-		if _, err := os.Stat(fullPath); err == nil {
-			files = append(files, file)
-		}
-	}
-
-	if len(files) == 0 {
-		return make(map[string]string), nil
-	}
-
-	// Use concurrent processing for file hashes
-	results, err := or.fileProcessor.ProcessFiles(files)
-	if err != nil {
-		return nil, err
-	}
-
-	return results, nil
+	return or.getCurrentState()
 }
 
-// getWorkingStateOptimized gets working state with concurrent processing
+// getWorkingStateOptimized hashes the working directory, sending files whose
+// stat data changed since the last scan to the concurrent file processor
 func (or *OptimizedRepo) getWorkingStateOptimized() (map[string]string, error) {
-	// Load ignore patterns
-	ignorePatterns, err := utils.LoadIgnorePatterns(or.Path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load ignore patterns: %w", err)
-	}
-
-	// Convert ignore patterns to strings
-	var ignoreStrings []string
-	for _, pattern := range ignorePatterns {
-		ignoreStrings = append(ignoreStrings, pattern.Pattern)
-	}
-
-	// Use concurrent file walker
-	walker := NewConcurrentFileWalker(ignoreStrings)
-	return walker.WalkAndProcess(or.Path)
-}
-
-// compareStatesOptimized compares states with concurrent processing
-func (or *OptimizedRepo) compareStatesOptimized(currentState, workingState map[string]string) []FileChange {
-	var changes []FileChange
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	// Process additions and modifications
-	for path, hash := range workingState {
-		wg.Add(1)
-		go func(filePath, fileHash string) {
-			defer wg.Done()
-
-			if currentHash, exists := currentState[filePath]; !exists {
-				// File was added
-				mu.Lock()
-				changes = append(changes, FileChange{
-					Path: filePath,
-					Type: ChangeTypeAdded,
-					Hash: fileHash,
-				})
-				mu.Unlock()
-			} else if currentHash != fileHash {
-				// File was modified
-				mu.Lock()
-				changes = append(changes, FileChange{
-					Path: filePath,
-					Type: ChangeTypeModified,
-					Hash: fileHash,
-				})
-				mu.Unlock()
-			}
-		}(path, hash)
-	}
-
-	// Process deletions
-	for path := range currentState {
-		wg.Add(1)
-		go func(filePath string) {
-			defer wg.Done()
-
-			if _, exists := workingState[filePath]; !exists {
-				// File was deleted
-				mu.Lock()
-				changes = append(changes, FileChange{
-					Path: filePath,
-					Type: ChangeTypeDeleted,
-					Hash: "",
-				})
-				mu.Unlock()
-			}
-		}(path)
-	}
-
-	wg.Wait()
-	return changes
+	return or.workingHashes(or.fileProcessor.ProcessFiles)
 }
 
 // CreateCommitOptimized creates a commit with optimized processing
@@ -319,33 +102,56 @@ func (or *OptimizedRepo) CreateCommitOptimized(message, author string) (*Commit,
 		return nil, fmt.Errorf("failed to get changes: %w", err)
 	}
 
+	parents, err := or.commitParents()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the HEAD snapshot and apply the working directory changes
+	head, err := or.getCurrentState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load HEAD snapshot: %w", err)
+	}
+
+	previous := make(map[string]string, len(head))
+	for file, blob := range head {
+		previous[file] = blob
+	}
+
 	commit := &Commit{
 		Message:   message,
 		Author:    author,
 		Timestamp: time.Now(),
-		Parent:    or.Head,
-		FileBlobs: make(map[string]string),
+		Parents:   parents,
+		FileBlobs: head,
 	}
 
+	blobDir := filepath.Join(or.Path, ".steria", "objects", "blobs")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob dir: %w", err)
+	}
+	store := &LocalBlobStore{Dir: blobDir}
+	changed := make(map[string]string)
 	for _, change := range changes {
-		if change.Type != ChangeTypeDeleted {
-			commit.Files = append(commit.Files, change.Path)
-			// Calculate hash and write blob
-			hash, err := or.cache.GetHash(filepath.Join(or.Path, change.Path))
-			if err != nil {
-				return nil, fmt.Errorf("failed to hash file %s: %w", change.Path, err)
-			}
-			blobDir := filepath.Join(or.Path, ".steria", "objects", "blobs")
-			if err := os.MkdirAll(blobDir, 0755); err != nil {
-				return nil, fmt.Errorf("failed to create blob dir: %w", err)
-			}
-			store := &LocalBlobStore{Dir: blobDir}
-			if err := writeBlobCompressed(store, hash, filepath.Join(or.Path, change.Path)); err != nil {
-				return nil, fmt.Errorf("failed to write compressed blob for %s: %w", change.Path, err)
-			}
-			commit.FileBlobs[change.Path] = hash
+		if change.Type == ChangeTypeDeleted {
+			delete(commit.FileBlobs, change.Path)
+			continue
 		}
+		changed[change.Path] = change.Hash
+	}
+	// A change can still point at content already stored, e.g. a revert or a rename
+	refs, stats, err := or.storeBlobs(or.Context(), store, changed, previous)
+	if err != nil {
+		return nil, err
+	}
+	for file, ref := range refs {
+		commit.FileBlobs[file] = ref
+	}
+	commit.Stats = stats
+	for file := range commit.FileBlobs {
+		commit.Files = append(commit.Files, file)
 	}
+	sort.Strings(commit.Files)
 	fmt.Printf("[DEBUG] FileBlobs length: %d, keys: %v\n", len(commit.FileBlobs), func() []string {
 		var k []string
 		for key := range commit.FileBlobs {
@@ -357,25 +163,29 @@ func (or *OptimizedRepo) CreateCommitOptimized(message, author string) (*Commit,
 		panic("[FATAL] FileBlobs is empty after populating! This is a critical bug.")
 	}
 
-	commitData, err := json.Marshal(commit)
+	treeHash, err := or.WriteTree(commit.FileBlobs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal commit: %w", err)
+		return nil, fmt.Errorf("failed to write tree: %w", err)
 	}
+	commit.Tree = treeHash
 
-	hash := sha256.Sum256(commitData)
-	commit.Hash = hex.EncodeToString(hash[:])
+	commit.Hash, err = hashCommit(commit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal commit: %w", err)
+	}
 
 	if err := or.saveCommitOptimized(commit); err != nil {
 		return nil, fmt.Errorf("failed to save commit: %w", err)
 	}
 
 	or.mu.Lock()
-	or.Head = commit.Hash
+	err = or.advanceHead(commit.Hash, or.commitOperation(commit))
 	or.mu.Unlock()
-
-	headPath := filepath.Join(or.Path, ".steria", "HEAD")
-	if err := os.WriteFile(headPath, []byte(commit.Hash), 0644); err != nil {
-		return nil, fmt.Errorf("failed to update HEAD: %w", err)
+	if err != nil {
+		return nil, err
+	}
+	if commit.IsMerge() {
+		or.clearMergeHead()
 	}
 
 	return commit, nil
@@ -383,7 +193,7 @@ func (or *OptimizedRepo) CreateCommitOptimized(message, author string) (*Commit,
 
 // saveCommitOptimized saves commit with optimized I/O
 func (or *OptimizedRepo) saveCommitOptimized(commit *Commit) error {
-	data, err := json.MarshalIndent(commit, "", "  ")
+	data, err := EncodeCommit(commit)
 	if err != nil {
 		return err
 	}
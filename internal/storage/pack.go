@@ -0,0 +1,483 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: pack.go
+// Description: Packfiles for Steria. Consolidates loose blob, tree and commit objects into a single pack with a sorted, fanout-indexed index so large repositories do not need one file per object.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Pack layout
+//
+//	<name>.pack: "SPCK" | version u32 | count u32 | object data... | sha256 of everything before it
+//	<name>.idx:  "SIDX" | version u32 | fanout [256]u32 | count * (hash [32]byte | kind u8 | offset u64 | length u64) | pack checksum [32]byte
+//
+// Object data is the exact bytes of the loose object (gzip for blobs, JSON for
+// trees and commits). Index entries are sorted by hash; fanout[b] is the number
+// of entries whose first hash byte is <= b, so a lookup only searches one bucket.
+const (
+	packVersion    = 1
+	packHeaderSize = 12
+	idxEntrySize   = 32 + 1 + 8 + 8
+)
+
+var (
+	packMagic = []byte("SPCK")
+	idxMagic  = []byte("SIDX")
+)
+
+// PackObjectKind identifies what a packed object is
+type PackObjectKind byte
+
+const (
+	PackBlob   PackObjectKind = 1
+	PackTree   PackObjectKind = 2
+	PackCommit PackObjectKind = 3
+)
+
+// packEntry locates one object inside a pack
+type packEntry struct {
+	hash   [32]byte
+	kind   PackObjectKind
+	offset uint64
+	length uint64
+}
+
+// packFile is a loaded pack index together with the path of its data file
+type packFile struct {
+	packPath string
+	fanout   [256]uint32
+	entries  []packEntry
+}
+
+// packObject is an object to be written into a new pack. Its bytes are
+// streamed from open while the pack is written, so packing never holds more
+// than one object in memory.
+type packObject struct {
+	hash string
+	kind PackObjectKind
+	size int64 // Expected length, or -1 when unknown
+	open func() (io.ReadCloser, error)
+}
+
+// packDirFor returns the pack directory that sits next to a blob directory
+func packDirFor(blobDir string) string {
+	return filepath.Join(filepath.Dir(blobDir), "pack")
+}
+
+// packDir returns the repository's pack directory
+func (r *Repo) packDir() string {
+	return filepath.Join(r.Path, ".steria", "objects", "pack")
+}
+
+// decodeHash parses a 64 character hex object hash
+func decodeHash(hash string) ([32]byte, bool) {
+	var out [32]byte
+	if len(hash) != 64 {
+		return out, false
+	}
+	if _, err := hex.Decode(out[:], []byte(hash)); err != nil {
+		return out, false
+	}
+	return out, true
+}
+
+// readPackIndex loads and validates a pack index
+func readPackIndex(idxPath string) (*packFile, error) {
+	data, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+256*4+32 || !bytes.Equal(data[:4], idxMagic) {
+		return nil, fmt.Errorf("invalid pack index %s", idxPath)
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != packVersion {
+		return nil, fmt.Errorf("unsupported pack index version %d in %s", v, idxPath)
+	}
+	pf := &packFile{packPath: strings.TrimSuffix(idxPath, ".idx") + ".pack"}
+	pos := 8
+	for i := range pf.fanout {
+		pf.fanout[i] = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	}
+	count := int(pf.fanout[255])
+	if len(data) != pos+count*idxEntrySize+32 {
+		return nil, fmt.Errorf("truncated pack index %s", idxPath)
+	}
+	pf.entries = make([]packEntry, count)
+	for i := range pf.entries {
+		e := &pf.entries[i]
+		copy(e.hash[:], data[pos:pos+32])
+		e.kind = PackObjectKind(data[pos+32])
+		e.offset = binary.BigEndian.Uint64(data[pos+33:])
+		e.length = binary.BigEndian.Uint64(data[pos+41:])
+		pos += idxEntrySize
+	}
+	return pf, nil
+}
+
+// find returns the index entry for a hash and kind
+func (pf *packFile) find(hash [32]byte, kind PackObjectKind) (packEntry, bool) {
+	lo := 0
+	if hash[0] > 0 {
+		lo = int(pf.fanout[hash[0]-1])
+	}
+	hi := int(pf.fanout[hash[0]])
+	bucket := pf.entries[lo:hi]
+	i := sort.Search(len(bucket), func(i int) bool {
+		if c := bytes.Compare(bucket[i].hash[:], hash[:]); c != 0 {
+			return c > 0
+		}
+		return bucket[i].kind >= kind
+	})
+	if i < len(bucket) && bucket[i].hash == hash && bucket[i].kind == kind {
+		return bucket[i], true
+	}
+	return packEntry{}, false
+}
+
+// object returns a packed object for copying into another pack
+func (pf *packFile) object(e packEntry) packObject {
+	return packObject{hash: hex.EncodeToString(e.hash[:]), kind: e.kind, size: int64(e.length), open: func() (io.ReadCloser, error) {
+		f, err := os.Open(pf.packPath)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, int64(e.offset), int64(e.length)), f}, nil
+	}}
+}
+
+// read returns the bytes of a packed object
+func (pf *packFile) read(e packEntry) ([]byte, error) {
+	f, err := os.Open(pf.packPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, e.length)
+	if _, err := f.ReadAt(data, int64(e.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read packed object: %w", err)
+	}
+	return data, nil
+}
+
+// packSet is the set of packs in one pack directory, reloaded whenever the
+// directory changes so packs written by gc become visible
+type packSet struct {
+	modTime int64
+	packs   []*packFile
+}
+
+var (
+	packSetsMu sync.Mutex
+	packSets   = map[string]*packSet{}
+)
+
+// loadPacks returns the packs in dir. A missing directory means no packs.
+func loadPacks(dir string) []*packFile {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil
+	}
+	packSetsMu.Lock()
+	defer packSetsMu.Unlock()
+	if set, ok := packSets[dir]; ok && set.modTime == info.ModTime().UnixNano() {
+		return set.packs
+	}
+	set := &packSet{modTime: info.ModTime().UnixNano()}
+	idxFiles, _ := filepath.Glob(filepath.Join(dir, "*.idx"))
+	sort.Strings(idxFiles)
+	for _, idx := range idxFiles {
+		pf, err := readPackIndex(idx)
+		if err != nil {
+			continue // A broken index must not hide the loose objects or other packs
+		}
+		set.packs = append(set.packs, pf)
+	}
+	packSets[dir] = set
+	return set.packs
+}
+
+// forgetPacks drops the cached pack list for dir. Directory mtimes can be too
+// coarse to notice a pack being replaced within the same tick.
+func forgetPacks(dir string) {
+	packSetsMu.Lock()
+	delete(packSets, dir)
+	packSetsMu.Unlock()
+}
+
+// readPacked looks an object up in the packs of dir
+func readPacked(dir, hash string, kind PackObjectKind) ([]byte, error) {
+	key, ok := decodeHash(hash)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, pf := range loadPacks(dir) {
+			if e, ok := pf.find(key, kind); ok {
+				data, err := pf.read(e)
+				if err == nil || !os.IsNotExist(err) {
+					return data, err
+				}
+				break // Pack was replaced by gc; reload the pack list
+			}
+		}
+		if attempt == 0 {
+			forgetPacks(dir)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// hasPacked reports whether an object is in one of the packs of dir
+func hasPacked(dir, hash string, kind PackObjectKind) bool {
+	key, ok := decodeHash(hash)
+	if !ok {
+		return false
+	}
+	for _, pf := range loadPacks(dir) {
+		if _, ok := pf.find(key, kind); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listPacked returns the hashes of all packed objects of one kind in dir
+func listPacked(dir string, kind PackObjectKind) []string {
+	var hashes []string
+	for _, pf := range loadPacks(dir) {
+		for _, e := range pf.entries {
+			if e.kind == kind {
+				hashes = append(hashes, hex.EncodeToString(e.hash[:]))
+			}
+		}
+	}
+	return hashes
+}
+
+// writePack writes objects as a new pack in dir and returns its name. The
+// index is renamed into place last, so readers never see a partial pack.
+func writePack(dir string, objects []packObject) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create pack dir: %w", err)
+	}
+	entries := make([]packEntry, 0, len(objects))
+	tmpPack, err := os.CreateTemp(dir, "tmp-*.pack")
+	if err != nil {
+		return "", fmt.Errorf("failed to create pack: %w", err)
+	}
+	defer os.Remove(tmpPack.Name())
+	defer tmpPack.Close()
+
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(tmpPack, sum))
+	header := make([]byte, packHeaderSize)
+	copy(header, packMagic)
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	w.Write(header)
+	offset := uint64(packHeaderSize)
+	for _, obj := range objects {
+		key, ok := decodeHash(obj.hash)
+		if !ok {
+			return "", fmt.Errorf("cannot pack object with invalid hash %q", obj.hash)
+		}
+		in, err := obj.open()
+		if err != nil {
+			return "", fmt.Errorf("failed to read object %s: %w", obj.hash, err)
+		}
+		n, err := io.Copy(w, in)
+		in.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to write pack: %w", err)
+		}
+		if obj.size >= 0 && n != obj.size {
+			return "", fmt.Errorf("failed to read object %s: got %d of %d bytes", obj.hash, n, obj.size)
+		}
+		entries = append(entries, packEntry{hash: key, kind: obj.kind, offset: offset, length: uint64(n)})
+		offset += uint64(n)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write pack: %w", err)
+	}
+	checksum := sum.Sum(nil)
+	if _, err := tmpPack.Write(checksum); err != nil {
+		return "", fmt.Errorf("failed to write pack: %w", err)
+	}
+	if err := tmpPack.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync pack: %w", err)
+	}
+	if err := tmpPack.Close(); err != nil {
+		return "", fmt.Errorf("failed to close pack: %w", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].hash[:], entries[j].hash[:]); c != 0 {
+			return c < 0
+		}
+		return entries[i].kind < entries[j].kind
+	})
+	var idx bytes.Buffer
+	idx.Write(idxMagic)
+	binary.Write(&idx, binary.BigEndian, uint32(packVersion))
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&idx, binary.BigEndian, fanout)
+	for _, e := range entries {
+		idx.Write(e.hash[:])
+		idx.WriteByte(byte(e.kind))
+		binary.Write(&idx, binary.BigEndian, e.offset)
+		binary.Write(&idx, binary.BigEndian, e.length)
+	}
+	idx.Write(checksum)
+
+	name := "pack-" + hex.EncodeToString(checksum)
+	packPath := filepath.Join(dir, name+".pack")
+	if err := os.Rename(tmpPack.Name(), packPath); err != nil {
+		return "", fmt.Errorf("failed to install pack: %w", err)
+	}
+	if err := atomicWrite(filepath.Join(dir, name+".idx"), idx.Bytes()); err != nil {
+		return "", fmt.Errorf("failed to write pack index: %w", err)
+	}
+	return name, nil
+}
+
+// GCResult summarizes a 'steria gc' run
+type GCResult struct {
+	Pack         string // Name of the pack that now holds every object, "" if there was nothing to pack
+	Objects      int    // Objects in the new pack
+	LooseRemoved int    // Loose object files deleted after packing
+	PacksRemoved int    // Older packs merged into the new one
+}
+
+// looseObject is a loose object file found on disk
+type looseObject struct {
+	packObject
+	path string
+}
+
+// looseObjects lists the loose blob, tree and commit files. Object data is
+// not read; callers load what they need from path.
+func (r *Repo) looseObjects() ([]looseObject, error) {
+	objectsDir := filepath.Join(r.Path, ".steria", "objects")
+	var loose []looseObject
+	add := func(path, hash string, kind PackObjectKind) {
+		if _, ok := decodeHash(hash); ok { // Anything else (e.g. a delta patch) is left alone
+			open := func() (io.ReadCloser, error) { return os.Open(path) }
+			loose = append(loose, looseObject{packObject{hash: hash, kind: kind, size: -1, open: open}, path})
+		}
+	}
+
+	blobDir := filepath.Join(objectsDir, "blobs")
+	blobs, _ := os.ReadDir(blobDir)
+	for _, e := range blobs {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".gz") {
+			add(filepath.Join(blobDir, e.Name()), strings.TrimSuffix(e.Name(), ".gz"), PackBlob)
+		}
+	}
+	for _, base := range []struct {
+		dir  string
+		kind PackObjectKind
+	}{{filepath.Join(objectsDir, "trees"), PackTree}, {objectsDir, PackCommit}} {
+		fans, _ := os.ReadDir(base.dir)
+		for _, fan := range fans {
+			if !fan.IsDir() || len(fan.Name()) != 2 {
+				continue
+			}
+			files, _ := os.ReadDir(filepath.Join(base.dir, fan.Name()))
+			for _, f := range files {
+				if f.IsDir() || strings.HasSuffix(f.Name(), ".tmp") {
+					continue
+				}
+				add(filepath.Join(base.dir, fan.Name(), f.Name()), fan.Name()+f.Name(), base.kind)
+			}
+		}
+	}
+	return loose, nil
+}
+
+// GC packs every loose object together with the contents of existing packs
+// into a single new pack, then deletes the loose copies and the old packs
+func (r *Repo) GC() (*GCResult, error) {
+	dir := r.packDir()
+	oldPacks := loadPacks(dir)
+	loose, err := r.looseObjects()
+	if err != nil {
+		return nil, err
+	}
+	result := &GCResult{}
+	if len(loose) == 0 && len(oldPacks) <= 1 {
+		return result, nil // Already fully packed
+	}
+
+	// Only hashes and kinds are collected; writePack streams each object in
+	seen := map[string]bool{}
+	var objects []packObject
+	for _, pf := range oldPacks {
+		for _, e := range pf.entries {
+			key := fmt.Sprintf("%d:%x", e.kind, e.hash)
+			if !seen[key] {
+				seen[key] = true
+				objects = append(objects, pf.object(e))
+			}
+		}
+	}
+	for _, obj := range loose {
+		key := fmt.Sprintf("%d:%s", obj.kind, obj.hash)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		objects = append(objects, obj.packObject)
+	}
+
+	name, err := writePack(dir, objects)
+	if err != nil {
+		return nil, err
+	}
+	defer forgetPacks(dir)
+	result.Pack = name
+	result.Objects = len(objects)
+
+	// Only delete what is now safely in the new pack
+	for _, pf := range oldPacks {
+		if strings.TrimSuffix(filepath.Base(pf.packPath), ".pack") == name {
+			continue
+		}
+		os.Remove(strings.TrimSuffix(pf.packPath, ".pack") + ".idx")
+		if err := os.Remove(pf.packPath); err == nil {
+			result.PacksRemoved++
+		}
+	}
+	for _, obj := range loose {
+		if err := os.Remove(obj.path); err == nil {
+			result.LooseRemoved++
+			if obj.kind != PackBlob {
+				os.Remove(filepath.Dir(obj.path)) // Drop the fan-out directory once empty
+			}
+		}
+	}
+	return result, nil
+}
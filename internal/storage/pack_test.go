@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGCPacksLooseObjects(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/src", 0755)
+	os.WriteFile(dir+"/src/packed.txt", []byte("packed content for gc test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	head := repo.Head
+
+	result, err := repo.GC()
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Pack == "" || result.LooseRemoved == 0 || result.LooseRemoved != result.Objects {
+		t.Fatalf("Expected every loose object to be packed and removed, got %+v", result)
+	}
+	if loose, _ := repo.looseObjects(); len(loose) != 0 {
+		t.Fatalf("Expected no loose objects after gc, got %d", len(loose))
+	}
+
+	commit, err := repo.LoadCommit(head)
+	if err != nil {
+		t.Fatalf("LoadCommit from pack failed: %v", err)
+	}
+	blob := commit.FileBlobs[filepath.Join("src", "packed.txt")]
+	if !repo.BlobStore.HasBlob(ctx, blob) {
+		t.Fatalf("Expected packed blob %s to be found", blob)
+	}
+	data, err := ReadBlobDecompressed(ctx, repo.BlobStore, blob)
+	if err != nil || string(data) != "packed content for gc test" {
+		t.Fatalf("Reading packed blob returned %q, %v", data, err)
+	}
+	blobs, err := repo.BlobStore.ListBlobs(ctx)
+	if err != nil || len(blobs) == 0 {
+		t.Fatalf("Expected packed blobs to be listed, got %v, %v", blobs, err)
+	}
+
+	// New loose objects and the old pack are merged into one new pack
+	os.WriteFile(dir+"/src/packed.txt", []byte("second version"), 0644)
+	if _, err := repo.CreateCommit("Second", "tester"); err != nil {
+		t.Fatalf("CreateCommit after gc failed: %v", err)
+	}
+	again, err := repo.GC()
+	if err != nil {
+		t.Fatalf("Second GC failed: %v", err)
+	}
+	if again.PacksRemoved != 1 || again.Objects <= result.Objects {
+		t.Fatalf("Expected the old pack to be merged, got %+v", again)
+	}
+	packs, _ := filepath.Glob(filepath.Join(repo.packDir(), "*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("Expected a single pack, got %v", packs)
+	}
+	if _, err := repo.LoadCommit(head); err != nil {
+		t.Fatalf("LoadCommit after repack failed: %v", err)
+	}
+}
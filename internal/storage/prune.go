@@ -0,0 +1,518 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: prune.go
+// Description: Reachability walk and unreachable object pruning for Steria. Objects no ref, tag, stash or staged file can reach are deleted once they are older than a grace period.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPruneExpire is how old an unreachable object must be before 'steria prune' deletes it
+const DefaultPruneExpire = 14 * 24 * time.Hour
+
+// Reachability is the set of objects reachable from the repository's roots
+type Reachability struct {
+	Commits map[string]bool
+	Trees   map[string]bool
+	Blobs   map[string]bool // Includes chunk lists and their chunks
+
+	chunkLists []string // Chunk refs whose chunks still need marking
+}
+
+// PruneOptions controls a prune run
+type PruneOptions struct {
+	Expire time.Duration // Unreachable objects modified more recently than this are kept
+	DryRun bool          // Only report what would be deleted
+}
+
+// PruneResult lists the unreachable objects found and what was done with them
+type PruneResult struct {
+	Commits      []string // Unreachable commits old enough to delete
+	Trees        []string
+	Blobs        []string
+	Recent       int   // Unreachable objects kept because they are inside the grace period
+	CacheFiles   int   // Expired blob cache files
+	BytesFreed   int64 // Size of what was (or, for a dry run, would be) deleted
+	PacksRewrite int   // Packs rewritten without their unreachable objects
+}
+
+// Total returns the number of unreachable objects selected for deletion
+func (p *PruneResult) Total() int {
+	return len(p.Commits) + len(p.Trees) + len(p.Blobs)
+}
+
+// freshenObject bumps the mtime of an object that is being reused, so a
+// concurrent prune sees it as new and keeps it for the grace period
+func freshenObject(loosePath, packDir, hash string, kind PackObjectKind) {
+	now := time.Now()
+	if err := os.Chtimes(loosePath, now, now); err == nil {
+		return
+	}
+	key, ok := decodeHash(hash)
+	if !ok {
+		return
+	}
+	for _, pf := range loadPacks(packDir) {
+		if _, ok := pf.find(key, kind); ok {
+			os.Chtimes(pf.packPath, now, now)
+			return
+		}
+	}
+}
+
+// FreshenBlob marks an existing blob as recently used
+func (l *LocalBlobStore) FreshenBlob(hash string) {
+	freshenObject(filepath.Join(l.Dir, hash+".gz"), packDirFor(l.Dir), hash, PackBlob)
+}
+
+// freshenBlob marks a reused blob as recent if the store supports it
+func freshenBlob(store BlobStore, hash string) {
+	if f, ok := store.(interface{ FreshenBlob(hash string) }); ok {
+		f.FreshenBlob(hash)
+	}
+}
+
+// rootCommits returns every commit a ref points at: HEAD, MERGE_HEAD, all
+// branches, tags and remote-tracking refs, plus every still-stored commit a reflog or the
+// operation log names
+func (r *Repo) rootCommits() ([]string, error) {
+	steriaDir := filepath.Join(r.Path, ".steria")
+	var roots []string
+	addFile := func(path string) {
+		if data, err := os.ReadFile(path); err == nil {
+			if hash := strings.TrimSpace(string(data)); hash != "" {
+				roots = append(roots, hash)
+			}
+		}
+	}
+	addFile(filepath.Join(steriaDir, "HEAD"))
+	addFile(r.mergeHeadPath())
+
+	branchesDir := filepath.Join(steriaDir, "branches")
+	err := filepath.Walk(branchesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && !isRefScratchFile(path) {
+			addFile(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read branches: %w", err)
+	}
+
+	tagsDir := filepath.Join(steriaDir, "refs", "tags")
+	tags, _ := os.ReadDir(tagsDir)
+	for _, e := range tags {
+		data, err := os.ReadFile(filepath.Join(tagsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var tag struct {
+			Commit string `json:"commit"`
+		}
+		if json.Unmarshal(data, &tag) == nil && tag.Commit != "" {
+			roots = append(roots, tag.Commit)
+		}
+	}
+
+	filepath.Walk(filepath.Join(steriaDir, "refs", "remotes"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !isRefScratchFile(path) {
+			addFile(path)
+		}
+		return nil
+	})
+
+	for _, hash := range r.reflogCommits() {
+		if r.hasCommit(hash) {
+			roots = append(roots, hash)
+		}
+	}
+	opCommits, _, _ := r.operationRoots()
+	for _, hash := range opCommits {
+		if r.hasCommit(hash) {
+			roots = append(roots, hash)
+		}
+	}
+	return roots, nil
+}
+
+// rootBlobs returns blobs referenced outside of commits: stashed files, the
+// staging index and stashes the operation log remembers
+func (r *Repo) rootBlobs() []string {
+	var blobs []string
+	stashDir := filepath.Join(r.Path, ".steria", "stashes")
+	stashes, _ := os.ReadDir(stashDir)
+	for _, e := range stashes {
+		data, err := os.ReadFile(filepath.Join(stashDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var stash struct {
+			Files map[string]string `json:"files"`
+		}
+		if json.Unmarshal(data, &stash) == nil {
+			for _, blob := range stash.Files {
+				blobs = append(blobs, blob)
+			}
+		}
+	}
+	if data, err := os.ReadFile(r.indexPath()); err == nil {
+		var idx Index
+		if json.Unmarshal(data, &idx) == nil {
+			for _, entry := range idx.Entries {
+				blobs = append(blobs, entry.Hash)
+			}
+		}
+	}
+	_, _, opBlobs := r.operationRoots()
+	return append(blobs, opBlobs...)
+}
+
+// markBlobRef marks the blobs a commit's blob ref depends on. Legacy delta
+// refs ("delta:<base>:<patch>") keep both their base and patch alive.
+func (reach *Reachability) markBlobRef(ref string) {
+	if strings.HasPrefix(ref, "delta:") {
+		parts := strings.Split(ref, ":")
+		if len(parts) == 3 {
+			reach.markBlobRef(parts[1])
+			reach.Blobs[parts[2]] = true
+		}
+		return
+	}
+	if _, list, ok := parseChunkRef(ref); ok {
+		if !reach.Blobs[list] {
+			reach.Blobs[list] = true
+			reach.chunkLists = append(reach.chunkLists, ref)
+		}
+		return
+	}
+	reach.Blobs[strings.TrimSuffix(ref, ".gz")] = true
+}
+
+// markTree marks a tree and everything below it
+func (r *Repo) markTree(reach *Reachability, hash string) error {
+	if reach.Trees[hash] {
+		return nil
+	}
+	tree, err := r.LoadTree(hash)
+	if err != nil {
+		return fmt.Errorf("failed to load tree %s: %w", hash, err)
+	}
+	reach.Trees[hash] = true
+	for _, e := range tree.Entries {
+		if e.Type == TreeEntryTree {
+			if err := r.markTree(reach, e.Hash); err != nil {
+				return err
+			}
+		} else {
+			reach.markBlobRef(e.Hash)
+		}
+	}
+	return nil
+}
+
+// newReachability returns an empty reachability set
+func newReachability() *Reachability {
+	return &Reachability{Commits: map[string]bool{}, Trees: map[string]bool{}, Blobs: map[string]bool{}}
+}
+
+// markCommit marks a commit's tree and the blobs it names
+func (r *Repo) markCommit(reach *Reachability, commit *Commit) error {
+	reach.Commits[commit.Hash] = true
+	if commit.Tree != "" {
+		if err := r.markTree(reach, commit.Tree); err != nil {
+			return err
+		}
+	}
+	for _, blob := range commit.FileBlobs {
+		reach.markBlobRef(blob)
+	}
+	return nil
+}
+
+// expandBlobs marks the chunks of every marked chunk list and the delta bases
+// of every marked blob, all of which must be stored locally
+func (r *Repo) expandBlobs(reach *Reachability) error {
+	store := &LocalBlobStore{Dir: filepath.Join(r.Path, ".steria", "objects", "blobs")}
+	for _, ref := range reach.chunkLists {
+		list, err := LoadChunkList(r.Context(), store, ref)
+		if err != nil {
+			return err
+		}
+		for _, c := range list.Chunks {
+			reach.Blobs[c.Hash] = true
+		}
+	}
+	reach.chunkLists = nil
+
+	// A delta object needs its base blob, which only older history may reference
+	queue := make([]string, 0, len(reach.Blobs))
+	for blob := range reach.Blobs {
+		queue = append(queue, blob)
+	}
+	for len(queue) > 0 {
+		blob := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if base := deltaBase(r.storedBlobHeader(blob)); base != "" && !reach.Blobs[base] {
+			reach.Blobs[base] = true
+			queue = append(queue, base)
+		}
+	}
+	return nil
+}
+
+// Reachable walks every commit, tree and blob reachable from the repository's
+// refs, tags, stashes and staging index. A missing object along the way is an
+// error, since pruning with an incomplete walk could delete live data.
+func (r *Repo) Reachable() (*Reachability, error) {
+	reach := newReachability()
+	roots, err := r.rootCommits()
+	if err != nil {
+		return nil, err
+	}
+	stack := roots
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reach.Commits[hash] {
+			continue
+		}
+		commit, err := r.loadCommit(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commit %s: %w", hash, err)
+		}
+		if err := r.markCommit(reach, commit); err != nil {
+			return nil, err
+		}
+		stack = append(stack, commit.Parents...)
+	}
+	// Working directory and index snapshots of logged operations
+	_, opTrees, _ := r.operationRoots()
+	for _, hash := range opTrees {
+		if _, err := r.LoadTree(hash); err != nil {
+			continue
+		}
+		if err := r.markTree(reach, hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, blob := range r.rootBlobs() {
+		reach.markBlobRef(blob)
+	}
+	if err := r.expandBlobs(reach); err != nil {
+		return nil, err
+	}
+	return reach, nil
+}
+
+// storedBlobHeader returns the first bytes of a blob as stored in the local
+// repository, enough to tell a delta object and its base apart
+func (r *Repo) storedBlobHeader(hash string) []byte {
+	buf := make([]byte, deltaHeaderSize)
+	blobPath := filepath.Join(r.Path, ".steria", "objects", "blobs", hash+".gz")
+	if f, err := os.Open(blobPath); err == nil {
+		defer f.Close()
+		n, _ := io.ReadFull(f, buf)
+		return buf[:n]
+	}
+	key, ok := decodeHash(hash)
+	if !ok {
+		return nil
+	}
+	for _, pf := range loadPacks(r.packDir()) {
+		if e, ok := pf.find(key, PackBlob); ok {
+			if e.length > uint64(len(buf)) {
+				e.length = uint64(len(buf))
+			}
+			data, _ := pf.read(e)
+			return data
+		}
+	}
+	return nil
+}
+
+// reachable reports whether an object of the given kind is in the set
+func (reach *Reachability) reachable(kind PackObjectKind, hash string) bool {
+	switch kind {
+	case PackCommit:
+		return reach.Commits[hash]
+	case PackTree:
+		return reach.Trees[hash]
+	default:
+		return reach.Blobs[hash]
+	}
+}
+
+// record adds an object selected for deletion to the result
+func (p *PruneResult) record(kind PackObjectKind, hash string, size int64) {
+	switch kind {
+	case PackCommit:
+		p.Commits = append(p.Commits, hash)
+	case PackTree:
+		p.Trees = append(p.Trees, hash)
+	default:
+		p.Blobs = append(p.Blobs, hash)
+	}
+	p.BytesFreed += size
+}
+
+// Prune deletes unreachable objects older than opts.Expire, along with expired
+// blob cache files. Objects written or reused by a commit running at the same
+// time are newer than the grace period, and reachability is recomputed right
+// before deleting so refs that moved during the walk are honoured.
+func (r *Repo) Prune(opts PruneOptions) (*PruneResult, error) {
+	reach, err := r.Reachable()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-opts.Expire)
+	result := &PruneResult{}
+
+	loose, err := r.looseObjects()
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		looseObject
+		size int64
+	}
+	var doomed []candidate
+	for _, obj := range loose {
+		if reach.reachable(obj.kind, obj.hash) {
+			continue
+		}
+		info, err := os.Stat(obj.path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			result.Recent++
+			continue
+		}
+		doomed = append(doomed, candidate{obj, info.Size()})
+	}
+
+	// Packed objects share their pack's mtime
+	dir := r.packDir()
+	var stalePacks []*packFile
+	for _, pf := range loadPacks(dir) {
+		info, err := os.Stat(pf.packPath)
+		if err != nil {
+			continue
+		}
+		recent := info.ModTime().After(cutoff)
+		stale := false
+		for _, e := range pf.entries {
+			if reach.reachable(e.kind, fmt.Sprintf("%x", e.hash)) {
+				continue
+			}
+			if recent {
+				result.Recent++
+				continue
+			}
+			stale = true
+		}
+		if stale {
+			stalePacks = append(stalePacks, pf)
+		}
+	}
+
+	cacheDir := filepath.Join(r.Path, ".steria", "objects", "cache")
+	cacheFiles, _ := os.ReadDir(cacheDir)
+	var expiredCache []string
+	for _, e := range cacheFiles {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		expiredCache = append(expiredCache, filepath.Join(cacheDir, e.Name()))
+		result.CacheFiles++
+		result.BytesFreed += info.Size()
+	}
+
+	// Recompute reachability so anything a concurrent commit or branch update
+	// made reachable during the scan is kept
+	if !opts.DryRun {
+		if reach, err = r.Reachable(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range doomed {
+		if reach.reachable(c.kind, c.hash) {
+			continue
+		}
+		if !opts.DryRun {
+			// Re-check the mtime: the object may have been reused since the scan
+			if info, err := os.Stat(c.path); err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(c.path); err != nil {
+				return nil, fmt.Errorf("failed to remove %s: %w", c.path, err)
+			}
+			if c.kind != PackBlob {
+				os.Remove(filepath.Dir(c.path))
+			}
+		}
+		result.record(c.kind, c.hash, c.size)
+	}
+
+	if len(stalePacks) > 0 {
+		var keep []packObject
+		for _, pf := range stalePacks {
+			for _, e := range pf.entries {
+				hash := fmt.Sprintf("%x", e.hash)
+				if !reach.reachable(e.kind, hash) {
+					result.record(e.kind, hash, int64(e.length))
+					continue
+				}
+				if opts.DryRun {
+					continue
+				}
+				keep = append(keep, pf.object(e))
+			}
+		}
+		if !opts.DryRun {
+			if len(keep) > 0 {
+				if _, err := writePack(dir, keep); err != nil {
+					return nil, err
+				}
+			}
+			for _, pf := range stalePacks {
+				// A pack reused by a commit since the scan is left for the next run
+				if info, err := os.Stat(pf.packPath); err != nil || info.ModTime().After(cutoff) {
+					continue
+				}
+				os.Remove(strings.TrimSuffix(pf.packPath, ".pack") + ".idx")
+				os.Remove(pf.packPath)
+			}
+			forgetPacks(dir)
+		}
+		result.PacksRewrite = len(stalePacks)
+	}
+
+	if !opts.DryRun {
+		for _, path := range expiredCache {
+			os.Remove(path)
+		}
+	}
+
+	sort.Strings(result.Commits)
+	sort.Strings(result.Trees)
+	sort.Strings(result.Blobs)
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ageObjects backdates every object file so it falls outside the grace period
+func ageObjects(t *testing.T, repo *Repo) {
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	filepath.Walk(filepath.Join(repo.Path, ".steria", "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+}
+
+func TestPruneRemovesUnreachableObjects(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.WriteFile(dir+"/keep.txt", []byte("kept"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	kept := repo.Head
+
+	os.WriteFile(dir+"/dropped.txt", []byte("only in the dropped commit"), 0644)
+	dropped, err := repo.CreateCommit("Dropped", "tester")
+	if err != nil {
+		t.Fatalf("CreateCommit failed: %v", err)
+	}
+	droppedBlob := dropped.FileBlobs["dropped.txt"]
+	if err := repo.advanceHead(kept, "test"); err != nil {
+		t.Fatalf("advanceHead failed: %v", err)
+	}
+	// The reflog keeps every commit a ref once named; forget it
+	os.RemoveAll(dir + "/.steria/logs")
+
+	// Fresh unreachable objects are protected by the grace period
+	result, err := repo.Prune(PruneOptions{Expire: DefaultPruneExpire})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if result.Total() != 0 || result.Recent == 0 {
+		t.Fatalf("Expected recent objects to be kept, got %+v", result)
+	}
+
+	ageObjects(t, repo)
+	dry, err := repo.Prune(PruneOptions{Expire: DefaultPruneExpire, DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(dry.Commits) != 1 || dry.Commits[0] != dropped.Hash || len(dry.Blobs) != 1 || dry.Blobs[0] != droppedBlob {
+		t.Fatalf("Expected the dropped commit and its blob to be listed, got %+v", dry)
+	}
+	if _, err := repo.loadCommit(dropped.Hash); err != nil {
+		t.Fatalf("Dry run deleted the commit: %v", err)
+	}
+
+	if _, err := repo.Prune(PruneOptions{Expire: DefaultPruneExpire}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if _, err := repo.loadCommit(dropped.Hash); err == nil {
+		t.Error("Expected unreachable commit to be deleted")
+	}
+	if repo.BlobStore.HasBlob(ctx, droppedBlob) {
+		t.Error("Expected unreachable blob to be deleted")
+	}
+	commit, err := repo.LoadCommit(kept)
+	if err != nil {
+		t.Fatalf("Reachable commit was deleted: %v", err)
+	}
+	if !repo.BlobStore.HasBlob(ctx, commit.FileBlobs["keep.txt"]) {
+		t.Error("Reachable blob was deleted")
+	}
+}
+
+func TestPruneRewritesPacks(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/keep.txt", []byte("kept in pack"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	kept := repo.Head
+	os.WriteFile(dir+"/dropped.txt", []byte("packed but dropped"), 0644)
+	dropped, _ := repo.CreateCommit("Dropped", "tester")
+	repo.advanceHead(kept, "test")
+	os.RemoveAll(dir + "/.steria/logs")
+	if _, err := repo.GC(); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	ageObjects(t, repo)
+
+	result, err := repo.Prune(PruneOptions{Expire: time.Hour})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if result.PacksRewrite != 1 || len(result.Commits) != 1 {
+		t.Fatalf("Expected the pack to be rewritten without the dropped commit, got %+v", result)
+	}
+	if _, err := repo.loadCommit(dropped.Hash); err == nil {
+		t.Error("Expected packed unreachable commit to be deleted")
+	}
+	if _, err := repo.LoadCommit(kept); err != nil {
+		t.Fatalf("Reachable packed commit was lost: %v", err)
+	}
+}
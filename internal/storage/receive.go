@@ -0,0 +1,184 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: receive.go
+// Description: Verified blob transfer into a local Steria store. Blobs from remotes and uploads are decoded and re-hashed before they become visible, and content that does not match its name is quarantined.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobRejected marks a received blob whose content does not match its name
+var ErrBlobRejected = errors.New("blob failed verification")
+
+// quarantineDirFor returns the quarantine directory next to a blob directory
+func quarantineDirFor(blobDir string) string {
+	return filepath.Join(filepath.Dir(blobDir), "quarantine")
+}
+
+// ReceiveBlob stores a blob read from an untrusted source in a local store.
+// The stored bytes are written to the quarantine directory while they are
+// decompressed and re-hashed, and only moved into the store once they match
+// hash. Rejected content stays in quarantine for inspection and the error
+// wraps ErrBlobRejected. Delta objects are resolved against bases already in
+// the local store.
+func ReceiveBlob(ctx context.Context, dst *LocalBlobStore, hash string, r io.Reader) error {
+	hash = strings.TrimSuffix(hash, ".gz")
+	if _, ok := decodeHash(hash); !ok {
+		return fmt.Errorf("%w: %q is not a content hash", ErrBlobRejected, hash)
+	}
+	quarantine := quarantineDirFor(dst.Dir)
+	if err := os.MkdirAll(quarantine, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(quarantine, hash+".gz.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	plain, verr := verifyStoredStream(ctx, dst, hash, io.TeeReader(&contextReader{ctx: ctx, r: r}, tmp))
+	if err := tmp.Close(); err != nil && verr == nil {
+		verr = err
+	}
+	if verr != nil {
+		if ctx.Err() != nil || !errors.Is(verr, ErrBlobRejected) {
+			return verr
+		}
+		held := filepath.Join(quarantine, hash+".gz")
+		os.Rename(tmp.Name(), held)
+		return fmt.Errorf("%w; quarantined at %s", verr, held)
+	}
+	if plain {
+		// Blobs are stored compressed, so uncompressed content is gzipped first
+		return compressInto(tmp.Name(), filepath.Join(dst.Dir, hash+".gz"))
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dst.Dir, hash+".gz"))
+}
+
+// compressInto gzips the file at src into dst, which appears complete or not
+// at all
+func compressInto(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to compress blob: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to compress blob: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// verifyStoredStream reads a stored blob to the end and checks that it
+// decodes to content with the given hash. It reports whether the blob was
+// plain, uncompressed content rather than a gzip or delta object.
+func verifyStoredStream(ctx context.Context, dst *LocalBlobStore, hash string, r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(deltaObjectMagic))
+	sum := sha256.New()
+	plain := false
+	switch {
+	case bytes.Equal(magic, deltaObjectMagic):
+		stored, err := io.ReadAll(io.LimitReader(br, maxDeltaObjectSize+1))
+		if err != nil {
+			return false, err
+		}
+		if len(stored) > maxDeltaObjectSize {
+			return false, fmt.Errorf("%w: %s: delta object exceeds %d bytes", ErrBlobRejected, hash, maxDeltaObjectSize)
+		}
+		if base := deltaBase(stored); base != "" && !dst.HasBlob(ctx, base) {
+			return false, fmt.Errorf("delta base %s of blob %s is not stored", base, hash)
+		}
+		if _, err := readDeltaObject(ctx, dst, hash, stored); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, fmt.Errorf("%w: %s: %v", ErrBlobRejected, hash, err)
+		}
+		return false, nil
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return false, fmt.Errorf("%w: %s: %v", ErrBlobRejected, hash, err)
+		}
+		_, err = io.Copy(sum, gr)
+		gr.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+				return false, fmt.Errorf("%w: %s: %v", ErrBlobRejected, hash, err)
+			}
+			return false, err
+		}
+	default:
+		plain = true
+		if _, err := io.Copy(sum, br); err != nil {
+			return false, err
+		}
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return false, fmt.Errorf("%w: %s: content hash mismatch", ErrBlobRejected, hash)
+	}
+	return plain, nil
+}
+
+// FetchBlob copies a blob from a remote into a local store, verifying it with
+// ReceiveBlob. The base of a delta object is fetched first when the local
+// store does not have it yet.
+func FetchBlob(ctx context.Context, dst *LocalBlobStore, src BlobStore, hash string) error {
+	return fetchBlob(ctx, dst, src, strings.TrimSuffix(hash, ".gz"), 0)
+}
+
+func fetchBlob(ctx context.Context, dst *LocalBlobStore, src BlobStore, hash string, depth int) error {
+	if depth > maxDeltaDepth {
+		return fmt.Errorf("%w: delta chain for %s is too deep", ErrBlobRejected, hash)
+	}
+	in, err := src.OpenBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReaderSize(in, deltaHeaderSize)
+	header, _ := br.Peek(deltaHeaderSize)
+	if base := deltaBase(header); base != "" && !dst.HasBlob(ctx, base) {
+		if _, ok := decodeHash(base); !ok {
+			return fmt.Errorf("%w: %s names an invalid delta base", ErrBlobRejected, hash)
+		}
+		if err := fetchBlob(ctx, dst, src, base, depth+1); err != nil {
+			return fmt.Errorf("failed to fetch delta base %s: %w", base, err)
+		}
+	}
+	return ReceiveBlob(ctx, dst, hash, br)
+}
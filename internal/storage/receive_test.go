@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchBlobVerifiesAndQuarantines(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	remote := &LocalBlobStore{Dir: filepath.Join(dir, "remote", "blobs")}
+	local := &LocalBlobStore{Dir: filepath.Join(dir, "local", "objects", "blobs")}
+	hashOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	// A delta whose base only the remote has
+	base := make([]byte, 64*1024)
+	rand.New(rand.NewSource(14)).Read(base)
+	edited := append([]byte("edited header "), base...)
+	baseHash, editedHash := hashOf(base), hashOf(edited)
+	compressed, _ := compressBytes(base)
+	remote.PutBlob(ctx, baseHash, compressed)
+	if ok, err := writeBlobDelta(ctx, remote, editedHash, baseHash, edited); !ok || err != nil {
+		t.Fatalf("writeBlobDelta failed: %v, %v", ok, err)
+	}
+	if err := FetchBlob(ctx, local, remote, editedHash); err != nil {
+		t.Fatalf("FetchBlob of a delta failed: %v", err)
+	}
+	if !local.HasBlob(ctx, baseHash) {
+		t.Error("Expected the delta base to be fetched first")
+	}
+	data, err := ReadBlobDecompressed(ctx, local, editedHash)
+	if err != nil || !bytes.Equal(data, edited) {
+		t.Errorf("Fetched delta does not read back: %v", err)
+	}
+
+	// A remote that serves the wrong content under a hash
+	poisoned := hashOf([]byte("what the name promises"))
+	wrong, _ := compressBytes([]byte("something else entirely"))
+	remote.PutBlob(ctx, poisoned, wrong)
+	err = FetchBlob(ctx, local, remote, poisoned)
+	if !errors.Is(err, ErrBlobRejected) {
+		t.Fatalf("Expected a mismatched blob to be rejected, got %v", err)
+	}
+	if local.HasBlob(ctx, poisoned) {
+		t.Error("A rejected blob must not enter the store")
+	}
+	held := filepath.Join(quarantineDirFor(local.Dir), poisoned+".gz")
+	if got, _ := os.ReadFile(held); !bytes.Equal(got, wrong) {
+		t.Errorf("Expected the rejected bytes in quarantine at %s", held)
+	}
+
+	// Uploads get the same treatment, and names must be content hashes
+	if err := ReceiveBlob(ctx, local, "../escape", bytes.NewReader(wrong)); !errors.Is(err, ErrBlobRejected) {
+		t.Errorf("Expected a non-hash name to be rejected, got %v", err)
+	}
+	good := []byte("uploaded content")
+	goodCompressed, _ := compressBytes(good)
+	if err := ReceiveBlob(ctx, local, hashOf(good)+".gz", bytes.NewReader(goodCompressed)); err != nil {
+		t.Fatalf("ReceiveBlob of valid content failed: %v", err)
+	}
+	if data, err := ReadBlobDecompressed(ctx, local, hashOf(good)); err != nil || !bytes.Equal(data, good) {
+		t.Errorf("Received blob does not read back: %v", err)
+	}
+	if entries, _ := os.ReadDir(quarantineDirFor(local.Dir)); len(entries) != 1 {
+		t.Errorf("Expected only the rejected blob in quarantine, got %d entries", len(entries))
+	}
+
+	// Uncompressed uploads are stored compressed so they read back
+	plain := []byte("uploaded without compression")
+	if err := ReceiveBlob(ctx, local, hashOf(plain), bytes.NewReader(plain)); err != nil {
+		t.Fatalf("ReceiveBlob of plain content failed: %v", err)
+	}
+	if data, err := ReadBlobDecompressed(ctx, local, hashOf(plain)); err != nil || !bytes.Equal(data, plain) {
+		t.Errorf("Plain upload does not read back: %v", err)
+	}
+
+	// A delta object past the size bound is refused without reading it all
+	huge := io.MultiReader(bytes.NewReader(deltaObjectMagic), io.LimitReader(zeroReader{}, maxDeltaObjectSize+1024))
+	if err := ReceiveBlob(ctx, local, hashOf([]byte("huge")), huge); !errors.Is(err, ErrBlobRejected) {
+		t.Errorf("Expected an oversized delta object to be rejected, got %v", err)
+	}
+}
+
+// zeroReader reads an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,289 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: reflog.go
+// Description: Reflogs for Steria. Every move of HEAD or a branch is appended to a per-ref log under .steria/logs recording the old and new commit, when, who and which operation moved it, so overwritten commits can still be found and named as Stem@{2} or HEAD@{yesterday}.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReflogEntry records one move of a ref
+type ReflogEntry struct {
+	Old   string    `json:"old"` // Empty when the ref was created
+	New   string    `json:"new"`
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor"`
+	Op    string    `json:"op"` // e.g. "commit: fix the parser", "switch-branch: Stem -> dev"
+}
+
+// WithOperation returns a shallow copy of the repository whose ref updates
+// are recorded in the reflog under op instead of the default operation name,
+// e.g. "rebase" for the commits a rebase creates
+func (r *Repo) WithOperation(op string) *Repo {
+	rc := *r
+	rc.op = op
+	return &rc
+}
+
+// operation returns the name ref updates are logged under
+func (r *Repo) operation(def string) string {
+	if r.op != "" {
+		return r.op
+	}
+	return def
+}
+
+// refPath returns the file holding ref: HEAD, a branch name, or a full
+// refs/... name such as refs/remotes/origin/Stem
+func (r *Repo) refPath(ref string) string {
+	switch {
+	case ref == "HEAD":
+		return filepath.Join(r.Path, ".steria", "HEAD")
+	case strings.HasPrefix(ref, "refs/"):
+		return filepath.Join(r.Path, ".steria", filepath.FromSlash(ref))
+	}
+	return filepath.Join(r.Path, ".steria", "branches", filepath.FromSlash(ref))
+}
+
+// reflogPath returns the log file of ref
+func (r *Repo) reflogPath(ref string) string {
+	switch {
+	case ref == "HEAD":
+		return filepath.Join(r.Path, ".steria", "logs", "HEAD")
+	case strings.HasPrefix(ref, "refs/"):
+		return filepath.Join(r.Path, ".steria", "logs", filepath.FromSlash(ref))
+	}
+	return filepath.Join(r.Path, ".steria", "logs", "branches", filepath.FromSlash(ref))
+}
+
+// UpdateRef points ref (HEAD or a branch name) at hash under the ref's lock
+// and records the move in the ref's reflog. Writing the value the ref already
+// holds is not logged.
+func (r *Repo) UpdateRef(ref, hash, op string) error {
+	return r.NewRefTransaction().Update(ref, hash, op).Commit()
+}
+
+// appendReflog adds one entry to the end of ref's log
+func (r *Repo) appendReflog(ref string, entry ReflogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := r.reflogPath(ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to write reflog of %s: %w", ref, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write reflog of %s: %w", ref, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write reflog of %s: %w", ref, err)
+	}
+	return f.Close()
+}
+
+// Reflog returns the entries of ref's log, newest first. A ref that has
+// never moved has an empty log.
+func (r *Repo) Reflog(ref string) ([]ReflogEntry, error) {
+	f, err := os.Open(r.reflogPath(ref))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reflog of %s: %w", ref, err)
+	}
+	defer f.Close()
+
+	var entries []ReflogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry ReflogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // A torn final line from an interrupted write
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reflog of %s: %w", ref, err)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// renameReflog moves a branch's log along with the branch
+func (r *Repo) renameReflog(oldName, newName string) error {
+	oldPath, newPath := r.reflogPath(oldName), r.reflogPath(newName)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// deleteReflog removes a deleted branch's log. Its commits stay findable
+// through the HEAD reflog.
+func (r *Repo) deleteReflog(name string) error {
+	err := os.Remove(r.reflogPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// reflogCommits returns every commit named by any reflog entry
+func (r *Repo) reflogCommits() []string {
+	var hashes []string
+	seen := map[string]bool{}
+	logsDir := filepath.Join(r.Path, ".steria", "logs")
+	filepath.Walk(logsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(logsDir, path)
+		ref := filepath.ToSlash(rel)
+		if ref != "HEAD" {
+			ref = strings.TrimPrefix(ref, "branches/")
+		}
+		entries, _ := r.Reflog(ref)
+		for _, e := range entries {
+			for _, hash := range []string{e.Old, e.New} {
+				if hash != "" && !seen[hash] {
+					seen[hash] = true
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+		return nil
+	})
+	return hashes
+}
+
+var (
+	actorOnce sync.Once
+	actorName string
+)
+
+// reflogActor names whoever is running steria: the OS user
+func reflogActor() string {
+	actorOnce.Do(func() {
+		if u, err := user.Current(); err == nil && u.Username != "" {
+			actorName = u.Username
+		} else if name := os.Getenv("USER"); name != "" {
+			actorName = name
+		} else {
+			actorName = "unknown"
+		}
+	})
+	return actorName
+}
+
+// resolveReflog resolves ref@{n} (the value ref had n moves ago) and
+// ref@{date} (the value ref had at that time)
+func (r *Repo) resolveReflog(ref, selector string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if ref != "HEAD" {
+		if _, err := os.Stat(r.refPath(ref)); err != nil {
+			return "", fmt.Errorf("unknown branch '%s'", ref)
+		}
+	}
+	entries, err := r.Reflog(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no reflog for '%s'", ref)
+	}
+
+	if n, err := strconv.Atoi(selector); err == nil {
+		switch {
+		case n < 0:
+			return "", fmt.Errorf("invalid reflog index %d", n)
+		case n < len(entries):
+			return entries[n].New, nil
+		case n == len(entries) && entries[n-1].Old != "":
+			return entries[n-1].Old, nil
+		}
+		return "", fmt.Errorf("reflog of '%s' only has %d entries", ref, len(entries))
+	}
+
+	when, err := parseReflogTime(selector, time.Now())
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if !e.Time.After(when) {
+			return e.New, nil
+		}
+	}
+	if oldest := entries[len(entries)-1]; oldest.Old != "" {
+		return oldest.Old, nil // Before the log starts the ref held the first entry's old value
+	}
+	return "", fmt.Errorf("'%s' did not exist at %s", ref, when.Format(time.RFC3339))
+}
+
+// reflogUnits are the units accepted in relative reflog dates
+var reflogUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// parseReflogTime parses the date of a ref@{date} revision: now, yesterday,
+// relative dates such as "2.hours.ago" or "3 days ago", or an absolute
+// RFC 3339 time, "2006-01-02 15:04:05" or "2006-01-02" in local time
+func parseReflogTime(s string, now time.Time) (time.Time, error) {
+	switch s {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.Add(-24 * time.Hour), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	fields := strings.FieldsFunc(s, func(c rune) bool { return c == '.' || c == ' ' })
+	if len(fields) == 3 && fields[2] == "ago" {
+		fields = fields[:2]
+	}
+	if len(fields) == 2 {
+		n, err := strconv.Atoi(fields[0])
+		unit, ok := reflogUnits[strings.TrimSuffix(fields[1], "s")]
+		if err == nil && ok && n >= 0 {
+			return now.Add(-time.Duration(n) * unit), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid reflog date '%s'", s)
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReflogRecordsRefMovesAndResolvesSelectors(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := repo.Head
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha two"), 0644)
+	second, err := repo.CreateCommit("second\n\nbody", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := repo.Reflog("Stem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 || entries[0].New != second.Hash || entries[0].Old != first || entries[0].Op != "commit: second" {
+		t.Fatalf("Expected the newest Stem entry to record the commit, got %+v", entries)
+	}
+	if entries[0].Actor == "" || entries[0].Time.IsZero() {
+		t.Errorf("Expected an actor and time, got %+v", entries[0])
+	}
+	if head, _ := repo.Reflog("HEAD"); len(head) != len(entries) {
+		t.Errorf("Expected HEAD and Stem to log the same moves, got %d and %d entries", len(head), len(entries))
+	}
+
+	// A rebase-style move back loses the second commit from every ref
+	if err := repo.WithOperation("rebase").UpdateRef("Stem", first, "rebase (finish)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpdateRef("Stem", first, "noop"); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := repo.Reflog("Stem"); len(after) != len(entries)+1 {
+		t.Errorf("Expected rewriting the same value not to be logged, got %d entries", len(after))
+	}
+	for rev, want := range map[string]string{
+		"Stem@{0}":   first,
+		"Stem@{1}":   second.Hash,
+		"Stem@{2}":   first,
+		"HEAD@{0}":   second.Hash,
+		"Stem@{now}": first,
+	} {
+		got, err := repo.ResolveRevision(rev)
+		if err != nil || got != want {
+			t.Errorf("ResolveRevision(%s) = %s, %v; want %s", rev, got, err, want)
+		}
+	}
+	for _, rev := range []string{"Stem@{99}", "missing@{0}", "Stem@{sometime}"} {
+		if _, err := repo.ResolveRevision(rev); err == nil {
+			t.Errorf("Expected ResolveRevision(%s) to fail", rev)
+		}
+	}
+
+	// The commit only the reflog remembers survives pruning and is not dangling
+	reach, err := repo.Reachable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reach.Commits[second.Hash] {
+		t.Error("Expected a commit named by the reflog to stay reachable")
+	}
+	result, err := repo.Fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := findProblem(result, FsckDangling, second.Hash); p != nil {
+		t.Errorf("Expected a reflog commit not to be dangling, got %+v", p)
+	}
+
+	// Renaming a branch moves its log; deleting it removes the log
+	if err := repo.renameReflog("Stem", "trunk"); err != nil {
+		t.Fatal(err)
+	}
+	if moved, _ := repo.Reflog("trunk"); len(moved) == 0 {
+		t.Error("Expected the reflog to follow the renamed branch")
+	}
+	repo.deleteReflog("trunk")
+	if gone, _ := repo.Reflog("trunk"); len(gone) != 0 {
+		t.Error("Expected the reflog of a deleted branch to be removed")
+	}
+}
+
+func TestParseReflogTime(t *testing.T) {
+	now := time.Date(2025, 6, 10, 12, 0, 0, 0, time.UTC)
+	for in, want := range map[string]time.Time{
+		"now":                  now,
+		"yesterday":            now.Add(-24 * time.Hour),
+		"2.hours.ago":          now.Add(-2 * time.Hour),
+		"3 days ago":           now.Add(-72 * time.Hour),
+		"1.week":               now.Add(-7 * 24 * time.Hour),
+		"2025-06-01T08:00:00Z": time.Date(2025, 6, 1, 8, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseReflogTime(in, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseReflogTime(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseReflogTime("2.fortnights.ago", now); err == nil {
+		t.Error("Expected an unknown unit to be rejected")
+	}
+}
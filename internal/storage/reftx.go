@@ -0,0 +1,299 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: reftx.go
+// Description: Ref transactions for Steria. HEAD, branch refs and the current-branch file are updated under per-ref lock files, each update can require the ref to still hold an expected value, and a transaction over several refs either applies completely or not at all, so concurrent steria processes never leave HEAD and a branch disagreeing.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrRefConflict is returned when a ref no longer holds the value an update expected
+var ErrRefConflict = errors.New("ref changed concurrently")
+
+// ErrRefLocked is returned when another process holds a ref's lock for too long
+var ErrRefLocked = errors.New("ref is locked by another steria process")
+
+// refLockTimeout is how long a transaction waits for another process's ref lock
+var refLockTimeout = 2 * time.Second
+
+// currentBranchRef names the current-branch file in a transaction's updates
+const currentBranchRef = "(current branch)"
+
+// refUpdate is one change in a ref transaction
+type refUpdate struct {
+	ref      string // HEAD, a branch name, or currentBranchRef
+	path     string
+	value    string // New value; ignored for deletes
+	old      string // Expected current value when check is set; "" means absent
+	check    bool
+	delete   bool
+	op       string
+	renameTo string // Branch whose reflog this branch's log moves to
+
+	current string // Value found once the ref was locked
+	existed bool
+	lock    string
+}
+
+// ReadRef returns the commit ref (HEAD or a branch name) points at
+func (r *Repo) ReadRef(ref string) (string, error) {
+	data, err := os.ReadFile(r.refPath(ref))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("ref '%s' does not exist", ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// RefTransaction collects ref updates and applies them together. Updates are
+// applied by Commit with every ref locked: if any expected value does not
+// match, or any write fails, no ref is changed.
+type RefTransaction struct {
+	r       *Repo
+	updates []*refUpdate
+}
+
+// NewRefTransaction starts an empty ref transaction
+func (r *Repo) NewRefTransaction() *RefTransaction {
+	return &RefTransaction{r: r}
+}
+
+func (t *RefTransaction) add(u *refUpdate) *RefTransaction {
+	if u.path == "" {
+		u.path = t.r.refPath(u.ref)
+	}
+	t.updates = append(t.updates, u)
+	return t
+}
+
+// Update points ref (HEAD or a branch name) at hash whatever it holds now
+func (t *RefTransaction) Update(ref, hash, op string) *RefTransaction {
+	return t.add(&refUpdate{ref: ref, value: hash, op: op})
+}
+
+// UpdateFrom points ref at hash only if it still holds old. An empty old
+// requires the ref not to exist yet (or to be empty).
+func (t *RefTransaction) UpdateFrom(ref, hash, old, op string) *RefTransaction {
+	return t.add(&refUpdate{ref: ref, value: hash, old: old, check: true, op: op})
+}
+
+// Create adds a branch that must not exist yet
+func (t *RefTransaction) Create(ref, hash, op string) *RefTransaction {
+	return t.UpdateFrom(ref, hash, "", op)
+}
+
+// Delete removes a branch, and its reflog, if it still holds old
+func (t *RefTransaction) Delete(ref, old string) *RefTransaction {
+	return t.add(&refUpdate{ref: ref, old: old, check: true, delete: true})
+}
+
+// Rename moves branch oldName, which must still hold hash, to newName, which
+// must not exist yet. The branch's reflog moves with it.
+func (t *RefTransaction) Rename(oldName, newName, hash, op string) *RefTransaction {
+	t.add(&refUpdate{ref: oldName, old: hash, check: true, delete: true, renameTo: newName})
+	return t.Create(newName, hash, op)
+}
+
+// SetCurrentBranch records name as the checked-out branch
+func (t *RefTransaction) SetCurrentBranch(name string) *RefTransaction {
+	return t.add(&refUpdate{ref: currentBranchRef, path: filepath.Join(t.r.Path, ".steria", "branch"), value: name})
+}
+
+// Commit locks every ref in the transaction, checks their expected values and
+// applies all updates. On any error the refs are left as they were.
+func (t *RefTransaction) Commit() error {
+	updates := append([]*refUpdate(nil), t.updates...)
+	sort.Slice(updates, func(i, j int) bool { return updates[i].path < updates[j].path })
+	for i := 1; i < len(updates); i++ {
+		if updates[i].path == updates[i-1].path {
+			return fmt.Errorf("ref transaction updates %s twice", updates[i].ref)
+		}
+	}
+
+	// Lock in path order so concurrent transactions cannot deadlock
+	defer func() {
+		for _, u := range updates {
+			if u.lock != "" {
+				os.Remove(u.lock)
+			}
+		}
+	}()
+	for _, u := range updates {
+		if err := u.acquire(); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range updates {
+		if err := u.verify(); err != nil {
+			return err
+		}
+	}
+
+	// Each lock file already holds its new value; renaming it over the ref is
+	// atomic, and a failure part way rolls the earlier refs back
+	var applied []*refUpdate
+	for _, u := range updates {
+		var err error
+		if u.delete {
+			err = os.Remove(u.path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.Rename(u.lock, u.path)
+			if err == nil {
+				u.lock = ""
+			}
+		}
+		if err != nil {
+			for _, done := range applied {
+				done.rollback()
+			}
+			return fmt.Errorf("failed to update %s: %w", u.ref, err)
+		}
+		applied = append(applied, u)
+	}
+
+	for _, u := range updates {
+		switch {
+		case u.ref == currentBranchRef:
+			t.r.Branch = u.value
+		case u.renameTo != "":
+			t.r.renameReflog(u.ref, u.renameTo)
+		case u.delete:
+			t.r.deleteReflog(u.ref)
+		}
+	}
+	for _, u := range updates {
+		if u.ref == currentBranchRef || u.delete {
+			continue
+		}
+		if u.ref == "HEAD" {
+			t.r.Head = u.value
+		}
+		if u.current != u.value {
+			entry := ReflogEntry{Old: u.current, New: u.value, Time: time.Now(), Actor: reflogActor(), Op: u.op}
+			if err := t.r.appendReflog(u.ref, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// acquire creates the ref's lock file holding its new value and reads the
+// value the ref has under the lock
+func (u *refUpdate) acquire() error {
+	if err := os.MkdirAll(filepath.Dir(u.path), 0755); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", u.ref, err)
+	}
+	lock := u.path + ".lock"
+	deadline := time.Now().Add(refLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			u.lock = lock
+			_, err = f.WriteString(u.value)
+			if err == nil {
+				err = f.Sync()
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to lock %s: %w", u.ref, err)
+			}
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to lock %s: %w", u.ref, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s (remove %s if no steria process is running)", ErrRefLocked, u.ref, lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data, err := os.ReadFile(u.path)
+	switch {
+	case err == nil:
+		u.current, u.existed = strings.TrimSpace(string(data)), true
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read %s: %w", u.ref, err)
+	}
+	return nil
+}
+
+// verify checks a locked ref against the value the update expects
+func (u *refUpdate) verify() error {
+	if !u.check || u.current == u.old {
+		return nil
+	}
+	if u.old == "" {
+		return fmt.Errorf("%w: %s already exists at %s", ErrRefConflict, u.ref, shortRef(u.current))
+	}
+	if !u.existed {
+		return fmt.Errorf("%w: %s no longer exists, expected %s", ErrRefConflict, u.ref, shortRef(u.old))
+	}
+	return fmt.Errorf("%w: %s is at %s, expected %s", ErrRefConflict, u.ref, shortRef(u.current), shortRef(u.old))
+}
+
+// compareAndSwapFile moves a ref file outside a repository's own refs, such
+// as a branch of a local remote, from old ("" for absent) to value under the
+// same lock protocol as a ref transaction. Nothing is logged.
+func compareAndSwapFile(name, path, old, value string) error {
+	u := &refUpdate{ref: name, path: path, value: value, old: old, check: true}
+	defer func() {
+		if u.lock != "" {
+			os.Remove(u.lock)
+		}
+	}()
+	if err := u.acquire(); err != nil {
+		return err
+	}
+	if err := u.verify(); err != nil {
+		return err
+	}
+	if err := os.Rename(u.lock, u.path); err != nil {
+		return fmt.Errorf("failed to update %s: %w", name, err)
+	}
+	u.lock = ""
+	return nil
+}
+
+// rollback restores a ref that was already updated to the value it had
+func (u *refUpdate) rollback() {
+	if !u.existed {
+		os.Remove(u.path)
+		return
+	}
+	atomicWrite(u.path, []byte(u.current))
+}
+
+// isRefScratchFile reports whether a file among the refs is a lock or a
+// temporary file of an update in progress rather than a ref
+func isRefScratchFile(path string) bool {
+	return strings.HasSuffix(path, ".lock") || strings.HasSuffix(path, ".tmp")
+}
+
+// shortRef abbreviates a ref value for messages
+func shortRef(value string) string {
+	if value == "" {
+		return "nothing"
+	}
+	if len(value) > 8 {
+		return value[:8]
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRefTransactionsAreAtomicAndCompareAndSwap(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := repo.Head
+	other := strings.Repeat("b", 64)
+	third := strings.Repeat("c", 64)
+
+	// A stale expected value changes nothing, not even the refs that matched
+	err = repo.NewRefTransaction().
+		UpdateFrom("HEAD", other, base, "test").
+		Create("dev", other, "test").
+		UpdateFrom("Stem", other, third, "test").
+		SetCurrentBranch("dev").
+		Commit()
+	if !errors.Is(err, ErrRefConflict) {
+		t.Fatalf("Expected ErrRefConflict, got %v", err)
+	}
+	if head, _ := repo.ReadRef("HEAD"); head != base || repo.Head != base {
+		t.Errorf("Expected HEAD to stay at %s, got %s", base, head)
+	}
+	if _, err := repo.ReadRef("dev"); err == nil {
+		t.Error("Expected the failed transaction not to create dev")
+	}
+	if current, _ := os.ReadFile(filepath.Join(dir, ".steria", "branch")); string(current) != "Stem" {
+		t.Errorf("Expected the current branch to stay Stem, got %q", current)
+	}
+	if locks, _ := filepath.Glob(filepath.Join(dir, ".steria", "branches", "*.lock")); len(locks) != 0 {
+		t.Errorf("Expected no lock files to be left behind, got %v", locks)
+	}
+
+	// A matching transaction moves every ref and the current branch together
+	err = repo.NewRefTransaction().
+		UpdateFrom("HEAD", other, base, "test").
+		Create("dev", other, "test").
+		SetCurrentBranch("dev").
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev, _ := repo.ReadRef("dev"); dev != other || repo.Head != other || repo.Branch != "dev" {
+		t.Errorf("Expected HEAD and dev at %s on dev, got %s, %s on %s", other, repo.Head, dev, repo.Branch)
+	}
+	if err := repo.NewRefTransaction().Rename("dev", "feature", other, "test").SetCurrentBranch("feature").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := repo.Reflog("feature"); len(log) != 2 {
+		t.Errorf("Expected the renamed branch to keep its reflog, got %+v", log)
+	}
+	if err := repo.NewRefTransaction().Delete("feature", third).Commit(); !errors.Is(err, ErrRefConflict) {
+		t.Errorf("Expected deleting a moved branch to conflict, got %v", err)
+	}
+
+	// A held lock blocks updates until it times out
+	lock := filepath.Join(dir, ".steria", "branches", "Stem.lock")
+	os.WriteFile(lock, nil, 0644)
+	defer func(d time.Duration) { refLockTimeout = d }(refLockTimeout)
+	refLockTimeout = 50 * time.Millisecond
+	if err := repo.UpdateRef("Stem", third, "test"); !errors.Is(err, ErrRefLocked) {
+		t.Errorf("Expected ErrRefLocked, got %v", err)
+	}
+	os.Remove(lock)
+
+	// Of concurrent compare-and-swaps from the same value exactly one wins
+	refLockTimeout = 5 * time.Second
+	stem, _ := repo.ReadRef("Stem")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wins := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hash := strings.Repeat(string(rune('0'+i)), 64)
+			if repo.NewRefTransaction().UpdateFrom("Stem", hash, stem, "test").Commit() == nil {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("Expected exactly one concurrent update to win, got %d", wins)
+	}
+}
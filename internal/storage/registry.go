@@ -0,0 +1,79 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: registry.go
+// Description: Read-only access to projects published in a Steria project registry, a web server hosting a plain copy of each project directory. Used by steria projects pull to restore a version without cloning.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RegistryProject is a project in a registry, read straight from its .steria
+// directory: commits at objects/<hash[:2]>/<hash[2:]>, trees under
+// objects/trees and blobs under objects/blobs
+type RegistryProject struct {
+	URL     string        // e.g. https://steria-remote.example.com/my-project
+	Timeout time.Duration // Per request; 0 means DefaultRemoteTimeout, negative disables
+}
+
+// BlobStore returns the project's blobs as a read-only blob store
+func (p *RegistryProject) BlobStore() BlobStore {
+	return &HTTPBlobStore{BaseURL: p.URL + "/.steria/objects", Timeout: p.Timeout}
+}
+
+// Commit fetches a commit with its file snapshot. Tree-based commits have
+// their trees fetched and flattened, each checked against its hash; commits
+// written before trees carry their snapshot themselves.
+func (p *RegistryProject) Commit(ctx context.Context, hash string) (*Commit, error) {
+	if _, ok := decodeHash(hash); !ok {
+		return nil, fmt.Errorf("%q is not a commit hash", hash)
+	}
+	data, err := httpExchange(ctx, p.Timeout, "GET", p.URL+"/.steria/objects/"+hash[:2]+"/"+hash[2:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch commit %s: %w", shortRef(hash), err)
+	}
+	commit, err := DecodeCommit(hash, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse commit %s: %w", shortRef(hash), err)
+	}
+	if commit.FileBlobs != nil || commit.Tree == "" {
+		return commit, nil
+	}
+	files, err := flattenTree(commit.Tree, func(tree string) (*Tree, error) {
+		if _, ok := decodeHash(tree); !ok {
+			return nil, fmt.Errorf("%w: %q is not a tree hash", ErrObjectRejected, tree)
+		}
+		data, err := httpExchange(ctx, p.Timeout, "GET", p.URL+"/.steria/objects/trees/"+tree[:2]+"/"+tree[2:], nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyObject(PackTree, tree, data); err != nil {
+			return nil, err
+		}
+		var t Tree
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for file := range files {
+		if !filepath.IsLocal(file) {
+			return nil, fmt.Errorf("%w: commit %s names a file outside the project: %q", ErrObjectRejected, shortRef(hash), file)
+		}
+	}
+	commit.FileBlobs = files
+	for file := range files {
+		commit.Files = append(commit.Files, file)
+	}
+	sort.Strings(commit.Files)
+	return commit, nil
+}
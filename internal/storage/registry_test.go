@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryProjectReadsTreeCommits(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "src", "lib"), 0755)
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("readme"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "lib", "util.go"), []byte("package lib"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repo.loadCommit(repo.Head)
+	if err != nil || stored.Tree == "" || stored.FileBlobs != nil {
+		t.Fatalf("Expected a tree-based commit, got %+v, %v", stored, err)
+	}
+
+	// The registry is the project directory served as plain files
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	ctx := context.Background()
+	project := &RegistryProject{URL: server.URL}
+	commit, err := project.Commit(ctx, repo.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commit.Files) != 2 || commit.FileBlobs[filepath.Join("src", "lib", "util.go")] == "" {
+		t.Fatalf("Expected both files from the flattened tree, got %v", commit.FileBlobs)
+	}
+	out := filepath.Join(t.TempDir(), "util.go")
+	if err := WriteBlobToFile(ctx, project.BlobStore(), commit.FileBlobs[filepath.Join("src", "lib", "util.go")], out); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "package lib" {
+		t.Errorf("Expected the file restored from the registry, got %q", data)
+	}
+
+	// A tree that does not match its hash is refused
+	treeFile := filepath.Join(dir, ".steria", "objects", "trees", stored.Tree[:2], stored.Tree[2:])
+	os.WriteFile(treeFile, []byte(`{"entries":[]}`), 0644)
+	if _, err := project.Commit(ctx, repo.Head); err == nil {
+		t.Error("Expected a tampered tree to be rejected")
+	}
+}
@@ -0,0 +1,195 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: remote.go
+// Description: Remote configuration for Steria. Loads .steria/remotes.json and opens the RemoteStore behind each remote with its configured timeout.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultRemoteTimeout bounds how long a remote may stay silent before a
+// request to it is abandoned, unless the remote sets its own timeout
+const DefaultRemoteTimeout = 30 * time.Second
+
+// RemoteConfig is one entry of .steria/remotes.json
+type RemoteConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Timeout is a Go duration such as "90s"; empty means DefaultRemoteTimeout
+	// and "0" disables the timeout
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// RemotesFile is the contents of .steria/remotes.json
+type RemotesFile struct {
+	Remotes []RemoteConfig `json:"remotes"`
+}
+
+// LoadRemotes reads the configured remotes; a missing file means no remotes
+func LoadRemotes(repoPath string) (*RemotesFile, error) {
+	data, err := os.ReadFile(filepath.Join(repoPath, ".steria", "remotes.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &RemotesFile{}, nil
+		}
+		return nil, err
+	}
+	var rf RemotesFile
+	if err := json.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("failed to parse remotes.json: %w", err)
+	}
+	return &rf, nil
+}
+
+// SaveRemotes writes the configured remotes
+func SaveRemotes(repoPath string, rf *RemotesFile) error {
+	data, err := json.MarshalIndent(rf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repoPath, ".steria", "remotes.json"), data, 0644)
+}
+
+// Find returns the remote with the given name
+func (rf *RemotesFile) Find(name string) (*RemoteConfig, bool) {
+	for i := range rf.Remotes {
+		if rf.Remotes[i].Name == name {
+			return &rf.Remotes[i], true
+		}
+	}
+	return nil, false
+}
+
+// TimeoutDuration parses the remote's timeout. A negative result means the
+// timeout is disabled.
+func (rc *RemoteConfig) TimeoutDuration() (time.Duration, error) {
+	if rc.Timeout == "" {
+		return DefaultRemoteTimeout, nil
+	}
+	d, err := time.ParseDuration(rc.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q for remote '%s': %w", rc.Timeout, rc.Name, err)
+	}
+	if d <= 0 {
+		return -1, nil
+	}
+	return d, nil
+}
+
+// OpenRemoteStore returns the store, blobs and history, behind a configured remote
+func OpenRemoteStore(ctx context.Context, rc *RemoteConfig) (RemoteStore, error) {
+	timeout, err := rc.TimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+	switch rc.Type {
+	case "http":
+		return &HTTPBlobStore{BaseURL: rc.URL, Timeout: timeout}, nil
+	case "s3":
+		s, err := NewS3BlobStore(ctx, rc.URL, "")
+		if err != nil {
+			return nil, err
+		}
+		s.Timeout = timeout
+		return s, nil
+	case "peer":
+		return &PeerToPeerBlobStore{Peers: strings.Split(rc.URL, ","), Timeout: timeout}, nil
+	case "local":
+		return &LocalBlobStore{Dir: rc.URL}, nil
+	default:
+		return nil, fmt.Errorf("unknown remote type: %s", rc.Type)
+	}
+}
+
+// remoteTimeout resolves a store's Timeout field: zero means the default and
+// a negative value disables the timeout
+func remoteTimeout(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultRemoteTimeout
+	}
+	return d
+}
+
+// withTimeout bounds a whole request by the store's timeout
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d = remoteTimeout(d); d < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// withStallTimeout returns a context that is cancelled once touch has not
+// been called for the store's timeout. Streams call touch on every read or
+// write, so a large transfer may take as long as it needs while a remote
+// that stops responding is still abandoned.
+func withStallTimeout(ctx context.Context, d time.Duration) (context.Context, func(), context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if d = remoteTimeout(d); d < 0 {
+		return ctx, func() {}, cancel
+	}
+	timer := time.AfterFunc(d, cancel)
+	return ctx, func() { timer.Reset(d) }, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// touchReader calls touch whenever data arrives and releases its request
+// context on Close
+type touchReader struct {
+	io.ReadCloser
+	touch  func()
+	cancel context.CancelFunc
+}
+
+func (t *touchReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.touch()
+	}
+	return n, err
+}
+
+func (t *touchReader) Close() error {
+	err := t.ReadCloser.Close()
+	t.cancel()
+	return err
+}
+
+// touchWriter calls touch whenever data has been handed on
+type touchWriter struct {
+	w     io.Writer
+	touch func()
+}
+
+func (t *touchWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		t.touch()
+	}
+	return n, err
+}
+
+// touchFile is a seekable upload body that calls touch as it is read
+type touchFile struct {
+	*os.File
+	touch func()
+}
+
+func (t *touchFile) Read(p []byte) (int, error) {
+	n, err := t.File.Read(p)
+	if n > 0 {
+		t.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemoteTimeoutAndCancellation(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	ctx := context.Background()
+	store := &HTTPBlobStore{BaseURL: hung.URL, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if store.HasBlob(ctx, "abc") {
+		t.Error("Expected a hung remote to report the blob missing")
+	}
+	if _, err := store.OpenBlob(ctx, "abc"); err == nil {
+		t.Error("Expected OpenBlob on a hung remote to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Timeouts took %v", elapsed)
+	}
+
+	// A cancelled write leaves nothing behind in a local store
+	dir := t.TempDir()
+	local := &LocalBlobStore{Dir: dir}
+	cctx, cancel := context.WithCancel(ctx)
+	w, err := local.CreateBlob(cctx, "partial")
+	if err != nil {
+		t.Fatalf("CreateBlob failed: %v", err)
+	}
+	w.Write([]byte("half a blob"))
+	cancel()
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("Expected writes after cancellation to fail")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Expected Close after cancellation to fail")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no partial blob, found %d files", len(entries))
+	}
+
+	rc := RemoteConfig{Name: "origin", Type: "http", URL: hung.URL, Timeout: "0"}
+	if d, err := rc.TimeoutDuration(); err != nil || d >= 0 {
+		t.Errorf("Expected timeout 0 to disable the timeout, got %v, %v", d, err)
+	}
+	rc.Timeout = "soon"
+	if _, err := OpenRemoteStore(ctx, &rc); err == nil {
+		t.Error("Expected an invalid timeout to be rejected")
+	}
+}
@@ -0,0 +1,422 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: remoterefs.go
+// Description: History namespace of Steria remotes. Next to their blobs, the HTTP, S3, peer and local backends store commit and tree objects and a ref namespace of branch tips, so push and pull can transfer history rather than bare file contents.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// HistoryStore is the history namespace of a remote: commit and tree objects
+// stored under their hash, and the remote's branches
+type HistoryStore interface {
+	PutObject(ctx context.Context, kind PackObjectKind, hash string, data []byte) error
+	GetObject(ctx context.Context, kind PackObjectKind, hash string) ([]byte, error)
+	HasObject(ctx context.Context, kind PackObjectKind, hash string) bool
+	// ListRefs returns branch name -> commit hash for every branch on the remote
+	ListRefs(ctx context.Context) (map[string]string, error)
+	// UpdateRef moves a branch to hash only while it still points at old ("" if
+	// it must not exist yet), and fails with ErrRefConflict otherwise
+	UpdateRef(ctx context.Context, branch, old, hash string) error
+}
+
+// RemoteStore is everything a remote holds: blobs and history
+type RemoteStore interface {
+	BlobStore
+	HistoryStore
+}
+
+// objectNamespace returns the directory (or URL path) objects of a kind live under
+func objectNamespace(kind PackObjectKind) string {
+	if kind == PackTree {
+		return "trees"
+	}
+	return "commits"
+}
+
+// validRefName reports whether a branch name is safe to use as a path below
+// a remote's refs namespace
+func validRefName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || isRefScratchFile(name) {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return !strings.ContainsAny(name, "\\\x00")
+}
+
+// httpExchange makes one request within timeout and returns the response
+// body. A status other than 200, 201 or 204 is an error wrapping
+// os.ErrNotExist for 404, ErrRefConflict for 412 and ErrRefLocked for 423.
+func httpExchange(ctx context.Context, timeout time.Duration, method, url string, body []byte) ([]byte, error) {
+	return httpExchangeWithHeader(ctx, timeout, method, url, body, nil)
+}
+
+// httpExchangeWithHeader is httpExchange with extra request headers
+func httpExchangeWithHeader(ctx context.Context, timeout time.Duration, method, url string, body []byte, header http.Header) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("HTTP %s %s: %w", method, url, os.ErrNotExist)
+	case http.StatusPreconditionFailed, http.StatusLocked:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		sentinel := ErrRefConflict
+		if resp.StatusCode == http.StatusLocked {
+			sentinel = ErrRefLocked
+		}
+		return nil, fmt.Errorf("%w: %s", sentinel, strings.TrimPrefix(strings.TrimSpace(string(msg)), sentinel.Error()+": "))
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 201 && resp.StatusCode != 204 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &HTTPStatusError{Method: method, Status: resp.Status, Code: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// decodeRefs parses a ref listing; a remote without a refs namespace yet has no branches
+func decodeRefs(data []byte, err error) (map[string]string, error) {
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("failed to parse remote refs: %w", err)
+	}
+	return refs, nil
+}
+
+// HTTPBlobStore history: GET, HEAD and PUT /commits/<hash> and /trees/<hash>,
+// GET /refs for the branch listing and PUT /refs/<branch> with the new tip,
+// conditional on If-Match: "<old>" or If-None-Match: * for a new branch
+func (h *HTTPBlobStore) PutObject(ctx context.Context, kind PackObjectKind, hash string, data []byte) error {
+	_, err := httpExchange(ctx, h.Timeout, "PUT", h.BaseURL+"/"+objectNamespace(kind)+"/"+hash, data)
+	return err
+}
+
+func (h *HTTPBlobStore) GetObject(ctx context.Context, kind PackObjectKind, hash string) ([]byte, error) {
+	return httpExchange(ctx, h.Timeout, "GET", h.BaseURL+"/"+objectNamespace(kind)+"/"+hash, nil)
+}
+
+func (h *HTTPBlobStore) HasObject(ctx context.Context, kind PackObjectKind, hash string) bool {
+	_, err := httpExchange(ctx, h.Timeout, "HEAD", h.BaseURL+"/"+objectNamespace(kind)+"/"+hash, nil)
+	return err == nil
+}
+
+func (h *HTTPBlobStore) ListRefs(ctx context.Context) (map[string]string, error) {
+	return decodeRefs(httpExchange(ctx, h.Timeout, "GET", h.BaseURL+"/refs", nil))
+}
+
+func (h *HTTPBlobStore) UpdateRef(ctx context.Context, branch, old, hash string) error {
+	_, err := httpExchangeWithHeader(ctx, h.Timeout, "PUT", h.BaseURL+"/refs/"+branch, []byte(hash), refPrecondition(old))
+	return err
+}
+
+// refPrecondition returns the headers that make a ref PUT compare-and-swap
+func refPrecondition(old string) http.Header {
+	if old == "" {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {`"` + old + `"`}}
+}
+
+// RefPreconditionOld returns the value a ref update request expects the ref
+// to have, from If-Match or If-None-Match: *; ok is false when the request
+// names neither
+func RefPreconditionOld(header http.Header) (old string, ok bool) {
+	if header.Get("If-None-Match") == "*" {
+		return "", true
+	}
+	if match := header.Get("If-Match"); match != "" {
+		return strings.Trim(match, `"`), true
+	}
+	return "", false
+}
+
+// S3BlobStore history: {prefix}commits/<hash>, {prefix}trees/<hash> and
+// {prefix}refs/<branch> holding the branch tip. Ref updates are conditional
+// writes on the object's ETag.
+func (s *S3BlobStore) PutObject(ctx context.Context, kind PackObjectKind, hash string, data []byte) error {
+	return s.putKey(ctx, s.Prefix+objectNamespace(kind)+"/"+hash, data)
+}
+
+func (s *S3BlobStore) GetObject(ctx context.Context, kind PackObjectKind, hash string) ([]byte, error) {
+	return s.getKey(ctx, s.Prefix+objectNamespace(kind)+"/"+hash)
+}
+
+func (s *S3BlobStore) HasObject(ctx context.Context, kind PackObjectKind, hash string) bool {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+	key := s.Prefix + objectNamespace(kind) + "/" + hash
+	_, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.Bucket, Key: &key})
+	return err == nil
+}
+
+func (s *S3BlobStore) ListRefs(ctx context.Context) (map[string]string, error) {
+	refs := map[string]string{}
+	prefix := s.Prefix + "refs/"
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{Bucket: &s.Bucket, Prefix: &prefix})
+	for paginator.HasMorePages() {
+		pageCtx, cancel := withTimeout(ctx, s.Timeout)
+		page, err := paginator.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			data, err := s.getKey(ctx, *obj.Key)
+			if err != nil {
+				return nil, err
+			}
+			refs[strings.TrimPrefix(*obj.Key, prefix)] = strings.TrimSpace(string(data))
+		}
+	}
+	return refs, nil
+}
+
+func (s *S3BlobStore) UpdateRef(ctx context.Context, branch, old, hash string) error {
+	key := s.Prefix + "refs/" + branch
+	input := &s3.PutObjectInput{Bucket: &s.Bucket, Key: &key, Body: bytes.NewReader([]byte(hash))}
+	current, etag, err := s.getRef(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current != old {
+		return fmt.Errorf("%w: remote branch %s is at %s, expected %s", ErrRefConflict, branch, shortRef(current), shortRef(old))
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	putCtx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+	if _, err := s.Client.PutObject(putCtx, input); err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+			return fmt.Errorf("%w: remote branch %s changed during the update", ErrRefConflict, branch)
+		}
+		return err
+	}
+	return nil
+}
+
+// getRef reads a ref object and its ETag; both are empty if it does not exist
+func (s *S3BlobStore) getRef(ctx context.Context, key string) (string, string, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.Bucket, Key: &key})
+	if err != nil {
+		var missing *s3types.NoSuchKey
+		if errors.As(err, &missing) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(string(data)), aws.ToString(resp.ETag), nil
+}
+
+func (s *S3BlobStore) putKey(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{Bucket: &s.Bucket, Key: &key, Body: bytes.NewReader(data)})
+	return err
+}
+
+func (s *S3BlobStore) getKey(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.Bucket, Key: &key})
+	if err != nil {
+		var missing *s3types.NoSuchKey
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// PeerToPeerBlobStore history speaks the HTTP protocol to every peer: writes
+// go to all of them, reads are answered by the first peer that can
+func (p *PeerToPeerBlobStore) PutObject(ctx context.Context, kind PackObjectKind, hash string, data []byte) error {
+	return p.putAll(ctx, "/"+objectNamespace(kind)+"/"+hash, data)
+}
+
+func (p *PeerToPeerBlobStore) GetObject(ctx context.Context, kind PackObjectKind, hash string) ([]byte, error) {
+	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if data, err := httpExchange(ctx, p.Timeout, "GET", peer+"/"+objectNamespace(kind)+"/"+hash, nil); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("object %s not found on any peer", hash)
+}
+
+func (p *PeerToPeerBlobStore) HasObject(ctx context.Context, kind PackObjectKind, hash string) bool {
+	for _, peer := range p.Peers {
+		if _, err := httpExchange(ctx, p.Timeout, "HEAD", peer+"/"+objectNamespace(kind)+"/"+hash, nil); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PeerToPeerBlobStore) ListRefs(ctx context.Context) (map[string]string, error) {
+	var lastErr error
+	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		refs, err := decodeRefs(httpExchange(ctx, p.Timeout, "GET", peer+"/refs", nil))
+		if err == nil {
+			return refs, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no peers configured")
+	}
+	return nil, lastErr
+}
+
+// UpdateRef moves the branch on every peer in turn. A peer that has moved on
+// stops the update; peers before it keep the new tip.
+func (p *PeerToPeerBlobStore) UpdateRef(ctx context.Context, branch, old, hash string) error {
+	if len(p.Peers) == 0 {
+		return fmt.Errorf("no peers configured")
+	}
+	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := httpExchangeWithHeader(ctx, p.Timeout, "PUT", peer+"/refs/"+branch, []byte(hash), refPrecondition(old)); err != nil {
+			return fmt.Errorf("peer %s: %w", peer, err)
+		}
+	}
+	return nil
+}
+
+// putAll uploads to every peer and returns the last failure, if any
+func (p *PeerToPeerBlobStore) putAll(ctx context.Context, path string, data []byte) error {
+	var lastErr error
+	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := httpExchange(ctx, p.Timeout, "PUT", peer+path, data); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// LocalBlobStore history: <dir>/commits/<hash>, <dir>/trees/<hash> and
+// <dir>/refs/<branch>, next to the .gz blobs
+func (l *LocalBlobStore) PutObject(ctx context.Context, kind PackObjectKind, hash string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.writeFile(filepath.Join(l.Dir, objectNamespace(kind), hash), data)
+}
+
+func (l *LocalBlobStore) GetObject(ctx context.Context, kind PackObjectKind, hash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(l.Dir, objectNamespace(kind), hash))
+}
+
+func (l *LocalBlobStore) HasObject(ctx context.Context, kind PackObjectKind, hash string) bool {
+	_, err := os.Stat(filepath.Join(l.Dir, objectNamespace(kind), hash))
+	return err == nil
+}
+
+func (l *LocalBlobStore) ListRefs(ctx context.Context) (map[string]string, error) {
+	refs := map[string]string{}
+	refsDir := filepath.Join(l.Dir, "refs")
+	err := filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || isRefScratchFile(path) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(refsDir, path)
+		refs[filepath.ToSlash(rel)] = strings.TrimSpace(string(data))
+		return nil
+	})
+	return refs, err
+}
+
+func (l *LocalBlobStore) UpdateRef(ctx context.Context, branch, old, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validRefName(branch) {
+		return fmt.Errorf("invalid branch name %q", branch)
+	}
+	return compareAndSwapFile("remote branch "+branch, filepath.Join(l.Dir, "refs", filepath.FromSlash(branch)), old, hash)
+}
+
+// writeFile writes a history file through a temporary name
+func (l *LocalBlobStore) writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomicWrite(path, data)
+}
@@ -6,17 +6,17 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"steria/internal/utils"
-
 	"sync"
 
 	"container/list"
@@ -41,6 +41,25 @@ type Repo struct {
 	Branch    string // Current branch
 	RemoteURL string
 	BlobStore BlobStore
+	ctx       context.Context // Cancels blob transfers; set with WithContext
+	op        string          // Operation ref updates are logged under; set with WithOperation
+	transfer  TransferOptions // Workers, retries and progress of remote transfers; set with WithTransfer
+}
+
+// WithContext returns a shallow copy of the repository whose storage and
+// remote operations are cancelled with ctx
+func (r *Repo) WithContext(ctx context.Context) *Repo {
+	rc := *r
+	rc.ctx = ctx
+	return &rc
+}
+
+// Context returns the repository's context, or context.Background if none was set
+func (r *Repo) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
 // Config holds repository configuration
@@ -48,6 +67,13 @@ type Config struct {
 	Name    string    `json:"name"`
 	Author  string    `json:"author"`
 	Created time.Time `json:"created"`
+	// ChunkThreshold is the file size in bytes from which files are stored as
+	// content-defined chunks; 0 means DefaultChunkThreshold
+	ChunkThreshold int64 `json:"chunk_threshold,omitempty"`
+	// RepositoryFormatVersion is the on-disk format; see CurrentFormatVersion
+	RepositoryFormatVersion int `json:"repository_format_version"`
+	// Features lists the optional on-disk capabilities the repository uses
+	Features []string `json:"features,omitempty"`
 }
 
 // Commit represents a commit in the repository
@@ -56,9 +82,11 @@ type Commit struct {
 	Message   string            `json:"message"`
 	Author    string            `json:"author"`
 	Timestamp time.Time         `json:"timestamp"`
-	Parent    string            `json:"parent"`
-	Files     []string          `json:"files"`
-	FileBlobs map[string]string `json:"file_blobs"`
+	Parents   []string          `json:"parents,omitempty"`    // First parent is the branch the commit was made on; merges add the merged-in heads
+	Tree      string            `json:"tree,omitempty"`       // Root tree hash; replaces Files/FileBlobs for new commits
+	Files     []string          `json:"files,omitempty"`      // Legacy flat file list, filled from Tree on load
+	FileBlobs map[string]string `json:"file_blobs,omitempty"` // Legacy flat snapshot, filled from Tree on load
+	Stats     CommitStats       `json:"-"`                    // Blobs written vs reused while creating the commit; not stored
 }
 
 // FileChange represents a change to a file
@@ -111,8 +139,8 @@ func LoadOrInitRepo(path string) (*Repo, error) {
 	return initRepo(path)
 }
 
-// loadRepo loads an existing repository
-func loadRepo(path string) (*Repo, error) {
+// readRepo reads a repository without checking its format version
+func readRepo(path string) (*Repo, error) {
 	configPath := filepath.Join(path, ".steria", "config.json")
 
 	data, err := os.ReadFile(configPath)
@@ -124,6 +152,11 @@ func loadRepo(path string) (*Repo, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	// Repositories migrated to canonical commits before format versioning
+	if config.RepositoryFormatVersion == 0 && legacyCommitEncoding(data) == "canonical-v1" {
+		config.RepositoryFormatVersion = 1
+		config.Features = defaultFeatures()
+	}
 
 	headPath := filepath.Join(path, ".steria", "HEAD")
 	head := ""
@@ -162,6 +195,30 @@ func loadRepo(path string) (*Repo, error) {
 	return repo, nil
 }
 
+// loadRepo loads an existing repository whose format this build supports
+func loadRepo(path string) (*Repo, error) {
+	repo, err := readRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormat(repo.Config); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// saveConfig writes the repository's config.json
+func (r *Repo) saveConfig() error {
+	data, err := json.MarshalIndent(r.Config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := atomicWrite(filepath.Join(r.Path, ".steria", "config.json"), data); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
 // initRepo initializes a new repository
 func initRepo(path string) (*Repo, error) {
 	steriaPath := filepath.Join(path, ".steria")
@@ -181,9 +238,11 @@ func initRepo(path string) (*Repo, error) {
 
 	// Create initial config
 	config := &Config{
-		Name:    filepath.Base(path),
-		Author:  "KleaSCM",
-		Created: time.Now(),
+		Name:                    filepath.Base(path),
+		Author:                  "KleaSCM",
+		Created:                 time.Now(),
+		RepositoryFormatVersion: CurrentFormatVersion,
+		Features:                defaultFeatures(),
 	}
 
 	configData, err := json.MarshalIndent(config, "", "  ")
@@ -237,17 +296,11 @@ func initRepo(path string) (*Repo, error) {
 			}
 		}
 		// Recalculate commit hash and save under new hash
-		commitData, _ := json.Marshal(initialCommit)
-		hash := sha256.Sum256(commitData)
-		initialCommit.Hash = hex.EncodeToString(hash[:])
+		initialCommit.Hash, _ = hashCommit(initialCommit)
 		repo.saveCommit(initialCommit)
 		// Reload the commit object from disk and update all pointers
 		newCommit, _ := repo.LoadCommit(initialCommit.Hash)
-		repo.Head = newCommit.Hash
-		headPath := filepath.Join(path, ".steria", "HEAD")
-		os.WriteFile(headPath, []byte(newCommit.Hash), 0644)
-		branchRefPath := filepath.Join(path, ".steria", "branches", "Stem")
-		os.WriteFile(branchRefPath, []byte(newCommit.Hash), 0644)
+		repo.advanceHead(newCommit.Hash, repo.commitOperation(newCommit))
 	}
 
 	// Always create .steria/branches/Stem pointing to HEAD
@@ -255,8 +308,7 @@ func initRepo(path string) (*Repo, error) {
 	if err := os.MkdirAll(branchesDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create branches dir: %w", err)
 	}
-	StemBranchPath := filepath.Join(branchesDir, "Stem")
-	if err := os.WriteFile(StemBranchPath, []byte(initialCommit.Hash), 0644); err != nil {
+	if err := repo.UpdateRef("Stem", initialCommit.Hash, repo.commitOperation(initialCommit)); err != nil {
 		return nil, fmt.Errorf("failed to create Stem branch ref: %w", err)
 	}
 
@@ -280,10 +332,8 @@ func initRepo(path string) (*Repo, error) {
 	return repo, nil
 }
 
-// GetChanges returns all changes in the working directory
+// GetChanges returns all changes in the working directory relative to HEAD
 func (r *Repo) GetChanges() ([]FileChange, error) {
-	var changes []FileChange
-
 	// Get current state
 	currentState, err := r.getCurrentState()
 	if err != nil {
@@ -296,75 +346,53 @@ func (r *Repo) GetChanges() ([]FileChange, error) {
 		return nil, fmt.Errorf("failed to get working state: %w", err)
 	}
 
-	// Compare states
-	for path, hash := range workingState {
-		if currentHash, exists := currentState[path]; !exists {
-			// File was added
-			changes = append(changes, FileChange{
-				Path: path,
-				Type: ChangeTypeAdded,
-				Hash: hash,
-			})
-		} else if currentHash != hash {
-			// File was modified
-			changes = append(changes, FileChange{
-				Path: path,
-				Type: ChangeTypeModified,
-				Hash: hash,
-			})
-		}
-	}
-
-	// Check for deleted files
-	for path := range currentState {
-		if _, exists := workingState[path]; !exists {
-			changes = append(changes, FileChange{
-				Path: path,
-				Type: ChangeTypeDeleted,
-				Hash: "",
-			})
-		}
-	}
-
-	return changes, nil
+	return compareStates(currentState, workingState), nil
 }
 
+// ErrNothingToCommit is returned by CreateCommit when the working directory
+// has no files to snapshot
+var ErrNothingToCommit = errors.New("nothing to commit: the working directory has no files")
+
 // CreateCommit creates a new commit
 func (r *Repo) CreateCommit(message, author string) (*Commit, error) {
 	fmt.Printf("[DEBUG] CreateCommit called: message=%q, author=%q, parent=%q\n", message, author, r.Head)
+	parents, err := r.commitParents()
+	if err != nil {
+		return nil, err
+	}
 	commit := &Commit{
 		Message:   message,
 		Author:    author,
 		Timestamp: time.Now(),
-		Parent:    r.Head,
+		Parents:   parents,
 		FileBlobs: make(map[string]string),
 	}
 
-	allFiles := getAllFiles(r.Path)
-	if len(allFiles) == 0 {
-		panic("[FATAL] getAllFiles returned no files! This is a critical bug.")
+	// Hash in parallel, reusing stat-cached hashes for files that did not change
+	files, err := r.workingHashes(NewFileProcessor().ProcessFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash working directory: %w", err)
 	}
-	fmt.Printf("[DEBUG] getAllFiles: %v\n", allFiles)
-	for _, file := range allFiles {
-		if strings.HasPrefix(file, filepath.Join(r.Path, ".steria")) {
-			continue // skip internal files
-		}
-		rel, _ := filepath.Rel(r.Path, file)
-		hash, err := r.calculateFileHash(file)
-		if err != nil {
-			return nil, fmt.Errorf("failed to hash file %s: %w", file, err)
-		}
-		blobDir := filepath.Join(r.Path, ".steria", "objects", "blobs")
-		if err := os.MkdirAll(blobDir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create blob dir: %w", err)
-		}
-		if err := WriteBlobCompressed(r.BlobStore, hash, file); err != nil {
-			return nil, fmt.Errorf("failed to write compressed blob for %s: %w", file, err)
-		}
-		commit.FileBlobs[rel] = hash
+	if len(files) == 0 {
+		return nil, ErrNothingToCommit
+	}
+	blobDir := filepath.Join(r.Path, ".steria", "objects", "blobs")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob dir: %w", err)
+	}
+	// Only content the blob store does not already have is compressed and written
+	previous, err := r.headFiles()
+	if err != nil {
+		return nil, err
+	}
+	commit.FileBlobs, commit.Stats, err = r.storeBlobs(r.Context(), r.BlobStore, files, previous)
+	if err != nil {
+		return nil, err
+	}
+	for rel := range commit.FileBlobs {
 		commit.Files = append(commit.Files, rel)
-		fmt.Printf("[DEBUG] Adding file to commit: %s -> %s\n", rel, hash)
 	}
+	sort.Strings(commit.Files)
 	fmt.Printf("[DEBUG] FileBlobs length: %d, keys: %v\n", len(commit.FileBlobs), func() []string {
 		var k []string
 		for key := range commit.FileBlobs {
@@ -375,91 +403,112 @@ func (r *Repo) CreateCommit(message, author string) (*Commit, error) {
 	if len(commit.FileBlobs) == 0 {
 		panic("[FATAL] FileBlobs is empty after populating! This is a critical bug.")
 	}
+	if err := r.writeCommit(commit); err != nil {
+		return nil, err
+	}
+
+	go r.autoSyncToRemotes()
+
+	return commit, nil
+}
+
+// writeCommit stores the commit's tree and commit object and moves HEAD to it
+func (r *Repo) writeCommit(commit *Commit) error {
+	treeHash, err := r.WriteTree(commit.FileBlobs)
+	if err != nil {
+		return fmt.Errorf("failed to write tree: %w", err)
+	}
+	commit.Tree = treeHash
 	// Always set commit.Hash before saving
-	commitData, err := json.Marshal(commit)
+	commit.Hash, err = hashCommit(commit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal commit: %w", err)
+		return fmt.Errorf("failed to marshal commit: %w", err)
 	}
-	hash := sha256.Sum256(commitData)
-	commit.Hash = hex.EncodeToString(hash[:])
 	if err := r.saveCommit(commit); err != nil {
-		return nil, fmt.Errorf("failed to save commit: %w", err)
+		return fmt.Errorf("failed to save commit: %w", err)
 	}
 
-	r.Head = commit.Hash
-	headPath := filepath.Join(r.Path, ".steria", "HEAD")
-	if err := os.WriteFile(headPath, []byte(commit.Hash), 0644); err != nil {
-		return nil, fmt.Errorf("failed to update HEAD: %w", err)
+	if err := r.advanceHead(commit.Hash, r.commitOperation(commit)); err != nil {
+		return err
+	}
+	if commit.IsMerge() {
+		r.clearMergeHead()
 	}
+	return nil
+}
 
+// advanceHead points HEAD and the current branch at the given commit in one
+// ref transaction, logging the move in both reflogs under op. It fails with
+// ErrRefConflict if another process moved HEAD since this one read it.
+func (r *Repo) advanceHead(hash, op string) error {
 	branchFile := filepath.Join(r.Path, ".steria", "branch")
 	branchNameBytes, err := os.ReadFile(branchFile)
 	branchName := "Stem"
 	if err == nil {
 		branchName = strings.TrimSpace(string(branchNameBytes))
 	}
-	branchRefPath := filepath.Join(r.Path, ".steria", "branches", branchName)
-	os.WriteFile(branchRefPath, []byte(commit.Hash), 0644)
-
-	go r.autoSyncToRemotes()
-
-	return commit, nil
-}
-
-// autoSyncToRemotes automatically pushes to all configured remotes
-func (r *Repo) autoSyncToRemotes() {
-	remotesPath := filepath.Join(r.Path, ".steria", "remotes.json")
-	data, err := os.ReadFile(remotesPath)
+	err = r.NewRefTransaction().
+		UpdateFrom("HEAD", hash, r.Head, op).
+		Update(branchName, hash, op).
+		Commit()
 	if err != nil {
-		return // No remotes configured
+		return fmt.Errorf("failed to move HEAD: %w", err)
 	}
+	return nil
+}
 
-	var rf struct {
-		Remotes []struct {
-			Name string `json:"name"`
-			Type string `json:"type"`
-			URL  string `json:"url"`
-		} `json:"remotes"`
+// commitOperation describes a new commit in the reflog
+func (r *Repo) commitOperation(commit *Commit) string {
+	op := "commit"
+	switch {
+	case commit.IsMerge():
+		op = "commit (merge)"
+	case len(commit.Parents) == 0:
+		op = "commit (initial)"
 	}
+	subject, _, _ := strings.Cut(commit.Message, "\n")
+	return r.operation(op) + ": " + subject
+}
 
-	if err := json.Unmarshal(data, &rf); err != nil {
-		return
+// autoSyncToRemotes automatically uploads the blobs of new commits to all
+// configured remotes, negotiated from the remote branches like a push. It runs
+// in the background, so each remote's timeout keeps a hung remote from
+// holding it forever and cancelling the repository's context stops it.
+// Transient failures are retried; objects that still fail are reported on
+// stderr and left for the next push.
+func (r *Repo) autoSyncToRemotes() {
+	ctx := r.Context()
+	rf, err := LoadRemotes(r.Path)
+	if err != nil {
+		return // No usable remotes
 	}
 
-	for _, remote := range rf.Remotes {
-		var store BlobStore
-		switch remote.Type {
-		case "http":
-			store = &HTTPBlobStore{BaseURL: remote.URL}
-		case "s3":
-			s, err := NewS3BlobStore(remote.URL, "")
-			if err != nil {
-				continue
-			}
-			store = s
-		case "peer":
-			store = &PeerToPeerBlobStore{Peers: strings.Split(remote.URL, ",")}
-		case "local":
-			store = &LocalBlobStore{Dir: remote.URL}
-		default:
+	for i := range rf.Remotes {
+		store, err := OpenRemoteStore(ctx, &rf.Remotes[i])
+		if err != nil {
 			continue
 		}
 
-		// Push new blobs to this remote
-		local := &LocalBlobStore{Dir: filepath.Join(r.Path, ".steria", "objects", "blobs")}
-		blobs, err := local.ListBlobs()
+		// Push the blobs of commits the remote does not have yet
+		if r.Head == "" {
+			return
+		}
+		refs, err := store.ListRefs(ctx)
 		if err != nil {
 			continue
 		}
-
-		for _, blob := range blobs {
-			if !store.HasBlob(blob) {
-				data, err := local.GetBlob(blob)
-				if err != nil {
-					continue
-				}
-				store.PutBlob(blob, data) // Ignore errors for auto-sync
-			}
+		plan, err := r.planPush(store, refs, r.Head)
+		if err != nil {
+			continue
+		}
+		run := r.WithTransfer(TransferOptions{Workers: r.transfer.Workers, Retries: r.transfer.Retries, Backoff: r.transfer.Backoff}).startTransfer()
+		r.sendBlobs(run, store, plan.blobs)
+		failed := run.finish()
+		if ctx.Err() != nil {
+			return
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(os.Stderr, "⚠️ Auto-sync to '%s': %d objects failed after retries; the next push sends them\n", rf.Remotes[i].Name, len(failed))
 		}
 	}
 }
@@ -479,77 +528,52 @@ func (r *Repo) Sync() error {
 	return nil
 }
 
-// LoadCommit loads a commit object (public method)
+// LoadCommit loads a commit object (public method). Tree-based commits have
+// their Files and FileBlobs flattened from the root tree so existing readers keep working.
 func (r *Repo) LoadCommit(hash string) (*Commit, error) {
-	return r.loadCommit(hash)
+	commit, err := r.loadCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.CommitFiles(commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
 }
 
-// getCurrentState returns the current committed state
+// getCurrentState returns the blob hash of every file in the HEAD commit
 func (r *Repo) getCurrentState() (map[string]string, error) {
 	if r.Head == "" {
 		return make(map[string]string), nil
 	}
 
-	commit, err := r.loadCommit(r.Head)
+	commit, err := r.LoadCommit(r.Head)
 	if err != nil {
 		return nil, err
 	}
 
-	state := make(map[string]string)
-	for _, file := range commit.Files {
-		// For now, just use file path as hash
-		// In a real implementation, we'd store actual file hashes
-		state[file] = "placeholder"
+	state := make(map[string]string, len(commit.FileBlobs))
+	for file, blob := range commit.FileBlobs {
+		state[file] = blob
 	}
 
 	return state, nil
 }
 
-// getWorkingState returns the current working directory state
+// getWorkingState returns the content hash of every file in the working
+// directory, rehashing only files whose stat data changed since the last scan
 func (r *Repo) getWorkingState() (map[string]string, error) {
-	state := make(map[string]string)
-
-	// Load ignore patterns
-	ignorePatterns, err := utils.LoadIgnorePatterns(r.Path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load ignore patterns: %w", err)
-	}
-
-	err = filepath.Walk(r.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get relative path
-		relPath, err := filepath.Rel(r.Path, path)
-		if err != nil {
-			return err
-		}
-
-		// Check if should be ignored
-		if utils.ShouldIgnore(relPath, ignorePatterns) {
-			if info.IsDir() {
-				return filepath.SkipDir
+	return r.workingHashes(func(paths []string) (map[string]string, error) {
+		hashes := make(map[string]string, len(paths))
+		for _, path := range paths {
+			hash, err := r.calculateFileHash(path)
+			if err != nil {
+				return nil, err
 			}
-			return nil
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		// Calculate file hash
-		hash, err := r.calculateFileHash(path)
-		if err != nil {
-			return err
+			hashes[path] = hash
 		}
-
-		state[relPath] = hash
-		return nil
+		return hashes, nil
 	})
-
-	return state, err
 }
 
 // calculateFileHash calculates the SHA256 hash of a file
@@ -568,12 +592,34 @@ func (r *Repo) calculateFileHash(path string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// saveCommit saves a commit object
-func (r *Repo) saveCommit(commit *Commit) error {
+// storedCommit returns the form of a commit that is written to disk. Commits
+// with a root tree do not repeat the flat file list.
+func storedCommit(commit *Commit) *Commit {
+	if commit.Tree == "" {
+		return commit
+	}
+	stored := *commit
+	stored.Files = nil
+	stored.FileBlobs = nil
+	return &stored
+}
+
+// hashCommit calculates the hash of a commit from its canonical encoding
+func hashCommit(commit *Commit) (string, error) {
+	data, err := EncodeCommit(commit)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// writeCommitObject stores the canonical encoding of a commit under its hash
+func (r *Repo) writeCommitObject(commit *Commit) error {
 	if len(commit.Hash) < 2 {
 		return fmt.Errorf("commit hash too short: %q", commit.Hash)
 	}
-	data, err := json.MarshalIndent(commit, "", "  ")
+	data, err := EncodeCommit(commit)
 	if err != nil {
 		return err
 	}
@@ -581,56 +627,72 @@ func (r *Repo) saveCommit(commit *Commit) error {
 	if err := os.MkdirAll(filepath.Dir(commitPath), 0755); err != nil {
 		return err
 	}
-	if err := os.WriteFile(commitPath, data, 0644); err != nil {
+	return atomicWrite(commitPath, data)
+}
+
+// saveCommit saves a commit object
+func (r *Repo) saveCommit(commit *Commit) error {
+	if err := r.writeCommitObject(commit); err != nil {
 		return err
 	}
+	commitPath := filepath.Join(r.Path, ".steria", "objects", commit.Hash[:2], commit.Hash[2:])
 	fmt.Printf("[DEBUG] saveCommit: %+v\n", commit)
 	written, _ := os.ReadFile(commitPath)
 	fmt.Printf("[DEBUG] Written commit file: %s\n", string(written))
 	return nil
 }
 
-// loadCommit loads a commit object
+// loadCommit loads a commit object without flattening its tree
 func (r *Repo) loadCommit(hash string) (*Commit, error) {
-	commitPath := filepath.Join(r.Path, ".steria", "objects", hash[:2], hash[2:])
-
-	data, err := os.ReadFile(commitPath)
-	if err != nil {
-		return nil, err
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("commit hash too short: %q", hash)
 	}
-
-	var commit Commit
-	if err := json.Unmarshal(data, &commit); err != nil {
+	data, err := r.readCommitObject(hash)
+	if err != nil {
 		return nil, err
 	}
-
-	return &commit, nil
+	return DecodeCommit(hash, data)
 }
 
-func writeBlobCompressed(blobStore BlobStore, hash, filePath string) error {
+// writeBlobCompressed streams a file through gzip into the store. When hash is
+// a content hash the file is checked against it, so a file that changed after
+// it was hashed is never stored under the old hash.
+func writeBlobCompressed(ctx context.Context, blobStore BlobStore, hash, filePath string) error {
 	in, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
-	var buf bytes.Buffer
-	gw := gzip.NewWriter(&buf)
-	if _, err := io.Copy(gw, in); err != nil {
-		gw.Close()
+	out, err := blobStore.CreateBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, io.TeeReader(in, sum)); err != nil {
+		out.Abort()
 		return err
 	}
 	if err := gw.Close(); err != nil {
+		out.Abort()
 		return err
 	}
-	return blobStore.PutBlob(hash, buf.Bytes())
+	if _, ok := decodeHash(hash); ok && hex.EncodeToString(sum.Sum(nil)) != hash {
+		out.Abort()
+		return fmt.Errorf("file %s changed while it was being stored", filePath)
+	}
+	return out.Close()
 }
 
 // Update ReadBlobDecompressed to handle delta:<basehash>:<deltahash> entries.
 // Add a new exported function ReadFileBlobDecompressed(blobDir string, blobRef string) ([]byte, error) that handles both normal and delta blobs.
-func ReadBlobDecompressed(blobStore BlobStore, hash string) ([]byte, error) {
+func ReadBlobDecompressed(ctx context.Context, blobStore BlobStore, hash string) ([]byte, error) {
 	// Try .gz first
 	gzPath := hash + ".gz"
-	if data, err := blobStore.GetBlob(gzPath); err == nil {
+	if data, err := blobStore.GetBlob(ctx, gzPath); err == nil {
+		if isDeltaObject(data) {
+			return readDeltaObject(ctx, blobStore, hash, data)
+		}
 		fmt.Printf("[DEBUG] ReadBlobDecompressed: reading gzipped blob %s\n", gzPath)
 		gr, err := gzip.NewReader(bytes.NewReader(data))
 		if err != nil {
@@ -639,27 +701,26 @@ func ReadBlobDecompressed(blobStore BlobStore, hash string) ([]byte, error) {
 		}
 		defer gr.Close()
 		out, err := ioutil.ReadAll(gr)
-		fmt.Printf("[DEBUG] ReadBlobDecompressed: decompressed data: %q\n", out)
+		fmt.Printf("[DEBUG] ReadBlobDecompressed: decompressed %d bytes\n", len(out))
 		return out, err
 	}
 	// Fallback to plain
 	plainPath := hash
 	fmt.Printf("[DEBUG] ReadBlobDecompressed: reading plain blob %s\n", plainPath)
-	return blobStore.GetBlob(plainPath)
+	return blobStore.GetBlob(ctx, plainPath)
 }
 
-// Add helpers for delta encoding/decoding
+// writeDeltaPatch writes a binary delta that turns baseData into newData
 func writeDeltaPatch(baseData, newData []byte, patchPath string) error {
-	dmp := diffmatchpatch.New()
-	baseStr := string(baseData)
-	newStr := string(newData)
-	diffs := dmp.DiffMain(baseStr, newStr, false)
-	patches := dmp.PatchMake(baseStr, diffs)
-	patchStr := dmp.PatchToText(patches)
-	return os.WriteFile(patchPath, []byte(patchStr), 0644)
+	return os.WriteFile(patchPath, encodeDelta(baseData, newData), 0644)
 }
 
+// applyDeltaPatch applies a delta written by writeDeltaPatch. Patches from
+// older versions were diffmatchpatch text patches and are still understood.
 func applyDeltaPatch(baseData []byte, patchData []byte) ([]byte, error) {
+	if bytes.HasPrefix(patchData, deltaMagic) {
+		return applyDelta(baseData, patchData)
+	}
 	dmp := diffmatchpatch.New()
 	baseStr := string(baseData)
 	patches, err := dmp.PatchFromText(string(patchData))
@@ -729,18 +790,25 @@ var (
 )
 
 // Add disk cache support for blobs
-func ReadFileBlobDecompressed(blobStore BlobStore, blobRef string) ([]byte, error) {
+func ReadFileBlobDecompressed(ctx context.Context, blobStore BlobStore, blobRef string) ([]byte, error) {
+	// Chunked files can be far larger than anything worth caching
+	if IsChunkRef(blobRef) {
+		return readChunked(ctx, blobStore, blobRef)
+	}
 	cacheKey := blobRef
 	if data, ok := blobCache.Get(cacheKey); ok {
 		return data, nil
 	}
-	// Disk cache path
-	cacheDir := filepath.Join(filepath.Dir(blobRef), "..", "cache")
-	os.MkdirAll(cacheDir, 0755)
-	cacheFile := filepath.Join(cacheDir, safeCacheFileName(blobRef))
-	if data, err := os.ReadFile(cacheFile); err == nil {
-		blobCache.Put(cacheKey, data)
-		return data, nil
+	// Disk cache lives next to the blob directory of local stores
+	cacheFile := ""
+	if local, ok := blobStore.(*LocalBlobStore); ok {
+		cacheDir := filepath.Join(filepath.Dir(local.Dir), "cache")
+		os.MkdirAll(cacheDir, 0755)
+		cacheFile = filepath.Join(cacheDir, safeCacheFileName(blobRef))
+		if data, err := os.ReadFile(cacheFile); err == nil {
+			blobCache.Put(cacheKey, data)
+			return data, nil
+		}
 	}
 	if strings.HasPrefix(blobRef, "delta:") {
 		parts := strings.Split(blobRef, ":")
@@ -749,30 +817,37 @@ func ReadFileBlobDecompressed(blobStore BlobStore, blobRef string) ([]byte, erro
 		}
 		baseHash := parts[1]
 		deltaHash := parts[2]
-		baseData, err := ReadFileBlobDecompressed(blobStore, baseHash)
+		baseData, err := ReadFileBlobDecompressed(ctx, blobStore, baseHash)
 		if err != nil {
 			return nil, err
 		}
-		patchPath := deltaHash
-		patchData, err := os.ReadFile(patchPath)
+		// The patch is an object in the same store as the base
+		patchData, err := blobStore.GetBlob(ctx, deltaHash)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to read delta %s: %w", deltaHash, err)
 		}
 		result, err := applyDeltaPatch(baseData, patchData)
 		if err == nil {
 			blobCache.Put(cacheKey, result)
-			os.WriteFile(cacheFile, result, 0644)
+			writeBlobCache(cacheFile, result)
 		}
 		return result, err
 	}
-	data, err := ReadBlobDecompressed(blobStore, blobRef)
+	data, err := ReadBlobDecompressed(ctx, blobStore, blobRef)
 	if err == nil {
 		blobCache.Put(cacheKey, data)
-		os.WriteFile(cacheFile, data, 0644)
+		writeBlobCache(cacheFile, data)
 	}
 	return data, err
 }
 
+// writeBlobCache stores decompressed blob content in the disk cache, if there is one
+func writeBlobCache(cacheFile string, data []byte) {
+	if cacheFile != "" {
+		os.WriteFile(cacheFile, data, 0644)
+	}
+}
+
 // safeCacheFileName returns a filesystem-safe cache file name for a blobRef
 func safeCacheFileName(blobRef string) string {
 	return strings.ReplaceAll(strings.ReplaceAll(blobRef, ":", "_"), "/", "_")
@@ -781,22 +856,30 @@ func safeCacheFileName(blobRef string) string {
 // BlobStore interface abstracts blob storage for distributed support
 // LocalBlobStore implements BlobStore for local disk storage
 
+// PutBlob/GetBlob are byte-slice helpers for small objects; large content goes
+// through OpenBlob/CreateBlob, which stream the stored (compressed) bytes.
+// Every method honours ctx, so a cancelled command stops its transfers.
 type BlobStore interface {
-	PutBlob(hash string, data []byte) error
-	GetBlob(hash string) ([]byte, error)
-	HasBlob(hash string) bool
-	ListBlobs() ([]string, error)
+	PutBlob(ctx context.Context, hash string, data []byte) error
+	GetBlob(ctx context.Context, hash string) ([]byte, error)
+	HasBlob(ctx context.Context, hash string) bool
+	ListBlobs(ctx context.Context) ([]string, error)
+	OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error)
+	CreateBlob(ctx context.Context, hash string) (BlobWriter, error)
 }
 
 // HTTPBlobStore implements BlobStore for HTTP(S) remote storage
 // Expects a REST API with endpoints: /blobs/{hash}.gz (GET, PUT, HEAD), /blobs (GET for list)
 type HTTPBlobStore struct {
-	BaseURL string // e.g. https://my-steria-remote.com
+	BaseURL string        // e.g. https://my-steria-remote.com
+	Timeout time.Duration // Per request, or without progress while streaming; 0 means DefaultRemoteTimeout, negative disables
 }
 
-func (h *HTTPBlobStore) PutBlob(hash string, data []byte) error {
+func (h *HTTPBlobStore) PutBlob(ctx context.Context, hash string, data []byte) error {
+	ctx, cancel := withTimeout(ctx, h.Timeout)
+	defer cancel()
 	url := h.BaseURL + "/blobs/" + hash + ".gz"
-	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -806,27 +889,35 @@ func (h *HTTPBlobStore) PutBlob(hash string, data []byte) error {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 && resp.StatusCode != 201 {
-		return fmt.Errorf("HTTP PUT failed: %s", resp.Status)
+		return &HTTPStatusError{Method: "PUT", Status: resp.Status, Code: resp.StatusCode}
 	}
 	return nil
 }
 
-func (h *HTTPBlobStore) GetBlob(hash string) ([]byte, error) {
+func (h *HTTPBlobStore) GetBlob(ctx context.Context, hash string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, h.Timeout)
+	defer cancel()
 	url := h.BaseURL + "/blobs/" + hash + ".gz"
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP GET failed: %s", resp.Status)
+		return nil, &HTTPStatusError{Method: "GET", Status: resp.Status, Code: resp.StatusCode}
 	}
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (h *HTTPBlobStore) HasBlob(hash string) bool {
+func (h *HTTPBlobStore) HasBlob(ctx context.Context, hash string) bool {
+	ctx, cancel := withTimeout(ctx, h.Timeout)
+	defer cancel()
 	url := h.BaseURL + "/blobs/" + hash + ".gz"
-	req, _ := http.NewRequest("HEAD", url, nil)
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return false
@@ -835,15 +926,21 @@ func (h *HTTPBlobStore) HasBlob(hash string) bool {
 	return resp.StatusCode == 200
 }
 
-func (h *HTTPBlobStore) ListBlobs() ([]string, error) {
+func (h *HTTPBlobStore) ListBlobs(ctx context.Context) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, h.Timeout)
+	defer cancel()
 	url := h.BaseURL + "/blobs"
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP GET failed: %s", resp.Status)
+		return nil, &HTTPStatusError{Method: "GET", Status: resp.Status, Code: resp.StatusCode}
 	}
 	var blobs []string
 	if err := json.NewDecoder(resp.Body).Decode(&blobs); err != nil {
@@ -855,13 +952,14 @@ func (h *HTTPBlobStore) ListBlobs() ([]string, error) {
 // S3BlobStore implements BlobStore for Amazon S3 (or compatible) storage
 // Stores blobs as {prefix}/{hash}.gz in the bucket
 type S3BlobStore struct {
-	Bucket string
-	Prefix string
-	Client *s3.Client
+	Bucket  string
+	Prefix  string
+	Client  *s3.Client
+	Timeout time.Duration // Same meaning as HTTPBlobStore.Timeout
 }
 
-func NewS3BlobStore(bucket, prefix string) (*S3BlobStore, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background())
+func NewS3BlobStore(ctx context.Context, bucket, prefix string) (*S3BlobStore, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -869,9 +967,11 @@ func NewS3BlobStore(bucket, prefix string) (*S3BlobStore, error) {
 	return &S3BlobStore{Bucket: bucket, Prefix: prefix, Client: client}, nil
 }
 
-func (s *S3BlobStore) PutBlob(hash string, data []byte) error {
+func (s *S3BlobStore) PutBlob(ctx context.Context, hash string, data []byte) error {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
 	key := s.Prefix + hash + ".gz"
-	_, err := s.Client.PutObject(context.Background(), &s3.PutObjectInput{
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: &s.Bucket,
 		Key:    &key,
 		Body:   bytes.NewReader(data),
@@ -879,9 +979,11 @@ func (s *S3BlobStore) PutBlob(hash string, data []byte) error {
 	return err
 }
 
-func (s *S3BlobStore) GetBlob(hash string) ([]byte, error) {
+func (s *S3BlobStore) GetBlob(ctx context.Context, hash string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
 	key := s.Prefix + hash + ".gz"
-	resp, err := s.Client.GetObject(context.Background(), &s3.GetObjectInput{
+	resp, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &s.Bucket,
 		Key:    &key,
 	})
@@ -892,16 +994,18 @@ func (s *S3BlobStore) GetBlob(hash string) ([]byte, error) {
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (s *S3BlobStore) HasBlob(hash string) bool {
+func (s *S3BlobStore) HasBlob(ctx context.Context, hash string) bool {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
 	key := s.Prefix + hash + ".gz"
-	_, err := s.Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+	_, err := s.Client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: &s.Bucket,
 		Key:    &key,
 	})
 	return err == nil
 }
 
-func (s *S3BlobStore) ListBlobs() ([]string, error) {
+func (s *S3BlobStore) ListBlobs(ctx context.Context) ([]string, error) {
 	var blobs []string
 	prefix := s.Prefix
 	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
@@ -909,7 +1013,9 @@ func (s *S3BlobStore) ListBlobs() ([]string, error) {
 		Prefix: &prefix,
 	})
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(context.Background())
+		pageCtx, cancel := withTimeout(ctx, s.Timeout)
+		page, err := paginator.NextPage(pageCtx)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
@@ -926,26 +1032,34 @@ func (s *S3BlobStore) ListBlobs() ([]string, error) {
 // PeerToPeerBlobStore implements BlobStore for peer-to-peer HTTP sync
 // Peers is a list of Steria node base URLs (e.g., http://peer1:8080)
 type PeerToPeerBlobStore struct {
-	Peers []string
+	Peers   []string
+	Timeout time.Duration // Per peer; same meaning as HTTPBlobStore.Timeout
 }
 
-func (p *PeerToPeerBlobStore) PutBlob(hash string, data []byte) error {
+func (p *PeerToPeerBlobStore) PutBlob(ctx context.Context, hash string, data []byte) error {
 	var lastErr error
 	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		url := peer + "/blobs/" + hash + ".gz"
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+		reqCtx, cancel := withTimeout(ctx, p.Timeout)
+		req, err := http.NewRequestWithContext(reqCtx, "PUT", url, bytes.NewReader(data))
 		if err != nil {
+			cancel()
 			lastErr = err
 			continue
 		}
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
+			cancel()
 			lastErr = err
 			continue
 		}
 		resp.Body.Close()
+		cancel()
 		if resp.StatusCode != 200 && resp.StatusCode != 201 {
-			lastErr = fmt.Errorf("HTTP PUT failed: %s", resp.Status)
+			lastErr = &HTTPStatusError{Method: "PUT", Status: resp.Status, Code: resp.StatusCode}
 			continue
 		}
 		lastErr = nil
@@ -953,43 +1067,73 @@ func (p *PeerToPeerBlobStore) PutBlob(hash string, data []byte) error {
 	return lastErr
 }
 
-func (p *PeerToPeerBlobStore) GetBlob(hash string) ([]byte, error) {
+func (p *PeerToPeerBlobStore) GetBlob(ctx context.Context, hash string) ([]byte, error) {
 	for _, peer := range p.Peers {
-		url := peer + "/blobs/" + hash + ".gz"
-		resp, err := http.Get(url)
-		if err != nil {
-			continue
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode == 200 {
-			return ioutil.ReadAll(resp.Body)
+		data, err := p.getFrom(ctx, peer, hash)
+		if err == nil {
+			return data, nil
 		}
 	}
 	return nil, fmt.Errorf("blob %s not found on any peer", hash)
 }
 
-func (p *PeerToPeerBlobStore) HasBlob(hash string) bool {
+// getFrom fetches a blob from one peer within the store's timeout
+func (p *PeerToPeerBlobStore) getFrom(ctx context.Context, peer, hash string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, p.Timeout)
+	defer cancel()
+	url := peer + "/blobs/" + hash + ".gz"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &HTTPStatusError{Method: "GET", Status: resp.Status, Code: resp.StatusCode}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (p *PeerToPeerBlobStore) HasBlob(ctx context.Context, hash string) bool {
 	for _, peer := range p.Peers {
 		url := peer + "/blobs/" + hash + ".gz"
-		req, _ := http.NewRequest("HEAD", url, nil)
+		reqCtx, cancel := withTimeout(ctx, p.Timeout)
+		req, _ := http.NewRequestWithContext(reqCtx, "HEAD", url, nil)
 		resp, err := http.DefaultClient.Do(req)
 		if err == nil && resp.StatusCode == 200 {
 			resp.Body.Close()
+			cancel()
 			return true
 		}
 		if resp != nil {
 			resp.Body.Close()
 		}
+		cancel()
 	}
 	return false
 }
 
-func (p *PeerToPeerBlobStore) ListBlobs() ([]string, error) {
+func (p *PeerToPeerBlobStore) ListBlobs(ctx context.Context) ([]string, error) {
 	blobSet := map[string]struct{}{}
 	for _, peer := range p.Peers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		url := peer + "/blobs"
-		resp, err := http.Get(url)
+		reqCtx, cancel := withTimeout(ctx, p.Timeout)
+		req, _ := http.NewRequestWithContext(reqCtx, "GET", url, nil)
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil || resp.StatusCode != 200 {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			cancel()
 			continue
 		}
 		var blobs []string
@@ -999,6 +1143,7 @@ func (p *PeerToPeerBlobStore) ListBlobs() ([]string, error) {
 			}
 		}
 		resp.Body.Close()
+		cancel()
 	}
 	var merged []string
 	for b := range blobSet {
@@ -1011,12 +1156,27 @@ type LocalBlobStore struct {
 	Dir string
 }
 
-func (l *LocalBlobStore) PutBlob(hash string, data []byte) error {
-	path := filepath.Join(l.Dir, hash+".gz")
-	return os.WriteFile(path, data, 0644)
+// PutBlob writes through a temporary file so a cancelled or failed write
+// never leaves a truncated blob under its final name
+func (l *LocalBlobStore) PutBlob(ctx context.Context, hash string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w, err := l.CreateBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
 }
 
-func (l *LocalBlobStore) GetBlob(hash string) ([]byte, error) {
+func (l *LocalBlobStore) GetBlob(ctx context.Context, hash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// If hash ends with .gz, use as is; otherwise, try with .gz
 	path := filepath.Join(l.Dir, hash)
 	if _, err := os.Stat(path); err == nil {
@@ -1028,24 +1188,36 @@ func (l *LocalBlobStore) GetBlob(hash string) ([]byte, error) {
 			return os.ReadFile(gzPath)
 		}
 	}
-	return nil, os.ErrNotExist
+	// Packed blobs hold the same compressed bytes as the loose .gz file
+	return readPacked(packDirFor(l.Dir), strings.TrimSuffix(hash, ".gz"), PackBlob)
 }
 
-func (l *LocalBlobStore) HasBlob(hash string) bool {
+func (l *LocalBlobStore) HasBlob(ctx context.Context, hash string) bool {
 	path := filepath.Join(l.Dir, hash+".gz")
-	_, err := os.Stat(path)
-	return err == nil
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	return hasPacked(packDirFor(l.Dir), hash, PackBlob)
 }
 
-func (l *LocalBlobStore) ListBlobs() ([]string, error) {
+func (l *LocalBlobStore) ListBlobs(ctx context.Context) ([]string, error) {
 	entries, err := os.ReadDir(l.Dir)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	seen := map[string]bool{}
 	var blobs []string
 	for _, e := range entries {
 		if !e.IsDir() && strings.HasSuffix(e.Name(), ".gz") {
-			blobs = append(blobs, strings.TrimSuffix(e.Name(), ".gz"))
+			hash := strings.TrimSuffix(e.Name(), ".gz")
+			seen[hash] = true
+			blobs = append(blobs, hash)
+		}
+	}
+	for _, hash := range listPacked(packDirFor(l.Dir), PackBlob) {
+		if !seen[hash] {
+			seen[hash] = true
+			blobs = append(blobs, hash)
 		}
 	}
 	return blobs, nil
@@ -1053,11 +1225,11 @@ func (l *LocalBlobStore) ListBlobs() ([]string, error) {
 
 // Exported wrappers for test use
 func WriteBlobCompressed(blobStore BlobStore, hash, filePath string) error {
-	return writeBlobCompressed(blobStore, hash, filePath)
+	return writeBlobCompressed(context.Background(), blobStore, hash, filePath)
 }
 
 func ReadBlobDecompressedExported(blobStore BlobStore, hash string) ([]byte, error) {
-	return ReadBlobDecompressed(blobStore, hash)
+	return ReadBlobDecompressed(context.Background(), blobStore, hash)
 }
 
 func WriteDeltaPatch(baseData, newData []byte, patchPath string) error {
@@ -1069,7 +1241,7 @@ func ApplyDeltaPatch(baseData []byte, patchData []byte) ([]byte, error) {
 }
 
 func ReadFileBlobDecompressedExported(blobStore BlobStore, blobRef string) ([]byte, error) {
-	return ReadFileBlobDecompressed(blobStore, blobRef)
+	return ReadFileBlobDecompressed(context.Background(), blobStore, blobRef)
 }
 
 // LoadConflicts loads the conflicts.json file from the repo
@@ -1159,6 +1331,7 @@ func StartBackgroundIndexer(repo *Repo) {
 	indexerOnce.Do(func() {
 		go func() {
 			for {
+				// Skips a round while another process holds the lock exclusively
 				_ = BuildIndex(repo)
 				time.Sleep(10 * time.Second) // Reindex every 10s (tune as needed)
 			}
@@ -1167,7 +1340,15 @@ func StartBackgroundIndexer(repo *Repo) {
 }
 
 // BuildIndex scans all files and commits and updates the index files in .steria/index/.
+// It reads under a shared repository lock and gives up with ErrRepoLocked
+// while another process is changing the repository.
 func BuildIndex(repo *Repo) error {
+	lock, err := LockRepo(repo.Path, LockShared, "search index")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	indexDir := filepath.Join(repo.Path, ".steria", "index")
 	os.MkdirAll(indexDir, 0755)
 	fileIndex := map[string][]string{}   // token -> []filePath
@@ -1218,18 +1399,11 @@ func getAllFiles(root string) []string {
 	return files
 }
 
-// getAllCommits returns all commits in the repo
+// getAllCommits returns all commits reachable from HEAD
 func getAllCommits(repo *Repo) []*Commit {
-	var commits []*Commit
-	seen := map[string]bool{}
-	for hash := repo.Head; hash != "" && !seen[hash]; {
-		seen[hash] = true
-		c, err := repo.LoadCommit(hash)
-		if err != nil {
-			break
-		}
-		commits = append(commits, c)
-		hash = c.Parent
+	commits, err := repo.WalkHistory(repo.Head)
+	if err != nil {
+		return nil
 	}
 	return commits
 }
@@ -1269,17 +1443,25 @@ func SearchCommitIndex(repo *Repo, token string) []string {
 	return idx[strings.ToLower(token)]
 }
 
-// MergeBranches merges the given branch into the current branch, detecting and marking conflicts
-// If a conflict is detected, the file is marked with conflict markers and an entry is added to conflicts.json
-// Returns a list of conflicted files
-func (r *Repo) MergeBranches(targetBranch string, author string) ([]string, error) {
-	// Load target branch HEAD
-	targetBranchPath := filepath.Join(r.Path, ".steria", "branches", targetBranch)
-	targetHeadBytes, err := os.ReadFile(targetBranchPath)
+// MergeBranches merges the given branch into the current branch using a three-way merge against
+// their merge base. If the current branch is an ancestor of the target it is fast-forwarded; if the
+// target is already contained in the current branch nothing changes.
+// Files changed on only one side take that side's version, and files changed on both sides are
+// merged line by line. Regions changed differently on both sides are marked with conflict markers
+// and an entry is added to conflicts.json.
+// A clean merge is recorded immediately as a merge commit with both heads as parents. Otherwise the
+// merged-in head is kept in MERGE_HEAD and the merge commit is created by the first commit made after
+// every conflict has been resolved.
+func (r *Repo) MergeBranches(targetBranch string, author string) (*MergeResult, error) {
+	if pending := r.MergeHead(); pending != "" {
+		return nil, fmt.Errorf("a merge of %s is already in progress; resolve conflicts and commit first", pending)
+	}
+
+	// Load target branch HEAD; remote-tracking branches such as origin/Stem merge too
+	targetHead, err := r.ResolveRevision(targetBranch)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read target branch HEAD: %w", err)
 	}
-	targetHead := string(targetHeadBytes)
 	targetCommit, err := r.LoadCommit(targetHead)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load target branch commit: %w", err)
@@ -1291,122 +1473,199 @@ func (r *Repo) MergeBranches(targetBranch string, author string) ([]string, erro
 		return nil, fmt.Errorf("failed to load current HEAD commit: %w", err)
 	}
 
-	conflictedFiles := []string{}
-	conflictTime := time.Now().Format(time.RFC3339)
-
-	// For each file in either commit, check for conflicts
-	seen := map[string]struct{}{}
-	for _, file := range append(currentCommit.Files, targetCommit.Files...) {
-		if _, ok := seen[file]; ok {
-			continue
-		}
-		seen[file] = struct{}{}
+	base, err := r.MergeBase(r.Head, targetHead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find merge base: %w", err)
+	}
+	result := &MergeResult{Base: base}
 
-		// Defensive: ensure FileBlobs is non-nil
-		if currentCommit.FileBlobs == nil {
-			currentCommit.FileBlobs = make(map[string]string)
-		}
-		if targetCommit.FileBlobs == nil {
-			targetCommit.FileBlobs = make(map[string]string)
-		}
-		curBlob := currentCommit.FileBlobs[file]
-		tgtBlob := targetCommit.FileBlobs[file]
-		// Fallback: if blob is missing, recalculate hash from file
-		if curBlob == "" {
-			curPath := filepath.Join(r.Path, file)
-			if _, err := os.Stat(curPath); err == nil {
-				hash, _ := r.calculateFileHash(curPath)
-				curBlob = hash
-			}
+	if base == targetHead {
+		result.UpToDate = true
+		result.Commit = r.Head
+		return result, nil
+	}
+	if base == r.Head {
+		if err := r.checkoutSnapshot(currentCommit.FileBlobs, targetCommit.FileBlobs); err != nil {
+			return nil, fmt.Errorf("failed to update working directory: %w", err)
 		}
-		if tgtBlob == "" {
-			// Try to get from target branch's working dir (not always possible)
-			// For now, leave as empty
+		if err := r.advanceHead(targetHead, r.operation("merge "+targetBranch)+": fast-forward"); err != nil {
+			return nil, err
 		}
+		result.FastForward = true
+		result.Commit = targetHead
+		return result, nil
+	}
 
-		if curBlob == tgtBlob {
-			continue // No change
+	baseFiles := map[string]string{}
+	if base != "" {
+		baseCommit, err := r.LoadCommit(base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load merge base: %w", err)
 		}
+		baseFiles = baseCommit.FileBlobs
+	}
 
-		// If file only changed in one branch, auto-merge
-		if curBlob == "" || tgtBlob == "" {
-			// Use the non-empty version
-			chosenBlob := curBlob
-			if chosenBlob == "" {
-				chosenBlob = tgtBlob
-			}
-			blobDir := filepath.Join(r.Path, ".steria", "objects", "blobs")
-			store := &LocalBlobStore{Dir: blobDir}
-			data, err := ReadFileBlobDecompressed(store, chosenBlob)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read blob for %s: %w", file, err)
+	files := map[string]struct{}{}
+	for _, snapshot := range []map[string]string{baseFiles, currentCommit.FileBlobs, targetCommit.FileBlobs} {
+		for file := range snapshot {
+			files[file] = struct{}{}
+		}
+	}
+	// Refuse before writing anything if a file the merge writes or removes
+	// has local changes
+	planned := make(map[string]string, len(currentCommit.FileBlobs))
+	for file, blob := range currentCommit.FileBlobs {
+		planned[file] = blob
+	}
+	for file := range files {
+		baseBlob, curBlob, tgtBlob := baseFiles[file], currentCommit.FileBlobs[file], targetCommit.FileBlobs[file]
+		switch {
+		case curBlob == tgtBlob, baseBlob == tgtBlob:
+		case tgtBlob == "":
+			if baseBlob == curBlob {
+				delete(planned, file)
 			}
-			os.WriteFile(filepath.Join(r.Path, file), data, 0644)
-			continue
+		default:
+			planned[file] = tgtBlob
 		}
+	}
+	if err := r.checkClean(currentCommit.FileBlobs, planned); err != nil {
+		return nil, fmt.Errorf("%w; commit or stash them first", err)
+	}
 
-		// Both changed: check for line-level conflicts
-		blobDir := filepath.Join(r.Path, ".steria", "objects", "blobs")
-		store := &LocalBlobStore{Dir: blobDir}
-		curData, err := ReadFileBlobDecompressed(store, curBlob)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read current blob for %s: %w", file, err)
+	if err := os.WriteFile(r.mergeHeadPath(), []byte(targetHead), 0644); err != nil {
+		return nil, fmt.Errorf("failed to record merge head: %w", err)
+	}
+
+	oursLabel := strings.TrimSpace(r.Branch)
+	if oursLabel == "" {
+		oursLabel = "HEAD"
+	}
+	conflictTime := time.Now().Format(time.RFC3339)
+	readLines := func(blob string) ([]string, error) {
+		if blob == "" {
+			return nil, nil
 		}
-		tgtData, err := ReadFileBlobDecompressed(store, tgtBlob)
+		data, err := ReadFileBlobDecompressed(r.Context(), r.BlobStore, blob)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read target blob for %s: %w", file, err)
+			return nil, err
 		}
+		return splitLines(string(data)), nil
+	}
 
-		curLines := splitLines(string(curData))
-		tgtLines := splitLines(string(tgtData))
+	// The merge commit is HEAD's snapshot with the merged files swapped in, so
+	// nothing else in the working directory ends up in it
+	snapshot := make(map[string]string, len(currentCommit.FileBlobs))
+	for file, blob := range currentCommit.FileBlobs {
+		snapshot[file] = blob
+	}
+	merged := map[string]string{} // Cleanly merged file -> content hash
+	var cleanFiles []string
+	for file := range files {
+		baseBlob := baseFiles[file]
+		curBlob := currentCommit.FileBlobs[file]
+		tgtBlob := targetCommit.FileBlobs[file]
 
-		conflictLines := []int{}
-		maxLines := len(curLines)
-		if len(tgtLines) > maxLines {
-			maxLines = len(tgtLines)
-		}
-		merged := []string{}
-		for i := 0; i < maxLines; i++ {
-			var curLine, tgtLine string
-			if i < len(curLines) {
-				curLine = curLines[i]
+		switch {
+		case curBlob == tgtBlob, baseBlob == tgtBlob:
+			// Same on both sides, or only changed on the current branch
+			continue
+
+		case baseBlob == curBlob:
+			// Only changed on the target branch
+			cleanFiles = append(cleanFiles, file)
+			if tgtBlob == "" {
+				os.Remove(filepath.Join(r.Path, file))
+				delete(snapshot, file)
+				continue
 			}
-			if i < len(tgtLines) {
-				tgtLine = tgtLines[i]
+			if err := r.restoreFile(file, tgtBlob); err != nil {
+				return nil, fmt.Errorf("failed to read blob for %s: %w", file, err)
 			}
-			if curLine == tgtLine {
-				merged = append(merged, curLine)
-			} else {
-				// Conflict!
-				merged = append(merged, "<<<<<<< mine")
-				merged = append(merged, curLine)
-				merged = append(merged, "=======")
-				merged = append(merged, tgtLine)
-				merged = append(merged, ">>>>>>> theirs")
-				conflictLines = append(conflictLines, i+1)
+			snapshot[file] = tgtBlob
+
+		case curBlob == "" || tgtBlob == "":
+			// Modified on one side, deleted on the other: keep the modified version
+			details := "Modified on '" + targetBranch + "' but deleted on '" + oursLabel + "'"
+			if tgtBlob == "" {
+				details = "Modified on '" + oursLabel + "' but deleted on '" + targetBranch + "'"
+			} else if err := r.restoreFile(file, tgtBlob); err != nil {
+				return nil, fmt.Errorf("failed to read blob for %s: %w", file, err)
 			}
-		}
-
-		if len(conflictLines) > 0 {
-			// Write merged file with conflict markers
-			os.WriteFile(filepath.Join(r.Path, file), []byte(joinLines(merged)), 0644)
-			// Add to conflicts.json
 			AddConflict(r.Path, Conflict{
 				File:     file,
-				Type:     "line",
-				Lines:    conflictLines,
+				Type:     "file",
 				Status:   "unresolved",
 				Detected: conflictTime,
-				Details:  "Merge conflict detected during merge of branch '" + targetBranch + "'",
+				Details:  details,
 			})
-			conflictedFiles = append(conflictedFiles, file)
-		} else {
-			// No conflict, auto-merge
-			os.WriteFile(filepath.Join(r.Path, file), []byte(joinLines(merged)), 0644)
+			result.Conflicts = append(result.Conflicts, file)
+
+		default:
+			// Changed on both sides: merge line by line against the base
+			baseLines, err := readLines(baseBlob)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read base blob for %s: %w", file, err)
+			}
+			curLines, err := readLines(curBlob)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read current blob for %s: %w", file, err)
+			}
+			tgtLines, err := readLines(tgtBlob)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read target blob for %s: %w", file, err)
+			}
+			mergedLines, conflictLines := merge3Lines(baseLines, curLines, tgtLines, oursLabel, targetBranch)
+			content := []byte(joinLines(mergedLines))
+			if err := os.WriteFile(filepath.Join(r.Path, file), content, 0644); err != nil {
+				return nil, fmt.Errorf("failed to write merged %s: %w", file, err)
+			}
+			if len(conflictLines) > 0 {
+				AddConflict(r.Path, Conflict{
+					File:     file,
+					Type:     "line",
+					Lines:    conflictLines,
+					Status:   "unresolved",
+					Detected: conflictTime,
+					Details:  "Merge conflict detected during merge of branch '" + targetBranch + "'",
+				})
+				result.Conflicts = append(result.Conflicts, file)
+			} else {
+				cleanFiles = append(cleanFiles, file)
+				sum := sha256.Sum256(content)
+				merged[file] = hex.EncodeToString(sum[:])
+			}
+		}
+	}
+
+	if len(result.Conflicts) > 0 {
+		// Stage the cleanly merged files so only the conflicts are left to resolve
+		if len(cleanFiles) > 0 {
+			if _, err := r.Stage(cleanFiles...); err != nil {
+				return nil, fmt.Errorf("failed to stage merged files: %w", err)
+			}
 		}
+		sort.Strings(result.Conflicts)
+		return result, nil
 	}
 
-	return conflictedFiles, nil
+	message := fmt.Sprintf("Merge branch '%s'", targetBranch)
+	if oursLabel != "HEAD" {
+		message += fmt.Sprintf(" into %s", oursLabel)
+	}
+	stored, _, err := r.storeBlobs(r.Context(), r.BlobStore, merged, currentCommit.FileBlobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store merged files: %w", err)
+	}
+	for file, blob := range stored {
+		snapshot[file] = blob
+	}
+	commit, err := r.commitSnapshot(message, author, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create merge commit: %w", err)
+	}
+	result.Commit = commit.Hash
+	return result, nil
 }
 
 // splitLines splits a string into lines (preserving empty lines)
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"os"
 	"testing"
 )
@@ -55,6 +56,16 @@ func TestCreateCommitAndGetChanges(t *testing.T) {
 	}
 }
 
+func TestCreateCommitEmptyWorkingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	os.Remove(dir + "/file.txt")
+	if _, err := repo.CreateCommit("msg", "author"); !errors.Is(err, ErrNothingToCommit) {
+		t.Errorf("Expected ErrNothingToCommit, got %v", err)
+	}
+}
+
 func TestHasRemote(t *testing.T) {
 	dir := t.TempDir()
 	// Create a user file so getAllFiles finds something
@@ -0,0 +1,64 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: revision.go
+// Description: Revision resolution for Steria. Turns HEAD, branch names, tag names, remote-tracking branches, reflog selectors and commit hashes given on the command line into commit hashes.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveRevision returns the commit hash named by rev: HEAD, a branch, a
+// tag, a remote-tracking branch such as origin/Stem, a full commit hash, or a
+// reflog selector such as Stem@{2} or HEAD@{yesterday}
+func (r *Repo) ResolveRevision(rev string) (string, error) {
+	steriaDir := filepath.Join(r.Path, ".steria")
+	if i := strings.Index(rev, "@{"); i >= 0 && strings.HasSuffix(rev, "}") {
+		ref := rev[:i]
+		if tracking := "refs/remotes/" + ref; ref != "" && !r.isBranch(ref) && fileExists(r.refPath(tracking)) {
+			ref = tracking
+		}
+		return r.resolveReflog(ref, rev[i+2:len(rev)-1])
+	}
+	if rev == "HEAD" {
+		if r.Head == "" {
+			return "", fmt.Errorf("HEAD does not point at a commit yet")
+		}
+		return r.Head, nil
+	}
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "branches", filepath.FromSlash(rev))); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "refs", "tags", rev)); err == nil {
+		var tag struct {
+			Commit string `json:"commit"`
+		}
+		if err := json.Unmarshal(data, &tag); err != nil {
+			return "", fmt.Errorf("failed to parse tag '%s': %w", rev, err)
+		}
+		return tag.Commit, nil
+	}
+	if data, err := os.ReadFile(filepath.Join(steriaDir, "refs", "remotes", filepath.FromSlash(rev))); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if _, ok := decodeHash(rev); ok {
+		return rev, nil
+	}
+	return "", fmt.Errorf("unknown revision '%s'", rev)
+}
+
+// isBranch reports whether name is a local branch
+func (r *Repo) isBranch(name string) bool {
+	return fileExists(r.refPath(name))
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
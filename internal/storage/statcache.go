@@ -0,0 +1,222 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: statcache.go
+// Description: Persistent stat cache for Steria. Remembers each working directory file's size, mtime, inode and content hash so status and commit only rehash files that changed on disk.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"steria/internal/utils"
+)
+
+// racyWindow is how recently a file may have been modified and still be
+// cached. A file written within the same timestamp tick as its hash was
+// computed could change again without its mtime moving, so it is always rehashed.
+const racyWindow = 2 * time.Second
+
+// StatEntry is the cached hash of a working directory file together with the
+// stat data it was computed from
+type StatEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Inode   uint64 `json:"inode,omitempty"`
+	Hash    string `json:"hash"`
+}
+
+// StatCache maps repository-relative paths to their last known stat data and hash
+type StatCache struct {
+	Entries map[string]StatEntry `json:"entries"`
+	path    string
+	mu      sync.Mutex
+	dirty   bool
+}
+
+// statCachePath returns the location of the stat cache
+func (r *Repo) statCachePath() string {
+	return filepath.Join(r.Path, ".steria", "statcache.json")
+}
+
+// loadStatCache reads the stat cache. A missing or unreadable cache is
+// treated as empty, since every entry can be recomputed.
+func (r *Repo) loadStatCache() *StatCache {
+	sc := &StatCache{Entries: make(map[string]StatEntry), path: r.statCachePath()}
+	data, err := os.ReadFile(sc.path)
+	if err != nil {
+		return sc
+	}
+	if err := json.Unmarshal(data, sc); err != nil || sc.Entries == nil {
+		sc.Entries = make(map[string]StatEntry)
+	}
+	return sc
+}
+
+// Save writes the cache back to disk if any entry changed
+func (sc *StatCache) Save() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.dirty {
+		return nil
+	}
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal stat cache: %w", err)
+	}
+	if err := atomicWrite(sc.path, data); err != nil {
+		return fmt.Errorf("failed to write stat cache: %w", err)
+	}
+	sc.dirty = false
+	return nil
+}
+
+// statEntryFor builds the stat part of a cache entry from file info
+func statEntryFor(info os.FileInfo) StatEntry {
+	entry := StatEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Inode = uint64(st.Ino)
+	}
+	return entry
+}
+
+// Lookup returns the cached hash for a file if its stat data is unchanged
+func (sc *StatCache) Lookup(rel string, info os.FileInfo) (string, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cached, ok := sc.Entries[rel]
+	if !ok {
+		return "", false
+	}
+	current := statEntryFor(info)
+	if cached.Size != current.Size || cached.ModTime != current.ModTime || cached.Inode != current.Inode {
+		return "", false
+	}
+	return cached.Hash, true
+}
+
+// Store records a freshly computed hash. Files modified within racyWindow are
+// not cached so a same-tick rewrite cannot be missed.
+func (sc *StatCache) Store(rel string, info os.FileInfo, hash string) {
+	if time.Since(info.ModTime()) < racyWindow {
+		return
+	}
+	entry := statEntryFor(info)
+	entry.Hash = hash
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.Entries[rel] != entry {
+		sc.Entries[rel] = entry
+		sc.dirty = true
+	}
+}
+
+// Prune drops entries for files that are no longer in the working directory
+func (sc *StatCache) Prune(present map[string]os.FileInfo) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for rel := range sc.Entries {
+		if _, ok := present[rel]; !ok {
+			delete(sc.Entries, rel)
+			sc.dirty = true
+		}
+	}
+}
+
+// scanWorkingTree lists the non-ignored files in the working directory with their stat data
+func (r *Repo) scanWorkingTree() (map[string]os.FileInfo, error) {
+	ignorePatterns, err := utils.LoadIgnorePatterns(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+
+	files := make(map[string]os.FileInfo)
+	err = filepath.Walk(r.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(r.Path, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && utils.ShouldIgnore(relPath, ignorePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files[relPath] = info
+		}
+		return nil
+	})
+	return files, err
+}
+
+// workingHashes returns path -> content hash for the working directory. Files
+// whose stat data matches the stat cache reuse the cached hash; the rest are
+// handed to hashMisses as absolute paths, and the cache is updated on disk.
+func (r *Repo) workingHashes(hashMisses func(paths []string) (map[string]string, error)) (map[string]string, error) {
+	files, err := r.scanWorkingTree()
+	if err != nil {
+		return nil, err
+	}
+
+	cache := r.loadStatCache()
+	state := make(map[string]string, len(files))
+	var misses []string
+	for rel, info := range files {
+		if hash, ok := cache.Lookup(rel, info); ok {
+			state[rel] = hash
+			continue
+		}
+		misses = append(misses, filepath.Join(r.Path, rel))
+	}
+
+	if len(misses) > 0 {
+		hashed, err := hashMisses(misses)
+		if err != nil {
+			return nil, err
+		}
+		for _, full := range misses {
+			rel, _ := filepath.Rel(r.Path, full)
+			hash, ok := hashed[full]
+			if !ok {
+				return nil, fmt.Errorf("failed to hash file %s", rel)
+			}
+			state[rel] = hash
+			cache.Store(rel, files[rel], hash)
+		}
+	}
+
+	cache.Prune(files)
+	// A cache that fails to save only costs a rehash next time
+	cache.Save()
+	return state, nil
+}
+
+// compareStates reports the files added, modified and deleted in the working
+// state relative to a committed snapshot
+func compareStates(committed, working map[string]string) []FileChange {
+	var changes []FileChange
+	for path, hash := range working {
+		if committedHash, exists := committed[path]; !exists {
+			changes = append(changes, FileChange{Path: path, Type: ChangeTypeAdded, Hash: hash})
+		} else if BlobContentHash(committedHash) != hash {
+			changes = append(changes, FileChange{Path: path, Type: ChangeTypeModified, Hash: hash})
+		}
+	}
+	for path := range committed {
+		if _, exists := working[path]; !exists {
+			changes = append(changes, FileChange{Path: path, Type: ChangeTypeDeleted})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetChangesAgainstHeadBlobs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	os.WriteFile(dir+"/gone.txt", []byte("bye"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+
+	changes, err := repo.GetChanges()
+	if err != nil {
+		t.Fatalf("GetChanges failed: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Expected clean working directory after init, got %+v", changes)
+	}
+
+	os.WriteFile(dir+"/file.txt", []byte("changed"), 0644)
+	os.Remove(dir + "/gone.txt")
+	os.WriteFile(dir+"/new.txt", []byte("new"), 0644)
+	want := map[string]ChangeType{"file.txt": ChangeTypeModified, "gone.txt": ChangeTypeDeleted, "new.txt": ChangeTypeAdded}
+	for name, get := range map[string]func() ([]FileChange, error){
+		"GetChanges":          repo.GetChanges,
+		"GetChangesOptimized": NewOptimizedRepo(repo).GetChangesOptimized,
+	} {
+		changes, err := get()
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if len(changes) != len(want) {
+			t.Fatalf("%s: expected %d changes, got %+v", name, len(want), changes)
+		}
+		for _, c := range changes {
+			if want[c.Path] != c.Type {
+				t.Errorf("%s: %s reported as %s, want %s", name, c.Path, c.Type, want[c.Path])
+			}
+		}
+	}
+}
+
+func TestStatCacheSkipsUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(dir+"/file.txt", old, old)
+
+	if _, err := repo.getWorkingState(); err != nil {
+		t.Fatalf("getWorkingState failed: %v", err)
+	}
+	cache := repo.loadStatCache()
+	entry, ok := cache.Entries["file.txt"]
+	if !ok || entry.Hash == "" {
+		t.Fatalf("Expected file.txt in stat cache, got %+v", cache.Entries)
+	}
+
+	// A cached hash is trusted while the stat data is unchanged
+	entry.Hash = "cached-hash"
+	cache.Entries["file.txt"] = entry
+	cache.dirty = true
+	cache.Save()
+	state, _ := repo.getWorkingState()
+	if state["file.txt"] != "cached-hash" {
+		t.Errorf("Expected unchanged file to reuse cached hash, got %q", state["file.txt"])
+	}
+
+	// Any stat change forces a rehash
+	os.WriteFile(dir+"/file.txt", []byte("changed!"), 0644)
+	os.Chtimes(dir+"/file.txt", old, old)
+	state, _ = repo.getWorkingState()
+	if want, _ := repo.calculateFileHash(dir + "/file.txt"); state["file.txt"] != want {
+		t.Errorf("Expected changed file to be rehashed, got %q want %q", state["file.txt"], want)
+	}
+}
@@ -0,0 +1,758 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: transfer.go
+// Description: History transfer between a Steria repository and its remotes. Push uploads a branch with every commit, tree and blob the remote is missing and then moves the remote branch; fetch downloads every remote branch into remote-tracking refs (refs/remotes/<remote>/<branch>) after verifying each object against its hash; pull fetches and fast-forwards the current branch.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrObjectRejected marks a received commit or tree whose content does not match its name
+var ErrObjectRejected = errors.New("object failed verification")
+
+// TrackingRef returns the remote-tracking ref recording where branch was on remote
+func TrackingRef(remote, branch string) string {
+	return "refs/remotes/" + remote + "/" + branch
+}
+
+// Branches returns every local branch and the commit it points at
+func (r *Repo) Branches() (map[string]string, error) {
+	branches := map[string]string{}
+	branchesDir := filepath.Join(r.Path, ".steria", "branches")
+	err := filepath.Walk(branchesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || isRefScratchFile(path) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(branchesDir, path)
+		branches[filepath.ToSlash(rel)] = strings.TrimSpace(string(data))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read branches: %w", err)
+	}
+	return branches, nil
+}
+
+// ReadObject returns the stored bytes of a commit or tree
+func (r *Repo) ReadObject(kind PackObjectKind, hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("object hash too short: %q", hash)
+	}
+	if kind == PackTree {
+		return r.readTreeObject(hash)
+	}
+	return r.readCommitObject(hash)
+}
+
+// HasObject reports whether a commit or tree is stored
+func (r *Repo) HasObject(kind PackObjectKind, hash string) bool {
+	if kind == PackTree {
+		return r.hasTree(hash)
+	}
+	return r.hasCommit(hash)
+}
+
+// verifyObject checks that received commit or tree bytes hash to their name
+// and parse. Commits must also be in canonical form.
+func verifyObject(kind PackObjectKind, hash string, data []byte) error {
+	if _, ok := decodeHash(hash); !ok {
+		return fmt.Errorf("%w: %q is not an object hash", ErrObjectRejected, hash)
+	}
+	if kind == PackCommit {
+		if err := verifyCommitObject(hash, data); err != nil {
+			return fmt.Errorf("%w: commit %s: %v", ErrObjectRejected, hash, err)
+		}
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("%w: tree %s: content does not match its hash", ErrObjectRejected, hash)
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return fmt.Errorf("%w: tree %s: %v", ErrObjectRejected, hash, err)
+	}
+	return nil
+}
+
+// writeObject stores commit or tree bytes that have been verified
+func (r *Repo) writeObject(kind PackObjectKind, hash string, data []byte) error {
+	path := filepath.Join(r.Path, ".steria", "objects", hash[:2], hash[2:])
+	if kind == PackTree {
+		path = r.treePath(hash)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomicWrite(path, data)
+}
+
+// ReceiveObject verifies a commit or tree from an untrusted source and stores
+// it. Content that does not match its hash is refused with ErrObjectRejected.
+func (r *Repo) ReceiveObject(kind PackObjectKind, hash string, data []byte) error {
+	if err := verifyObject(kind, hash, data); err != nil {
+		return err
+	}
+	return r.writeObject(kind, hash, data)
+}
+
+// ReceiveRef points a branch at a pushed commit, which must already be
+// stored, if the branch still points at old ("" if it must not exist yet);
+// otherwise it fails with ErrRefConflict. When the branch is checked out,
+// HEAD moves with it and the working directory is updated to the pushed
+// commit under the repository lock; the push is refused with
+// ErrLocalChanges if that would overwrite uncommitted changes.
+func (r *Repo) ReceiveRef(branch, old, hash string) error {
+	if !validRefName(branch) {
+		return fmt.Errorf("invalid branch name %q", branch)
+	}
+	if !r.hasCommit(hash) {
+		return fmt.Errorf("commit %s has not been pushed", shortRef(hash))
+	}
+	op := r.operation("push")
+	tx := r.NewRefTransaction().UpdateFrom(branch, hash, old, op)
+	if strings.TrimSpace(r.Branch) != branch {
+		return tx.Commit()
+	}
+
+	lock, err := LockRepo(r.Path, LockExclusive, op)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	from, err := r.headFiles()
+	if err != nil {
+		return err
+	}
+	commit, err := r.LoadCommit(hash)
+	if err != nil {
+		return fmt.Errorf("failed to load commit %s: %w", hash, err)
+	}
+	if err := r.checkClean(from, commit.FileBlobs); err != nil {
+		return fmt.Errorf("cannot update checked-out branch %s: %w", branch, err)
+	}
+	if err := tx.UpdateFrom("HEAD", hash, r.Head, op).Commit(); err != nil {
+		return err
+	}
+	if err := r.checkoutSnapshot(from, commit.FileBlobs); err != nil {
+		return fmt.Errorf("failed to update working directory: %w", err)
+	}
+	return nil
+}
+
+// ErrPushRejected is returned when a push leaves the remote branch alone
+// because moving it would discard commits someone else pushed
+var ErrPushRejected = errors.New("push rejected")
+
+// PushStatus is what a push did to the remote branch
+type PushStatus string
+
+const (
+	PushNew         PushStatus = "new"          // The branch did not exist on the remote
+	PushFastForward PushStatus = "fast-forward" // The remote branch was an ancestor of the pushed commit
+	PushForced      PushStatus = "forced"       // Commits on the remote branch were discarded by --force or --force-with-lease
+	PushUpToDate    PushStatus = "up-to-date"   // The remote branch already pointed at the commit
+
+	PushRejectedNonFastForward PushStatus = "rejected-non-fast-forward" // The remote branch has commits the pushed one does not contain
+	PushRejectedFetchFirst     PushStatus = "rejected-fetch-first"      // The remote branch points at a commit that was never fetched
+	PushRejectedStale          PushStatus = "rejected-stale"            // --force-with-lease: the remote branch is not where it was expected
+	PushRejectedChanged        PushStatus = "rejected-changed"          // Someone else moved the remote branch while the push ran
+)
+
+// Rejected reports whether the remote branch was left alone
+func (s PushStatus) Rejected() bool {
+	return strings.HasPrefix(string(s), "rejected")
+}
+
+// PushOptions relax the fast-forward rule of a push
+type PushOptions struct {
+	// Force moves the remote branch even if that discards commits on it
+	Force bool
+	// Lease moves the remote branch regardless of history, but only while it
+	// still points at Expected ("" if it must not exist); used by
+	// --force-with-lease
+	Lease    bool
+	Expected string
+}
+
+// PushResult reports what a push transferred and did to the remote branch
+type PushResult struct {
+	Branch  string     `json:"branch"`
+	Commit  string     `json:"commit"`
+	Old     string     `json:"old,omitempty"` // Where the remote branch pointed before; empty if it was new
+	Status  PushStatus `json:"status"`
+	Reason  string     `json:"reason,omitempty"` // Why the push was rejected
+	Commits int        `json:"commits"`
+	Trees   int        `json:"trees"`
+	Blobs   int        `json:"blobs"`
+	// SetUpstream is true when this push made the remote branch the local
+	// branch's upstream
+	SetUpstream bool `json:"set_upstream,omitempty"`
+	// Failed lists objects that could not be uploaded after retries; the
+	// remote branch was left alone and pushing again sends only what is missing
+	Failed []TransferFailure `json:"failed,omitempty"`
+}
+
+// Push uploads branch to a remote together with every commit the remote does
+// not have yet and the trees and blobs those commits name, as negotiated by
+// planPush from the remote's branch tips. Blobs and trees go
+// first and commits parents first, so a remote that has a commit always has
+// its whole history; the remote branch moves last, compare-and-swap from the
+// value the push started from. Unless opts say otherwise the remote branch
+// must be an ancestor of the pushed commit; a rejected push returns its
+// result with an error wrapping ErrPushRejected. The remote-tracking ref of
+// the branch is updated to match, and a branch without an upstream gets the
+// remote branch as its upstream.
+func (r *Repo) Push(store RemoteStore, remote, branch string, opts PushOptions) (*PushResult, error) {
+	ctx := r.Context()
+	tip, err := r.ReadRef(branch)
+	if err != nil {
+		return nil, err
+	}
+	if tip == "" {
+		return nil, fmt.Errorf("branch '%s' has no commits", branch)
+	}
+	refs, err := store.ListRefs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote branches: %w", err)
+	}
+	result := &PushResult{Branch: branch, Commit: tip, Old: refs[branch]}
+	if err := r.checkPush(result, opts); err != nil {
+		return result, err
+	}
+
+	plan, err := r.planPush(store, refs, tip)
+	if err != nil {
+		return nil, err
+	}
+	run := r.startTransfer()
+	err = r.sendPlan(run, store, plan, result)
+	result.Failed = run.finish()
+	if err != nil {
+		if errors.Is(err, ErrTransferIncomplete) {
+			return result, err
+		}
+		return nil, err
+	}
+
+	if result.Status != PushUpToDate {
+		if err := store.UpdateRef(ctx, branch, result.Old, tip); err != nil {
+			if errors.Is(err, ErrRefConflict) {
+				return result, result.reject(PushRejectedChanged, "the remote branch moved while pushing; fetch and try again")
+			}
+			return nil, fmt.Errorf("failed to update remote branch '%s': %w", branch, err)
+		}
+	}
+	if err := r.UpdateRef(TrackingRef(remote, branch), tip, "push"); err != nil {
+		return result, err
+	}
+
+	// The first push of a branch makes the remote branch its upstream
+	up, err := r.Upstream(branch)
+	if err != nil {
+		return result, err
+	}
+	if up == nil {
+		if err := r.SetUpstream(branch, &Upstream{Remote: remote, Branch: branch}); err != nil {
+			return result, err
+		}
+		result.SetUpstream = true
+	}
+	return result, nil
+}
+
+// sendPlan uploads what planPush found missing: blobs, then trees, each
+// through the worker pool, and only when all of them made it the commits,
+// parents first, so a remote never has a commit without its history. Failed
+// objects are recorded on run with their error.
+func (r *Repo) sendPlan(run *transferRun, store RemoteStore, plan *pushPlan, result *PushResult) error {
+	var err error
+	if result.Blobs, err = r.sendBlobs(run, store, plan.blobs); err != nil {
+		return err
+	}
+	if err := run.incomplete("uploaded"); err != nil {
+		return err
+	}
+	var trees atomic.Int64
+	err = run.each(plan.trees, func(ctx context.Context, tree string) error {
+		data, err := r.readTreeObject(tree)
+		if err != nil {
+			return fmt.Errorf("failed to read tree %s: %w", tree, err)
+		}
+		if err := store.PutObject(ctx, PackTree, tree, data); err != nil {
+			return err
+		}
+		run.bytes.Add(int64(len(data)))
+		trees.Add(1)
+		return nil
+	})
+	result.Trees = int(trees.Load())
+	if err != nil {
+		return err
+	}
+	if err := run.incomplete("uploaded"); err != nil {
+		return err
+	}
+	for _, commit := range plan.commits {
+		err := run.do(commit.Hash, func(ctx context.Context) error {
+			data, err := r.readCommitObject(commit.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to read commit %s: %w", commit.Hash, err)
+			}
+			if err := store.PutObject(ctx, PackCommit, commit.Hash, data); err != nil {
+				return err
+			}
+			run.bytes.Add(int64(len(data)))
+			return nil
+		})
+		if err != nil {
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return run.incomplete("uploaded")
+		}
+		result.Commits++
+	}
+	return nil
+}
+
+// sendBlobs uploads blobs the remote is missing through the worker pool and
+// returns how many were sent. A delta blob is only accepted once its base is
+// there, so bases go a round ahead of the blobs built on them; a base outside
+// the list is probed, as the remote may lack it even when it has every blob
+// the negotiated history names.
+func (r *Repo) sendBlobs(run *transferRun, store RemoteStore, blobs []string) (int, error) {
+	ctx := r.Context()
+	local := run.counted(&LocalBlobStore{Dir: filepath.Join(r.Path, ".steria", "objects", "blobs")})
+	queued := map[string]bool{}
+	for _, hash := range blobs {
+		queued[hash] = true
+	}
+	pending := append([]string(nil), blobs...)
+	bases := map[string]string{}
+	for i := 0; i < len(pending); i++ {
+		hash := pending[i]
+		base := deltaBase(r.storedBlobHeader(hash))
+		if base == "" {
+			continue
+		}
+		if !queued[base] {
+			if store.HasBlob(ctx, base) {
+				continue
+			}
+			queued[base] = true
+			pending = append(pending, base)
+		}
+		bases[hash] = base
+	}
+	depths := map[string]int{}
+	var depth func(hash string) int
+	depth = func(hash string) int {
+		if d, ok := depths[hash]; ok {
+			return d
+		}
+		d := 0
+		if base, ok := bases[hash]; ok {
+			d = depth(base) + 1
+		}
+		depths[hash] = d
+		return d
+	}
+	var rounds [][]string
+	for _, hash := range pending {
+		d := depth(hash)
+		for len(rounds) <= d {
+			rounds = append(rounds, nil)
+		}
+		rounds[d] = append(rounds[d], hash)
+	}
+
+	var sent atomic.Int64
+	var uploaded sync.Map
+	for _, round := range rounds {
+		err := run.each(round, func(ctx context.Context, hash string) error {
+			if base, ok := bases[hash]; ok {
+				if _, done := uploaded.Load(base); !done {
+					return fmt.Errorf("delta base %s was not uploaded", base)
+				}
+			}
+			if err := CopyBlob(ctx, store, local, hash); err != nil {
+				return err
+			}
+			uploaded.Store(hash, true)
+			sent.Add(1)
+			return nil
+		})
+		if err != nil {
+			return int(sent.Load()), err
+		}
+	}
+	return int(sent.Load()), nil
+}
+
+// LeaseExpectation returns the commit --force-with-lease expects a remote
+// branch to be at: expected resolved as a revision, or when it is empty the
+// remote-tracking branch as of the last fetch ("" if it was never fetched)
+func (r *Repo) LeaseExpectation(remote, branch, expected string) (string, error) {
+	if expected == "" {
+		tracking, err := r.ReadRef(TrackingRef(remote, branch))
+		if err != nil {
+			return "", nil
+		}
+		return tracking, nil
+	}
+	return r.ResolveRevision(expected)
+}
+
+// checkPush decides what a push may do to the remote branch before anything
+// is uploaded: fast-forward it, force it, or reject the push
+func (r *Repo) checkPush(result *PushResult, opts PushOptions) error {
+	old, tip := result.Old, result.Commit
+	if opts.Lease && old != opts.Expected {
+		return result.reject(PushRejectedStale, fmt.Sprintf("the remote branch is at %s, expected %s", shortRef(old), shortRef(opts.Expected)))
+	}
+	switch {
+	case old == tip:
+		result.Status = PushUpToDate
+		return nil
+	case old == "":
+		result.Status = PushNew
+		return nil
+	}
+	fastForward := false
+	if r.hasCommit(old) {
+		var err error
+		if fastForward, err = r.IsAncestor(old, tip); err != nil {
+			return err
+		}
+	}
+	switch {
+	case fastForward:
+		result.Status = PushFastForward
+	case opts.Force || opts.Lease:
+		result.Status = PushForced
+	case !r.hasCommit(old):
+		return result.reject(PushRejectedFetchFirst, "the remote branch has commits you do not have; fetch and merge them first")
+	default:
+		return result.reject(PushRejectedNonFastForward, "the remote branch has commits the pushed one does not contain; merge them first")
+	}
+	return nil
+}
+
+// reject marks the push rejected and returns the error Push reports
+func (p *PushResult) reject(status PushStatus, reason string) error {
+	p.Status, p.Reason = status, reason
+	return fmt.Errorf("%w: %s: %s", ErrPushRejected, p.Branch, reason)
+}
+
+// TrackingUpdate is a remote-tracking ref moved by a fetch
+type TrackingUpdate struct {
+	Branch string `json:"branch"`
+	Old    string `json:"old,omitempty"` // Empty when the branch is new
+	New    string `json:"new"`
+}
+
+// FetchResult reports what a fetch transferred
+type FetchResult struct {
+	Updated  []TrackingUpdate `json:"updated"`
+	Commits  int              `json:"commits"`
+	Trees    int              `json:"trees"`
+	Blobs    int              `json:"blobs"`
+	Rejected []string         `json:"rejected,omitempty"` // Objects that failed verification
+	// Failed lists objects that could not be downloaded after retries; no
+	// remote-tracking ref moved and fetching again downloads only what is missing
+	Failed []TransferFailure `json:"failed,omitempty"`
+}
+
+// pendingObject is a verified commit or tree held back until everything it names is stored
+type pendingObject struct {
+	kind PackObjectKind
+	hash string
+	data []byte
+}
+
+// Fetch downloads every branch of a remote into remote-tracking refs along
+// with the commits, trees and blobs they need that are not stored locally.
+// Every object is verified against its hash. Blobs are stored first, then
+// trees and commits in an order where each object follows everything it
+// names, and the tracking refs move last, so an interrupted fetch never
+// leaves a commit whose history is incomplete. If any object fails
+// verification no ref is moved.
+func (r *Repo) Fetch(store RemoteStore, remote string) (*FetchResult, error) {
+	ctx := r.Context()
+	refs, err := store.ListRefs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote branches: %w", err)
+	}
+	result := &FetchResult{Updated: []TrackingUpdate{}}
+	run := r.startTransfer()
+	defer func() { result.Failed = run.finish() }()
+
+	reach := newReachability()
+	var pending []pendingObject
+	get := func(kind PackObjectKind, hash string) ([]byte, error) {
+		var data []byte
+		err := run.do(hash, func(ctx context.Context) error {
+			var err error
+			data, err = store.GetObject(ctx, kind, hash)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s %s: %w", strings.TrimSuffix(objectNamespace(kind), "s"), hash, err)
+		}
+		run.bytes.Add(int64(len(data)))
+		if err := verifyObject(kind, hash, data); err != nil {
+			result.Rejected = append(result.Rejected, hash)
+			return nil, err
+		}
+		return data, nil
+	}
+	var visitTree func(hash string) error
+	visitTree = func(hash string) error {
+		if reach.Trees[hash] || r.hasTree(hash) {
+			return nil
+		}
+		reach.Trees[hash] = true
+		data, err := get(PackTree, hash)
+		if err != nil {
+			return err
+		}
+		var tree Tree
+		json.Unmarshal(data, &tree)
+		for _, e := range tree.Entries {
+			if e.Type == TreeEntryTree {
+				if err := visitTree(e.Hash); err != nil {
+					return err
+				}
+			} else {
+				reach.markBlobRef(e.Hash)
+			}
+		}
+		pending = append(pending, pendingObject{PackTree, hash, data})
+		return nil
+	}
+	var visitCommit func(hash string) error
+	visitCommit = func(hash string) error {
+		if reach.Commits[hash] || r.hasCommit(hash) {
+			return nil
+		}
+		reach.Commits[hash] = true
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := get(PackCommit, hash)
+		if err != nil {
+			return err
+		}
+		commit, _ := DecodeCommit(hash, data)
+		if commit.Tree != "" {
+			if err := visitTree(commit.Tree); err != nil {
+				return err
+			}
+		}
+		for _, blob := range commit.FileBlobs {
+			reach.markBlobRef(blob)
+		}
+		for _, parent := range commit.Parents {
+			if err := visitCommit(parent); err != nil {
+				return err
+			}
+		}
+		pending = append(pending, pendingObject{PackCommit, hash, data})
+		return nil
+	}
+	branches := sortedKeys(stringSet(refs))
+	for _, branch := range branches {
+		if !validRefName(branch) {
+			return nil, fmt.Errorf("remote has an invalid branch name %q", branch)
+		}
+		if _, ok := decodeHash(refs[branch]); !ok {
+			return nil, fmt.Errorf("remote branch '%s' points at invalid commit %q", branch, refs[branch])
+		}
+		if err := visitCommit(refs[branch]); err != nil {
+			return result, err
+		}
+	}
+
+	// Blobs, then the chunks of chunked files once their lists are here,
+	// through the worker pool; FetchBlob fetches delta bases itself
+	local := &LocalBlobStore{Dir: filepath.Join(r.Path, ".steria", "objects", "blobs")}
+	src := run.counted(store)
+	var mu sync.Mutex
+	fetch := func(ctx context.Context, hash string) error {
+		if local.HasBlob(ctx, hash) {
+			return nil
+		}
+		if err := FetchBlob(ctx, local, src, hash); err != nil {
+			if errors.Is(err, ErrBlobRejected) {
+				mu.Lock()
+				result.Rejected = append(result.Rejected, hash)
+				mu.Unlock()
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		result.Blobs++
+		mu.Unlock()
+		return nil
+	}
+	if err := run.each(sortedKeys(reach.Blobs), fetch); err != nil {
+		return result, err
+	}
+	var chunks []string
+	for _, ref := range reach.chunkLists {
+		list, err := LoadChunkList(ctx, local, ref)
+		if err != nil {
+			if len(result.Rejected) > 0 || run.incomplete("downloaded") != nil {
+				continue // The list itself was rejected or failed
+			}
+			return result, err
+		}
+		for _, c := range list.Chunks {
+			chunks = append(chunks, c.Hash)
+		}
+	}
+	if err := run.each(chunks, fetch); err != nil {
+		return result, err
+	}
+	if len(result.Rejected) > 0 {
+		return result, fmt.Errorf("%d objects from '%s' failed verification and were quarantined", len(result.Rejected), remote)
+	}
+	if err := run.incomplete("downloaded"); err != nil {
+		return result, err
+	}
+
+	for _, obj := range pending {
+		if err := r.writeObject(obj.kind, obj.hash, obj.data); err != nil {
+			return result, fmt.Errorf("failed to store %s: %w", obj.hash, err)
+		}
+		if obj.kind == PackTree {
+			result.Trees++
+		} else {
+			result.Commits++
+		}
+	}
+
+	tx := r.NewRefTransaction()
+	for _, branch := range branches {
+		ref := TrackingRef(remote, branch)
+		old, _ := r.ReadRef(ref)
+		if old == refs[branch] {
+			continue
+		}
+		tx.UpdateFrom(ref, refs[branch], old, "fetch: "+remote)
+		result.Updated = append(result.Updated, TrackingUpdate{Branch: branch, Old: old, New: refs[branch]})
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to update remote-tracking refs: %w", err)
+	}
+	return result, nil
+}
+
+// stringSet returns the keys of a map as a set
+func stringSet(m map[string]string) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// PullResult reports a pull: what was fetched and what happened to the
+// current branch
+type PullResult struct {
+	*FetchResult
+	Upstream    string `json:"upstream"` // <remote>/<branch> the current branch was brought up to
+	FastForward bool   `json:"fast_forward,omitempty"`
+	UpToDate    bool   `json:"up_to_date,omitempty"`
+	Diverged    bool   `json:"diverged,omitempty"` // Both sides have new commits; merge the upstream to combine them
+	NoUpstream  bool   `json:"no_upstream,omitempty"`
+}
+
+// Pull fetches a remote and fast-forwards the current branch, and the
+// working directory, to its upstream when the local branch has no commits of
+// its own. Without an upstream on that remote the remote branch of the same
+// name is used.
+func (r *Repo) Pull(store RemoteStore, remote string) (*PullResult, error) {
+	fetched, err := r.Fetch(store, remote)
+	if err != nil {
+		return &PullResult{FetchResult: fetched}, err
+	}
+	branch := strings.TrimSpace(r.Branch)
+	up, err := r.Upstream(branch)
+	if err != nil {
+		return &PullResult{FetchResult: fetched}, err
+	}
+	if up == nil || up.Remote != remote {
+		up = &Upstream{Remote: remote, Branch: branch}
+	}
+	result := &PullResult{FetchResult: fetched, Upstream: up.String()}
+	target, err := r.ReadRef(up.Ref())
+	if err != nil {
+		result.NoUpstream = true
+		return result, nil
+	}
+	if target == r.Head {
+		result.UpToDate = true
+		return result, nil
+	}
+	if r.Head != "" {
+		behind, err := r.IsAncestor(r.Head, target)
+		if err != nil {
+			return result, err
+		}
+		if !behind {
+			ahead, err := r.IsAncestor(target, r.Head)
+			if err != nil {
+				return result, err
+			}
+			result.UpToDate, result.Diverged = ahead, !ahead
+			return result, nil
+		}
+	}
+	if err := r.fastForward(target, "pull: fast-forward to "+result.Upstream); err != nil {
+		return result, err
+	}
+	result.FastForward = true
+	return result, nil
+}
+
+// fastForward checks out a descendant of HEAD and moves HEAD and the current
+// branch to it
+func (r *Repo) fastForward(target, op string) error {
+	current, err := r.headFiles()
+	if err != nil {
+		return err
+	}
+	commit, err := r.LoadCommit(target)
+	if err != nil {
+		return fmt.Errorf("failed to load commit %s: %w", target, err)
+	}
+	if err := r.checkoutSnapshot(current, commit.FileBlobs); err != nil {
+		return fmt.Errorf("failed to update working directory: %w", err)
+	}
+	return r.advanceHead(target, op)
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPushAndPullHistory(t *testing.T) {
+	dirA := t.TempDir()
+	os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("one"), 0644)
+	a, err := LoadOrInitRepo(dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// B starts as a copy of A, sharing its first commit
+	dirB := t.TempDir()
+	if err := os.CopyFS(dirB, os.DirFS(dirA)); err != nil {
+		t.Fatal(err)
+	}
+	store := &LocalBlobStore{Dir: t.TempDir()}
+
+	// A commits and pushes: history, blobs and the branch reach the remote
+	os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("two"), 0644)
+	os.WriteFile(filepath.Join(dirA, "b.txt"), []byte("new file"), 0644)
+	commit, err := a.CreateCommit("Second", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.advanceHead(commit.Hash, "test"); err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := a.Push(store, "origin", "Stem", PushOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Commit != commit.Hash || pushed.Commits < 2 || pushed.Blobs == 0 {
+		t.Errorf("Expected the whole history and its blobs pushed, got %+v", pushed)
+	}
+	if refs, _ := store.ListRefs(a.Context()); refs["Stem"] != commit.Hash {
+		t.Errorf("Expected the remote Stem at %s, got %v", commit.Hash, refs)
+	}
+	if tracking, _ := a.ReadRef(TrackingRef("origin", "Stem")); tracking != commit.Hash {
+		t.Errorf("Expected push to move origin/Stem, got %q", tracking)
+	}
+	if up, _ := a.Upstream("Stem"); !pushed.SetUpstream || up == nil || up.String() != "origin/Stem" {
+		t.Errorf("Expected the first push to make origin/Stem the upstream, got %+v", up)
+	}
+	if again, err := a.Push(store, "origin", "Stem", PushOptions{}); err != nil || again.Commits != 0 || again.Old != commit.Hash || again.SetUpstream {
+		t.Errorf("Expected a second push to send nothing, got %+v, %v", again, err)
+	}
+
+	// B pulls: the tracking ref moves and the branch fast-forwards once clean
+	b, err := LoadOrInitRepo(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := b.Head
+
+	// An uncommitted edit the pull would overwrite stops it, naming the file
+	os.WriteFile(filepath.Join(dirB, "a.txt"), []byte("local edit"), 0644)
+	refused, err := b.Pull(store, "origin")
+	if !errors.Is(err, ErrLocalChanges) || !strings.Contains(err.Error(), "a.txt") {
+		t.Fatalf("Expected the pull to refuse naming a.txt, got %v", err)
+	}
+	if refused.Commits != 1 || len(refused.Updated) != 1 {
+		t.Errorf("Expected the refused pull to have fetched one new commit, got %+v", refused.FetchResult)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dirB, "a.txt")); b.Head != base || string(data) != "local edit" {
+		t.Fatalf("Expected B left at %s with the edit, got %s and %q", base, b.Head, data)
+	}
+	os.WriteFile(filepath.Join(dirB, "a.txt"), []byte("one"), 0644)
+
+	pulled, err := b.Pull(store, "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pulled.FastForward {
+		t.Errorf("Expected a fast-forward, got %+v", pulled)
+	}
+	if b.Head != commit.Hash {
+		t.Errorf("Expected B at %s, got %s", commit.Hash, b.Head)
+	}
+	if hash, err := b.ResolveRevision("origin/Stem"); err != nil || hash != commit.Hash {
+		t.Errorf("Expected origin/Stem to resolve to %s, got %s, %v", commit.Hash, hash, err)
+	}
+	for name, want := range map[string]string{"a.txt": "two", "b.txt": "new file"} {
+		if data, _ := os.ReadFile(filepath.Join(dirB, name)); string(data) != want {
+			t.Errorf("Expected %s to contain %q after the pull, got %q", name, want, data)
+		}
+	}
+	if again, err := b.Pull(store, "origin"); err != nil || !again.UpToDate {
+		t.Errorf("Expected a second pull to be up to date, got %+v, %v", again, err)
+	}
+
+	// A tampered commit is quarantined and no tracking ref moves
+	os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("three"), 0644)
+	third, err := a.CreateCommit("Third", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.advanceHead(third.Hash, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Push(store, "origin", "Stem", PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(store.Dir, "commits", third.Hash), []byte("forged"), 0644)
+	fetched, err := b.Fetch(store, "origin")
+	if err == nil || len(fetched.Rejected) != 1 {
+		t.Errorf("Expected the forged commit to be rejected, got %+v, %v", fetched, err)
+	}
+	if tracking, _ := b.ReadRef(TrackingRef("origin", "Stem")); tracking != commit.Hash {
+		t.Errorf("Expected origin/Stem to stay at %s, got %s", commit.Hash, tracking)
+	}
+	if b.hasCommit(third.Hash) {
+		t.Error("Expected the forged commit not to be stored")
+	}
+}
+
+func TestPushRejectsNonFastForward(t *testing.T) {
+	dirA := t.TempDir()
+	os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("one"), 0644)
+	a, err := LoadOrInitRepo(dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirB := t.TempDir()
+	if err := os.CopyFS(dirB, os.DirFS(dirA)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadOrInitRepo(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &LocalBlobStore{Dir: t.TempDir()}
+	commitIn := func(repo *Repo, dir, content string) string {
+		os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644)
+		commit, err := repo.CreateCommit(content, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.advanceHead(commit.Hash, "test"); err != nil {
+			t.Fatal(err)
+		}
+		return commit.Hash
+	}
+
+	// A pushes first; B's diverged push must not clobber it
+	fromA := commitIn(a, dirA, "from A")
+	if pushed, err := a.Push(store, "origin", "Stem", PushOptions{}); err != nil || pushed.Status != PushNew {
+		t.Fatalf("Expected a new remote branch, got %+v, %v", pushed, err)
+	}
+	fromB := commitIn(b, dirB, "from B")
+	pushed, err := b.Push(store, "origin", "Stem", PushOptions{})
+	if !errors.Is(err, ErrPushRejected) || pushed.Status != PushRejectedFetchFirst {
+		t.Errorf("Expected a push over unfetched commits to be rejected, got %+v, %v", pushed, err)
+	}
+	if _, err := b.Fetch(store, "origin"); err != nil {
+		t.Fatal(err)
+	}
+	pushed, err = b.Push(store, "origin", "Stem", PushOptions{})
+	if !errors.Is(err, ErrPushRejected) || pushed.Status != PushRejectedNonFastForward {
+		t.Errorf("Expected a diverged push to be rejected, got %+v, %v", pushed, err)
+	}
+	if refs, _ := store.ListRefs(b.Context()); refs["Stem"] != fromA {
+		t.Errorf("Expected the remote branch to stay at A's commit, got %s", refs["Stem"])
+	}
+
+	// A lease on a stale expectation fails; one on the fetched tip wins
+	pushed, err = b.Push(store, "origin", "Stem", PushOptions{Lease: true, Expected: fromB})
+	if !errors.Is(err, ErrPushRejected) || pushed.Status != PushRejectedStale {
+		t.Errorf("Expected a stale lease to be rejected, got %+v, %v", pushed, err)
+	}
+	expected, err := b.LeaseExpectation("origin", "Stem", "")
+	if err != nil || expected != fromA {
+		t.Fatalf("Expected the lease to default to origin/Stem at %s, got %s, %v", fromA, expected, err)
+	}
+	pushed, err = b.Push(store, "origin", "Stem", PushOptions{Lease: true, Expected: expected})
+	if err != nil || pushed.Status != PushForced {
+		t.Errorf("Expected the leased push to force the branch, got %+v, %v", pushed, err)
+	}
+
+	// A fast-forward on top of B's commit goes through without options
+	next := commitIn(b, dirB, "next")
+	if pushed, err := b.Push(store, "origin", "Stem", PushOptions{}); err != nil || pushed.Status != PushFastForward {
+		t.Errorf("Expected a fast-forward, got %+v, %v", pushed, err)
+	}
+
+	// The remote ref itself is compare-and-swap
+	if err := store.UpdateRef(b.Context(), "Stem", fromA, fromB); !errors.Is(err, ErrRefConflict) {
+		t.Errorf("Expected a swap from a stale value to conflict, got %v", err)
+	}
+	if err := store.UpdateRef(b.Context(), "Stem", "", fromB); !errors.Is(err, ErrRefConflict) {
+		t.Errorf("Expected creating an existing branch to conflict, got %v", err)
+	}
+	if refs, _ := store.ListRefs(b.Context()); refs["Stem"] != next {
+		t.Errorf("Expected the remote branch at %s, got %s", next, refs["Stem"])
+	}
+}
+
+func TestReceiveRefUpdatesCheckedOutBranch(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pusher starts from a copy; its commits reach the repository's
+	// object store through a fetch, the way a push stores them
+	pusherDir := t.TempDir()
+	if err := os.CopyFS(pusherDir, os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	pusher, err := LoadOrInitRepo(pusherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &LocalBlobStore{Dir: t.TempDir()}
+	pushed := func(content string) string {
+		os.WriteFile(filepath.Join(pusherDir, "a.txt"), []byte(content), 0644)
+		commit, err := pusher.CreateCommit(content, "pusher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pusher.Push(store, "origin", "Stem", PushOptions{Force: true}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.Fetch(store, "origin"); err != nil {
+			t.Fatal(err)
+		}
+		return commit.Hash
+	}
+
+	// A push to the checked-out branch checks the pushed commit out
+	base := repo.Head
+	first := pushed("pushed")
+	if err := repo.ReceiveRef("Stem", base, first); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); repo.Head != first || string(data) != "pushed" {
+		t.Fatalf("Expected HEAD and the working directory at the pushed commit, got %s and %q", repo.Head, data)
+	}
+
+	// The next commit builds on the pushed work instead of reverting it
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("local"), 0644)
+	next, err := repo.CreateCommit("local", "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushedCommit, _ := repo.LoadCommit(first); next.FileBlobs["a.txt"] != pushedCommit.FileBlobs["a.txt"] {
+		t.Error("Expected the next commit to keep the pushed a.txt")
+	}
+
+	// Uncommitted changes the push would overwrite refuse it
+	refused := pushed("refused")
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("local edit"), 0644)
+	if err := repo.ReceiveRef("Stem", next.Hash, refused); !errors.Is(err, ErrLocalChanges) || !strings.Contains(err.Error(), "a.txt") {
+		t.Fatalf("Expected the push to be refused naming a.txt, got %v", err)
+	}
+	if stem, _ := repo.ReadRef("Stem"); stem != next.Hash || repo.Head != next.Hash {
+		t.Errorf("Expected Stem and HEAD to stay at %s, got %s and %s", next.Hash, stem, repo.Head)
+	}
+}
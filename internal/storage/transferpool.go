@@ -0,0 +1,322 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: transferpool.go
+// Description: Parallel object transfers for Steria remotes. Push, fetch and auto-sync move objects through a bounded worker pool, retry transient HTTP and S3 failures with exponential backoff, report progress (objects, bytes, rate, ETA) while they run and collect the objects that still failed so they can be retried.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultTransferWorkers = 8                      // Objects in flight at once
+	DefaultTransferRetries = 4                      // Further attempts after a transient failure
+	DefaultRetryBackoff    = 500 * time.Millisecond // Wait before the first retry, doubled for each one after
+	maxRetryBackoff        = 30 * time.Second
+	progressInterval       = 200 * time.Millisecond
+)
+
+// ErrTransferIncomplete is returned when objects still failed to transfer
+// after their retries; the remote branch and remote-tracking refs are left
+// alone, and running the command again transfers only what is missing
+var ErrTransferIncomplete = errors.New("transfer incomplete")
+
+// TransferOptions tune how objects move to and from remotes
+type TransferOptions struct {
+	Workers int           // Concurrent transfers; 0 means DefaultTransferWorkers
+	Retries int           // Further attempts after a transient failure; 0 means DefaultTransferRetries, negative disables
+	Backoff time.Duration // First retry delay; 0 means DefaultRetryBackoff
+	// Progress is called a few times a second while objects move, and once
+	// more when the transfer is done
+	Progress func(TransferProgress)
+}
+
+// WithTransfer returns a shallow copy of the repository whose pushes,
+// fetches and auto-syncs use opts
+func (r *Repo) WithTransfer(opts TransferOptions) *Repo {
+	rc := *r
+	rc.transfer = opts
+	return &rc
+}
+
+// TransferProgress is a snapshot of a running transfer
+type TransferProgress struct {
+	Done    int           `json:"done"` // Objects finished, including failed ones
+	Total   int           `json:"total"`
+	Failed  int           `json:"failed"`
+	Bytes   int64         `json:"bytes"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Rate returns the bytes moved per second so far
+func (p TransferProgress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time left from the pace objects have finished at, or
+// returns 0 when there is nothing to go by yet
+func (p TransferProgress) ETA() time.Duration {
+	if p.Done == 0 || p.Done >= p.Total {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) / float64(p.Done) * float64(p.Total-p.Done)).Round(time.Second)
+}
+
+// String renders the progress as one line, e.g.
+// "12/40 objects, 3.2 MB, 1.1 MB/s, ETA 4s"
+func (p TransferProgress) String() string {
+	line := fmt.Sprintf("%d/%d objects, %s, %s/s", p.Done, p.Total, formatBytes(p.Bytes), formatBytes(int64(p.Rate())))
+	if p.Failed > 0 {
+		line += fmt.Sprintf(", %d failed", p.Failed)
+	}
+	if eta := p.ETA(); eta > 0 {
+		line += ", ETA " + eta.String()
+	}
+	return line
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 3.2 MB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// TransferFailure is an object that could not be transferred
+type TransferFailure struct {
+	Hash  string `json:"hash"`
+	Error string `json:"error"`
+}
+
+// HTTPStatusError is an HTTP response with an unexpected status
+type HTTPStatusError struct {
+	Method  string
+	Status  string // e.g. "503 Service Unavailable"
+	Code    int
+	Message string // Start of the response body, if any
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("HTTP %s failed: %s", e.Method, e.Status)
+	}
+	return fmt.Sprintf("HTTP %s failed: %s: %s", e.Method, e.Status, e.Message)
+}
+
+// transientStatus reports whether an HTTP status is worth retrying
+func transientStatus(code int) bool {
+	return code == 408 || code == 429 || code >= 500
+}
+
+// isTransient reports whether a failed transfer may succeed if tried again:
+// timeouts, dropped connections, throttling and server errors. Cancellation
+// and content that was refused are final.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var status *HTTPStatusError
+	if errors.As(err, &status) {
+		return transientStatus(status.Code)
+	}
+	// S3 response errors carry their status code
+	var response interface{ HTTPStatusCode() int }
+	if errors.As(err, &response) {
+		return transientStatus(response.HTTPStatusCode())
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// transferRun is one push, fetch or auto-sync moving objects: it retries,
+// counts and reports progress, and remembers what failed
+type transferRun struct {
+	ctx   context.Context
+	opts  TransferOptions
+	start time.Time
+
+	total, done, failed atomic.Int64
+	bytes               atomic.Int64
+
+	mu       sync.Mutex
+	failures []TransferFailure
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// startTransfer begins a transfer with the repository's transfer options
+func (r *Repo) startTransfer() *transferRun {
+	t := &transferRun{ctx: r.Context(), opts: r.transfer, start: time.Now(), stop: make(chan struct{})}
+	if t.opts.Progress != nil {
+		t.stopped.Add(1)
+		go func() {
+			defer t.stopped.Done()
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					t.opts.Progress(t.progress())
+				case <-t.stop:
+					return
+				}
+			}
+		}()
+	}
+	return t
+}
+
+// progress returns a snapshot of the transfer
+func (t *transferRun) progress() TransferProgress {
+	return TransferProgress{
+		Done:    int(t.done.Load()),
+		Total:   int(t.total.Load()),
+		Failed:  int(t.failed.Load()),
+		Bytes:   t.bytes.Load(),
+		Elapsed: time.Since(t.start),
+	}
+}
+
+// finish stops progress reporting, reports the final state and returns the
+// objects that failed
+func (t *transferRun) finish() []TransferFailure {
+	close(t.stop)
+	t.stopped.Wait()
+	if t.opts.Progress != nil {
+		t.opts.Progress(t.progress())
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures
+}
+
+// incomplete returns the error for a transfer that left objects behind
+func (t *transferRun) incomplete(verb string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d objects could not be %s", ErrTransferIncomplete, len(t.failures), verb)
+}
+
+// retry runs fn until it succeeds, fails for good or runs out of attempts,
+// waiting with exponential backoff and jitter between attempts
+func (t *transferRun) retry(fn func(ctx context.Context) error) error {
+	retries := t.opts.Retries
+	if retries == 0 {
+		retries = DefaultTransferRetries
+	}
+	backoff := t.opts.Backoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn(t.ctx)
+		if err == nil || attempt >= retries || !isTransient(t.ctx, err) {
+			return err
+		}
+		wait := backoff + rand.N(backoff/2+1)
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// do transfers one object with retries, counting it and recording it as
+// failed if it never succeeds
+func (t *transferRun) do(hash string, fn func(ctx context.Context) error) error {
+	t.total.Add(1)
+	err := t.retry(fn)
+	t.done.Add(1)
+	if err != nil && t.ctx.Err() == nil {
+		t.failed.Add(1)
+		t.mu.Lock()
+		t.failures = append(t.failures, TransferFailure{Hash: hash, Error: err.Error()})
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// each transfers objects concurrently on up to Workers goroutines. Failed
+// objects are recorded and the rest carry on; only cancellation stops it
+// early, returning the context's error.
+func (t *transferRun) each(hashes []string, fn func(ctx context.Context, hash string) error) error {
+	workers := t.opts.Workers
+	if workers <= 0 {
+		workers = DefaultTransferWorkers
+	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(hashes)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range jobs {
+				t.do(hash, func(ctx context.Context) error { return fn(ctx, hash) })
+			}
+		}()
+	}
+	for _, hash := range hashes {
+		if t.ctx.Err() != nil {
+			break
+		}
+		jobs <- hash
+	}
+	close(jobs)
+	wg.Wait()
+	return t.ctx.Err()
+}
+
+// counted wraps a blob store so bytes read from it count towards progress
+func (t *transferRun) counted(store BlobStore) BlobStore {
+	return &countingBlobStore{BlobStore: store, bytes: &t.bytes}
+}
+
+// countingBlobStore counts the bytes streamed out of OpenBlob
+type countingBlobStore struct {
+	BlobStore
+	bytes *atomic.Int64
+}
+
+func (c *countingBlobStore) OpenBlob(ctx context.Context, hash string) (io.ReadCloser, error) {
+	in, err := c.BlobStore.OpenBlob(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: in, bytes: c.bytes}, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
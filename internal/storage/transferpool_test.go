@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore answers blob uploads with 503 until a hash has failed failures times
+type flakyStore struct {
+	*LocalBlobStore
+	failures int
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (s *flakyStore) CreateBlob(ctx context.Context, hash string) (BlobWriter, error) {
+	s.mu.Lock()
+	s.attempts[hash]++
+	fail := s.failures < 0 || s.attempts[hash] <= s.failures
+	s.mu.Unlock()
+	if fail {
+		return nil, &HTTPStatusError{Method: "PUT", Status: "503 Service Unavailable", Code: 503}
+	}
+	return s.LocalBlobStore.CreateBlob(ctx, hash)
+}
+
+func TestPushRetriesAndReportsFailures(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("two"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &LocalBlobStore{Dir: t.TempDir()}
+	var last TransferProgress
+	quick := TransferOptions{Workers: 2, Retries: 2, Backoff: time.Millisecond, Progress: func(p TransferProgress) { last = p }}
+
+	// A remote that keeps failing: nothing moves and every blob is reported
+	down := &flakyStore{LocalBlobStore: remote, failures: -1, attempts: map[string]int{}}
+	pushed, err := repo.WithTransfer(quick).Push(down, "origin", "Stem", PushOptions{})
+	if !errors.Is(err, ErrTransferIncomplete) || len(pushed.Failed) == 0 {
+		t.Fatalf("Expected failed blobs to be reported, got %+v, %v", pushed, err)
+	}
+	for _, f := range pushed.Failed {
+		if down.attempts[f.Hash] != 3 {
+			t.Errorf("Expected blob %s tried three times, got %d", f.Hash, down.attempts[f.Hash])
+		}
+	}
+	if pushed.Commits != 0 || last.Failed != len(pushed.Failed) || last.Done != last.Total {
+		t.Errorf("Expected no commits sent and final progress to count the failures, got %+v, %+v", pushed, last)
+	}
+	if refs, _ := remote.ListRefs(repo.Context()); len(refs) != 0 {
+		t.Errorf("Expected the remote branch not to move, got %v", refs)
+	}
+
+	// A remote that recovers: retries carry the push through
+	flaky := &flakyStore{LocalBlobStore: remote, failures: 1, attempts: map[string]int{}}
+	pushed, err = repo.WithTransfer(quick).Push(flaky, "origin", "Stem", PushOptions{})
+	if err != nil || len(pushed.Failed) != 0 || pushed.Blobs == 0 || pushed.Status != PushNew {
+		t.Fatalf("Expected the retried push to succeed, got %+v, %v", pushed, err)
+	}
+	if last.Done != last.Total || last.Bytes == 0 {
+		t.Errorf("Expected complete progress with bytes counted, got %+v", last)
+	}
+	if refs, _ := remote.ListRefs(repo.Context()); refs["Stem"] != repo.Head {
+		t.Errorf("Expected the remote Stem at %s, got %v", repo.Head, refs)
+	}
+}
+
+func TestTransferProgressLine(t *testing.T) {
+	p := TransferProgress{Done: 10, Total: 40, Bytes: 3 << 20, Elapsed: 2 * time.Second}
+	if got := p.String(); got != "10/40 objects, 3.0 MB, 1.5 MB/s, ETA 6s" {
+		t.Errorf("Unexpected progress line %q", got)
+	}
+	if !isTransient(context.Background(), &HTTPStatusError{Code: 503}) || isTransient(context.Background(), &HTTPStatusError{Code: 404}) {
+		t.Error("Expected 503 to be retried and 404 not")
+	}
+}
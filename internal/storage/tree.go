@@ -0,0 +1,296 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: tree.go
+// Description: Hierarchical tree objects for Steria. A tree maps directory entries to blob or subtree hashes so unchanged directories are shared between commits.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeEntryType distinguishes file entries from subdirectory entries
+type TreeEntryType string
+
+const (
+	TreeEntryBlob TreeEntryType = "blob"
+	TreeEntryTree TreeEntryType = "tree"
+)
+
+// TreeEntry is a single named entry in a tree object
+type TreeEntry struct {
+	Name string        `json:"name"`
+	Type TreeEntryType `json:"type"`
+	Hash string        `json:"hash"` // Blob ref for files, tree hash for directories
+}
+
+// Tree represents one directory level. Entries are kept sorted by name so the
+// same directory contents always produce the same tree hash.
+type Tree struct {
+	Entries []TreeEntry `json:"entries"`
+}
+
+// treePath returns the on-disk location of a tree object
+func (r *Repo) treePath(hash string) string {
+	return filepath.Join(r.Path, ".steria", "objects", "trees", hash[:2], hash[2:])
+}
+
+// hashTree returns the content hash of a tree object
+func hashTree(tree *Tree) (string, []byte, error) {
+	sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
+
+// saveTree writes a tree object unless an identical one is already stored
+func (r *Repo) saveTree(tree *Tree) (string, error) {
+	hash, data, err := hashTree(tree)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tree: %w", err)
+	}
+	p := r.treePath(hash)
+	if _, err := os.Stat(p); err == nil || hasPacked(r.packDir(), hash, PackTree) {
+		freshenObject(p, r.packDir(), hash, PackTree) // Shared with an earlier commit
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	if err := atomicWrite(p, data); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// LoadTree loads a tree object by hash
+func (r *Repo) LoadTree(hash string) (*Tree, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("tree hash too short: %q", hash)
+	}
+	data, err := r.readTreeObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to parse tree %s: %w", hash, err)
+	}
+	return &tree, nil
+}
+
+// readTreeObject returns the stored bytes of a tree
+func (r *Repo) readTreeObject(hash string) ([]byte, error) {
+	data, err := os.ReadFile(r.treePath(hash))
+	if os.IsNotExist(err) {
+		data, err = readPacked(r.packDir(), hash, PackTree)
+	}
+	return data, err
+}
+
+// hasTree reports whether a tree object is stored, loose or packed
+func (r *Repo) hasTree(hash string) bool {
+	if len(hash) < 2 {
+		return false
+	}
+	if _, err := os.Stat(r.treePath(hash)); err == nil {
+		return true
+	}
+	return hasPacked(r.packDir(), hash, PackTree)
+}
+
+// WriteTree stores the given path -> blob ref snapshot as a hierarchy of tree
+// objects and returns the root tree hash
+func (r *Repo) WriteTree(fileBlobs map[string]string) (string, error) {
+	type dirNode struct {
+		files map[string]string
+		dirs  map[string]*dirNode
+	}
+	newNode := func() *dirNode {
+		return &dirNode{files: map[string]string{}, dirs: map[string]*dirNode{}}
+	}
+	root := newNode()
+	for file, blob := range fileBlobs {
+		parts := strings.Split(filepath.ToSlash(file), "/")
+		node := root
+		for _, dir := range parts[:len(parts)-1] {
+			child, ok := node.dirs[dir]
+			if !ok {
+				child = newNode()
+				node.dirs[dir] = child
+			}
+			node = child
+		}
+		node.files[parts[len(parts)-1]] = blob
+	}
+
+	var write func(node *dirNode) (string, error)
+	write = func(node *dirNode) (string, error) {
+		tree := &Tree{}
+		for name, blob := range node.files {
+			tree.Entries = append(tree.Entries, TreeEntry{Name: name, Type: TreeEntryBlob, Hash: blob})
+		}
+		for name, child := range node.dirs {
+			hash, err := write(child)
+			if err != nil {
+				return "", err
+			}
+			tree.Entries = append(tree.Entries, TreeEntry{Name: name, Type: TreeEntryTree, Hash: hash})
+		}
+		return r.saveTree(tree)
+	}
+	return write(root)
+}
+
+// FlattenTree expands a root tree into a flat path -> blob ref map
+func (r *Repo) FlattenTree(hash string) (map[string]string, error) {
+	return flattenTree(hash, r.LoadTree)
+}
+
+// flattenTree expands a root tree into a flat path -> blob ref map, loading
+// each tree object with load
+func flattenTree(hash string, load func(hash string) (*Tree, error)) (map[string]string, error) {
+	files := make(map[string]string)
+	if err := flattenTreeInto(hash, "", files, load); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func flattenTreeInto(hash, prefix string, files map[string]string, load func(hash string) (*Tree, error)) error {
+	tree, err := load(hash)
+	if err != nil {
+		return fmt.Errorf("failed to load tree %s: %w", hash, err)
+	}
+	for _, e := range tree.Entries {
+		name := path.Join(prefix, e.Name)
+		switch e.Type {
+		case TreeEntryTree:
+			if err := flattenTreeInto(e.Hash, name, files, load); err != nil {
+				return err
+			}
+		default:
+			files[filepath.FromSlash(name)] = e.Hash
+		}
+	}
+	return nil
+}
+
+// CommitFiles returns the flat file snapshot of a commit, flattening its root
+// tree on first use. Legacy commits that carry FileBlobs directly are returned as-is.
+func (r *Repo) CommitFiles(commit *Commit) (map[string]string, error) {
+	if commit.FileBlobs != nil || commit.Tree == "" {
+		if commit.FileBlobs == nil {
+			commit.FileBlobs = make(map[string]string)
+		}
+		return commit.FileBlobs, nil
+	}
+	files, err := r.FlattenTree(commit.Tree)
+	if err != nil {
+		return nil, err
+	}
+	commit.FileBlobs = files
+	commit.Files = make([]string, 0, len(files))
+	for f := range files {
+		commit.Files = append(commit.Files, f)
+	}
+	sort.Strings(commit.Files)
+	return files, nil
+}
+
+// DiffTrees compares two root trees and returns the changed files. Subtrees
+// with identical hashes are skipped without being loaded. Either hash may be
+// empty to represent an empty tree.
+func (r *Repo) DiffTrees(oldHash, newHash string) ([]FileChange, error) {
+	var changes []FileChange
+	if err := r.diffTrees(oldHash, newHash, "", &changes); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func (r *Repo) diffTrees(oldHash, newHash, prefix string, changes *[]FileChange) error {
+	if oldHash == newHash {
+		return nil
+	}
+	entries := func(hash string) (map[string]TreeEntry, error) {
+		m := map[string]TreeEntry{}
+		if hash == "" {
+			return m, nil
+		}
+		tree, err := r.LoadTree(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range tree.Entries {
+			m[e.Name] = e
+		}
+		return m, nil
+	}
+	oldEntries, err := entries(oldHash)
+	if err != nil {
+		return err
+	}
+	newEntries, err := entries(newHash)
+	if err != nil {
+		return err
+	}
+
+	for name, ne := range newEntries {
+		p := path.Join(prefix, name)
+		oe, existed := oldEntries[name]
+		if existed && oe.Hash == ne.Hash && oe.Type == ne.Type {
+			continue
+		}
+		oldSub := ""
+		if existed && oe.Type == TreeEntryTree {
+			oldSub = oe.Hash
+		}
+		if ne.Type == TreeEntryTree {
+			if existed && oe.Type == TreeEntryBlob {
+				*changes = append(*changes, FileChange{Path: filepath.FromSlash(p), Type: ChangeTypeDeleted})
+			}
+			if err := r.diffTrees(oldSub, ne.Hash, p, changes); err != nil {
+				return err
+			}
+			continue
+		}
+		if oldSub != "" {
+			if err := r.diffTrees(oldSub, "", p, changes); err != nil {
+				return err
+			}
+			existed = false
+		}
+		changeType := ChangeTypeModified
+		if !existed {
+			changeType = ChangeTypeAdded
+		}
+		*changes = append(*changes, FileChange{Path: filepath.FromSlash(p), Type: changeType, Hash: ne.Hash})
+	}
+	for name, oe := range oldEntries {
+		if _, ok := newEntries[name]; ok {
+			continue
+		}
+		p := path.Join(prefix, name)
+		if oe.Type == TreeEntryTree {
+			if err := r.diffTrees(oe.Hash, "", p, changes); err != nil {
+				return err
+			}
+			continue
+		}
+		*changes = append(*changes, FileChange{Path: filepath.FromSlash(p), Type: ChangeTypeDeleted})
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteTreeAndFlatten(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	files := map[string]string{
+		"a.txt":                             "hash-a",
+		filepath.Join("src", "main.go"):     "hash-main",
+		filepath.Join("src", "lib", "x.go"): "hash-x",
+	}
+	root, err := repo.WriteTree(files)
+	if err != nil {
+		t.Fatalf("WriteTree failed: %v", err)
+	}
+	flat, err := repo.FlattenTree(root)
+	if err != nil {
+		t.Fatalf("FlattenTree failed: %v", err)
+	}
+	if len(flat) != len(files) {
+		t.Fatalf("Expected %d files, got %d", len(files), len(flat))
+	}
+	for path, hash := range files {
+		if flat[path] != hash {
+			t.Errorf("Flattened %s = %q, want %q", path, flat[path], hash)
+		}
+	}
+}
+
+func TestWriteTreeSharesUnchangedSubtrees(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	before := map[string]string{
+		filepath.Join("docs", "a.md"): "hash-a",
+		filepath.Join("src", "b.go"):  "hash-b",
+	}
+	after := map[string]string{
+		filepath.Join("docs", "a.md"): "hash-a",
+		filepath.Join("src", "b.go"):  "hash-b2",
+	}
+	rootBefore, _ := repo.WriteTree(before)
+	rootAfter, _ := repo.WriteTree(after)
+	treeBefore, _ := repo.LoadTree(rootBefore)
+	treeAfter, _ := repo.LoadTree(rootAfter)
+	if treeBefore.Entries[0].Name != "docs" || treeBefore.Entries[0].Hash != treeAfter.Entries[0].Hash {
+		t.Errorf("Expected unchanged docs subtree to be shared between trees")
+	}
+
+	changes, err := repo.DiffTrees(rootBefore, rootAfter)
+	if err != nil {
+		t.Fatalf("DiffTrees failed: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != filepath.Join("src", "b.go") || changes[0].Type != ChangeTypeModified {
+		t.Errorf("Unexpected tree diff: %+v", changes)
+	}
+}
+
+func TestCommitStoresRootTree(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/file.txt", []byte("test"), 0644)
+	repo, _ := LoadOrInitRepo(dir)
+	os.MkdirAll(dir+"/sub", 0755)
+	os.WriteFile(dir+"/sub/file2.txt", []byte("test2"), 0644)
+	c, err := repo.CreateCommit("msg", "author")
+	if err != nil {
+		t.Fatalf("Failed to create commit: %v", err)
+	}
+	if c.Tree == "" {
+		t.Fatalf("Expected commit to reference a root tree")
+	}
+	loaded, err := repo.LoadCommit(c.Hash)
+	if err != nil {
+		t.Fatalf("LoadCommit failed: %v", err)
+	}
+	if loaded.FileBlobs[filepath.Join("sub", "file2.txt")] == "" {
+		t.Errorf("Expected LoadCommit to flatten nested files from the tree")
+	}
+}
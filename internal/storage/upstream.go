@@ -0,0 +1,177 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: upstream.go
+// Description: Upstream branches for Steria. Records which remote-tracking branch each local branch follows in .steria/upstreams.json and counts how far a branch is ahead of and behind it.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upstream is the remote branch a local branch follows
+type Upstream struct {
+	Remote string `json:"remote"`
+	Branch string `json:"branch"`
+}
+
+// String returns the upstream as <remote>/<branch>, e.g. origin/Stem
+func (u Upstream) String() string {
+	return u.Remote + "/" + u.Branch
+}
+
+// Ref returns the remote-tracking ref holding the upstream's last known tip
+func (u Upstream) Ref() string {
+	return TrackingRef(u.Remote, u.Branch)
+}
+
+// ParseUpstream splits <remote>/<branch>; the branch may itself contain slashes
+func ParseUpstream(name string) (Upstream, error) {
+	remote, branch, ok := strings.Cut(name, "/")
+	if !ok || remote == "" || !validRefName(remote) || !validRefName(branch) {
+		return Upstream{}, fmt.Errorf("invalid upstream '%s': expected <remote>/<branch>", name)
+	}
+	return Upstream{Remote: remote, Branch: branch}, nil
+}
+
+// upstreamsPath returns the file mapping local branches to their upstreams
+func (r *Repo) upstreamsPath() string {
+	return filepath.Join(r.Path, ".steria", "upstreams.json")
+}
+
+// Upstreams returns the upstream of every local branch that has one
+func (r *Repo) Upstreams() (map[string]Upstream, error) {
+	upstreams := map[string]Upstream{}
+	data, err := os.ReadFile(r.upstreamsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return upstreams, nil
+		}
+		return nil, fmt.Errorf("failed to read upstreams: %w", err)
+	}
+	if err := json.Unmarshal(data, &upstreams); err != nil {
+		return nil, fmt.Errorf("failed to parse upstreams.json: %w", err)
+	}
+	return upstreams, nil
+}
+
+// saveUpstreams writes the upstream map, removing the file when it is empty
+func (r *Repo) saveUpstreams(upstreams map[string]Upstream) error {
+	if len(upstreams) == 0 {
+		if err := os.Remove(r.upstreamsPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to write upstreams: %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(upstreams, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicWrite(r.upstreamsPath(), data); err != nil {
+		return fmt.Errorf("failed to write upstreams: %w", err)
+	}
+	return nil
+}
+
+// Upstream returns the upstream of a local branch, or nil if it has none
+func (r *Repo) Upstream(branch string) (*Upstream, error) {
+	upstreams, err := r.Upstreams()
+	if err != nil {
+		return nil, err
+	}
+	up, ok := upstreams[branch]
+	if !ok {
+		return nil, nil
+	}
+	return &up, nil
+}
+
+// SetUpstream makes a local branch follow up; nil removes its upstream
+func (r *Repo) SetUpstream(branch string, up *Upstream) error {
+	upstreams, err := r.Upstreams()
+	if err != nil {
+		return err
+	}
+	if up == nil {
+		if _, ok := upstreams[branch]; !ok {
+			return nil
+		}
+		delete(upstreams, branch)
+	} else {
+		upstreams[branch] = *up
+	}
+	return r.saveUpstreams(upstreams)
+}
+
+// RenameUpstream moves the upstream of a renamed branch to its new name
+func (r *Repo) RenameUpstream(oldName, newName string) error {
+	upstreams, err := r.Upstreams()
+	if err != nil {
+		return err
+	}
+	up, ok := upstreams[oldName]
+	if !ok {
+		return nil
+	}
+	delete(upstreams, oldName)
+	upstreams[newName] = up
+	return r.saveUpstreams(upstreams)
+}
+
+// TrackingStatus compares a local branch with its upstream
+type TrackingStatus struct {
+	Upstream Upstream `json:"upstream"`
+	Ahead    int      `json:"ahead"`          // Commits on the branch the upstream does not have
+	Behind   int      `json:"behind"`         // Commits on the upstream the branch does not have
+	Gone     bool     `json:"gone,omitempty"` // The upstream has never been fetched or no longer exists
+}
+
+// TrackingStatus returns how far a local branch is ahead of and behind its
+// upstream as of the last fetch, or nil if the branch has no upstream
+func (r *Repo) TrackingStatus(branch string) (*TrackingStatus, error) {
+	up, err := r.Upstream(branch)
+	if err != nil || up == nil {
+		return nil, err
+	}
+	status := &TrackingStatus{Upstream: *up}
+	remote, err := r.ReadRef(up.Ref())
+	if err != nil || remote == "" {
+		status.Gone = true
+		return status, nil
+	}
+	local, err := r.ReadRef(branch)
+	if err != nil {
+		return nil, err
+	}
+	status.Ahead, status.Behind, err = r.AheadBehind(local, remote)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Summary describes the tracking status in a sentence about "your branch",
+// e.g. "ahead of 'origin/Stem' by 2 commits"
+func (t *TrackingStatus) Summary() string {
+	commits := func(n int) string {
+		if n == 1 {
+			return "1 commit"
+		}
+		return fmt.Sprintf("%d commits", n)
+	}
+	switch {
+	case t.Gone:
+		return fmt.Sprintf("based on '%s', which has not been fetched or is gone", t.Upstream)
+	case t.Ahead > 0 && t.Behind > 0:
+		return fmt.Sprintf("diverged from '%s': %s ahead, %s behind", t.Upstream, commits(t.Ahead), commits(t.Behind))
+	case t.Ahead > 0:
+		return fmt.Sprintf("ahead of '%s' by %s", t.Upstream, commits(t.Ahead))
+	case t.Behind > 0:
+		return fmt.Sprintf("behind '%s' by %s and can be fast-forwarded", t.Upstream, commits(t.Behind))
+	}
+	return fmt.Sprintf("up to date with '%s'", t.Upstream)
+}
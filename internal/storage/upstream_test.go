@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamAheadBehind(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644)
+	repo, err := LoadOrInitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile := func(content string) string {
+		os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644)
+		commit, err := repo.CreateCommit(content, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.advanceHead(commit.Hash, "test"); err != nil {
+			t.Fatal(err)
+		}
+		return commit.Hash
+	}
+	base := repo.Head
+
+	// A branch without an upstream has no tracking status
+	if status, err := repo.TrackingStatus("Stem"); status != nil || err != nil {
+		t.Errorf("Expected no tracking status, got %+v, %v", status, err)
+	}
+	if _, err := ParseUpstream("origin"); err == nil {
+		t.Error("Expected an upstream without a branch to be refused")
+	}
+	up, err := ParseUpstream("origin/feature/x")
+	if err != nil || up.Remote != "origin" || up.Branch != "feature/x" {
+		t.Fatalf("Expected origin and feature/x, got %+v, %v", up, err)
+	}
+	if err := repo.SetUpstream("Stem", &up); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := repo.TrackingStatus("Stem"); status == nil || !status.Gone {
+		t.Errorf("Expected an unfetched upstream to be gone, got %+v", status)
+	}
+
+	// Two local commits against one remote commit on top of the shared base
+	remoteTip := commitFile("remote")
+	if err := repo.UpdateRef(up.Ref(), remoteTip, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.NewRefTransaction().UpdateFrom("HEAD", base, repo.Head, "test").Update("Stem", base, "test").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	repo.Head = base
+	commitFile("local one")
+	commitFile("local two")
+	status, err := repo.TrackingStatus("Stem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Ahead != 2 || status.Behind != 1 || status.Gone {
+		t.Errorf("Expected ahead 2, behind 1, got %+v", status)
+	}
+	if got := status.Summary(); got != "diverged from 'origin/feature/x': 2 commits ahead, 1 commit behind" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+
+	// Renaming and deleting the branch carry its upstream along
+	if err := repo.RenameUpstream("Stem", "main"); err != nil {
+		t.Fatal(err)
+	}
+	if moved, _ := repo.Upstream("main"); moved == nil || *moved != up {
+		t.Errorf("Expected main to follow %s, got %+v", up, moved)
+	}
+	if err := repo.SetUpstream("main", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(repo.upstreamsPath()); !os.IsNotExist(err) {
+		t.Error("Expected upstreams.json to go once no branch has an upstream")
+	}
+}
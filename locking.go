@@ -0,0 +1,197 @@
+// Author: KleaSCM
+// Email: KleaSCM@gmail.com
+// Name of the file: locking.go
+// Description: Takes the repository lock for each Steria command before it runs: exclusively for commands that change the working directory or .steria, shared for read-only ones. Mutating commands are also recorded in the operation log.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"steria/internal/storage"
+
+	"github.com/spf13/cobra"
+)
+
+// commandLocks maps each command that works on a repository, by its path
+// below the root command, to the lock it runs under. Commands not listed
+// (clone, ignore, the remote, stash, tag, op and projects groups themselves,
+// help, completion) take no lock.
+var commandLocks = map[string]storage.LockMode{
+	"add":           storage.LockExclusive,
+	"add-branch":    storage.LockExclusive,
+	"add-project":   storage.LockExclusive,
+	"branch":        storage.LockExclusive,
+	"cherry-pick":   storage.LockExclusive,
+	"commit":        storage.LockExclusive,
+	"delete":        storage.LockExclusive,
+	"delete-branch": storage.LockExclusive,
+	"done":          storage.LockExclusive,
+	"gc":            storage.LockExclusive,
+	"merge":         storage.LockExclusive,
+	"migrate":       storage.LockExclusive,
+	"op restore":    storage.LockExclusive,
+	"prune":         storage.LockExclusive,
+	"pull":          storage.LockExclusive,
+	"push":          storage.LockExclusive,
+	"rebase":        storage.LockExclusive,
+	"remote add":    storage.LockExclusive,
+	"rename-branch": storage.LockExclusive,
+	"resolve":       storage.LockExclusive,
+	"restore":       storage.LockExclusive,
+	"stash apply":   storage.LockExclusive,
+	"stash drop":    storage.LockExclusive,
+	"stash pop":     storage.LockExclusive,
+	"stash save":    storage.LockExclusive,
+	"switch-branch": storage.LockExclusive,
+	"sync":          storage.LockExclusive,
+	"tag checkout":  storage.LockExclusive,
+	"tag create":    storage.LockExclusive,
+	"tag delete":    storage.LockExclusive,
+	"undo":          storage.LockExclusive,
+	"unstage":       storage.LockExclusive,
+
+	"blame":          storage.LockShared,
+	"branch-graph":   storage.LockShared,
+	"conflicts":      storage.LockShared,
+	"diff":           storage.LockShared,
+	"fetch":          storage.LockShared,
+	"fsck":           storage.LockShared,
+	"log":            storage.LockShared,
+	"op log":         storage.LockShared,
+	"reflog":         storage.LockShared,
+	"remote list":    storage.LockShared,
+	"search":         storage.LockShared,
+	"search reindex": storage.LockShared,
+	"send":           storage.LockShared,
+	"stash list":     storage.LockShared,
+	"status":         storage.LockShared,
+	"tag list":       storage.LockShared,
+	"verify":         storage.LockShared,
+
+	"projects add":    storage.LockExclusive,
+	"projects delete": storage.LockExclusive,
+	"projects pull":   storage.LockExclusive,
+}
+
+// unloggedCommands are exclusive commands kept out of the operation log:
+// migrate rewrites every object an entry could name, and undo and op restore
+// record their own entries
+var unloggedCommands = map[string]bool{
+	"migrate":    true,
+	"op restore": true,
+	"undo":       true,
+}
+
+// refOnlyCommands are logged exclusive commands that never touch the working
+// directory, so their operations record refs and the index without a
+// snapshot of every working file
+var refOnlyCommands = map[string]bool{
+	"add":           true,
+	"add-branch":    true,
+	"branch":        true,
+	"delete-branch": true,
+	"gc":            true,
+	"prune":         true,
+	"push":          true,
+	"remote add":    true,
+	"rename-branch": true,
+	"tag create":    true,
+	"tag delete":    true,
+	"unstage":       true,
+}
+
+// repoLock is the lock held by the running command, released on exit
+var repoLock *storage.RepoLock
+
+// pendingOp is the repository state captured before a mutating command ran
+var pendingOp struct {
+	repo     *storage.Repo
+	before   *storage.RefState
+	worktree bool // Whether the command's states include the working directory
+}
+
+// lockRepository takes the lock the command runs under, if it has one and is
+// run inside a repository
+func lockRepository(cmd *cobra.Command, args []string) error {
+	name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	mode, ok := commandLocks[name]
+	if !ok {
+		return nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	root := repoRootOf(cwd)
+	if root == "" {
+		return nil // Commands that create a repository lock nothing
+	}
+	lock, err := storage.LockRepo(root, mode, cmd.CommandPath())
+	if err != nil {
+		cmd.SilenceUsage = true
+		return err
+	}
+	repoLock = lock
+	if mode == storage.LockExclusive && !unloggedCommands[name] {
+		beginOperation(root, !refOnlyCommands[name])
+	}
+	return nil
+}
+
+// beginOperation captures the repository state a mutating command starts
+// from. A repository that cannot be read is left for the command to report.
+func beginOperation(root string, worktree bool) {
+	repo, err := storage.LoadOrInitRepo(root)
+	if err != nil {
+		return
+	}
+	before, err := captureState(repo, worktree)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: operation will not be logged: %v\n", err)
+		return
+	}
+	pendingOp.repo, pendingOp.before, pendingOp.worktree = repo, before, worktree
+}
+
+// captureState records the repository state, with the working directory
+// only for commands that may change it
+func captureState(repo *storage.Repo, worktree bool) (*storage.RefState, error) {
+	if worktree {
+		return repo.CaptureState()
+	}
+	return repo.CaptureRefState()
+}
+
+// finishOperation records the command that just ran in the operation log,
+// including a failed command that changed the repository part way
+func finishOperation(cmdErr error) {
+	if pendingOp.repo == nil {
+		return
+	}
+	after, err := captureState(pendingOp.repo, pendingOp.worktree)
+	if err == nil {
+		command := strings.Join(append([]string{"steria"}, os.Args[1:]...), " ")
+		_, err = pendingOp.repo.RecordOperation(command, pendingOp.before, after, cmdErr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to log operation: %v\n", err)
+	}
+}
+
+// repoRootOf walks up from dir to the nearest directory containing .steria
+func repoRootOf(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".steria")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
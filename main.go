@@ -6,8 +6,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"steria/cmd/branching"
 	"steria/cmd/projects"
@@ -22,6 +25,8 @@ func main() {
 		Use:   "steria",
 		Short: "Steria - A modern version control system",
 		Long:  "Steria is a fast, efficient version control system with advanced features.",
+		// Mutating commands run one at a time; read-only ones share the lock
+		PersistentPreRunE: lockRepository,
 	}
 
 	// Add all command groups
@@ -33,9 +38,8 @@ func main() {
 	rootCmd.AddCommand(branching.NewSwitchBranchCmd())
 	rootCmd.AddCommand(branching.NewBranchGraphCmd())
 
-	rootCmd.AddCommand(projects.NewAddCmd())
-	rootCmd.AddCommand(projects.NewDeleteCmd())
-	rootCmd.AddCommand(projects.NewPullCmd())
+	rootCmd.AddCommand(projects.NewProjectsCmd())
+	rootCmd.AddCommand(projects.NewLegacyCmds()...)
 
 	rootCmd.AddCommand(repository.NewCloneCmd())
 	rootCmd.AddCommand(repository.NewStatusCmd())
@@ -45,7 +49,8 @@ func main() {
 	rootCmd.AddCommand(repository.NewIgnoreCmd())
 	rootCmd.AddCommand(repository.NewRemoteCmd())
 	rootCmd.AddCommand(repository.NewPushCmd())
-	rootCmd.AddCommand(repository.NewPullCmd())
+	rootCmd.AddCommand(repository.NewFetchCmd())
+	rootCmd.AddCommand(projects.WithLegacyPull(repository.NewPullCmd()))
 	rootCmd.AddCommand(repository.NewTagCmd())
 	rootCmd.AddCommand(repository.NewCherryPickCmd())
 	rootCmd.AddCommand(repository.NewStashCmd())
@@ -53,13 +58,41 @@ func main() {
 	rootCmd.AddCommand(repository.NewRebaseCmd())
 	rootCmd.AddCommand(repository.NewConflictsCmd())
 	rootCmd.AddCommand(repository.NewResolveCmd())
+	rootCmd.AddCommand(repository.NewGCCmd())
+	rootCmd.AddCommand(repository.NewPruneCmd())
+	rootCmd.AddCommand(repository.NewFsckCmd())
+	rootCmd.AddCommand(repository.NewVerifyCmd())
+	rootCmd.AddCommand(repository.NewMigrateCmd())
+	rootCmd.AddCommand(repository.NewReflogCmd())
+	rootCmd.AddCommand(repository.NewOpCmd())
+	rootCmd.AddCommand(repository.NewUndoCmd())
 
+	rootCmd.AddCommand(projects.WithLegacyAdd(workflow.NewAddCmd()))
+	rootCmd.AddCommand(workflow.NewUnstageCmd())
 	rootCmd.AddCommand(workflow.NewCommitCmd())
 	rootCmd.AddCommand(workflow.NewDoneCmd())
 	rootCmd.AddCommand(workflow.NewSyncCmd())
 
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.ExecuteContext(interruptContext())
+	finishOperation(err)
+	repoLock.Release()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// interruptContext is cancelled on the first Ctrl-C (or SIGTERM) so in-flight
+// transfers stop and discard their partial blobs; a second Ctrl-C exits at once
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\nInterrupted, cleaning up... (press Ctrl-C again to quit immediately)")
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}